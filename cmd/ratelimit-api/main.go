@@ -0,0 +1,123 @@
+// Command ratelimit-api serves HTTP/JSON decision API of ratelimitapi for services which are not written in Go,
+// so they share quotas with Go services using the same policies and redis stores.
+//
+// Usage:
+//
+//	ratelimit-api -config ratelimit.yaml [-addr :8080] [-token TOKEN] [-reload-interval 5s]
+//
+// Config is a ratelimitconfig file, limits of its policies are reloaded when the file changes.
+// If token is set, admin API of ratelimitadmin is served under /admin/ as well, e.g. to unban a key of a policy
+// with penalty box by DELETE /admin/policies/{policy}/bans/{key}.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/ratelimitadmin"
+	"ratelimit/util/ratelimit/ratelimitapi"
+	"ratelimit/util/ratelimit/ratelimitconfig"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = 10 * time.Second
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stderr))
+}
+
+// run serves decision API until ctx is done and returns exit code
+func run(ctx context.Context, args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ratelimit-api", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "", "path of YAML or JSON config of policies")
+	addr := fs.String("addr", ":8080", "address of HTTP server")
+	token := fs.String("token", os.Getenv("RATELIMIT_API_TOKEN"),
+		"bearer token required from clients, $RATELIMIT_API_TOKEN by default")
+	reloadInterval := fs.Duration("reload-interval", 5*time.Second,
+		"how often config is checked for changes, zero disables reload")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		_, _ = fmt.Fprintln(stderr, "-config is required")
+		fs.Usage()
+		return 2
+	}
+
+	logger := slog.New(slog.NewTextHandler(stderr, nil))
+	cfg, err := ratelimitconfig.Load(*configPath)
+	if err != nil {
+		logger.Error("load config", slog.Any("error", err))
+		return 1
+	}
+	reg, err := ratelimitconfig.Build(cfg, ratelimitconfig.WithLogger(logger))
+	if err != nil {
+		logger.Error("build policies", slog.Any("error", err))
+		return 1
+	}
+	defer reg.Close()
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		logger.Error("listen", slog.Any("error", err))
+		return 1
+	}
+	srv := &http.Server{Handler: newHandler(reg, *token, logger), ReadHeaderTimeout: 5 * time.Second}
+
+	if *reloadInterval > 0 {
+		go ratelimitconfig.Watch(ctx, *configPath, reg, ratelimitconfig.WatchWithInterval(*reloadInterval),
+			ratelimitconfig.WatchWithApplyHandler(func(*ratelimitconfig.Config) {
+				logger.Info("config is reloaded")
+			}),
+			ratelimitconfig.WatchWithErrorHandler(func(err error) {
+				logger.Error("reload config", slog.Any("error", err))
+			}))
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("serving decision api", slog.String("addr", lis.Addr().String()),
+		slog.Int("policies", len(cfg.Policies)))
+	if err := srv.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("serve", slog.Any("error", err))
+		return 1
+	}
+	return 0
+}
+
+// newHandler creates decision API of policies of reg, requests must carry token unless it's empty.
+// Admin API is only served with token since it changes keys and bans
+func newHandler(reg *ratelimitconfig.Registry, token string, logger *slog.Logger) http.Handler {
+	limiters := make(map[string]ratelimit.Limiter)
+	for _, p := range reg.Policies() {
+		limiters[p.Config.Name] = p.Limiter
+	}
+	opts := []ratelimitapi.Option{ratelimitapi.WithLogger(logger)}
+	if token == "" {
+		return ratelimitapi.New(limiters, opts...)
+	}
+	authorizer := ratelimitadmin.BearerToken(token)
+	opts = append(opts, ratelimitapi.WithAuthorizer(authorizer))
+
+	mux := http.NewServeMux()
+	mux.Handle("/", ratelimitapi.New(limiters, opts...))
+	mux.Handle("/admin/", http.StripPrefix("/admin", ratelimitadmin.NewWithSource(reg.AdminPolicies,
+		ratelimitadmin.WithAuthorizer(authorizer), ratelimitadmin.WithLogger(logger))))
+	return mux
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"ratelimit/util/ratelimit/ratelimitconfig"
+	"strings"
+	"testing"
+)
+
+func TestRun_Usage(t *testing.T) {
+	var stderr bytes.Buffer
+	assert.Equal(t, 2, run(context.Background(), nil, &stderr))
+	assert.Contains(t, stderr.String(), "-config is required")
+}
+
+func TestNewHandler(t *testing.T) {
+	cfg, err := ratelimitconfig.Parse([]byte(`
+policies:
+  - name: api
+    algorithm: fixed_window
+    quota: 1
+    period: 1m
+`))
+	require.Nil(t, err)
+	reg, err := ratelimitconfig.Build(cfg)
+	require.Nil(t, err)
+	defer reg.Close()
+	h := newHandler(reg, "secret", slog.Default())
+
+	allow := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/allow", strings.NewReader(`{"policy":"api","key":"k1"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, req)
+		return res
+	}
+	assert.Equal(t, http.StatusForbidden, allow("").Code)
+	res := allow("secret")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"allowed":true`)
+
+	// admin API is mounted under /admin/
+	req := httptest.NewRequest(http.MethodDelete, "/admin/policies/api/keys/k1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.Contains(t, allow("secret").Body.String(), `"allowed":true`)
+}
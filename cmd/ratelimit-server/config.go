@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"ratelimit/util/ratelimit/ratelimitconfig"
+	"strings"
+)
+
+// serverConfig is config of policies extended by rules mapping descriptors to them, e.g.
+//
+//	stores:
+//	  shared:
+//	    type: redis
+//	    address: localhost:6379
+//	policies:
+//	  - name: per_ip
+//	    algorithm: leaky_bucket
+//	    rate: 10
+//	    period: 1s
+//	    burst: 20
+//	    store: shared
+//	descriptors:
+//	  - domain: edge
+//	    entries:
+//	      - key: remote_address
+//	    policy: per_ip
+type serverConfig struct {
+	ratelimitconfig.Config `yaml:",inline"`
+	Descriptors            []descriptorRule `yaml:"descriptors"`
+}
+
+// descriptorRule selects policy of descriptors of domain which have exactly its entries in the same order
+type descriptorRule struct {
+	Domain  string      `yaml:"domain"`
+	Entries []ruleEntry `yaml:"entries"`
+	Policy  string      `yaml:"policy"`
+}
+
+// ruleEntry matches descriptor entry with key, and value too unless it's empty
+type ruleEntry struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
+func loadConfig(path string) (*serverConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// parseConfig decodes config from YAML or JSON and validates it, unknown fields are rejected
+func parseConfig(data []byte) (*serverConfig, error) {
+	cfg := &serverConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *serverConfig) validate() error {
+	var errs []error
+	if err := c.Config.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, &ratelimitconfig.FieldError{Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	policies := make(map[string]bool, len(c.Policies))
+	for _, p := range c.Policies {
+		policies[p.Name] = true
+	}
+	for i, r := range c.Descriptors {
+		path := fmt.Sprintf("descriptors[%d]", i)
+		if r.Domain == "" {
+			fail(path+".domain", "is required")
+		}
+		if len(r.Entries) == 0 {
+			fail(path+".entries", "is required")
+		}
+		for j, e := range r.Entries {
+			if e.Key == "" {
+				fail(fmt.Sprintf("%s.entries[%d].key", path, j), "is required")
+			}
+		}
+		if !policies[r.Policy] {
+			fail(path+".policy", "unknown policy %q", r.Policy)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// match reports if descriptor d of domain is selected by rule
+func (r *descriptorRule) match(domain string, d *ratelimitv3.RateLimitDescriptor) bool {
+	entries := d.GetEntries()
+	if domain != r.Domain || len(entries) != len(r.Entries) {
+		return false
+	}
+	for i, e := range entries {
+		if e.GetKey() != r.Entries[i].Key || (r.Entries[i].Value != "" && e.GetValue() != r.Entries[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// descriptorKey returns key of descriptor d of domain passed to limiter, e.g. edge|remote_address=10.0.0.1
+func descriptorKey(domain string, d *ratelimitv3.RateLimitDescriptor) string {
+	var b strings.Builder
+	b.WriteString(domain)
+	for _, e := range d.GetEntries() {
+		b.WriteByte('|')
+		b.WriteString(e.GetKey())
+		b.WriteByte('=')
+		b.WriteString(e.GetValue())
+	}
+	return b.String()
+}
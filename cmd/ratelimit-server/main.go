@@ -0,0 +1,96 @@
+// Command ratelimit-server is a rate limit service implementing envoy RateLimitService gRPC API,
+// so limits can be enforced at envoy or istio edge by the same policies Go services use.
+//
+// Usage:
+//
+//	ratelimit-server -config ratelimit.yaml [-addr :8081]
+//
+// Config holds stores and policies of ratelimitconfig and descriptor rules mapping descriptors of a domain to
+// policies, keys of limiters are built from domain and entries of descriptor, e.g. edge|remote_address=10.0.0.1.
+// gRPC health service is served as well.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/ratelimitconfig"
+	"syscall"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stderr))
+}
+
+// run serves rate limit service until ctx is done and returns exit code
+func run(ctx context.Context, args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("ratelimit-server", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", "", "path of YAML or JSON config")
+	addr := fs.String("addr", ":8081", "address of gRPC server")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		_, _ = fmt.Fprintln(stderr, "-config is required")
+		fs.Usage()
+		return 2
+	}
+
+	logger := slog.New(slog.NewTextHandler(stderr, nil))
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		logger.Error("load config", slog.Any("error", err))
+		return 1
+	}
+	reg, err := ratelimitconfig.Build(&cfg.Config, ratelimitconfig.WithLogger(logger))
+	if err != nil {
+		logger.Error("build policies", slog.Any("error", err))
+		return 1
+	}
+	defer reg.Close()
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		logger.Error("listen", slog.Any("error", err))
+		return 1
+	}
+	srv := newServer(&service{
+		rules:    cfg.Descriptors,
+		registry: reg,
+		clock:    ratelimit.SystemClock,
+		logger:   logger,
+	})
+
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	logger.Info("serving rate limit service", slog.String("addr", lis.Addr().String()),
+		slog.Int("policies", len(cfg.Policies)), slog.Int("descriptors", len(cfg.Descriptors)))
+	if err := srv.Serve(lis); err != nil {
+		logger.Error("serve", slog.Any("error", err))
+		return 1
+	}
+	return 0
+}
+
+// newServer creates gRPC server of rate limit and health services
+func newServer(s *service) *grpc.Server {
+	srv := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(srv, s)
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	return srv
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"log/slog"
+	"math"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/ratelimitconfig"
+	"time"
+)
+
+// units of RateLimit reported to envoy, limit of policy is expressed in the smallest unit not shorter than period
+var units = []struct {
+	unit     rlsv3.RateLimitResponse_RateLimit_Unit
+	duration time.Duration
+}{
+	{unit: rlsv3.RateLimitResponse_RateLimit_SECOND, duration: time.Second},
+	{unit: rlsv3.RateLimitResponse_RateLimit_MINUTE, duration: time.Minute},
+	{unit: rlsv3.RateLimitResponse_RateLimit_HOUR, duration: time.Hour},
+	{unit: rlsv3.RateLimitResponse_RateLimit_DAY, duration: 24 * time.Hour},
+}
+
+// service implements envoy RateLimitService by limiters of policies selected by descriptor rules
+type service struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	rules    []descriptorRule
+	registry *ratelimitconfig.Registry
+	clock    ratelimit.Clock
+	logger   *slog.Logger
+}
+
+// ShouldRateLimit checks every descriptor of request by policy of the first rule matching it, descriptors no rule
+// matches are not limited. Overall code is OVER_LIMIT if any descriptor is over limit.
+// Store errors which are not resolved by error policy fail the whole request with Unavailable,
+// envoy then applies its failure_mode_deny setting
+func (s *service) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse,
+	error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, "domain is required")
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "descriptors are required")
+	}
+
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	for _, d := range req.GetDescriptors() {
+		hits := uint64(req.GetHitsAddend())
+		if d.GetHitsAddend() != nil {
+			hits = d.GetHitsAddend().GetValue()
+		}
+		if hits == 0 {
+			hits = 1
+		}
+
+		st, err := s.check(ctx, req.GetDomain(), d, int64(hits))
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "check descriptor: %v", err)
+		}
+		if st.GetCode() == rlsv3.RateLimitResponse_OVER_LIMIT {
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		resp.Statuses = append(resp.Statuses, st)
+	}
+	return resp, nil
+}
+
+func (s *service) check(ctx context.Context, domain string, d *ratelimitv3.RateLimitDescriptor,
+	hits int64) (*rlsv3.RateLimitResponse_DescriptorStatus, error) {
+	var p *ratelimitconfig.Policy
+	for i := range s.rules {
+		if s.rules[i].match(domain, d) {
+			p, _ = s.registry.Policy(s.rules[i].Policy)
+			break
+		}
+	}
+	if p == nil {
+		return &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK}, nil
+	}
+
+	key := descriptorKey(domain, d)
+	now := s.clock.Now()
+	r, allowed, err := p.Limiter.Allow(ctx, key, hits)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code:               rlsv3.RateLimitResponse_OK,
+		CurrentLimit:       currentLimit(p.Config),
+		LimitRemaining:     remaining(r),
+		DurationUntilReset: durationpb.New(resetAfter(p.Config, r, allowed, now)),
+	}
+	if !allowed {
+		st.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+		s.logger.DebugContext(ctx, "descriptor is over limit", slog.String("policy", p.Config.Name),
+			ratelimit.LogKey(key))
+	}
+	return st, nil
+}
+
+// currentLimit expresses sustained limit of policy, quota per window or leak rate, as requests per unit
+func currentLimit(pc ratelimitconfig.PolicyConfig) *rlsv3.RateLimitResponse_RateLimit {
+	events := float64(pc.Quota)
+	if pc.Algorithm == ratelimitconfig.AlgorithmLeakyBucket {
+		events = pc.Rate
+	}
+
+	u := units[len(units)-1]
+	for _, candidate := range units {
+		if candidate.duration >= pc.Period {
+			u = candidate
+			break
+		}
+	}
+	perUnit := math.Floor(events * float64(u.duration) / float64(pc.Period))
+	return &rlsv3.RateLimitResponse_RateLimit{
+		Name:            pc.Name,
+		RequestsPerUnit: uint32(min(max(perUnit, 1), math.MaxUint32)),
+		Unit:            u.unit,
+	}
+}
+
+// remaining returns number of events still allowed by reservation r
+func remaining(r *ratelimit.Reservation) uint32 {
+	n := r.Bucket - int64(math.Ceil(r.Req))
+	return uint32(min(max(n, 0), math.MaxUint32))
+}
+
+// resetAfter returns time until limit of key is fully restored, or until next event is allowed if it's
+// over limit
+func resetAfter(pc ratelimitconfig.PolicyConfig, r *ratelimit.Reservation, allowed bool,
+	now time.Time) time.Duration {
+	if !allowed {
+		return r.DelayFrom(now)
+	}
+	switch pc.Algorithm {
+	case ratelimitconfig.AlgorithmFixedWindow:
+		return now.Truncate(pc.Period).Add(pc.Period).Sub(now)
+	case ratelimitconfig.AlgorithmLeakyBucket:
+		return time.Duration(r.Req / pc.Rate * float64(pc.Period))
+	default:
+		// events leave rolling window one slice at a time, window is the upper bound
+		return pc.Period
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"log/slog"
+	"net"
+	"ratelimit/driver/redis"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/ratelimitconfig"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+stores:
+  shared:
+    type: redis
+policies:
+  - name: per_ip
+    algorithm: leaky_bucket
+    rate: 1
+    period: 10s
+    burst: 2
+    store: shared
+    key_prefix: "ip:"
+  - name: login
+    algorithm: fixed_window
+    quota: 3
+    period: 1m
+descriptors:
+  - domain: edge
+    entries:
+      - key: remote_address
+    policy: per_ip
+  - domain: edge
+    entries:
+      - key: remote_address
+      - key: path
+        value: /login
+    policy: login
+`
+
+func newTestService(t *testing.T) (*service, *miniredis.Miniredis, *clocktest.FakeClock) {
+	mr := miniredis.RunT(t)
+	client, err := redis.NewConnection(&redis.SingleConnection{Address: mr.Addr()})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	cfg, err := parseConfig([]byte(testConfig))
+	require.Nil(t, err)
+	// start of a minute window
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	reg, err := ratelimitconfig.Build(&cfg.Config, ratelimitconfig.WithRedisClient("shared", client),
+		ratelimitconfig.WithClock(clock))
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = reg.Close() })
+	return &service{rules: cfg.Descriptors, registry: reg, clock: clock, logger: slog.Default()}, mr, clock
+}
+
+func descriptor(kv ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i < len(kv); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: kv[i], Value: kv[i+1]})
+	}
+	return d
+}
+
+func TestParseConfig(t *testing.T) {
+	_, err := parseConfig([]byte(testConfig + `
+  - domain: ""
+    entries:
+      - value: x
+    policy: missing
+`))
+	require.NotNil(t, err)
+
+	var paths []string
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var fe *ratelimitconfig.FieldError
+		require.True(t, errors.As(e, &fe))
+		paths = append(paths, fe.Path)
+	}
+	assert.Equal(t, []string{"descriptors[2].domain", "descriptors[2].entries[0].key", "descriptors[2].policy"},
+		paths)
+
+	_, err = parseConfig([]byte("descriptors:\n  - domian: edge\n"))
+	assert.ErrorContains(t, err, "field domian not found")
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	s, mr, clock := newTestService(t)
+	ctx := context.Background()
+	ip := descriptor("remote_address", "10.0.0.1")
+	login := descriptor("remote_address", "10.0.0.1", "path", "/login")
+
+	clock.Advance(15 * time.Second)
+	resp, err := s.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{ip, login, descriptor("user", "u1")}})
+	require.Nil(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.GetOverallCode())
+	require.Len(t, resp.GetStatuses(), 3)
+
+	st := resp.GetStatuses()[0]
+	assert.Equal(t, "per_ip", st.GetCurrentLimit().GetName())
+	assert.Equal(t, uint32(6), st.GetCurrentLimit().GetRequestsPerUnit())
+	assert.Equal(t, rlsv3.RateLimitResponse_RateLimit_MINUTE, st.GetCurrentLimit().GetUnit())
+	assert.Equal(t, uint32(1), st.GetLimitRemaining())
+	assert.Equal(t, 10*time.Second, st.GetDurationUntilReset().AsDuration())
+	assert.True(t, mr.Exists("ip:edge|remote_address=10.0.0.1"))
+
+	st = resp.GetStatuses()[1]
+	assert.Equal(t, uint32(3), st.GetCurrentLimit().GetRequestsPerUnit())
+	assert.Equal(t, uint32(2), st.GetLimitRemaining())
+	assert.Equal(t, 45*time.Second, st.GetDurationUntilReset().AsDuration())
+
+	// descriptor without rule is not limited
+	assert.Nil(t, resp.GetStatuses()[2].GetCurrentLimit())
+
+	// hits of descriptor override hits of request
+	ip.HitsAddend = wrapperspb.UInt64(2)
+	resp, err = s.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{Domain: "edge", HitsAddend: 1,
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{ip, login}})
+	require.Nil(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, resp.GetOverallCode())
+	assert.Equal(t, rlsv3.RateLimitResponse_OVER_LIMIT, resp.GetStatuses()[0].GetCode())
+	assert.Equal(t, uint32(0), resp.GetStatuses()[0].GetLimitRemaining())
+	assert.Equal(t, 10*time.Second, resp.GetStatuses()[0].GetDurationUntilReset().AsDuration())
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.GetStatuses()[1].GetCode())
+
+	_, err = s.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{Descriptors: []*ratelimitv3.RateLimitDescriptor{ip}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	mr.SetError("down")
+	_, err = s.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{ip}})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestServer(t *testing.T) {
+	s, _, _ := newTestService(t)
+	lis := bufconn.Listen(1 << 16)
+	srv := newServer(s)
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}))
+	require.Nil(t, err)
+	defer conn.Close()
+
+	resp, err := rlsv3.NewRateLimitServiceClient(conn).ShouldRateLimit(context.Background(),
+		&rlsv3.RateLimitRequest{Domain: "edge",
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.2")}})
+	require.Nil(t, err)
+	assert.Equal(t, rlsv3.RateLimitResponse_OK, resp.GetOverallCode())
+	assert.Equal(t, uint32(1), resp.GetStatuses()[0].GetLimitRemaining())
+}
@@ -0,0 +1,335 @@
+// Command ratelimitctl inspects and manages rate limit state kept on redis.
+//
+// Usage:
+//
+//	ratelimitctl [flags] get KEY...
+//	ratelimitctl [flags] set KEY VALUE
+//	ratelimitctl [flags] reset KEY...
+//	ratelimitctl [flags] delete-prefix [-dry-run] PREFIX
+//	ratelimitctl [flags] export [PREFIX]
+//
+// Values of fixed window counters and leaky bucket RateData are decoded automatically, remaining events and
+// reset time are shown when the policy is given with -algorithm, -limit, -period and -rate.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	goredis "github.com/go-redis/redis/v7"
+	"io"
+	"os"
+	"ratelimit/driver/redis"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"ratelimit/util/ratelimit/leakybucket"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	defaultScanCount = int64(500)
+	errUsage         = errors.New("usage")
+)
+
+const usage = `Usage: ratelimitctl [flags] COMMAND [ARGS]
+
+Commands:
+  get KEY...                         show state of keys
+  set KEY VALUE                      set value of a key, -algorithm and -period are required
+  reset KEY...                       delete keys
+  delete-prefix [-dry-run] PREFIX    delete every key starting with PREFIX
+  export [PREFIX]                    print state of keys starting with PREFIX as JSON
+
+Flags:
+`
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdout, os.Stderr, ratelimit.SystemClock))
+}
+
+// ctl runs commands against a redis server
+type ctl struct {
+	client *redis.McRedis
+	policy policy
+	clock  ratelimit.Clock
+	out    io.Writer
+}
+
+// run executes command line args and returns exit code
+func run(ctx context.Context, args []string, stdout, stderr io.Writer, clock ratelimit.Clock) int {
+	fs := flag.NewFlagSet("ratelimitctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		_, _ = fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	addr := fs.String("addr", "localhost:6379", "address of redis server")
+	var p policy
+	fs.StringVar(&p.algorithm, "algorithm", "", "algorithm of policy, fixed_window or leaky_bucket")
+	fs.Int64Var(&p.limit, "limit", 0, "quota of fixed window or bucket size of leaky bucket")
+	fs.Float64Var(&p.rate, "rate", 0, "events leaked per period of leaky bucket")
+	fs.DurationVar(&p.period, "period", 0, "window of fixed window or leak period of leaky bucket")
+	fs.DurationVar(&p.ttl, "ttl", 0, "ttl of keys written by set, derived from policy by default")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	if p.algorithm != "" {
+		if err := p.validate(); err != nil {
+			_, _ = fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+
+	client, err := redis.NewConnection(&redis.SingleConnection{Address: *addr})
+	if err != nil {
+		_, _ = fmt.Fprintf(stderr, "connect to redis: %v\n", err)
+		return 1
+	}
+	defer client.Close()
+
+	c := &ctl{client: client, policy: p, clock: clock, out: stdout}
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "get":
+		err = c.get(cmdArgs)
+	case "set":
+		err = c.set(ctx, cmdArgs)
+	case "reset":
+		err = c.reset(cmdArgs)
+	case "delete-prefix":
+		err = c.deletePrefix(cmdArgs, stderr)
+	case "export":
+		err = c.export(cmdArgs)
+	default:
+		err = fmt.Errorf("%w: unknown command %q", errUsage, cmd)
+	}
+
+	if errors.Is(err, errUsage) {
+		_, _ = fmt.Fprintln(stderr, err)
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func (c *ctl) get(keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: get requires at least one key", errUsage)
+	}
+	states, err := c.states(keys)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "KEY\tALGORITHM\tVALUE\tTTL\tREMAINING\tRESET")
+	for _, k := range keys {
+		s, ok := states[k]
+		if !ok {
+			_, _ = fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\n", k)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Key, s.Algorithm,
+			strconv.FormatFloat(s.Value, 'f', -1, 64), formatTTL(s.Expire, c.clock.Now()),
+			formatRemaining(s.Remaining), formatTime(s.ResetAt))
+	}
+	return w.Flush()
+}
+
+func (c *ctl) set(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("%w: set requires KEY and VALUE", errUsage)
+	}
+	if c.policy.algorithm == "" {
+		return fmt.Errorf("%w: set requires -algorithm and -period", errUsage)
+	}
+	value, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || value < 0 {
+		return fmt.Errorf("%w: VALUE must be a non-negative integer", errUsage)
+	}
+
+	// values are written by stores so they are encoded exactly like limiters do
+	ttl := c.policy.storeTTL()
+	if c.policy.algorithm == algorithmFixedWindow {
+		store := fixedwindow.NewRedisStore(c.client, ttl, nil, fixedwindow.RedisWithClock(c.clock))
+		return store.Reset(ctx, args[0], value)
+	}
+	store := leakybucket.NewRedisStore(c.client, ttl, 0, nil, leakybucket.RedisWithClock(c.clock))
+	return store.Reset(ctx, args[0], value)
+}
+
+func (c *ctl) reset(keys []string) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("%w: reset requires at least one key", errUsage)
+	}
+	n, err := c.client.Del(keys...).Result()
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(c.out, "deleted %d keys\n", n)
+	return nil
+}
+
+func (c *ctl) deletePrefix(args []string, stderr io.Writer) error {
+	fs := flag.NewFlagSet("delete-prefix", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dryRun := fs.Bool("dry-run", false, "count keys without deleting them")
+	if err := fs.Parse(args); err != nil {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if fs.NArg() != 1 || fs.Arg(0) == "" {
+		return fmt.Errorf("%w: delete-prefix requires a non-empty PREFIX", errUsage)
+	}
+
+	var deleted int64
+	err := c.scan(fs.Arg(0), func(keys []string) error {
+		if *dryRun {
+			deleted += int64(len(keys))
+			return nil
+		}
+		n, err := c.client.Del(keys...).Result()
+		deleted += n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		_, _ = fmt.Fprintf(c.out, "%d keys would be deleted\n", deleted)
+		return nil
+	}
+	_, _ = fmt.Fprintf(c.out, "deleted %d keys\n", deleted)
+	return nil
+}
+
+func (c *ctl) export(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("%w: export accepts at most one PREFIX", errUsage)
+	}
+	var prefix string
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	states := []keyState{}
+	err := c.scan(prefix, func(keys []string) error {
+		page, err := c.states(keys)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if s, ok := page[k]; ok {
+				states = append(states, s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(states)
+}
+
+// scan calls f with batches of keys starting with prefix
+func (c *ctl) scan(prefix string, f func(keys []string) error) error {
+	match := escapeGlob(prefix) + "*"
+	var cursor uint64
+	for {
+		keys, next, err := c.client.Scan(cursor, match, defaultScanCount).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := f(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// states reads and decodes keys in a pipeline, keys which are missing or hold other data are left out
+func (c *ctl) states(keys []string) (map[string]keyState, error) {
+	gets := make([]*goredis.StringCmd, len(keys))
+	ttls := make([]*goredis.DurationCmd, len(keys))
+	_, err := c.client.Pipelined(func(pipeliner goredis.Pipeliner) error {
+		for i, k := range keys {
+			gets[i] = pipeliner.Get(k)
+			ttls[i] = pipeliner.PTTL(k)
+		}
+		return nil
+	})
+	var replyErr goredis.Error
+	if err != nil && err != goredis.Nil && !errors.As(err, &replyErr) {
+		return nil, err
+	}
+
+	now := c.clock.Now()
+	states := make(map[string]keyState, len(keys))
+	for i, k := range keys {
+		value, err := gets[i].Result()
+		if err != nil {
+			continue
+		}
+		s, ok := decodeState(k, value, ttls[i].Val(), now)
+		if !ok {
+			continue
+		}
+		s.apply(c.policy, now)
+		states[k] = s
+	}
+	return states, nil
+}
+
+// escapeGlob escapes special characters of redis MATCH pattern
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func formatTTL(expire *time.Time, now time.Time) string {
+	if expire == nil {
+		return "-"
+	}
+	return expire.Sub(now).String()
+}
+
+func formatRemaining(n *int64) string {
+	if n == nil {
+		return "-"
+	}
+	return strconv.FormatInt(*n, 10)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/leakybucket"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runCtl(t *testing.T, mr *miniredis.Miniredis, clock *clocktest.FakeClock, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), append([]string{"-addr", mr.Addr()}, args...), &stdout, &stderr, clock)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestGet(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	require.Nil(t, mr.Set("fw:k1", "7"))
+	mr.SetTTL("fw:k1", 40*time.Second)
+	require.Nil(t, mr.Set("lb:k1", leakybucket.RateData{Remain: 6, LastSec: 1699999990}.String()))
+
+	code, out, _ := runCtl(t, mr, clock, "-algorithm", "fixed_window", "-limit", "10", "-period", "1m",
+		"get", "fw:k1", "lb:k1", "missing")
+	require.Equal(t, 0, code)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 4)
+	assert.Equal(t, []string{"fw:k1", "fixed_window", "7", "40s", "3", "2023-11-14T22:14:00Z"},
+		strings.Fields(lines[1]))
+	// policy of other algorithm is not applied
+	assert.Equal(t, []string{"lb:k1", "leaky_bucket", "6", "-", "-", "-"}, strings.Fields(lines[2]))
+	assert.Equal(t, []string{"missing", "-", "-", "-", "-", "-"}, strings.Fields(lines[3]))
+}
+
+func TestSet_Export(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	policy := []string{"-algorithm", "leaky_bucket", "-limit", "10", "-rate", "2", "-period", "1s"}
+
+	code, _, _ := runCtl(t, mr, clock, append(policy, "set", "user:1", "8")...)
+	require.Equal(t, 0, code)
+	assert.Equal(t, 5*time.Second, mr.TTL("user:1"))
+	require.Nil(t, mr.Set("user:2", "not a counter"))
+	require.Nil(t, mr.Set("other", "1"))
+
+	// 2 events leak after a second
+	clock.Advance(time.Second)
+	code, out, _ := runCtl(t, mr, clock, append(policy, "export", "user:")...)
+	require.Equal(t, 0, code)
+	var states []keyState
+	require.Nil(t, json.Unmarshal([]byte(out), &states))
+	require.Len(t, states, 1)
+	assert.Equal(t, "user:1", states[0].Key)
+	assert.Equal(t, float64(8), states[0].Value)
+	assert.True(t, time.Unix(1700000000, 0).Equal(*states[0].Last))
+	assert.Equal(t, int64(4), *states[0].Remaining)
+	assert.True(t, time.Unix(1700000004, 0).Equal(*states[0].ResetAt))
+
+	code, _, stderr := runCtl(t, mr, clock, "set", "user:1", "8")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "set requires -algorithm")
+}
+
+func TestDeletePrefix(t *testing.T) {
+	mr := miniredis.RunT(t)
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	for _, k := range []string{"a*:1", "a*:2", "ab:1", "b:1"} {
+		require.Nil(t, mr.Set(k, "1"))
+	}
+
+	code, out, _ := runCtl(t, mr, clock, "delete-prefix", "-dry-run", "a*")
+	require.Equal(t, 0, code)
+	assert.Equal(t, "2 keys would be deleted\n", out)
+	assert.Len(t, mr.Keys(), 4)
+
+	// glob characters of prefix are matched literally
+	code, out, _ = runCtl(t, mr, clock, "delete-prefix", "a*")
+	require.Equal(t, 0, code)
+	assert.Equal(t, "deleted 2 keys\n", out)
+	assert.Equal(t, []string{"ab:1", "b:1"}, mr.Keys())
+
+	code, out, _ = runCtl(t, mr, clock, "reset", "ab:1", "missing")
+	require.Equal(t, 0, code)
+	assert.Equal(t, "deleted 1 keys\n", out)
+
+	code, _, _ = runCtl(t, mr, clock, "delete-prefix", "")
+	assert.Equal(t, 2, code)
+	code, _, _ = runCtl(t, mr, clock, "unknown")
+	assert.Equal(t, 2, code)
+}
+
+func TestKeyState_Apply(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	p := policy{algorithm: algorithmLeakyBucket, limit: 10, rate: 1, period: time.Second}
+
+	last := now.Add(-2 * time.Second)
+	s := keyState{KeyState: ratelimit.KeyState{Value: 5, Last: &last}, Algorithm: algorithmLeakyBucket}
+	s.apply(p, now)
+	assert.Equal(t, int64(7), *s.Remaining)
+
+	// level of a key without time of last event is not leaked
+	s = keyState{KeyState: ratelimit.KeyState{Value: 5}, Algorithm: algorithmLeakyBucket}
+	s.apply(p, now)
+	assert.Equal(t, int64(5), *s.Remaining)
+	assert.Equal(t, now.Add(5*time.Second), *s.ResetAt)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/leakybucket"
+	"strconv"
+	"time"
+)
+
+const (
+	algorithmFixedWindow = "fixed_window"
+	algorithmLeakyBucket = "leaky_bucket"
+)
+
+// policy is limit applied to keys, it's used to compute remaining events and reset time of a key
+type policy struct {
+	algorithm string
+	limit     int64
+	rate      float64
+	period    time.Duration
+	ttl       time.Duration
+}
+
+func (p policy) validate() error {
+	switch p.algorithm {
+	case algorithmFixedWindow, algorithmLeakyBucket:
+	default:
+		return fmt.Errorf("-algorithm must be %s or %s", algorithmFixedWindow, algorithmLeakyBucket)
+	}
+	if p.period <= 0 {
+		return fmt.Errorf("-period must be positive")
+	}
+	if p.algorithm == algorithmLeakyBucket && p.rate <= 0 {
+		return fmt.Errorf("-rate must be positive for %s", algorithmLeakyBucket)
+	}
+	return nil
+}
+
+// storeTTL returns ttl of keys written by store of policy, unless -ttl is set leaky bucket keys live until
+// a full bucket leaks like the default store of leakybucket.New
+func (p policy) storeTTL() time.Duration {
+	if p.ttl > 0 {
+		return p.ttl
+	}
+	if p.algorithm == algorithmFixedWindow || p.limit <= 0 {
+		return p.period
+	}
+	return p.period * time.Duration(int64(math.Ceil(float64(p.limit)/p.rate)))
+}
+
+// keyState is state of a key decoded from redis
+type keyState struct {
+	ratelimit.KeyState
+	Algorithm string `json:"algorithm"`
+	// Remaining and ResetAt are computed only if a policy of the same algorithm is given
+	Remaining *int64     `json:"remaining,omitempty"`
+	ResetAt   *time.Time `json:"reset_at,omitempty"`
+}
+
+// decodeState decodes value of key, which is a fixed window counter or leaky bucket RateData JSON,
+// ttl is remaining time to live of key. ok is false if value is neither of them
+func decodeState(key, value string, ttl time.Duration, now time.Time) (keyState, bool) {
+	var expire *time.Time
+	if ttl > 0 {
+		end := now.Add(ttl)
+		expire = &end
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return keyState{
+			KeyState:  ratelimit.KeyState{Key: key, Value: float64(n), Expire: expire},
+			Algorithm: algorithmFixedWindow,
+		}, true
+	}
+	data, err := leakybucket.RateDataFromJSON(value)
+	if err != nil {
+		return keyState{}, false
+	}
+	last := time.Unix(data.LastSec, data.LastNSec)
+	return keyState{
+		KeyState:  ratelimit.KeyState{Key: key, Value: data.Remain, Expire: expire, Last: &last},
+		Algorithm: algorithmLeakyBucket,
+	}, true
+}
+
+// apply computes remaining events and reset time of s under policy p at now
+func (s *keyState) apply(p policy, now time.Time) {
+	if p.limit <= 0 || p.algorithm != s.Algorithm {
+		return
+	}
+
+	var remaining int64
+	switch s.Algorithm {
+	case algorithmFixedWindow:
+		remaining = p.limit - int64(s.Value)
+		s.ResetAt = s.Expire
+	case algorithmLeakyBucket:
+		level := s.Value
+		if s.Last != nil && now.After(*s.Last) {
+			level = max(0, level-p.rate*float64(now.Sub(*s.Last))/float64(p.period))
+		}
+		remaining = int64(math.Floor(float64(p.limit) - level))
+		resetAt := now.Add(time.Duration(level / p.rate * float64(p.period)))
+		s.ResetAt = &resetAt
+	}
+	remaining = max(0, remaining)
+	s.Remaining = &remaining
+}
@@ -1,3 +1,16 @@
 module ratelimit
 
 go 1.22
+
+require (
+	github.com/alicebob/miniredis/v2 v2.39.0
+	github.com/go-redis/redis/v7 v7.4.1
+	github.com/stretchr/testify v1.12.1
+	go.uber.org/goleak v1.3.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	go.yaml.in/yaml/v3 v3.0.5 // indirect
+)
@@ -2,19 +2,25 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"math"
 	"net/http"
 	"ratelimit/util"
 	"ratelimit/util/httputil"
 	"ratelimit/util/ratelimit"
 	"ratelimit/util/ratelimit/leakybucket"
+	"ratelimit/util/ratelimit/penaltybox"
+	"ratelimit/util/ratelimit/ratelimitio"
 	"time"
 )
 
 const (
 	defaultRateLimitHeader  = "X-Api-Call-Limit"
 	defaultRetryAfterHeader = "X-Retry-After"
+	// bannedRetryAfterHeader is standard header telling banned clients when to come back
+	bannedRetryAfterHeader = "Retry-After"
 )
 
 type RateRequestKeyExtractor func(r *http.Request) string
@@ -58,6 +64,86 @@ func RateLimitWithLimiter(l ratelimit.Limiter) RateLimitOption {
 	}
 }
 
+// RateLimitWithErrorPolicy set how middleware handles request when limiter returns error
+// By default, server will response HTTP code 500 with message "error when check rate limit"
+func RateLimitWithErrorPolicy(p ratelimit.ErrorPolicy) RateLimitOption {
+	return func(m *LimitMid) {
+		m.errPolicy = p
+	}
+}
+
+// RateLimitWithErrorHandler set callback which is notified on every limiter error
+func RateLimitWithErrorHandler(h ratelimit.ErrorHandler) RateLimitOption {
+	return func(m *LimitMid) {
+		m.errHandler = h
+	}
+}
+
+// RateLimitWithFallbackLimiter set local limiter used to check request on ErrorPolicyFallback
+func RateLimitWithFallbackLimiter(l ratelimit.Limiter) RateLimitOption {
+	return func(m *LimitMid) {
+		m.fallbackLimiter = l
+	}
+}
+
+// RateLimitWithPolicyName set name of policy enforced by middleware, it's used to label telemetry
+func RateLimitWithPolicyName(name string) RateLimitOption {
+	return func(m *LimitMid) {
+		m.policyName = name
+	}
+}
+
+// RateLimitWithTracer set tracer of every checked request, e.g. ratelimitotel.CheckTracer
+// By default, requests are not traced
+func RateLimitWithTracer(t ratelimit.CheckTracer) RateLimitOption {
+	return func(m *LimitMid) {
+		m.tracer = t
+	}
+}
+
+// RateLimitWithLogger set logger of middleware, requests failed to be checked are logged at error level
+// while denied requests are logged at debug level. By default, slog.Default() is used
+func RateLimitWithLogger(l *slog.Logger) RateLimitOption {
+	return func(m *LimitMid) {
+		m.logger = l
+	}
+}
+
+// RateLimitWithObserver set observer notified when a key gets limited, recovers or is reset and when limiter
+// starts failing, events are reported with policy name of middleware and delivered asynchronously until
+// middleware is closed
+func RateLimitWithObserver(o ratelimit.Observer) RateLimitOption {
+	return func(m *LimitMid) {
+		m.observer = o
+	}
+}
+
+// RateLimitWithBandwidthLimiter set limiter of bytes of response body of allowed requests, body is written as
+// fast as limiter allows bytes of request key. By default, response body is not limited
+func RateLimitWithBandwidthLimiter(l ratelimit.Limiter, opts ...ratelimitio.Option) RateLimitOption {
+	return func(m *LimitMid) {
+		m.bandwidthLimiter = l
+		m.bandwidthOpts = opts
+	}
+}
+
+// RateLimitWithPenaltyBox set penalty box banning keys which keep exceeding limits, requests are checked by b
+// instead of limiter set by RateLimitWithLimiter, so b should wrap it. Requests of banned keys are served by
+// banned handler with Retry-After header
+func RateLimitWithPenaltyBox(b *penaltybox.Box) RateLimitOption {
+	return func(m *LimitMid) {
+		m.box = b
+	}
+}
+
+// RateLimitWithBannedHandler set handler of requests of banned keys
+// By default, server will response HTTP code 403 (Forbidden) with message "temporarily banned"
+func RateLimitWithBannedHandler(h http.Handler) RateLimitOption {
+	return func(m *LimitMid) {
+		m.bannedHandler = h
+	}
+}
+
 // LimitMid rate limit middleware
 type LimitMid struct {
 	reqExtractor RateRequestKeyExtractor
@@ -66,6 +152,22 @@ type LimitMid struct {
 	rateLimitHeader  string
 	retryAfterHeader string
 	exceedHandler    http.Handler
+
+	errPolicy       ratelimit.ErrorPolicy
+	errHandler      ratelimit.ErrorHandler
+	fallbackLimiter ratelimit.Limiter
+
+	policyName string
+	tracer     ratelimit.CheckTracer
+	logger     *slog.Logger
+	observer   ratelimit.Observer
+	notifier   *ratelimit.Notifier
+
+	bandwidthLimiter ratelimit.Limiter
+	bandwidthOpts    []ratelimitio.Option
+
+	box           *penaltybox.Box
+	bannedHandler http.Handler
 }
 
 // NewRateLimit create new rate limit middleware with RateLimitOption opts
@@ -83,12 +185,24 @@ func NewRateLimit(opts ...RateLimitOption) *LimitMid {
 	if m.exceedHandler == nil {
 		m.exceedHandler = &defaultExceedHandler{}
 	}
+	if m.box != nil {
+		m.mLimiter = m.box
+	}
+	if m.bannedHandler == nil {
+		m.bannedHandler = &defaultBannedHandler{}
+	}
 	if util.IsStringEmpty(m.rateLimitHeader) {
 		m.rateLimitHeader = defaultRateLimitHeader
 	}
 	if util.IsStringEmpty(m.retryAfterHeader) {
 		m.retryAfterHeader = defaultRetryAfterHeader
 	}
+	if m.logger == nil {
+		m.logger = slog.Default()
+	}
+	if m.observer != nil {
+		m.notifier = ratelimit.NewNotifier(m.observer)
+	}
 
 	return m
 }
@@ -99,7 +213,16 @@ func defaultRateReqExtractor(r *http.Request) string {
 
 // Reset reset counter for a specified key
 func (m *LimitMid) Reset(k string) error {
-	return m.mLimiter.Reset(context.Background(), k, 0)
+	if err := m.mLimiter.Reset(context.Background(), k, 0); err != nil {
+		return err
+	}
+	m.notifier.Reset(m.policyName, k)
+	return nil
+}
+
+// Close waits for queued events to be delivered to observer, limiters are left open since they are owned by caller
+func (m *LimitMid) Close() error {
+	return m.notifier.Close()
 }
 
 func (m *LimitMid) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
@@ -111,24 +234,116 @@ func (m *LimitMid) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.H
 		return
 	}
 
-	reservation, allowed, err := m.mLimiter.Allow(r.Context(), key, 1)
+	d, err := m.allow(r.Context(), key)
 	if err != nil {
+		m.logger.ErrorContext(r.Context(), "failed to check rate limit", slog.String("policy", m.policyName),
+			ratelimit.LogKey(key), slog.Any("error", err))
 		httputil.RespondError(w, http.StatusInternalServerError, "error when check rate limit")
 		return
 	}
+	if d.Banned() {
+		m.serveBanned(w, r, d)
+		return
+	}
+	if d.Reservation == nil {
+		m.serveDecision(w, r, next, key, d.Allowed)
+		return
+	}
 
+	reservation := d.Reservation
 	w.Header().Set(m.rateLimitHeader, fmt.Sprintf("%d/%d", int64(math.Ceil(reservation.Req)), reservation.Bucket))
 	w.Header().Set(m.retryAfterHeader, fmt.Sprintf("%.1f", float64(reservation.Delay()/time.Second)))
+	m.serveDecision(w, r, next, key, d.Allowed)
+}
+
+// allow checks request key by limiter and error policy, the check is traced if tracer is set
+// Trace of the check ends before serving request so spans of next handler are not nested in it
+func (m *LimitMid) allow(ctx context.Context, key string) (penaltybox.Decision, error) {
+	if m.tracer == nil {
+		return m.check(ctx, key)
+	}
+
+	ctx, end := m.tracer.StartCheck(ctx, m.policyName, key)
+	d, err := m.check(ctx, key)
+	end(d.Reservation, d.Allowed, err)
+	return d, err
+}
+
+// check checks request key by penalty box if it's set, so a ban is got with the same call, or by limiter
+func (m *LimitMid) check(ctx context.Context, key string) (penaltybox.Decision, error) {
+	var d penaltybox.Decision
+	var err error
+	if m.box != nil {
+		d, err = m.box.Check(ctx, key, 1)
+	} else {
+		d.Reservation, d.Allowed, err = m.mLimiter.Allow(ctx, key, 1)
+	}
+	if err != nil {
+		// other errors, e.g. a canceled request, say nothing about health of store
+		if errors.Is(err, ratelimit.ErrStoreUnavailable) {
+			m.notifier.StoreFailed(m.policyName, key, err)
+		}
+		reservation, allowed, err := m.handleLimiterErr(ctx, key, err)
+		return penaltybox.Decision{Reservation: reservation, Allowed: allowed}, err
+	}
+	m.notifier.StoreRecovered()
+	m.notifier.Decision(m.policyName, key, d.Reservation, d.Allowed)
+	return d, nil
+}
+
+func (m *LimitMid) serveDecision(w http.ResponseWriter, r *http.Request, next http.HandlerFunc, key string,
+	allowed bool) {
 	if allowed {
+		if m.bandwidthLimiter != nil {
+			w = ratelimitio.NewResponseWriter(r.Context(), w, m.bandwidthLimiter, key, m.bandwidthOpts...)
+		}
 		next(w, r)
 	} else {
+		m.logger.DebugContext(r.Context(), "request denied", slog.String("policy", m.policyName),
+			slog.String("path", r.URL.Path))
 		m.exceedHandler.ServeHTTP(w, r)
 	}
 }
 
+// serveBanned serves request of banned key by banned handler, Retry-After is counted by clock of penalty box
+func (m *LimitMid) serveBanned(w http.ResponseWriter, r *http.Request, d penaltybox.Decision) {
+	m.logger.DebugContext(r.Context(), "request of banned key", slog.String("policy", m.policyName),
+		slog.String("path", r.URL.Path), slog.Time("banned_until", d.BannedUntil))
+	w.Header().Set(bannedRetryAfterHeader, fmt.Sprintf("%d", int64(math.Ceil(d.BanRemaining().Seconds()))))
+	m.bannedHandler.ServeHTTP(w, r)
+}
+
+// handleLimiterErr resolve request decision by error policy, returned reservation is nil if decision is made
+// without any limiter
+func (m *LimitMid) handleLimiterErr(ctx context.Context, key string, err error) (*ratelimit.Reservation, bool, error) {
+	if m.errHandler != nil {
+		m.errHandler(ctx, key, err)
+	}
+
+	switch m.errPolicy {
+	case ratelimit.ErrorPolicyFailOpen:
+		return nil, true, nil
+	case ratelimit.ErrorPolicyFailClosed:
+		return nil, false, nil
+	case ratelimit.ErrorPolicyFallback:
+		if m.fallbackLimiter != nil {
+			return m.fallbackLimiter.Allow(ctx, key, 1)
+		}
+	}
+
+	return nil, false, err
+}
+
 type defaultExceedHandler struct {
 }
 
 func (h *defaultExceedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	httputil.RespondError(w, http.StatusTooManyRequests, "too many request")
 }
+
+type defaultBannedHandler struct {
+}
+
+func (h *defaultBannedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	httputil.RespondError(w, http.StatusForbidden, "temporarily banned")
+}
@@ -1,13 +1,19 @@
 package middleware
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"net/http"
 	"net/http/httptest"
 	"ratelimit/util"
 	"ratelimit/util/httputil"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
 	"ratelimit/util/ratelimit/leakybucket"
+	"ratelimit/util/ratelimit/penaltybox"
 	"testing"
 	"time"
 )
@@ -142,3 +148,211 @@ func TestRateLimit_Reset(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, res.Code)
 }
+
+type failedLimiter struct{}
+
+func (l failedLimiter) Reset(ctx context.Context, k string, v int64) error {
+	return errors.New("store is down")
+}
+
+func (l failedLimiter) Allow(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, errors.New("store is down")
+}
+
+func TestRateLimit_Error_Policy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   ratelimit.ErrorPolicy
+		fallback ratelimit.Limiter
+		wantCode int
+	}{
+		{name: "propagate", policy: ratelimit.ErrorPolicyPropagate, wantCode: http.StatusInternalServerError},
+		{name: "fail open", policy: ratelimit.ErrorPolicyFailOpen, wantCode: http.StatusOK},
+		{name: "fail closed", policy: ratelimit.ErrorPolicyFailClosed, wantCode: http.StatusTooManyRequests},
+		{name: "fallback", policy: ratelimit.ErrorPolicyFallback,
+			fallback: leakybucket.New(rate, time.Duration(duration)*time.Minute, bucket), wantCode: http.StatusOK},
+		{name: "fallback without limiter", policy: ratelimit.ErrorPolicyFallback,
+			wantCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var notified int
+			res, req := rateLimitPrepare()
+			rateLimit := NewRateLimit(RateLimitWithLimiter(failedLimiter{}),
+				RateLimitWithErrorPolicy(tt.policy),
+				RateLimitWithFallbackLimiter(tt.fallback),
+				RateLimitWithErrorHandler(func(ctx context.Context, k string, err error) {
+					notified++
+				}))
+			rateLimit.ServeHTTP(res, req, newRateLimitTestHandler())
+
+			assert.Equal(t, tt.wantCode, res.Code)
+			assert.Equal(t, 1, notified)
+		})
+	}
+}
+
+// tracedKey marks context of a traced check
+type tracedKey struct{}
+
+// recordingTracer records checks traced by middleware
+type recordingTracer struct {
+	checks []string
+	ended  []bool
+}
+
+func (t *recordingTracer) StartCheck(ctx context.Context, policy, key string) (context.Context,
+	func(r *ratelimit.Reservation, allowed bool, err error)) {
+	t.checks = append(t.checks, policy+"/"+key)
+	return context.WithValue(ctx, tracedKey{}, policy), func(r *ratelimit.Reservation, allowed bool, err error) {
+		t.ended = append(t.ended, allowed && r != nil && err == nil)
+	}
+}
+
+// ctxLimiter fails events whose context is not passed through tracer
+type ctxLimiter struct {
+	ratelimit.Limiter
+}
+
+func (l ctxLimiter) Allow(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	if ctx.Value(tracedKey{}) == nil {
+		return nil, false, errors.New("context is not traced")
+	}
+	return l.Limiter.Allow(ctx, k, v)
+}
+
+func TestRateLimit_Tracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	limiter := ctxLimiter{Limiter: leakybucket.New(rate, time.Duration(duration)*time.Minute, bucket)}
+	rateLimit := NewRateLimit(RateLimitWithLimiter(limiter), RateLimitWithPolicyName("api"),
+		RateLimitWithRequestKeyExtractor(func(r *http.Request) string {
+			return "k1"
+		}), RateLimitWithTracer(tracer))
+
+	res, req := rateLimitPrepare()
+	rateLimit.ServeHTTP(res, req, newRateLimitTestHandler())
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, []string{"api/k1"}, tracer.checks)
+	assert.Equal(t, []bool{true}, tracer.ended)
+}
+
+func TestRateLimit_Observer(t *testing.T) {
+	var events []ratelimit.Event
+	limiter := leakybucket.New(rate, time.Duration(duration)*time.Minute, 1)
+	rateLimit := NewRateLimit(RateLimitWithLimiter(limiter), RateLimitWithPolicyName("api"),
+		RateLimitWithRequestKeyExtractor(func(r *http.Request) string {
+			return "x_unique_id"
+		}),
+		RateLimitWithObserver(ratelimit.ObserverFunc(func(e ratelimit.Event) {
+			events = append(events, e)
+		})))
+
+	for i := 0; i < 3; i++ {
+		res, req := rateLimitPrepare()
+		rateLimit.ServeHTTP(res, req, newRateLimitTestHandler())
+	}
+	require.Nil(t, rateLimit.Reset("x_unique_id"))
+	require.Nil(t, rateLimit.Close())
+
+	require.Len(t, events, 2)
+	assert.Equal(t, ratelimit.EventLimitExceeded, events[0].Type)
+	assert.Equal(t, "api", events[0].Policy)
+	assert.Equal(t, "x_unique_id", events[0].Key)
+	assert.NotNil(t, events[0].Reservation)
+	assert.Equal(t, ratelimit.EventReset, events[1].Type)
+}
+
+// errLimiter fails every event with err
+type errLimiter struct {
+	failedLimiter
+	err error
+}
+
+func (l errLimiter) Allow(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, l.err
+}
+
+func TestRateLimit_Observer_StoreFailed(t *testing.T) {
+	for _, err := range []error{context.Canceled, fmt.Errorf("%w: down", ratelimit.ErrStoreUnavailable)} {
+		var events []ratelimit.Event
+		rateLimit := NewRateLimit(RateLimitWithLimiter(errLimiter{err: err}),
+			RateLimitWithErrorPolicy(ratelimit.ErrorPolicyFailOpen),
+			RateLimitWithObserver(ratelimit.ObserverFunc(func(e ratelimit.Event) {
+				events = append(events, e)
+			})))
+		res, req := rateLimitPrepare()
+		rateLimit.ServeHTTP(res, req, newRateLimitTestHandler())
+		require.Nil(t, rateLimit.Close())
+
+		// only unavailable store is reported
+		if !errors.Is(err, ratelimit.ErrStoreUnavailable) {
+			assert.Empty(t, events)
+			continue
+		}
+		require.Len(t, events, 1)
+		assert.Equal(t, ratelimit.EventStoreFallback, events[0].Type)
+	}
+}
+
+func TestRateLimit_Bandwidth(t *testing.T) {
+	// 5 bytes of response body per key
+	bandwidth := leakybucket.New(5, time.Hour, 5)
+	rateLimit := NewRateLimit(RateLimitWithLimiter(leakybucket.New(rate, time.Minute, bucket)),
+		RateLimitWithRequestKeyExtractor(func(r *http.Request) string {
+			return "x_unique_id"
+		}),
+		RateLimitWithBandwidthLimiter(bandwidth))
+
+	res, req := rateLimitPrepare()
+	rateLimit.ServeHTTP(res, req, newRateLimitTestHandler())
+	assert.Equal(t, "bar", res.Body.String())
+
+	// body waits for limiter until request is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	res, req = rateLimitPrepare()
+	var err error
+	rateLimit.ServeHTTP(res, req.WithContext(ctx), func(w http.ResponseWriter, r *http.Request) {
+		_, err = w.Write([]byte("bar"))
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, res.Body.String())
+}
+
+func TestRateLimit_PenaltyBox(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	limiter := leakybucket.New(rate, time.Duration(duration)*time.Minute, 1, leakybucket.WithClock(clock))
+	defer limiter.Close()
+	box := penaltybox.New(limiter, penaltybox.WithThreshold(2, time.Minute), penaltybox.WithClock(clock))
+	defer box.Close()
+	rateLimit := NewRateLimit(RateLimitWithPenaltyBox(box), RateLimitWithRequestKeyExtractor(
+		func(r *http.Request) string {
+			return "x_unique_id"
+		}))
+
+	// request reaching threshold is served as banned
+	var codes []int
+	for i := 0; i < 3; i++ {
+		res, req := rateLimitPrepare()
+		rateLimit.ServeHTTP(res, req, newRateLimitTestHandler())
+		codes = append(codes, res.Code)
+		if res.Code == http.StatusForbidden {
+			assert.Equal(t, "60", res.Header().Get("Retry-After"))
+			assert.Empty(t, res.Header().Get(defaultRateLimitHeader))
+		}
+	}
+	assert.Equal(t, []int{http.StatusOK, http.StatusTooManyRequests, http.StatusForbidden}, codes)
+
+	// Retry-After is counted by clock of box
+	clock.Advance(20 * time.Second)
+	res, req := rateLimitPrepare()
+	rateLimit.ServeHTTP(res, req, newRateLimitTestHandler())
+	assert.Equal(t, http.StatusForbidden, res.Code)
+	assert.Equal(t, "40", res.Header().Get("Retry-After"))
+
+	require.Nil(t, box.Unban(context.Background(), "x_unique_id"))
+	res, req = rateLimitPrepare()
+	rateLimit.ServeHTTP(res, req, newRateLimitTestHandler())
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+}
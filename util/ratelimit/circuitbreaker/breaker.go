@@ -0,0 +1,215 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"fmt"
+	"ratelimit/util/ratelimit"
+	"sync"
+	"time"
+)
+
+var (
+	ErrOpen = errors.New("circuit breaker is open")
+)
+
+var (
+	defaultMaxFailures = 5
+	defaultOpenTimeout = 5 * time.Second
+)
+
+// State is state of circuit breaker
+type State int32
+
+const (
+	// StateClosed let all calls go through
+	StateClosed State = iota
+	// StateOpen rejects all calls until open timeout elapses
+	StateOpen
+	// StateHalfOpen let a single probe call go through to check if dependency recovered
+	StateHalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half_open"
+	}
+	return fmt.Sprintf("State(%d)", int32(s))
+}
+
+// StateChangeHandler is notified every time breaker changes its state
+type StateChangeHandler func(from State, to State)
+
+type Option func(b *Breaker)
+
+// WithMaxFailures set number of consecutive failures which trips the breaker
+func WithMaxFailures(n int) Option {
+	return func(b *Breaker) {
+		b.maxFailures = n
+	}
+}
+
+// WithOpenTimeout set how long breaker stays open before letting a probe call go through
+func WithOpenTimeout(d time.Duration) Option {
+	return func(b *Breaker) {
+		b.openTimeout = d
+	}
+}
+
+// WithSlowThreshold set latency from which a successful call is still counted as failure
+// By default, latency is not taken into account
+func WithSlowThreshold(d time.Duration) Option {
+	return func(b *Breaker) {
+		b.slowThreshold = d
+	}
+}
+
+// WithClock set clock used to time open state
+func WithClock(c ratelimit.Clock) Option {
+	return func(b *Breaker) {
+		b.now = c.Now
+	}
+}
+
+// WithStateChangeHandler set callback which is notified on state change, it is called with breaker lock held
+// so it must not call breaker back
+func WithStateChangeHandler(h StateChangeHandler) Option {
+	return func(b *Breaker) {
+		b.onStateChange = h
+	}
+}
+
+// Breaker is a consecutive failures circuit breaker
+type Breaker struct {
+	maxFailures   int
+	openTimeout   time.Duration
+	slowThreshold time.Duration
+	onStateChange StateChangeHandler
+	now           func() time.Time
+
+	lock     sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	probeAt  time.Time
+	probing  bool
+	// generation is changed on every state change, so results of calls allowed in a previous state are ignored
+	generation uint64
+}
+
+func New(opts ...Option) *Breaker {
+	b := &Breaker{
+		maxFailures: defaultMaxFailures,
+		openTimeout: defaultOpenTimeout,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.maxFailures <= 0 {
+		b.maxFailures = defaultMaxFailures
+	}
+	if b.openTimeout <= 0 {
+		b.openTimeout = defaultOpenTimeout
+	}
+
+	return b
+}
+
+// Allow checks if a call can go through, every allowed call must be reported back by Done with returned
+// generation of breaker
+func (b *Breaker) Allow() (uint64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := b.now()
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) < b.openTimeout {
+			return 0, ErrOpen
+		}
+		b.setState(StateHalfOpen)
+		b.probing = true
+		b.probeAt = now
+		return b.generation, nil
+	case StateHalfOpen:
+		// only one probe at a time, start another one if previous probe is never reported
+		if b.probing && now.Sub(b.probeAt) < b.openTimeout {
+			return 0, ErrOpen
+		}
+		b.probing = true
+		b.probeAt = now
+		return b.generation, nil
+	}
+
+	return b.generation, nil
+}
+
+// Done reports result of a call allowed in generation gen, err must be nil if failure is not caused by
+// the dependency. Result of a call allowed before breaker changed its state is ignored, so only a probe
+// closes or reopens a half-open breaker
+func (b *Breaker) Done(gen uint64, err error, elapsed time.Duration) {
+	failed := err != nil || (b.slowThreshold > 0 && elapsed > b.slowThreshold)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if gen != b.generation {
+		return
+	}
+	if !failed {
+		b.failures = 0
+		if b.state == StateHalfOpen {
+			b.probing = false
+			b.setState(StateClosed)
+		}
+		return
+	}
+
+	b.failures++
+	switch b.state {
+	case StateHalfOpen:
+		b.probing = false
+		b.trip()
+	case StateClosed:
+		if b.failures >= b.maxFailures {
+			b.trip()
+		}
+	}
+}
+
+// State returns current state of breaker
+func (b *Breaker) State() State {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state
+}
+
+// Failures returns number of consecutive failures
+func (b *Breaker) Failures() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.failures
+}
+
+func (b *Breaker) trip() {
+	b.openedAt = b.now()
+	b.setState(StateOpen)
+}
+
+func (b *Breaker) setState(s State) {
+	if b.state == s {
+		return
+	}
+	from := b.state
+	b.state = s
+	b.generation++
+	if b.onStateChange != nil {
+		b.onStateChange(from, s)
+	}
+}
@@ -0,0 +1,82 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"ratelimit/util/ratelimit/clocktest"
+	"testing"
+	"time"
+)
+
+var errDown = errors.New("down")
+
+func TestBreaker(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Now())
+	var changes []State
+	b := New(WithMaxFailures(2), WithOpenTimeout(time.Second), WithSlowThreshold(100*time.Millisecond),
+		WithClock(clock), WithStateChangeHandler(func(from State, to State) {
+			changes = append(changes, to)
+		}))
+
+	gen, err := b.Allow()
+	assert.Nil(t, err)
+	b.Done(gen, errDown, 0)
+	assert.Equal(t, StateClosed, b.State())
+
+	// slow call is counted as failure
+	gen, err = b.Allow()
+	assert.Nil(t, err)
+	b.Done(gen, nil, time.Second)
+	assert.Equal(t, StateOpen, b.State())
+	_, err = b.Allow()
+	assert.ErrorIs(t, err, ErrOpen)
+
+	// only one probe is let through in half-open state
+	clock.Advance(time.Second)
+	gen, err = b.Allow()
+	assert.Nil(t, err)
+	assert.Equal(t, StateHalfOpen, b.State())
+	_, err = b.Allow()
+	assert.ErrorIs(t, err, ErrOpen)
+
+	// failed probe opens breaker again
+	b.Done(gen, errDown, 0)
+	assert.Equal(t, StateOpen, b.State())
+	clock.Advance(500 * time.Millisecond)
+	_, err = b.Allow()
+	assert.ErrorIs(t, err, ErrOpen)
+
+	// lost probe is replaced after open timeout
+	clock.Advance(500 * time.Millisecond)
+	_, err = b.Allow()
+	assert.Nil(t, err)
+	clock.Advance(time.Second)
+	gen, err = b.Allow()
+	assert.Nil(t, err)
+
+	b.Done(gen, nil, 0)
+	assert.Equal(t, StateClosed, b.State())
+	assert.Equal(t, 0, b.Failures())
+	assert.Equal(t, []State{StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}, changes)
+}
+
+func TestBreaker_Stale_Result(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Now())
+	b := New(WithMaxFailures(1), WithOpenTimeout(time.Second), WithClock(clock))
+
+	// slow call is allowed before breaker trips
+	stale, err := b.Allow()
+	assert.Nil(t, err)
+	gen, _ := b.Allow()
+	b.Done(gen, errDown, 0)
+	assert.Equal(t, StateOpen, b.State())
+
+	// its success does not close half-open breaker, only probe does
+	clock.Advance(time.Second)
+	probe, err := b.Allow()
+	assert.Nil(t, err)
+	b.Done(stale, nil, 0)
+	assert.Equal(t, StateHalfOpen, b.State())
+	b.Done(probe, errDown, 0)
+	assert.Equal(t, StateOpen, b.State())
+}
@@ -0,0 +1,48 @@
+package ratelimit
+
+import (
+	"time"
+)
+
+// Clock provides time to limiters and stores, it's replaced by a fake clock to make tests deterministic
+type Clock interface {
+	// Now returns current time
+	Now() time.Time
+	// After waits for duration d to elapse and then sends current time on returned channel
+	After(d time.Duration) <-chan time.Time
+	// NewTicker returns ticker sending current time every period d
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks of a Clock
+type Ticker interface {
+	// C returns channel on which ticks are delivered
+	C() <-chan time.Time
+	// Stop turns off ticker
+	Stop()
+}
+
+// SystemClock is Clock backed by package time
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
@@ -0,0 +1,178 @@
+// Package clocktest provides a manual clock to write deterministic tests of limiters and stores
+package clocktest
+
+import (
+	"ratelimit/util/ratelimit"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock is ratelimit.Clock which only moves when it's advanced
+type FakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*waiter
+	// timerAdded is closed and replaced whenever a timer is added
+	timerAdded chan struct{}
+}
+
+type waiter struct {
+	until  time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewFakeClock create clock starting at now
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{
+		now: now,
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	w := &waiter{
+		until: c.now.Add(d),
+		c:     make(chan time.Time, 1),
+	}
+	if d <= 0 {
+		w.c <- c.now
+		return w.c
+	}
+	c.waiters = append(c.waiters, w)
+	if c.timerAdded != nil {
+		close(c.timerAdded)
+		c.timerAdded = nil
+	}
+	return w.c
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) ratelimit.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	w := &waiter{
+		until:  c.now.Add(d),
+		period: d,
+		c:      make(chan time.Time, 1),
+	}
+	c.waiters = append(c.waiters, w)
+	return &fakeTicker{clock: c, w: w}
+}
+
+// Advance moves clock forward by d, firing timers and tickers which are due in order of their deadline.
+// Like time.Ticker, a tick is dropped if previous one is not received yet. Clock never moves backward
+func (c *FakeClock) Advance(d time.Duration) {
+	if d < 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool {
+			return c.waiters[i].until.Before(c.waiters[j].until)
+		})
+		if len(c.waiters) == 0 || c.waiters[0].until.After(end) {
+			break
+		}
+
+		w := c.waiters[0]
+		c.now = w.until
+		select {
+		case w.c <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			w.until = w.until.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+	}
+	c.now = end
+}
+
+// Set moves clock to t, it's a no-op if t is before current time
+func (c *FakeClock) Set(t time.Time) {
+	c.Advance(t.Sub(c.Now()))
+}
+
+// Waiters returns number of pending timers and tickers, it helps tests wait for a goroutine to start waiting
+func (c *FakeClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
+
+// Timers returns number of pending timers created by After. Tickers are not counted, so sweepers ticking on the
+// same clock don't throw off tests waiting for a goroutine to sleep
+func (c *FakeClock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.timers()
+}
+
+// BlockUntilTimers blocks until at least n timers created by After are pending
+func (c *FakeClock) BlockUntilTimers(n int) {
+	for {
+		c.lock.Lock()
+		if c.timers() >= n {
+			c.lock.Unlock()
+			return
+		}
+		if c.timerAdded == nil {
+			c.timerAdded = make(chan struct{})
+		}
+		added := c.timerAdded
+		c.lock.Unlock()
+		<-added
+	}
+}
+
+func (c *FakeClock) timers() int {
+	var n int
+	for _, w := range c.waiters {
+		if w.period == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *FakeClock) stop(w *waiter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, cw := range c.waiters {
+		if cw == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+type fakeTicker struct {
+	clock *FakeClock
+	w     *waiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.w.c
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.stop(t.w)
+}
@@ -0,0 +1,53 @@
+package clocktest
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	ticker := c.NewTicker(time.Second)
+	after := c.After(1500 * time.Millisecond)
+	assert.Equal(t, 2, c.Waiters())
+
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), <-ticker.C())
+	assert.Len(t, after, 0)
+
+	// tick of 2s is dropped since tick of 3s is not received
+	c.Advance(2 * time.Second)
+	assert.Equal(t, start.Add(1500*time.Millisecond), <-after)
+	assert.Equal(t, start.Add(2*time.Second), <-ticker.C())
+	assert.Len(t, ticker.C(), 0)
+	assert.Equal(t, start.Add(3*time.Second), c.Now())
+
+	ticker.Stop()
+	assert.Equal(t, 0, c.Waiters())
+
+	// clock never moves backward
+	c.Set(start)
+	assert.Equal(t, start.Add(3*time.Second), c.Now())
+	assert.Equal(t, start.Add(3*time.Second), <-c.After(0))
+}
+
+func TestFakeClock_BlockUntilTimers(t *testing.T) {
+	c := NewFakeClock(time.Unix(1000, 0))
+	ticker := c.NewTicker(time.Second)
+	defer ticker.Stop()
+	assert.Equal(t, 0, c.Timers())
+
+	fired := make(chan time.Time)
+	go func() {
+		fired <- <-c.After(time.Second)
+	}()
+	c.BlockUntilTimers(1)
+	assert.Equal(t, 1, c.Timers())
+	assert.Equal(t, 2, c.Waiters())
+
+	c.Advance(time.Second)
+	assert.Equal(t, time.Unix(1001, 0), <-fired)
+	assert.Equal(t, 0, c.Timers())
+}
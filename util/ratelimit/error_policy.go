@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrStoreUnavailable = errors.New("rate limit store unavailable")
+)
+
+// ErrorPolicy decides how an event is handled when its rate can not be calculated because of store error
+type ErrorPolicy int
+
+const (
+	// ErrorPolicyPropagate returns store error to caller, it's the default behaviour
+	ErrorPolicyPropagate ErrorPolicy = iota
+	// ErrorPolicyFailOpen allows event to pass
+	ErrorPolicyFailOpen
+	// ErrorPolicyFailClosed rejects event as if it reached limit
+	ErrorPolicyFailClosed
+	// ErrorPolicyFallback calculates event on local in-memory limiter with scaled-down quota
+	ErrorPolicyFallback
+)
+
+var errorPolicyNames = map[ErrorPolicy]string{
+	ErrorPolicyPropagate:  "propagate",
+	ErrorPolicyFailOpen:   "fail_open",
+	ErrorPolicyFailClosed: "fail_closed",
+	ErrorPolicyFallback:   "fallback",
+}
+
+func (p ErrorPolicy) String() string {
+	if name, ok := errorPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("ErrorPolicy(%d)", int(p))
+}
+
+// ParseErrorPolicy parses policy from its name, e.g. "fail_open"
+func ParseErrorPolicy(s string) (ErrorPolicy, error) {
+	s = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(s)), "-", "_")
+	for p, name := range errorPolicyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return ErrorPolicyPropagate, fmt.Errorf("unknown error policy %q", s)
+}
+
+// ErrorHandler is notified every time store error happens on event k
+type ErrorHandler func(ctx context.Context, k string, err error)
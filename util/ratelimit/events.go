@@ -0,0 +1,273 @@
+package ratelimit
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	defaultEventBuffer     = 1024
+	defaultMaxLimitedKeys  = 10000
+	defaultNotifierTimeout = 5 * time.Second
+)
+
+// EventType is kind of rate limit event
+type EventType int
+
+const (
+	// EventLimitExceeded fires on first rejection of a key, it does not fire again until key recovers
+	EventLimitExceeded EventType = iota
+	// EventLimitRecovered fires when a limited key is allowed again
+	EventLimitRecovered
+	// EventReset fires when usage of a key is reset
+	EventReset
+	// EventStoreFallback fires when store starts failing and events are resolved by error policy or fallback store,
+	// it does not fire again until store recovers
+	EventStoreFallback
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventLimitExceeded:
+		return "limit_exceeded"
+	case EventLimitRecovered:
+		return "limit_recovered"
+	case EventReset:
+		return "reset"
+	case EventStoreFallback:
+		return "store_fallback"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is notified to observers
+type Event struct {
+	Type EventType
+	// Policy is name of limiter or middleware firing the event
+	Policy string
+	Key    string
+	// Reservation is decision of event, it's nil for EventReset and EventStoreFallback
+	Reservation *Reservation
+	// Err is store error of EventStoreFallback
+	Err  error
+	Time time.Time
+}
+
+// Observer is notified of rate limit events, events are delivered one at a time from a separate goroutine
+type Observer interface {
+	OnEvent(e Event)
+}
+
+// ObserverFunc is function adapter of Observer
+type ObserverFunc func(e Event)
+
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+type NotifierOption func(n *Notifier)
+
+// NotifierWithBuffer set number of events queued for observer, events are dropped once queue is full
+func NotifierWithBuffer(size int) NotifierOption {
+	return func(n *Notifier) {
+		n.bufferSize = size
+	}
+}
+
+// NotifierWithMaxLimitedKeys bound number of limited keys tracked to detect recovery, keys whose limit is
+// already lifted are forgotten without EventLimitRecovered once the bound is exceeded
+func NotifierWithMaxLimitedKeys(n int) NotifierOption {
+	return func(nt *Notifier) {
+		nt.maxLimitedKeys = n
+	}
+}
+
+// NotifierWithClock set clock used to timestamp events
+func NotifierWithClock(c Clock) NotifierOption {
+	return func(n *Notifier) {
+		n.clock = c
+	}
+}
+
+// Notifier turns decisions of limiters into events and delivers them to observer asynchronously,
+// so a slow observer can not slow down checking events. Methods of nil Notifier are no-op
+type Notifier struct {
+	observer       Observer
+	bufferSize     int
+	maxLimitedKeys int
+	clock          Clock
+
+	// limited keeps TimeToAct of keys which have been rejected and not recovered yet
+	limited     sync.Map
+	limitedKeys atomic.Int64
+	pruneLock   sync.Mutex
+	// storeFailing is set from first store error until store succeeds again
+	storeFailing atomic.Bool
+
+	events    chan Event
+	dropped   atomic.Uint64
+	closeLock sync.RWMutex
+	closed    bool
+	done      chan struct{}
+}
+
+func NewNotifier(o Observer, opts ...NotifierOption) *Notifier {
+	n := &Notifier{
+		observer:       o,
+		bufferSize:     defaultEventBuffer,
+		maxLimitedKeys: defaultMaxLimitedKeys,
+		clock:          SystemClock,
+		done:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(n)
+	}
+
+	n.events = make(chan Event, n.bufferSize)
+	go n.run()
+	return n
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for e := range n.events {
+		n.observer.OnEvent(e)
+	}
+}
+
+// Notify queues event e, it's dropped if queue is full
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = n.clock.Now()
+	}
+
+	n.closeLock.RLock()
+	defer n.closeLock.RUnlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.events <- e:
+	default:
+		n.dropped.Add(1)
+	}
+}
+
+// Decision records decision of key k, it fires EventLimitExceeded on first rejection of k
+// and EventLimitRecovered once k is allowed again
+func (n *Notifier) Decision(policy string, k string, r *Reservation, allowed bool) {
+	if n == nil {
+		return
+	}
+
+	if allowed {
+		// Load first to stay lock free for keys which are not limited
+		if _, ok := n.limited.Load(k); !ok {
+			return
+		}
+		if _, ok := n.limited.LoadAndDelete(k); ok {
+			n.limitedKeys.Add(-1)
+			n.Notify(Event{Type: EventLimitRecovered, Policy: policy, Key: k, Reservation: copyReservation(r)})
+		}
+		return
+	}
+
+	var timeToAct time.Time
+	if r != nil {
+		timeToAct = r.TimeToAct
+	}
+	if _, loaded := n.limited.LoadOrStore(k, timeToAct); loaded {
+		return
+	}
+	if n.limitedKeys.Add(1) > int64(n.maxLimitedKeys) {
+		n.prune()
+	}
+	n.Notify(Event{Type: EventLimitExceeded, Policy: policy, Key: k, Reservation: copyReservation(r)})
+}
+
+// prune forgets limited keys whose limit is already lifted
+func (n *Notifier) prune() {
+	if !n.pruneLock.TryLock() {
+		return
+	}
+	defer n.pruneLock.Unlock()
+
+	now := n.clock.Now()
+	n.limited.Range(func(k, v any) bool {
+		if now.After(v.(time.Time)) {
+			if _, ok := n.limited.LoadAndDelete(k); ok {
+				n.limitedKeys.Add(-1)
+			}
+		}
+		return true
+	})
+}
+
+// Reset fires EventReset of key k, k is no longer limited
+func (n *Notifier) Reset(policy string, k string) {
+	if n == nil {
+		return
+	}
+	if _, ok := n.limited.LoadAndDelete(k); ok {
+		n.limitedKeys.Add(-1)
+	}
+	n.Notify(Event{Type: EventReset, Policy: policy, Key: k})
+}
+
+// StoreFailed fires EventStoreFallback if store was healthy before error err of key k
+func (n *Notifier) StoreFailed(policy string, k string, err error) {
+	if n == nil || !n.storeFailing.CompareAndSwap(false, true) {
+		return
+	}
+	n.Notify(Event{Type: EventStoreFallback, Policy: policy, Key: k, Err: err})
+}
+
+// StoreRecovered records that store succeeds, so next store error fires EventStoreFallback again
+func (n *Notifier) StoreRecovered() {
+	if n == nil || !n.storeFailing.Load() {
+		return
+	}
+	n.storeFailing.Store(false)
+}
+
+// Dropped returns number of events dropped because queue was full
+func (n *Notifier) Dropped() uint64 {
+	if n == nil {
+		return 0
+	}
+	return n.dropped.Load()
+}
+
+// Close stops accepting events and waits up to 5 seconds for queued events to be delivered
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+
+	n.closeLock.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.events)
+	}
+	n.closeLock.Unlock()
+
+	select {
+	case <-n.done:
+		return nil
+	case <-time.After(defaultNotifierTimeout):
+		return fmt.Errorf("observer did not finish in %v", defaultNotifierTimeout)
+	}
+}
+
+func copyReservation(r *Reservation) *Reservation {
+	if r == nil {
+		return nil
+	}
+	c := *r
+	return &c
+}
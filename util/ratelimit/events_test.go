@@ -0,0 +1,114 @@
+package ratelimit
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fixedClock struct {
+	systemClock
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
+func collect(events *[]Event) Observer {
+	return ObserverFunc(func(e Event) {
+		*events = append(*events, e)
+	})
+}
+
+func TestNotifier(t *testing.T) {
+	now := time.Unix(1699999980, 0)
+	var events []Event
+	n := NewNotifier(collect(&events), NotifierWithClock(fixedClock{now: now}))
+
+	limited := &Reservation{Req: 3, Bucket: 2, TimeToAct: now.Add(time.Minute)}
+	n.Decision("api", "k1", &Reservation{Req: 1, Bucket: 2}, true)
+	n.Decision("api", "k1", limited, false)
+	n.Decision("api", "k1", limited, false)
+	n.Decision("api", "k1", &Reservation{Req: 1, Bucket: 2}, true)
+	n.Decision("api", "k2", limited, false)
+	n.Reset("api", "k2")
+	n.Decision("api", "k2", &Reservation{Req: 1, Bucket: 2}, true)
+	n.StoreFailed("api", "k3", ErrStoreUnavailable)
+	n.StoreFailed("api", "k3", ErrStoreUnavailable)
+	n.StoreRecovered()
+	n.StoreFailed("api", "k3", ErrStoreUnavailable)
+	require.Nil(t, n.Close())
+
+	types := make([]EventType, 0, len(events))
+	for _, e := range events {
+		types = append(types, e.Type)
+		assert.Equal(t, "api", e.Policy)
+		assert.Equal(t, now, e.Time)
+	}
+	assert.Equal(t, []EventType{EventLimitExceeded, EventLimitRecovered, EventLimitExceeded, EventReset,
+		EventStoreFallback, EventStoreFallback}, types)
+	assert.Equal(t, "k1", events[0].Key)
+	assert.Equal(t, limited.TimeToAct, events[0].Reservation.TimeToAct)
+	assert.NotSame(t, limited, events[0].Reservation)
+	assert.Nil(t, events[3].Reservation)
+	assert.True(t, errors.Is(events[4].Err, ErrStoreUnavailable))
+	assert.Equal(t, uint64(0), n.Dropped())
+}
+
+func TestNotifier_Drop(t *testing.T) {
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	n := NewNotifier(ObserverFunc(func(e Event) {
+		if e.Key == "k0" {
+			wg.Done()
+			<-block
+		}
+	}), NotifierWithBuffer(1))
+
+	// first event is held by observer, second is queued and third is dropped
+	n.Notify(Event{Type: EventReset, Key: "k0"})
+	wg.Wait()
+	n.Notify(Event{Type: EventReset, Key: "k1"})
+	n.Notify(Event{Type: EventReset, Key: "k2"})
+	assert.Equal(t, uint64(1), n.Dropped())
+
+	close(block)
+	require.Nil(t, n.Close())
+	// events after close are ignored
+	n.Notify(Event{Type: EventReset, Key: "k3"})
+}
+
+func TestNotifier_MaxLimitedKeys(t *testing.T) {
+	now := time.Unix(1699999980, 0)
+	var events []Event
+	n := NewNotifier(collect(&events), NotifierWithClock(fixedClock{now: now}), NotifierWithMaxLimitedKeys(1))
+
+	// limit of k1 is already lifted so it's forgotten once k2 is limited
+	n.Decision("api", "k1", &Reservation{TimeToAct: now.Add(-time.Second)}, false)
+	n.Decision("api", "k2", &Reservation{TimeToAct: now.Add(time.Minute)}, false)
+	n.Decision("api", "k1", &Reservation{}, true)
+	n.Decision("api", "k2", &Reservation{}, true)
+	require.Nil(t, n.Close())
+
+	types := make([]EventType, 0, len(events))
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []EventType{EventLimitExceeded, EventLimitExceeded, EventLimitRecovered}, types)
+	assert.Equal(t, "k2", events[2].Key)
+}
+
+func TestNotifier_Nil(t *testing.T) {
+	var n *Notifier
+	n.Decision("api", "k1", nil, false)
+	n.Reset("api", "k1")
+	n.StoreFailed("api", "k1", ErrStoreUnavailable)
+	n.StoreRecovered()
+	assert.Equal(t, uint64(0), n.Dropped())
+	assert.Nil(t, n.Close())
+}
@@ -0,0 +1,66 @@
+package fixedwindow_test
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"ratelimit/driver/redis"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"ratelimit/util/ratelimit/ratelimittest"
+	"testing"
+	"time"
+)
+
+func TestInMemStore_Conformance(t *testing.T) {
+	ratelimittest.TestFixedWindowStore(t, func(t *testing.T, ttl time.Duration,
+		clock *clocktest.FakeClock) ratelimittest.Harness[fixedwindow.Store] {
+		s := fixedwindow.NewMemStore(ttl, fixedwindow.MemWithClock(clock))
+		t.Cleanup(func() { _ = s.Close() })
+		return ratelimittest.Harness[fixedwindow.Store]{Store: s}
+	})
+}
+
+func TestInMemStore_Sharded_Conformance(t *testing.T) {
+	ratelimittest.TestFixedWindowStore(t, func(t *testing.T, ttl time.Duration,
+		clock *clocktest.FakeClock) ratelimittest.Harness[fixedwindow.Store] {
+		s := fixedwindow.NewMemStore(ttl, fixedwindow.MemWithClock(clock), fixedwindow.MemWithShards(4),
+			fixedwindow.MemWithMaxKeys(100, ratelimit.EvictionCLOCK))
+		t.Cleanup(func() { _ = s.Close() })
+		return ratelimittest.Harness[fixedwindow.Store]{Store: s}
+	})
+}
+
+func TestInMemRollingStore_Conformance(t *testing.T) {
+	ratelimittest.TestFixedWindowStore(t, func(t *testing.T, ttl time.Duration,
+		clock *clocktest.FakeClock) ratelimittest.Harness[fixedwindow.Store] {
+		s := fixedwindow.NewMemRollingStore(ttl, 6, fixedwindow.MemWithClock(clock))
+		t.Cleanup(func() { _ = s.Close() })
+		return ratelimittest.Harness[fixedwindow.Store]{Store: s}
+	})
+}
+
+func TestRedisStore_Conformance(t *testing.T) {
+	ratelimittest.TestFixedWindowStore(t, func(t *testing.T, ttl time.Duration,
+		clock *clocktest.FakeClock) ratelimittest.Harness[fixedwindow.Store] {
+		mr := miniredis.RunT(t)
+		// window end is set by EXPIREAT, which is relative to server time
+		mr.SetTime(clock.Now())
+		client, err := redis.NewConnection(&redis.SingleConnection{
+			Address: mr.Addr(),
+		})
+		require.Nil(t, err)
+		t.Cleanup(func() { _ = client.Close() })
+
+		s := fixedwindow.NewRedisStore(client, ttl, nil, fixedwindow.RedisWithClock(clock))
+		t.Cleanup(func() { _ = s.Close() })
+		return ratelimittest.Harness[fixedwindow.Store]{
+			Store: s,
+			Advance: func(d time.Duration) {
+				mr.FastForward(d)
+				mr.SetTime(clock.Now())
+			},
+			Fail: mr.Close,
+		}
+	})
+}
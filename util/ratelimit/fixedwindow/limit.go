@@ -2,16 +2,42 @@ package fixedwindow
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"ratelimit/util/ratelimit"
+	"sync/atomic"
 	"time"
 )
 
-type Limiter struct {
+// limits is quota of events allowed per window
+type limits struct {
 	// support unit of second only
 	windowTime time.Duration
 	quota      int64
+}
+
+type Limiter struct {
+	// limits is replaced by Update, Allow loads it once so an event is checked against a single config
+	limits atomic.Pointer[limits]
 
 	store Store
+	// ownStore is true if store is created by limiter, which is closed with limiter
+	ownStore bool
+
+	errPolicy     ratelimit.ErrorPolicy
+	errHandler    ratelimit.ErrorHandler
+	fallbackScale float64
+	fallback      *Limiter
+
+	clock  ratelimit.Clock
+	logger *slog.Logger
+
+	name     string
+	observer ratelimit.Observer
+	notifier *ratelimit.Notifier
 }
 
 type LimiterOption func(l *Limiter)
@@ -22,44 +48,225 @@ func WithStore(s Store) LimiterOption {
 	}
 }
 
+// WithClock set clock used to timestamp events, it's passed to store created by limiter as well
+func WithClock(c ratelimit.Clock) LimiterOption {
+	return func(l *Limiter) {
+		l.clock = c
+	}
+}
+
+// WithLogger set logger of limiter, it's passed to store created by limiter as well
+// Denied events and store errors are logged at debug level, by default slog.Default() is used
+func WithLogger(logger *slog.Logger) LimiterOption {
+	return func(l *Limiter) {
+		l.logger = logger
+	}
+}
+
+// WithName set name of limiter, it's reported as policy of events
+func WithName(name string) LimiterOption {
+	return func(l *Limiter) {
+		l.name = name
+	}
+}
+
+// WithObserver set observer notified when a key gets limited, recovers or is reset and when store starts failing,
+// events are delivered asynchronously until limiter is closed
+func WithObserver(o ratelimit.Observer) LimiterOption {
+	return func(l *Limiter) {
+		l.observer = o
+	}
+}
+
+// WithErrorPolicy set how limiter handles event when store returns error
+// By default, store error is returned to caller
+func WithErrorPolicy(p ratelimit.ErrorPolicy) LimiterOption {
+	return func(l *Limiter) {
+		l.errPolicy = p
+	}
+}
+
+// WithErrorHandler set callback which is notified on every store error
+func WithErrorHandler(h ratelimit.ErrorHandler) LimiterOption {
+	return func(l *Limiter) {
+		l.errHandler = h
+	}
+}
+
+// WithFallbackScale set ratio of quota used by local limiter of ErrorPolicyFallback,
+// e.g. 0.25 for a service running 4 instances sharing the same store
+func WithFallbackScale(scale float64) LimiterOption {
+	return func(l *Limiter) {
+		l.fallbackScale = scale
+	}
+}
+
 func New(windowTime time.Duration, quota int64, opts ...LimiterOption) *Limiter {
 	l := &Limiter{
-		windowTime: windowTime,
-		quota:      quota,
+		fallbackScale: 1,
+		clock:         ratelimit.SystemClock,
+		logger:        slog.Default(),
 	}
+	l.limits.Store(&limits{windowTime: windowTime, quota: quota})
 	for _, opt := range opts {
 		opt(l)
 	}
 
 	if l.store == nil {
-		l.store = NewMemStore(windowTime)
+		l.store = NewMemStore(windowTime, MemWithClock(l.clock),
+			MemWithLogger(l.logger))
+		l.ownStore = true
+	}
+	if l.observer != nil {
+		l.notifier = ratelimit.NewNotifier(l.observer, ratelimit.NotifierWithClock(l.clock))
+	}
+	if l.errPolicy == ratelimit.ErrorPolicyFallback {
+		l.fallback = newFallback(windowTime, quota, l.fallbackScale, WithClock(l.clock), WithLogger(l.logger))
 	}
 
 	return l
 }
 
+// newFallback create local limiter with quota scaled down by scale
+func newFallback(windowTime time.Duration, quota int64, scale float64,
+	opts ...LimiterOption) *Limiter {
+	return New(windowTime, scaleQuota(quota, scale), opts...)
+}
+
+func scaleQuota(quota int64, scale float64) int64 {
+	if scale <= 0 || scale > 1 {
+		scale = 1
+	}
+	fbQuota := int64(math.Floor(float64(quota) * scale))
+	if fbQuota < 1 {
+		fbQuota = 1
+	}
+	return fbQuota
+}
+
+// Update changes window and quota of limiter while it's in use. Counters of keys are kept, so events counted
+// in current window are checked against the new quota. Changing window requires store to implement
+// WindowUpdater, counters of the current window then expire at end of the new window at the latest.
+// Store set by WithStore may be shared by other limiters, so its window is left to its owner, who updates it
+// before the limiter, and Update fails if the window of store differs
+func (l *Limiter) Update(windowTime time.Duration, quota int64) error {
+	if windowTime <= 0 || quota <= 0 {
+		return errors.New("window and quota must be positive")
+	}
+
+	if windowTime != l.limits.Load().windowTime {
+		u, ok := l.store.(WindowUpdater)
+		switch {
+		case !ok:
+			return errors.New("store does not support updating window")
+		case l.ownStore:
+			u.UpdateWindow(windowTime)
+		case u.Window() != windowTime:
+			return fmt.Errorf("window of store is %s, store set by WithStore must be updated by its owner",
+				u.Window())
+		}
+	}
+	l.limits.Store(&limits{windowTime: windowTime, quota: quota})
+	if l.fallback != nil {
+		return l.fallback.Update(windowTime, scaleQuota(quota, l.fallbackScale))
+	}
+	return nil
+}
+
 func (l *Limiter) Allow(ctx context.Context, k string, w int64) (r *ratelimit.Reservation, allowed bool, err error) {
-	now := time.Now()
+	now := l.clock.Now()
+	c := l.limits.Load()
 	newVal, err := l.store.Incr(ctx, k, w, now)
 	if err != nil {
-		return nil, false, err
+		return l.handleStoreErr(ctx, k, w, now, err)
 	}
+	l.notifier.StoreRecovered()
 
-	if newVal > l.quota {
-		return &ratelimit.Reservation{
-			Req:       float64(l.quota),
-			Bucket:    l.quota,
-			TimeToAct: nextWindowTime(now, l.windowTime),
+	if newVal > c.quota {
+		timeToAct := nextWindowTime(now, c.windowTime)
+		l.logger.DebugContext(ctx, "event denied", ratelimit.LogKey(k), slog.Duration("delay", timeToAct.Sub(now)))
+		r = &ratelimit.Reservation{
+			Req:       float64(c.quota),
+			Bucket:    c.quota,
+			TimeToAct: timeToAct,
 			Last:      now,
-		}, false, nil
+		}
+		l.notifier.Decision(l.name, k, r, false)
+		return r, false, nil
 	}
 
-	return &ratelimit.Reservation{
+	r = &ratelimit.Reservation{
 		Req:       float64(newVal),
-		Bucket:    l.quota,
+		Bucket:    c.quota,
 		TimeToAct: now,
 		Last:      now,
-	}, true, nil
+	}
+	l.notifier.Decision(l.name, k, r, true)
+	return r, true, nil
+}
+
+// Peek checks event k with weight of w against counter of current window of k without counting it, store
+// must implement ratelimit.Inspector. Store errors are returned regardless of error policy
+func (l *Limiter) Peek(ctx context.Context, k string, w int64) (*ratelimit.Reservation, bool, error) {
+	inspector, ok := l.store.(ratelimit.Inspector)
+	if !ok {
+		return nil, false, ratelimit.ErrPeekNotSupported
+	}
+	now := l.clock.Now()
+	c := l.limits.Load()
+	state, ok, err := inspector.State(ctx, k)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r := &ratelimit.Reservation{Bucket: c.quota, TimeToAct: now, Last: now}
+	if !ok {
+		return r, w <= c.quota, nil
+	}
+	r.Req = state.Value
+	if int64(state.Value)+w <= c.quota {
+		return r, true, nil
+	}
+	r.TimeToAct = nextWindowTime(now, c.windowTime)
+	if state.Expire != nil {
+		r.TimeToAct = *state.Expire
+	}
+	return r, false, nil
+}
+
+// handleStoreErr resolve result of event k when store fails by configured error policy
+func (l *Limiter) handleStoreErr(ctx context.Context, k string, w int64, now time.Time,
+	err error) (*ratelimit.Reservation, bool, error) {
+	if l.errHandler != nil {
+		l.errHandler(ctx, k, err)
+	}
+	l.notifier.StoreFailed(l.name, k, err)
+	l.logger.DebugContext(ctx, "store failed, event is resolved by error policy", ratelimit.LogKey(k),
+		slog.String("error_policy", l.errPolicy.String()), slog.Any("error", err))
+
+	c := l.limits.Load()
+	switch l.errPolicy {
+	case ratelimit.ErrorPolicyFailOpen:
+		return &ratelimit.Reservation{
+			Req:       0,
+			Bucket:    c.quota,
+			TimeToAct: now,
+			Last:      now,
+		}, true, nil
+	case ratelimit.ErrorPolicyFailClosed:
+		return &ratelimit.Reservation{
+			Req:       float64(c.quota),
+			Bucket:    c.quota,
+			TimeToAct: nextWindowTime(now, c.windowTime),
+			Last:      now,
+		}, false, nil
+	case ratelimit.ErrorPolicyFallback:
+		if l.fallback != nil {
+			return l.fallback.Allow(ctx, k, w)
+		}
+	}
+
+	return nil, false, err
 }
 
 func nextWindowTime(now time.Time, windowTime time.Duration) time.Time {
@@ -71,6 +278,22 @@ func nextWindowTime(now time.Time, windowTime time.Duration) time.Time {
 	return tr
 }
 
+// Close releases store created by limiter and local fallback limiter, store set by WithStore is left open
+func (l *Limiter) Close() error {
+	var err error
+	if closer, ok := l.store.(io.Closer); ok && l.ownStore {
+		err = closer.Close()
+	}
+	if l.fallback != nil {
+		err = errors.Join(err, l.fallback.Close())
+	}
+	return errors.Join(err, l.notifier.Close())
+}
+
 func (l *Limiter) Reset(ctx context.Context, k string, value int64) error {
-	return l.store.Reset(ctx, k, value)
+	if err := l.store.Reset(ctx, k, value); err != nil {
+		return err
+	}
+	l.notifier.Reset(l.name, k)
+	return nil
 }
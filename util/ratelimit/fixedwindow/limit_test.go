@@ -0,0 +1,157 @@
+package fixedwindow
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	// start of a minute window
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	l := New(time.Minute, 2, WithClock(clock))
+	defer l.Close()
+
+	clock.Advance(20 * time.Second)
+	for i := 0; i < 2; i++ {
+		_, allowed, err := l.Allow(context.Background(), "k1", 1)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	r, allowed, err := l.Allow(context.Background(), "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 40*time.Second, r.DelayFrom(clock.Now()))
+
+	clock.Advance(40 * time.Second)
+	r, allowed, _ = l.Allow(context.Background(), "k1", 1)
+	assert.True(t, allowed)
+	assert.Equal(t, float64(1), r.Req)
+}
+
+func TestLimiter_Peek(t *testing.T) {
+	ctx := context.Background()
+	// start of a minute window
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	l := New(time.Minute, 2, WithClock(clock))
+	defer l.Close()
+
+	r, allowed, err := l.Peek(ctx, "k1", 2)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, float64(0), r.Req)
+
+	_, _, _ = l.Allow(ctx, "k1", 1)
+	clock.Advance(20 * time.Second)
+	r, allowed, err = l.Peek(ctx, "k1", 2)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, float64(1), r.Req)
+	assert.Equal(t, 40*time.Second, r.DelayFrom(clock.Now()))
+
+	// peek does not count event
+	_, allowed, _ = l.Allow(ctx, "k1", 1)
+	assert.True(t, allowed)
+}
+
+func TestLimiter_Update(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	l := New(time.Minute, 2, WithClock(clock))
+	defer l.Close()
+
+	clock.Advance(20 * time.Second)
+	for i := 0; i < 3; i++ {
+		_, _, err := l.Allow(context.Background(), "k1", 1)
+		require.Nil(t, err)
+	}
+
+	// events counted before update are checked against the new quota
+	require.Nil(t, l.Update(time.Minute, 4))
+	r, allowed, _ := l.Allow(context.Background(), "k1", 1)
+	assert.True(t, allowed)
+	assert.Equal(t, float64(4), r.Req)
+	assert.Equal(t, int64(4), r.Bucket)
+
+	// counter is kept until end of the new shorter window
+	require.Nil(t, l.Update(10*time.Second, 4))
+	clock.Advance(5 * time.Second)
+	r, allowed, _ = l.Allow(context.Background(), "k1", 1)
+	assert.False(t, allowed)
+	assert.Equal(t, 5*time.Second, r.DelayFrom(clock.Now()))
+
+	clock.Advance(5 * time.Second)
+	r, allowed, _ = l.Allow(context.Background(), "k1", 1)
+	assert.True(t, allowed)
+	assert.Equal(t, float64(1), r.Req)
+
+	assert.NotNil(t, l.Update(0, 4))
+}
+
+func TestLimiter_Update_SharedStore(t *testing.T) {
+	store := NewMemStore(time.Minute)
+	defer store.Close()
+	l1 := New(time.Minute, 2, WithStore(store))
+	l2 := New(time.Minute, 2, WithStore(store))
+
+	// window of shared store is left to its owner
+	assert.NotNil(t, l1.Update(10*time.Second, 2))
+	assert.Equal(t, time.Minute, store.Window())
+
+	store.UpdateWindow(10 * time.Second)
+	require.Nil(t, l1.Update(10*time.Second, 2))
+	require.Nil(t, l2.Update(10*time.Second, 4))
+	assert.Equal(t, 10*time.Second, store.Window())
+}
+
+func TestLimiter_Update_Concurrent(t *testing.T) {
+	l := New(time.Minute, 100)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r, _, err := l.Allow(context.Background(), "k1", 1)
+				assert.Nil(t, err)
+				assert.Contains(t, []int64{100, 200}, r.Bucket)
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		require.Nil(t, l.Update(time.Minute, int64(100+100*(i%2))))
+	}
+	wg.Wait()
+}
+
+func TestLimiter_Observer(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	var types []ratelimit.EventType
+	l := New(time.Minute, 1, WithClock(clock), WithName("api"), WithObserver(ratelimit.ObserverFunc(
+		func(e ratelimit.Event) {
+			assert.Equal(t, "api", e.Policy)
+			assert.Equal(t, "k1", e.Key)
+			types = append(types, e.Type)
+		})))
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_, _, err := l.Allow(ctx, "k1", 1)
+		require.Nil(t, err)
+	}
+	clock.Advance(time.Minute)
+	_, allowed, err := l.Allow(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	require.Nil(t, l.Reset(ctx, "k1", 0))
+	require.Nil(t, l.Close())
+
+	assert.Equal(t, []ratelimit.EventType{ratelimit.EventLimitExceeded, ratelimit.EventLimitRecovered,
+		ratelimit.EventReset}, types)
+}
@@ -0,0 +1,66 @@
+package fixedwindow
+
+import (
+	"context"
+	"log/slog"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/internal/memstore"
+	"time"
+)
+
+type MemStoreOption func(o *memstore.Options)
+
+// MemWithSweepInterval set how often expired keys are swept, by default it's equal to ttl
+func MemWithSweepInterval(d time.Duration) MemStoreOption {
+	return func(o *memstore.Options) {
+		o.SweepInterval = d
+	}
+}
+
+// MemWithContext stop sweeper when ctx is done, Close stops it as well
+func MemWithContext(ctx context.Context) MemStoreOption {
+	return func(o *memstore.Options) {
+		o.Ctx = ctx
+	}
+}
+
+// MemWithMaxKeys bound number of keys kept by store, key is evicted by policy p once store is full
+// By default, number of keys is only bounded by sweeper
+func MemWithMaxKeys(n int, p ratelimit.EvictionPolicy) MemStoreOption {
+	return func(o *memstore.Options) {
+		o.MaxKeys = n
+		o.Eviction = p
+	}
+}
+
+// MemWithEvictedKeyPolicy set how a key coming back after being evicted is treated
+// By default, evicted key starts over as a fresh one
+func MemWithEvictedKeyPolicy(p ratelimit.EvictedKeyPolicy) MemStoreOption {
+	return func(o *memstore.Options) {
+		o.EvictedKeys = p
+	}
+}
+
+// MemWithShards split keys of store into n lock stripes instead of a single sync.Map,
+// it reduces contention when many cores update a few hot keys and does not allocate on updating existing key.
+// Keys bounded by MemWithMaxKeys are split evenly between stripes, every stripe evicts its own keys
+func MemWithShards(n int) MemStoreOption {
+	return func(o *memstore.Options) {
+		o.Shards = n
+	}
+}
+
+// MemWithClock set clock used to sweep and reset keys
+func MemWithClock(c ratelimit.Clock) MemStoreOption {
+	return func(o *memstore.Options) {
+		o.Clock = c
+	}
+}
+
+// MemWithLogger set logger of store, swept keys are logged at debug level
+// By default, slog.Default() is used
+func MemWithLogger(l *slog.Logger) MemStoreOption {
+	return func(o *memstore.Options) {
+		o.Logger = l
+	}
+}
@@ -2,83 +2,233 @@ package fixedwindow
 
 import (
 	"context"
-	"errors"
-	"fmt"
+	"log/slog"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/internal/evict"
+	"ratelimit/util/ratelimit/internal/keytable"
+	"ratelimit/util/ratelimit/internal/memstore"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type InMemStore struct {
-	ttl  time.Duration
-	mMap sync.Map
+	// ttl is length of window, it's changed by UpdateWindow
+	ttl  atomic.Int64
+	mMap *keytable.Table[memRateData]
+
+	// ghosts keeps counter of evicted keys if EvictedKeyRestore policy is used
+	ghosts   *evict.Ghosts[windowCount]
+	restores atomic.Uint64
+
+	clock   ratelimit.Clock
+	logger  *slog.Logger
+	sweeper *memstore.Sweeper
 }
 
+// memRateData is counter of a key, val is updated atomically while window is not over,
+// lock is only taken to start a new window
 type memRateData struct {
+	val    atomic.Int64
+	expire atomic.Int64
+	lock   sync.Mutex
+}
+
+func newMemRateData(val int64, expire time.Time) *memRateData {
+	rData := &memRateData{}
+	rData.val.Store(val)
+	rData.expire.Store(expire.UnixNano())
+	return rData
+}
+
+// windowCount is compact counter of evicted key
+type windowCount struct {
 	val    int64
 	expire time.Time
-	lock   sync.Mutex
 }
 
-func NewMemStore(ttl time.Duration) *InMemStore {
+func NewMemStore(ttl time.Duration, opts ...MemStoreOption) *InMemStore {
+	o := memstore.NewOptions(ttl, opts...)
 	m := &InMemStore{
-		ttl: ttl,
+		clock:  o.Clock,
+		logger: o.Logger,
 	}
-	go func() {
-		for {
-			time.Sleep(ttl)
-			now := time.Now()
-			m.mMap.Range(func(key, value interface{}) bool {
-				rData, ok := value.(*memRateData)
-				if !ok {
-					log.Errorw("malformed rate data", "context", fmt.Sprintf("key: %v", key))
-					m.mMap.Delete(key)
-					return true
-				}
-				rData.lock.Lock()
-				expire := rData.expire
-				if now.After(expire) {
-					log.Infof("delete %v", key)
-					m.mMap.Delete(key)
-				}
-				rData.lock.Unlock()
-				return true
-			})
-		}
-	}()
+	m.ttl.Store(int64(ttl))
+	tableOpts := keytable.Options[memRateData]{
+		MaxKeys:  o.MaxKeys,
+		Eviction: o.Eviction,
+		Shards:   o.Shards,
+		New:      m.newRateData,
+	}
+	if o.MaxKeys > 0 && o.EvictedKeys == ratelimit.EvictedKeyRestore {
+		m.ghosts = evict.NewGhosts[windowCount](o.MaxKeys)
+		tableOpts.OnEvict = m.rememberEvicted
+	}
+	m.mMap = keytable.New(tableOpts)
+	m.sweeper = memstore.NewSweeper(o, m.sweep)
 
 	return m
 }
 
-// Incr use set-then-get approach to reduce lock that help improve performance
-func (m *InMemStore) Incr(ctx context.Context, key string, value int64, now time.Time) (int64, error) {
-	data, _ := m.mMap.LoadOrStore(key, &memRateData{})
-	rData, ok := data.(*memRateData)
-	if !ok {
-		return 0, errors.New("malformed data")
+// sweep removes keys of passed windows
+func (m *InMemStore) sweep() {
+	now := m.clock.Now()
+	m.mMap.Range(func(key string, rData *memRateData) bool {
+		rData.lock.Lock()
+		if now.UnixNano() >= rData.expire.Load() {
+			m.mMap.Delete(key)
+			m.logger.Debug("swept expired key", ratelimit.LogKey(key))
+		}
+		rData.lock.Unlock()
+		return true
+	})
+}
+
+func (m *InMemStore) rememberEvicted(key string, rData *memRateData) {
+	m.ghosts.Put(key, windowCount{
+		val:    rData.val.Load(),
+		expire: time.Unix(0, rData.expire.Load()),
+	})
+}
+
+// newRateData create counter of new key, it's restored if key has been evicted recently
+func (m *InMemStore) newRateData(key string) *memRateData {
+	if m.ghosts != nil {
+		if c, ok := m.ghosts.Take(key); ok {
+			m.restores.Add(1)
+			return newMemRateData(c.val, c.expire)
+		}
+	}
+	return &memRateData{}
+}
+
+// Stats returns number of keys and evictions of store
+func (m *InMemStore) Stats() ratelimit.StoreStats {
+	return ratelimit.StoreStats{
+		Keys:      m.mMap.Len(),
+		Evictions: m.mMap.Evictions(),
+		Restores:  m.restores.Load(),
 	}
+}
 
-	dataExpire := now.Truncate(m.ttl).Add(m.ttl)
+// Keys lists keys of unfinished windows in sorted order, cursor is last key of previous page
+func (m *InMemStore) Keys(ctx context.Context, cursor string, limit int) (ratelimit.KeyPage, error) {
+	now := m.clock.Now()
+	keys, more := m.mMap.Page(cursor, limit)
+	page := ratelimit.KeyPage{Keys: make([]ratelimit.KeyState, 0, len(keys))}
+	for _, key := range keys {
+		if state, ok := m.state(key, now); ok {
+			page.Keys = append(page.Keys, state)
+		}
+	}
+	if more {
+		page.Next = keys[len(keys)-1]
+	}
+	return page, nil
+}
 
+// State returns counter of key if its window is not over
+func (m *InMemStore) State(ctx context.Context, key string) (ratelimit.KeyState, bool, error) {
+	state, ok := m.state(key, m.clock.Now())
+	return state, ok, nil
+}
+
+func (m *InMemStore) state(key string, now time.Time) (ratelimit.KeyState, bool) {
+	rData, ok := m.mMap.Load(key)
+	if !ok {
+		return ratelimit.KeyState{}, false
+	}
 	rData.lock.Lock()
-	if now.After(rData.expire) {
-		rData.val = 0
+	defer rData.lock.Unlock()
+	expire := rData.expire.Load()
+	if now.UnixNano() >= expire {
+		return ratelimit.KeyState{}, false
+	}
+	end := time.Unix(0, expire)
+	return ratelimit.KeyState{Key: key, Value: float64(rData.val.Load()), Expire: &end}, true
+}
+
+// Incr use set-then-get approach to reduce lock that help improve performance,
+// counter is only locked when its window is over, an increment racing with window change may be
+// counted in the new window
+func (m *InMemStore) Incr(ctx context.Context, key string, value int64, now time.Time) (int64, error) {
+	rData := m.mMap.LoadOrCreate(key)
+
+	var val int64
+	// window ends right at expire time
+	if nowNano := now.UnixNano(); nowNano < rData.expire.Load() {
+		val = rData.val.Add(value)
+	} else {
+		rData.lock.Lock()
+		if nowNano >= rData.expire.Load() {
+			rData.val.Store(0)
+			window := m.Window()
+			rData.expire.Store(now.Truncate(window).Add(window).UnixNano())
+		}
+		val = rData.val.Add(value)
+		rData.lock.Unlock()
 	}
-	rData.val++
-	rData.expire = dataExpire
-	rData.lock.Unlock()
 
 	// set again to avoid race condition with sweep routine
-	m.mMap.LoadOrStore(key, rData)
+	m.mMap.Keep(key, rData)
 
-	return rData.val, nil
+	return val, nil
 }
 
 // Reset set counter of key to value
 func (m *InMemStore) Reset(ctx context.Context, key string, value int64) error {
-	now := time.Now()
-	m.mMap.Store(key, &memRateData{
-		val:    value,
-		expire: now.Truncate(m.ttl).Add(m.ttl),
-	})
+	if m.ghosts != nil {
+		m.ghosts.Take(key)
+	}
+	now := m.clock.Now()
+	window := m.Window()
+	m.mMap.Store(key, newMemRateData(value, now.Truncate(window).Add(window)))
 	return nil
 }
+
+// discount subtracts value merged into redis from counter of key in window ending at expire, so counter of
+// a fallback store only holds usage which is not merged yet. Counter of another window is left alone
+func (m *InMemStore) discount(key string, value int64, expire time.Time) {
+	rData, ok := m.mMap.Load(key)
+	if !ok {
+		return
+	}
+	// lock keeps window from changing while increments of the current window are added concurrently
+	rData.lock.Lock()
+	defer rData.lock.Unlock()
+	if rData.expire.Load() != expire.UnixNano() {
+		return
+	}
+	for {
+		val := rData.val.Load()
+		if rData.val.CompareAndSwap(val, max(0, val-value)) {
+			return
+		}
+	}
+}
+
+// Close stops sweeper and waits for it to exit, store keeps working without expiring keys
+func (m *InMemStore) Close() error {
+	return m.sweeper.Close()
+}
+
+// Window returns length of window
+func (m *InMemStore) Window() time.Duration {
+	return time.Duration(m.ttl.Load())
+}
+
+// UpdateWindow changes length of window, counters are kept until end of their current window
+// which is cut short to end of the new one if needed
+func (m *InMemStore) UpdateWindow(ttl time.Duration) {
+	m.ttl.Store(int64(ttl))
+	now := m.clock.Now()
+	end := now.Truncate(ttl).Add(ttl).UnixNano()
+	m.mMap.Range(func(key string, rData *memRateData) bool {
+		rData.lock.Lock()
+		if rData.expire.Load() > end {
+			rData.expire.Store(end)
+		}
+		rData.lock.Unlock()
+		return true
+	})
+}
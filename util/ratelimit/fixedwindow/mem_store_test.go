@@ -0,0 +1,183 @@
+package fixedwindow
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
+	"log/slog"
+	"math/rand"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInMemStore_Close(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mstore := NewMemStore(time.Hour, MemWithContext(ctx))
+	cancel()
+	<-mstore.sweeper.Done()
+	require.Nil(t, mstore.Close())
+
+	mstore = NewMemStore(20*time.Millisecond, MemWithSweepInterval(5*time.Millisecond))
+	_, err := mstore.Incr(context.Background(), "k1", 1, time.Now())
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := mstore.mMap.Load("k1")
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	require.Nil(t, mstore.Close())
+	// close is idempotent
+	require.Nil(t, mstore.Close())
+
+	rstore := NewMemRollingStore(20*time.Millisecond, 2, MemWithSweepInterval(5*time.Millisecond))
+	_, err = rstore.Incr(context.Background(), "k1", 1, time.Now())
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := rstore.mMap.Load("k1")
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	require.Nil(t, rstore.Close())
+
+	l := New(time.Second, 1, WithErrorPolicy(ratelimit.ErrorPolicyFallback))
+	require.Nil(t, l.Close())
+}
+
+func TestInMemStore_Sweep_Logging(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	mstore := NewMemStore(time.Minute, MemWithClock(clock), MemWithLogger(logger))
+
+	_, err := mstore.Incr(context.Background(), "203.0.113.7", 1, clock.Now())
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		clock.Advance(time.Minute)
+		return mstore.Stats().Keys == 0
+	}, time.Second, 5*time.Millisecond)
+	// sweeper is stopped so its logs are flushed
+	require.Nil(t, mstore.Close())
+
+	assert.Contains(t, buf.String(), "level=DEBUG msg=\"swept expired key\" key_hash="+ratelimit.HashKey("203.0.113.7"))
+	assert.NotContains(t, buf.String(), "203.0.113.7")
+}
+
+func TestInMemStore_MaxKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		eviction    ratelimit.EvictionPolicy
+		evictedKeys ratelimit.EvictedKeyPolicy
+		wantK1      int64
+	}{
+		{name: "lru fresh", eviction: ratelimit.EvictionLRU, evictedKeys: ratelimit.EvictedKeyFresh, wantK1: 1},
+		{name: "clock fresh", eviction: ratelimit.EvictionCLOCK, evictedKeys: ratelimit.EvictedKeyFresh, wantK1: 1},
+		{name: "lru restore", eviction: ratelimit.EvictionLRU, evictedKeys: ratelimit.EvictedKeyRestore, wantK1: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mstore := NewMemStore(time.Minute, MemWithMaxKeys(2, tt.eviction),
+				MemWithEvictedKeyPolicy(tt.evictedKeys))
+			defer mstore.Close()
+
+			now := time.Now()
+			for _, k := range []string{"k1", "k2", "k2", "k3"} {
+				_, err := mstore.Incr(context.Background(), k, 1, now)
+				require.Nil(t, err)
+			}
+			stats := mstore.Stats()
+			assert.Equal(t, int64(2), stats.Keys)
+			assert.Equal(t, uint64(1), stats.Evictions)
+
+			newVal, err := mstore.Incr(context.Background(), "k1", 1, now)
+			require.Nil(t, err)
+			assert.Equal(t, tt.wantK1, newVal)
+			assert.Equal(t, int64(2), mstore.Stats().Keys)
+		})
+	}
+}
+
+func TestInMemStore_Incr_Sharded(t *testing.T) {
+	mstore := NewMemStore(time.Minute, MemWithShards(16))
+	defer mstore.Close()
+
+	now := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = mstore.Incr(context.Background(), "k1", 2, now)
+		}()
+	}
+	wg.Wait()
+	newVal, err := mstore.Incr(context.Background(), "k1", 1, now)
+	require.Nil(t, err)
+	assert.Equal(t, int64(101), newVal)
+
+	// counter starts over in next window
+	newVal, err = mstore.Incr(context.Background(), "k1", 1, now.Add(time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), newVal)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = mstore.Incr(context.Background(), "k1", 1, now.Add(time.Minute))
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func BenchmarkInMemStore_Incr(b *testing.B) {
+	b.Run("sync map", func(b *testing.B) {
+		benchmarkInMemStoreIncr(b, NewMemStore(time.Minute))
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkInMemStoreIncr(b, NewMemStore(time.Minute, MemWithShards(64)))
+	})
+}
+
+func benchmarkInMemStoreIncr(b *testing.B, mstore *InMemStore) {
+	defer mstore.Close()
+
+	keyList := [...]string{"k1", "k2", "k3", "k4", "k5", "k6"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mstore.Incr(context.Background(), keyList[rand.Int()%len(keyList)], 1, time.Now())
+		}
+	})
+}
+
+func TestInMemStore_Discount(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	mstore := NewMemStore(time.Minute, MemWithClock(clock))
+	defer mstore.Close()
+	end := clock.Now().Truncate(time.Minute).Add(time.Minute)
+
+	_, err := mstore.Incr(ctx, "k1", 5, clock.Now())
+	require.Nil(t, err)
+	mstore.discount("k1", 3, end)
+	newVal, err := mstore.Incr(ctx, "k1", 1, clock.Now())
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), newVal)
+
+	// usage of another window is not discounted
+	mstore.discount("k1", 1, end.Add(-time.Minute))
+	mstore.discount("k2", 1, end)
+	state, ok, err := mstore.State(ctx, "k1")
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, float64(3), state.Value)
+
+	// counter does not go below zero
+	mstore.discount("k1", 10, end)
+	state, _, _ = mstore.State(ctx, "k1")
+	assert.Equal(t, float64(0), state.Value)
+}
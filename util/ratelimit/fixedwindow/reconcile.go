@@ -0,0 +1,64 @@
+package fixedwindow
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fallbackUsage is count of a key on fallback store in a window, which has not been merged to redis yet
+type fallbackUsage struct {
+	Count  int64
+	Expire time.Time
+}
+
+// fallbackLedger records usage counted on fallback store while redis is unavailable
+type fallbackLedger struct {
+	lock sync.Mutex
+	keys map[string]fallbackUsage
+	// size is number of keys, used to check ledger without locking
+	size atomic.Int64
+}
+
+func newFallbackLedger() *fallbackLedger {
+	return &fallbackLedger{
+		keys: make(map[string]fallbackUsage),
+	}
+}
+
+// add counts value to key in window ending at expire, usage of older windows is dropped
+func (l *fallbackLedger) add(key string, value int64, expire time.Time) {
+	l.lock.Lock()
+	u, ok := l.keys[key]
+	if !ok {
+		l.size.Add(1)
+	}
+	switch {
+	case expire.After(u.Expire):
+		u = fallbackUsage{Count: value, Expire: expire}
+	case expire.Equal(u.Expire):
+		u.Count += value
+	}
+	l.keys[key] = u
+	l.lock.Unlock()
+}
+
+// take removes all recorded usage from ledger
+func (l *fallbackLedger) take() map[string]fallbackUsage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.keys) == 0 {
+		return nil
+	}
+	keys := l.keys
+	l.keys = make(map[string]fallbackUsage)
+	l.size.Store(0)
+	return keys
+}
+
+// putBack merges usage taken from ledger back
+func (l *fallbackLedger) putBack(keys map[string]fallbackUsage) {
+	for key, u := range keys {
+		l.add(key, u.Count, u.Expire)
+	}
+}
@@ -0,0 +1,31 @@
+package fixedwindow
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFallbackLedger(t *testing.T) {
+	window := time.Unix(1000, 0)
+	l := newFallbackLedger()
+	l.add("k1", 2, window)
+	l.add("k1", 3, window)
+	// older window is dropped
+	l.add("k2", 1, window.Add(time.Minute))
+	l.add("k2", 4, window)
+	assert.Equal(t, int64(2), l.size.Load())
+
+	pending := l.take()
+	assert.Equal(t, map[string]fallbackUsage{
+		"k1": {Count: 5, Expire: window},
+		"k2": {Count: 1, Expire: window.Add(time.Minute)},
+	}, pending)
+	assert.Equal(t, int64(0), l.size.Load())
+	assert.Nil(t, l.take())
+
+	l.add("k1", 1, window)
+	l.putBack(pending)
+	assert.Equal(t, fallbackUsage{Count: 6, Expire: window}, l.keys["k1"])
+	assert.Equal(t, int64(2), l.size.Load())
+}
@@ -0,0 +1,383 @@
+package fixedwindow
+
+import (
+	"context"
+	"fmt"
+	goredis "github.com/go-redis/redis/v7"
+	"log/slog"
+	"ratelimit/driver/redis"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/circuitbreaker"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RedisStore counts events of a window with INCRBY on a key expiring at the end of the window
+type RedisStore struct {
+	client        *redis.McRedis
+	fallbackInMem *InMemStore
+	// ttl is length of window, it's changed by UpdateWindow
+	ttl        atomic.Int64
+	breaker    *circuitbreaker.Breaker
+	errHandler ratelimit.ErrorHandler
+	clock      ratelimit.Clock
+	logger     *slog.Logger
+	notifier   *ratelimit.Notifier
+
+	// usage counted on fallback store, merged back to redis once it's healthy
+	ledger      *fallbackLedger
+	reconciling atomic.Bool
+
+	fallbacks atomic.Uint64
+	// degraded is set while redis is failing, so outage is logged once
+	degraded atomic.Bool
+
+	closeLock   sync.Mutex
+	closed      bool
+	reconcileWG sync.WaitGroup
+}
+
+type RedisStoreOption func(s *RedisStore)
+
+// RedisWithBreaker set circuit breaker guarding redis calls, while breaker is open
+// events are counted on fallback store without touching redis
+func RedisWithBreaker(b *circuitbreaker.Breaker) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.breaker = b
+	}
+}
+
+// RedisWithErrorHandler set callback which is notified when usage counted on fallback store
+// can not be merged back to redis
+func RedisWithErrorHandler(h ratelimit.ErrorHandler) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.errHandler = h
+	}
+}
+
+// RedisWithClock set clock used to timestamp reset data and expire fallback usage
+func RedisWithClock(c ratelimit.Clock) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.clock = c
+	}
+}
+
+// RedisWithLogger set logger of store, redis outage and recovery are logged once rather than per event
+// By default, slog.Default() is used
+func RedisWithLogger(l *slog.Logger) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.logger = l
+	}
+}
+
+// RedisWithObserver set observer notified with EventStoreFallback when redis starts failing,
+// events are delivered asynchronously until store is closed
+func RedisWithObserver(o ratelimit.Observer) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.notifier = ratelimit.NewNotifier(o)
+	}
+}
+
+// NewRedisStore create store with window of ttl, events are counted on fallbackInMem if redis is unavailable
+func NewRedisStore(client *redis.McRedis, ttl time.Duration, fallbackInMem *InMemStore,
+	opts ...RedisStoreOption) *RedisStore {
+	s := &RedisStore{
+		client:        client,
+		fallbackInMem: fallbackInMem,
+		ledger:        newFallbackLedger(),
+		clock:         ratelimit.SystemClock,
+		logger:        slog.Default(),
+	}
+	s.ttl.Store(int64(ttl))
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (m *RedisStore) redisIncr(k string, v int64, expire time.Time) (int64, error) {
+	var incr *goredis.IntCmd
+	_, err := m.client.TxPipelined(func(pipeliner goredis.Pipeliner) error {
+		incr = pipeliner.IncrBy(k, v)
+		pipeliner.ExpireAt(k, expire)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// Incr count event with key to value unit
+func (m *RedisStore) Incr(ctx context.Context, key string, value int64, now time.Time) (int64, error) {
+	var gen uint64
+	if m.breaker != nil {
+		var err error
+		if gen, err = m.breaker.Allow(); err != nil {
+			return m.fallbackIncr(ctx, key, value, now, err)
+		}
+	}
+
+	start := time.Now()
+	newVal, err := m.redisIncr(key, value, m.windowEnd(now))
+	if m.breaker != nil {
+		m.breaker.Done(gen, err, time.Since(start))
+	}
+	m.reportHealth(key, err)
+	if err != nil {
+		return m.fallbackIncr(ctx, key, value, now, err)
+	}
+	m.triggerReconcile()
+	return newVal, nil
+}
+
+func (m *RedisStore) fallbackIncr(ctx context.Context, key string, value int64, now time.Time,
+	err error) (int64, error) {
+	m.fallbacks.Add(1)
+	// fallback to use memory
+	if m.fallbackInMem != nil {
+		newVal, fbErr := m.fallbackInMem.Incr(ctx, key, value, now)
+		if fbErr == nil {
+			m.ledger.add(key, value, m.windowEnd(now))
+		}
+		return newVal, fbErr
+	}
+
+	// let limiter decide by its error policy
+	return 0, fmt.Errorf("%w: %w", ratelimit.ErrStoreUnavailable, err)
+}
+
+// Reset set counter of key to value
+func (m *RedisStore) Reset(ctx context.Context, key string, value int64) error {
+	var gen uint64
+	if m.breaker != nil {
+		var err error
+		if gen, err = m.breaker.Allow(); err != nil {
+			return fmt.Errorf("%w: %w", ratelimit.ErrStoreUnavailable, err)
+		}
+	}
+
+	start := time.Now()
+	err := m.redisReset(key, value)
+	if m.breaker != nil {
+		m.breaker.Done(gen, err, time.Since(start))
+	}
+	m.reportHealth(key, err)
+	return err
+}
+
+func (m *RedisStore) redisReset(key string, value int64) error {
+	if value == 0 {
+		return m.client.Del(key).Err()
+	}
+
+	now := m.clock.Now()
+	return m.client.Set(key, value, m.windowEnd(now).Sub(now)).Err()
+}
+
+func (m *RedisStore) windowEnd(now time.Time) time.Time {
+	window := m.Window()
+	return now.Truncate(window).Add(window)
+}
+
+// Window returns length of window
+func (m *RedisStore) Window() time.Duration {
+	return time.Duration(m.ttl.Load())
+}
+
+// UpdateWindow changes length of window of store and its fallback store, counter of a key is carried into
+// the new window on its next increment which sets key to expire at end of the new window
+func (m *RedisStore) UpdateWindow(ttl time.Duration) {
+	m.ttl.Store(int64(ttl))
+	if m.fallbackInMem != nil {
+		m.fallbackInMem.UpdateWindow(ttl)
+	}
+}
+
+// Keys lists keys of redis with SCAN, cursor is SCAN cursor returned by previous page and limit is passed as
+// COUNT hint. Keys holding other data are skipped, usage counted on fallback store is not listed
+func (m *RedisStore) Keys(ctx context.Context, cursor string, limit int) (ratelimit.KeyPage, error) {
+	var scanCursor uint64
+	if cursor != "" {
+		c, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return ratelimit.KeyPage{}, fmt.Errorf("invalid cursor %q", cursor)
+		}
+		scanCursor = c
+	}
+
+	keys, next, err := m.client.Scan(scanCursor, "", int64(limit)).Result()
+	if err != nil {
+		return ratelimit.KeyPage{}, err
+	}
+	states, err := m.states(keys)
+	if err != nil {
+		return ratelimit.KeyPage{}, err
+	}
+	page := ratelimit.KeyPage{Keys: states}
+	if next != 0 {
+		page.Next = strconv.FormatUint(next, 10)
+	}
+	return page, nil
+}
+
+// State returns state of key kept on redis
+func (m *RedisStore) State(ctx context.Context, key string) (ratelimit.KeyState, bool, error) {
+	states, err := m.states([]string{key})
+	if err != nil || len(states) == 0 {
+		return ratelimit.KeyState{}, false, err
+	}
+	return states[0], true, nil
+}
+
+// states reads counter and ttl of keys in a pipeline, keys which are missing or not a counter are skipped
+func (m *RedisStore) states(keys []string) ([]ratelimit.KeyState, error) {
+	gets := make([]*goredis.StringCmd, len(keys))
+	ttls := make([]*goredis.DurationCmd, len(keys))
+	_, err := m.client.Pipelined(func(pipeliner goredis.Pipeliner) error {
+		for i, k := range keys {
+			gets[i] = pipeliner.Get(k)
+			ttls[i] = pipeliner.PTTL(k)
+		}
+		return nil
+	})
+	if err != nil && !isReplyError(err) {
+		return nil, err
+	}
+
+	now := m.clock.Now()
+	states := make([]ratelimit.KeyState, 0, len(keys))
+	for i, k := range keys {
+		val, err := gets[i].Int64()
+		if err != nil || ttls[i].Err() != nil || ttls[i].Val() <= 0 {
+			continue
+		}
+		expire := now.Add(ttls[i].Val())
+		states = append(states, ratelimit.KeyState{Key: k, Value: float64(val), Expire: &expire})
+	}
+	return states, nil
+}
+
+// isReplyError reports if err is replied by redis for a single command rather than a connection failure
+func isReplyError(err error) bool {
+	if err == goredis.Nil {
+		return true
+	}
+	_, ok := err.(goredis.Error)
+	return ok
+}
+
+// reportHealth logs and notifies transition of redis between healthy and failing, err is nil if redis responded
+func (m *RedisStore) reportHealth(key string, err error) {
+	if err != nil {
+		m.notifier.StoreFailed("", key, err)
+		if m.degraded.CompareAndSwap(false, true) {
+			m.logger.Warn("redis store is unavailable", slog.Bool("fallback", m.fallbackInMem != nil),
+				slog.Any("error", err))
+		}
+		return
+	}
+	m.notifier.StoreRecovered()
+	if m.degraded.CompareAndSwap(true, false) {
+		m.logger.Info("redis store recovered")
+	}
+}
+
+// Stats returns number of events counted on fallback store, Retries is always zero since counters are
+// incremented without watching keys
+func (m *RedisStore) Stats() ratelimit.RedisStoreStats {
+	return ratelimit.RedisStoreStats{
+		Fallbacks:   m.fallbacks.Load(),
+		PendingKeys: m.ledger.size.Load(),
+	}
+}
+
+// triggerReconcile starts merging fallback usage in background if there is any
+func (m *RedisStore) triggerReconcile() {
+	if m.ledger.size.Load() == 0 || !m.reconciling.CompareAndSwap(false, true) {
+		return
+	}
+
+	m.closeLock.Lock()
+	defer m.closeLock.Unlock()
+	if m.closed {
+		m.reconciling.Store(false)
+		return
+	}
+	m.reconcileWG.Add(1)
+	go func() {
+		defer m.reconcileWG.Done()
+		defer m.reconciling.Store(false)
+		_ = m.Reconcile(context.Background())
+	}()
+}
+
+// Close waits for background reconciliation and queued events to finish, redis client and fallback store are not closed
+// since they are owned by caller
+func (m *RedisStore) Close() error {
+	m.closeLock.Lock()
+	m.closed = true
+	m.closeLock.Unlock()
+
+	m.reconcileWG.Wait()
+	return m.notifier.Close()
+}
+
+// Reconcile merges counts of current window counted on fallback store while redis was unavailable back into redis,
+// so clients do not get a free burst once redis recovers. Usage which can not be merged is kept for next call
+func (m *RedisStore) Reconcile(ctx context.Context) error {
+	pending := m.ledger.take()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var gen uint64
+	if m.breaker != nil {
+		var err error
+		if gen, err = m.breaker.Allow(); err != nil {
+			m.ledger.putBack(pending)
+			return fmt.Errorf("%w: %w", ratelimit.ErrStoreUnavailable, err)
+		}
+	}
+
+	var firstErr error
+	var failed int
+	now := m.clock.Now()
+	for key, u := range pending {
+		if ctx.Err() != nil {
+			m.ledger.add(key, u.Count, u.Expire)
+			continue
+		}
+		// window of usage is over
+		if !now.Before(u.Expire) {
+			continue
+		}
+
+		if _, err := m.redisIncr(key, u.Count, u.Expire); err != nil {
+			failed++
+			m.ledger.add(key, u.Count, u.Expire)
+			if m.errHandler != nil {
+				m.errHandler(ctx, key, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		// merged usage is not counted again by fallback store if redis fails in the same window
+		m.fallbackInMem.discount(key, u.Count, u.Expire)
+	}
+	if m.breaker != nil {
+		m.breaker.Done(gen, firstErr, 0)
+	}
+	if firstErr != nil {
+		m.logger.Warn("failed to merge fallback usage into redis", slog.Int("keys", failed),
+			slog.Any("error", firstErr))
+	} else {
+		firstErr = ctx.Err()
+	}
+
+	return firstErr
+}
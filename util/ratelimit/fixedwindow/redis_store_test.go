@@ -0,0 +1,169 @@
+package fixedwindow
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/driver/redis"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/circuitbreaker"
+	"ratelimit/util/ratelimit/clocktest"
+	"testing"
+	"time"
+)
+
+// newTestRedis starts in-process redis server at time of clock, it's closed with test
+func newTestRedis(t *testing.T, clock *clocktest.FakeClock) (*miniredis.Miniredis, *redis.McRedis) {
+	mr := miniredis.RunT(t)
+	mr.SetTime(clock.Now())
+	client, err := redis.NewConnection(&redis.SingleConnection{
+		Address: mr.Addr(),
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return mr, client
+}
+
+// advance moves both clock and redis server time forward by d
+func advance(clock *clocktest.FakeClock, mr *miniredis.Miniredis, d time.Duration) {
+	clock.Advance(d)
+	mr.FastForward(d)
+	mr.SetTime(clock.Now())
+}
+
+func TestRedisStore_Incr(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	mr, client := newTestRedis(t, clock)
+	rstore := NewRedisStore(client, time.Minute, nil, RedisWithClock(clock))
+
+	newVal, err := rstore.Incr(ctx, "k1", 1, clock.Now())
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), newVal)
+	newVal, err = rstore.Incr(ctx, "k1", 2, clock.Now())
+	require.Nil(t, err)
+	assert.Equal(t, int64(3), newVal)
+
+	// key expires at the end of window
+	assert.Equal(t, time.Minute, mr.TTL("k1"))
+	advance(clock, mr, 40*time.Second)
+	_, err = rstore.Incr(ctx, "k1", 1, clock.Now())
+	require.Nil(t, err)
+	assert.Equal(t, 20*time.Second, mr.TTL("k1"))
+
+	mr.FastForward(20 * time.Second)
+	assert.False(t, mr.Exists("k1"))
+}
+
+func TestRedisStore_Keys(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	mr, client := newTestRedis(t, clock)
+	rstore := NewRedisStore(client, time.Minute, nil, RedisWithClock(clock))
+
+	for _, k := range []string{"k1", "k2", "k3"} {
+		_, err := rstore.Incr(ctx, k, 2, clock.Now())
+		require.Nil(t, err)
+	}
+	// keys of other data are skipped
+	require.Nil(t, mr.Set("other", "text"))
+	mr.HSet("hash", "f", "v")
+
+	var states []ratelimit.KeyState
+	cursor := ""
+	for {
+		page, err := rstore.Keys(ctx, cursor, 2)
+		require.Nil(t, err)
+		states = append(states, page.Keys...)
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	require.Len(t, states, 3)
+	assert.Equal(t, float64(2), states[0].Value)
+	assert.Equal(t, clock.Now().Add(time.Minute), *states[0].Expire)
+
+	state, ok, err := rstore.State(ctx, "k2")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "k2", state.Key)
+	_, ok, err = rstore.State(ctx, "missing")
+	require.Nil(t, err)
+	assert.False(t, ok)
+	_, err = rstore.Keys(ctx, "x", 2)
+	assert.NotNil(t, err)
+}
+
+func TestRedisStore_Reset(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	mr, client := newTestRedis(t, clock)
+	rstore := NewRedisStore(client, time.Minute, nil, RedisWithClock(clock))
+
+	clock.Advance(15 * time.Second)
+	require.Nil(t, rstore.Reset(ctx, "k1", 5))
+	val, err := mr.Get("k1")
+	require.Nil(t, err)
+	assert.Equal(t, "5", val)
+	assert.Equal(t, 45*time.Second, mr.TTL("k1"))
+
+	// reset to zero deletes key
+	require.Nil(t, rstore.Reset(ctx, "k1", 0))
+	assert.False(t, mr.Exists("k1"))
+}
+
+func TestRedisStore_Fallback(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	mr, client := newTestRedis(t, clock)
+
+	mstore := NewMemStore(time.Minute, MemWithClock(clock))
+	defer mstore.Close()
+	breaker := circuitbreaker.New(circuitbreaker.WithMaxFailures(2), circuitbreaker.WithOpenTimeout(time.Second),
+		circuitbreaker.WithClock(clock))
+	rstore := NewRedisStore(client, time.Minute, mstore, RedisWithBreaker(breaker), RedisWithClock(clock))
+
+	_, err := rstore.Incr(ctx, "k1", 1, clock.Now())
+	require.Nil(t, err)
+
+	mr.SetError("ERR down")
+	for i := int64(1); i <= 3; i++ {
+		newVal, err := rstore.Incr(ctx, "k1", 1, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, i, newVal)
+	}
+	assert.Equal(t, circuitbreaker.StateOpen, breaker.State())
+	assert.Equal(t, ratelimit.RedisStoreStats{Fallbacks: 3, PendingKeys: 1}, rstore.Stats())
+	assert.ErrorIs(t, rstore.Reset(ctx, "k1", 0), ratelimit.ErrStoreUnavailable)
+
+	// fallback usage is merged back once redis recovers
+	mr.SetError("")
+	advance(clock, mr, time.Second)
+	_, err = rstore.Incr(ctx, "k2", 1, clock.Now())
+	require.Nil(t, err)
+	require.Nil(t, rstore.Close())
+	assert.Equal(t, circuitbreaker.StateClosed, breaker.State())
+	assert.Equal(t, int64(0), rstore.ledger.size.Load())
+	val, err := mr.Get("k1")
+	require.Nil(t, err)
+	assert.Equal(t, "4", val)
+	assert.Equal(t, 59*time.Second, mr.TTL("k1"))
+
+	// merged usage is cleared from fallback store, so it's not counted twice if redis fails again
+	state, ok, err := mstore.State(ctx, "k1")
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, float64(0), state.Value)
+}
+
+func TestRedisStore_Fallback_Missing(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	mr, client := newTestRedis(t, clock)
+	rstore := NewRedisStore(client, time.Minute, nil)
+
+	mr.SetError("ERR down")
+	_, err := rstore.Incr(context.Background(), "k1", 1, clock.Now())
+	assert.ErrorIs(t, err, ratelimit.ErrStoreUnavailable)
+}
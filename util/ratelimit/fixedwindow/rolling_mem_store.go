@@ -2,17 +2,30 @@ package fixedwindow
 
 import (
 	"context"
-	"errors"
-	"fmt"
+	"log/slog"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/internal/evict"
+	"ratelimit/util/ratelimit/internal/keytable"
+	"ratelimit/util/ratelimit/internal/memstore"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type InMemRollingStore struct {
-	ttl          time.Duration
+	// ttl is length of rolling window, it's changed by UpdateWindow
+	ttl          atomic.Int64
 	numberWindow int64
-	sliceTTL     time.Duration
-	mMap         sync.Map
+	mMap         *keytable.Table[memRateRollingData]
+
+	// ghosts keeps counter of evicted keys if EvictedKeyRestore policy is used,
+	// all slices of an evicted key are merged into its latest one
+	ghosts   *evict.Ghosts[sliceCount]
+	restores atomic.Uint64
+
+	clock   ratelimit.Clock
+	logger  *slog.Logger
+	sweeper *memstore.Sweeper
 }
 
 type memRateRollingData struct {
@@ -20,62 +33,156 @@ type memRateRollingData struct {
 	lock      sync.Mutex
 }
 
-func NewMemRollingStore(ttl time.Duration, numberWindow int64) *InMemRollingStore {
+// sliceCount is compact counter of evicted key
+type sliceCount struct {
+	slice time.Time
+	val   int64
+}
+
+func NewMemRollingStore(ttl time.Duration, numberWindow int64, opts ...MemStoreOption) *InMemRollingStore {
+	o := memstore.NewOptions(ttl, opts...)
 	m := &InMemRollingStore{
-		ttl:          ttl,
+		clock:        o.Clock,
+		logger:       o.Logger,
 		numberWindow: numberWindow,
-		sliceTTL:     ttl / time.Duration(numberWindow),
 	}
-	go func() {
-		for {
-			time.Sleep(ttl)
-			now := time.Now()
-			m.mMap.Range(func(key, value interface{}) bool {
-				rData, ok := value.(*memRateRollingData)
-				if !ok {
-					log.Errorw("malformed rate data", "context", fmt.Sprintf("key: %v", key))
-					m.mMap.Delete(key)
-					return true
-				}
-
-				expire := now.Add(-m.ttl)
-				rData.lock.Lock()
-				var countNonExpire = int64(0)
-				for k := range rData.sliceVals {
-					if !expire.Before(k) {
-						countNonExpire++
-						break
-					}
-				}
-				if countNonExpire == 0 {
-					m.mMap.Delete(key)
-				}
-				rData.lock.Unlock()
-
-				return true
-			})
-		}
-	}()
+	m.ttl.Store(int64(ttl))
+	tableOpts := keytable.Options[memRateRollingData]{
+		MaxKeys:  o.MaxKeys,
+		Eviction: o.Eviction,
+		Shards:   o.Shards,
+		New:      m.newRateData,
+	}
+	if o.MaxKeys > 0 && o.EvictedKeys == ratelimit.EvictedKeyRestore {
+		m.ghosts = evict.NewGhosts[sliceCount](o.MaxKeys)
+		tableOpts.OnEvict = m.rememberEvicted
+	}
+	m.mMap = keytable.New(tableOpts)
+	m.sweeper = memstore.NewSweeper(o, m.sweep)
 
 	return m
 }
 
-// Incr use set-then-get approach to reduce lock that help improve performance
-func (m *InMemRollingStore) Incr(ctx context.Context, key string, value int64, now time.Time) (int64, error) {
-	data, _ := m.mMap.LoadOrStore(key, &memRateRollingData{
-		sliceVals: make(map[time.Time]int64),
+// sweep removes keys which have no slice in rolling window
+func (m *InMemRollingStore) sweep() {
+	now := m.clock.Now()
+	m.mMap.Range(func(key string, rData *memRateRollingData) bool {
+		expire := now.Add(-m.Window())
+		rData.lock.Lock()
+		var countNonExpire = int64(0)
+		for k := range rData.sliceVals {
+			if expire.Before(k) {
+				countNonExpire++
+				break
+			}
+		}
+		if countNonExpire == 0 {
+			m.mMap.Delete(key)
+			m.logger.Debug("swept expired key", ratelimit.LogKey(key))
+		}
+		rData.lock.Unlock()
+
+		return true
 	})
-	rData, ok := data.(*memRateRollingData)
+}
+
+func (m *InMemRollingStore) rememberEvicted(key string, rData *memRateRollingData) {
+	var c sliceCount
+	rData.lock.Lock()
+	for k, v := range rData.sliceVals {
+		c.val += v
+		if k.After(c.slice) {
+			c.slice = k
+		}
+	}
+	rData.lock.Unlock()
+	m.ghosts.Put(key, c)
+}
+
+// newRateData create counter of new key, it's restored if key has been evicted recently
+func (m *InMemRollingStore) newRateData(key string) *memRateRollingData {
+	rData := &memRateRollingData{
+		sliceVals: make(map[time.Time]int64),
+	}
+	if m.ghosts != nil {
+		if c, ok := m.ghosts.Take(key); ok {
+			m.restores.Add(1)
+			rData.sliceVals[c.slice] = c.val
+		}
+	}
+	return rData
+}
+
+// Stats returns number of keys and evictions of store
+func (m *InMemRollingStore) Stats() ratelimit.StoreStats {
+	return ratelimit.StoreStats{
+		Keys:      m.mMap.Len(),
+		Evictions: m.mMap.Evictions(),
+		Restores:  m.restores.Load(),
+	}
+}
+
+// Keys lists keys having slices in rolling window in sorted order, cursor is last key of previous page
+func (m *InMemRollingStore) Keys(ctx context.Context, cursor string, limit int) (ratelimit.KeyPage, error) {
+	now := m.clock.Now()
+	keys, more := m.mMap.Page(cursor, limit)
+	page := ratelimit.KeyPage{Keys: make([]ratelimit.KeyState, 0, len(keys))}
+	for _, key := range keys {
+		if state, ok := m.state(key, now); ok {
+			page.Keys = append(page.Keys, state)
+		}
+	}
+	if more {
+		page.Next = keys[len(keys)-1]
+	}
+	return page, nil
+}
+
+// State returns sum of slices of key in rolling window, Expire is when oldest of them leaves the window
+func (m *InMemRollingStore) State(ctx context.Context, key string) (ratelimit.KeyState, bool, error) {
+	state, ok := m.state(key, m.clock.Now())
+	return state, ok, nil
+}
+
+func (m *InMemRollingStore) state(key string, now time.Time) (ratelimit.KeyState, bool) {
+	rData, ok := m.mMap.Load(key)
 	if !ok {
-		return 0, errors.New("malformed data")
+		return ratelimit.KeyState{}, false
+	}
+	window := m.Window()
+	expire := now.Add(-window)
+	state := ratelimit.KeyState{Key: key}
+	var oldest time.Time
+	rData.lock.Lock()
+	for k, v := range rData.sliceVals {
+		if expire.After(k) {
+			continue
+		}
+		state.Value += float64(v)
+		if oldest.IsZero() || k.Before(oldest) {
+			oldest = k
+		}
+	}
+	rData.lock.Unlock()
+	if oldest.IsZero() {
+		return ratelimit.KeyState{}, false
 	}
+	end := oldest.Add(window)
+	state.Expire = &end
+	return state, true
+}
+
+// Incr use set-then-get approach to reduce lock that help improve performance
+func (m *InMemRollingStore) Incr(ctx context.Context, key string, value int64, now time.Time) (int64, error) {
+	rData := m.mMap.LoadOrCreate(key)
 
-	sliceIdx := now.Truncate(m.sliceTTL)
-	expire := now.Add(-m.ttl)
+	window := m.Window()
+	sliceIdx := now.Truncate(window / time.Duration(m.numberWindow))
+	expire := now.Add(-window)
 
 	rData.lock.Lock()
 	// clear expire slice value, sum all non-expire windows
-	var count = int64(1)
+	var count = value
 	for k, v := range rData.sliceVals {
 		if expire.After(k) {
 			delete(rData.sliceVals, k)
@@ -83,19 +190,22 @@ func (m *InMemRollingStore) Incr(ctx context.Context, key string, value int64, n
 			count += v
 		}
 	}
-	rData.sliceVals[sliceIdx]++
+	rData.sliceVals[sliceIdx] += value
 	rData.lock.Unlock()
 
 	// set again to avoid race condition with sweep routine
-	m.mMap.LoadOrStore(key, rData)
+	m.mMap.Keep(key, rData)
 
 	return count, nil
 }
 
 // Reset set counter of key to value
 func (m *InMemRollingStore) Reset(ctx context.Context, key string, value int64) error {
-	now := time.Now()
-	sliceIdx := now.Truncate(m.sliceTTL)
+	if m.ghosts != nil {
+		m.ghosts.Take(key)
+	}
+	now := m.clock.Now()
+	sliceIdx := now.Truncate(m.Window() / time.Duration(m.numberWindow))
 	m.mMap.Store(key, &memRateRollingData{
 		sliceVals: map[time.Time]int64{
 			sliceIdx: value,
@@ -103,3 +213,18 @@ func (m *InMemRollingStore) Reset(ctx context.Context, key string, value int64)
 	})
 	return nil
 }
+
+// Close stops sweeper and waits for it to exit, store keeps working without expiring keys
+func (m *InMemRollingStore) Close() error {
+	return m.sweeper.Close()
+}
+
+// Window returns length of rolling window
+func (m *InMemRollingStore) Window() time.Duration {
+	return time.Duration(m.ttl.Load())
+}
+
+// UpdateWindow changes length of rolling window, slices counted so far are kept and summed over the new window
+func (m *InMemRollingStore) UpdateWindow(ttl time.Duration) {
+	m.ttl.Store(int64(ttl))
+}
@@ -3,7 +3,10 @@ package fixedwindow
 import (
 	"context"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"math/rand"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
 	"sync"
 	"testing"
 	"time"
@@ -12,36 +15,94 @@ import (
 // TestInMemRollingStore_Incr
 // count at 0,5*2,7*2,9*2,11,16
 func TestInMemRollingStore_Incr(t *testing.T) {
-	m := NewMemRollingStore(time.Second*10, 10)
-	newVal, _ := m.Incr(context.Background(), "k1", 1, time.Now())
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	m := NewMemRollingStore(time.Second*10, 10, MemWithClock(clock))
+	defer m.Close()
+	newVal, _ := m.Incr(context.Background(), "k1", 1, clock.Now())
 	assert.Equal(t, int64(1), newVal)
 
-	time.Sleep(time.Second * 5)
+	clock.Advance(time.Second * 5)
 	for i := 0; i < 3; i++ {
 		wg := sync.WaitGroup{}
+		vals := make([]int64, 2)
 		for j := 0; j < 2; j++ {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				newVal, _ = m.Incr(context.Background(), "k1", 1, time.Now())
+				vals[j], _ = m.Incr(context.Background(), "k1", 1, clock.Now())
 			}()
 		}
 		wg.Wait()
+		newVal = max(vals[0], vals[1])
 
-		time.Sleep(time.Second * 2)
+		clock.Advance(time.Second * 2)
 	}
 	assert.Equal(t, int64(7), newVal)
 
-	newVal, _ = m.Incr(context.Background(), "k1", 1, time.Now())
+	newVal, _ = m.Incr(context.Background(), "k1", 1, clock.Now())
 	assert.Equal(t, int64(7), newVal)
 
-	time.Sleep(time.Second * 5)
-	newVal, _ = m.Incr(context.Background(), "k1", 1, time.Now())
+	clock.Advance(time.Second * 5)
+	newVal, _ = m.Incr(context.Background(), "k1", 1, clock.Now())
 	assert.Equal(t, int64(6), newVal)
 }
 
+func TestInMemRollingStore_Incr_Weight(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	m := NewMemRollingStore(time.Second*10, 10, MemWithClock(clock))
+	defer m.Close()
+
+	// event counts its weight rather than 1
+	newVal, _ := m.Incr(ctx, "k1", 3, clock.Now())
+	assert.Equal(t, int64(3), newVal)
+	clock.Advance(time.Second * 5)
+	newVal, _ = m.Incr(ctx, "k1", 4, clock.Now())
+	assert.Equal(t, int64(7), newVal)
+	newVal, _ = m.Incr(ctx, "k1", 0, clock.Now())
+	assert.Equal(t, int64(7), newVal)
+
+	// weight leaves rolling window with its slice
+	clock.Advance(time.Second * 6)
+	newVal, _ = m.Incr(ctx, "k1", 1, clock.Now())
+	assert.Equal(t, int64(5), newVal)
+}
+
+func TestInMemRollingStore_State(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	m := NewMemRollingStore(time.Second*10, 10, MemWithClock(clock))
+	defer m.Close()
+
+	_, _ = m.Incr(ctx, "k1", 2, clock.Now())
+	clock.Advance(time.Second * 4)
+	_, _ = m.Incr(ctx, "k1", 3, clock.Now())
+	_, _ = m.Incr(ctx, "k2", 1, clock.Now())
+
+	state, ok, err := m.State(ctx, "k1")
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, float64(5), state.Value)
+	assert.Equal(t, time.Unix(1700000010, 0), *state.Expire)
+
+	// first slice of k1 leaves rolling window
+	clock.Advance(time.Second * 7)
+	page, err := m.Keys(ctx, "", 10)
+	require.Nil(t, err)
+	expire := time.Unix(1700000014, 0)
+	assert.Equal(t, []ratelimit.KeyState{
+		{Key: "k1", Value: 3, Expire: &expire},
+		{Key: "k2", Value: 1, Expire: &expire},
+	}, page.Keys)
+
+	clock.Advance(time.Second * 4)
+	_, ok, _ = m.State(ctx, "k1")
+	assert.False(t, ok)
+}
+
 func BenchmarkInMemRollingStore_Incr(b *testing.B) {
 	mstore := NewMemRollingStore(time.Second*10, 10)
+	defer mstore.Close()
 
 	keyList := [...]string{"k1", "k2", "k3", "k4", "k5", "k6"}
 
@@ -11,3 +11,11 @@ type Store interface {
 	// Reset set counter of key to value
 	Reset(ctx context.Context, key string, value int64) error
 }
+
+// WindowUpdater is implemented by stores whose window can be changed while they are in use,
+// Limiter.Update requires it to change window of limiter
+type WindowUpdater interface {
+	UpdateWindow(ttl time.Duration)
+	// Window returns length of window
+	Window() time.Duration
+}
@@ -0,0 +1,34 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// KeyState is usage of a key kept by a store
+type KeyState struct {
+	Key string `json:"key"`
+	// Value is counter of current window for fixed window stores and level of bucket for leaky bucket stores
+	Value float64 `json:"value"`
+	// Expire is end of current window of fixed window stores, it's nil for leaky bucket stores
+	Expire *time.Time `json:"expire,omitempty"`
+	// Last is time of last counted event of leaky bucket stores, it's nil for fixed window stores
+	Last *time.Time `json:"last,omitempty"`
+}
+
+// KeyPage is a page of keys listed by Inspector
+type KeyPage struct {
+	Keys []KeyState `json:"keys"`
+	// Next is cursor of next page, it's empty once all keys are listed
+	Next string `json:"next,omitempty"`
+}
+
+// Inspector is implemented by stores whose keys can be listed for administration
+type Inspector interface {
+	// Keys lists a page of active keys from cursor, empty cursor starts from first key.
+	// limit bounds size of page, stores scanning keys treat it as a hint so a page may hold
+	// fewer or more keys than limit while Next is not empty
+	Keys(ctx context.Context, cursor string, limit int) (KeyPage, error)
+	// State returns state of key, ok is false if key is not kept by store or it's expired
+	State(ctx context.Context, key string) (state KeyState, ok bool, err error)
+}
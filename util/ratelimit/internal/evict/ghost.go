@@ -0,0 +1,55 @@
+package evict
+
+import (
+	"ratelimit/util/ratelimit/internal/keyhash"
+	"sync"
+)
+
+// Ghosts remembers compact state of a bounded number of evicted keys by their hash,
+// so an evicted key coming back is not treated as a fresh one
+type Ghosts[V any] struct {
+	lock    sync.Mutex
+	entries map[uint64]ghost[V]
+	ring    []uint64
+	next    int
+}
+
+type ghost[V any] struct {
+	val  V
+	slot int
+}
+
+// NewGhosts create ghost table keeping state of at most capacity keys, the oldest one is forgotten first
+func NewGhosts[V any](capacity int) *Ghosts[V] {
+	return &Ghosts[V]{
+		entries: make(map[uint64]ghost[V], capacity),
+		ring:    make([]uint64, capacity),
+	}
+}
+
+// Put remembers state v of evicted key
+func (g *Ghosts[V]) Put(key string, v V) {
+	h := keyhash.Sum64(key)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if old, ok := g.entries[g.ring[g.next]]; ok && old.slot == g.next {
+		delete(g.entries, g.ring[g.next])
+	}
+	g.ring[g.next] = h
+	g.entries[h] = ghost[V]{val: v, slot: g.next}
+	g.next = (g.next + 1) % len(g.ring)
+}
+
+// Take returns and forgets state of key
+func (g *Ghosts[V]) Take(key string) (V, bool) {
+	h := keyhash.Sum64(key)
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	e, ok := g.entries[h]
+	if ok {
+		delete(g.entries, h)
+	}
+	return e.val, ok
+}
@@ -0,0 +1,164 @@
+// Package evict bounds number of keys kept by in-memory stores
+package evict
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Tracker tracks usage of keys and picks victim once number of keys exceeds its capacity
+type Tracker interface {
+	// Touch marks key as used, returns evicted key if adding key exceeds capacity
+	Touch(key string) (evicted string, ok bool)
+	// Remove forgets key
+	Remove(key string)
+	// Len returns number of tracked keys
+	Len() int
+}
+
+// NewLRU create tracker evicting least recently used key, every Touch takes exclusive lock
+func NewLRU(capacity int) Tracker {
+	return &lru{
+		capacity: capacity,
+		items:    make(map[string]*list.Element, capacity),
+		order:    list.New(),
+	}
+}
+
+type lru struct {
+	capacity int
+	lock     sync.Mutex
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+func (l *lru) Touch(key string) (string, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if e, ok := l.items[key]; ok {
+		l.order.MoveToFront(e)
+		return "", false
+	}
+	l.items[key] = l.order.PushFront(key)
+	if l.order.Len() <= l.capacity {
+		return "", false
+	}
+
+	victim := l.order.Back()
+	l.order.Remove(victim)
+	evicted := victim.Value.(string)
+	delete(l.items, evicted)
+	return evicted, true
+}
+
+func (l *lru) Remove(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if e, ok := l.items[key]; ok {
+		l.order.Remove(e)
+		delete(l.items, key)
+	}
+}
+
+func (l *lru) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.items)
+}
+
+// NewCLOCK create tracker approximating LRU with second-chance algorithm, Touch of a tracked key only takes shared lock
+func NewCLOCK(capacity int) Tracker {
+	return &clock{
+		capacity: capacity,
+		index:    make(map[string]int, capacity),
+		slots:    make([]clockSlot, 0, capacity),
+	}
+}
+
+type clockSlot struct {
+	key  string
+	used bool
+	ref  atomic.Bool
+}
+
+type clock struct {
+	capacity int
+	lock     sync.RWMutex
+	index    map[string]int
+	slots    []clockSlot
+	free     []int
+	hand     int
+}
+
+func (c *clock) Touch(key string) (string, bool) {
+	c.lock.RLock()
+	if i, ok := c.index[key]; ok {
+		c.slots[i].ref.Store(true)
+		c.lock.RUnlock()
+		return "", false
+	}
+	c.lock.RUnlock()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if i, ok := c.index[key]; ok {
+		c.slots[i].ref.Store(true)
+		return "", false
+	}
+
+	if n := len(c.free); n > 0 {
+		i := c.free[n-1]
+		c.free = c.free[:n-1]
+		c.put(i, key)
+		return "", false
+	}
+	if len(c.slots) < c.capacity {
+		c.slots = append(c.slots, clockSlot{})
+		c.put(len(c.slots)-1, key)
+		return "", false
+	}
+
+	// give referenced keys a second chance until finding victim
+	for {
+		s := &c.slots[c.hand]
+		if s.used && !s.ref.Load() {
+			break
+		}
+		s.ref.Store(false)
+		c.hand = (c.hand + 1) % len(c.slots)
+	}
+	evicted := c.slots[c.hand].key
+	delete(c.index, evicted)
+	c.put(c.hand, key)
+	c.hand = (c.hand + 1) % len(c.slots)
+	return evicted, true
+}
+
+func (c *clock) put(i int, key string) {
+	c.slots[i].key = key
+	c.slots[i].used = true
+	c.slots[i].ref.Store(false)
+	c.index[key] = i
+}
+
+func (c *clock) Remove(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if i, ok := c.index[key]; ok {
+		delete(c.index, key)
+		c.slots[i].key = ""
+		c.slots[i].used = false
+		c.slots[i].ref.Store(false)
+		c.free = append(c.free, i)
+	}
+}
+
+func (c *clock) Len() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.index)
+}
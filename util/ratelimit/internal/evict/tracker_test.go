@@ -0,0 +1,73 @@
+package evict
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLRU(t *testing.T) {
+	l := NewLRU(2)
+	_, ok := l.Touch("k1")
+	assert.False(t, ok)
+	_, ok = l.Touch("k2")
+	assert.False(t, ok)
+	_, ok = l.Touch("k1")
+	assert.False(t, ok)
+
+	evicted, ok := l.Touch("k3")
+	assert.True(t, ok)
+	assert.Equal(t, "k2", evicted)
+
+	l.Remove("k1")
+	assert.Equal(t, 1, l.Len())
+	_, ok = l.Touch("k4")
+	assert.False(t, ok)
+	assert.Equal(t, 2, l.Len())
+}
+
+func TestCLOCK(t *testing.T) {
+	c := NewCLOCK(3)
+	for _, k := range []string{"k1", "k2", "k3"} {
+		_, ok := c.Touch(k)
+		assert.False(t, ok)
+	}
+	// k1 and k3 get second chance
+	c.Touch("k1")
+	c.Touch("k3")
+
+	evicted, ok := c.Touch("k4")
+	assert.True(t, ok)
+	assert.Equal(t, "k2", evicted)
+
+	// reference of k1 is cleared by previous pass, k3 gets its second chance
+	evicted, ok = c.Touch("k5")
+	assert.True(t, ok)
+	assert.Equal(t, "k1", evicted)
+
+	c.Remove("k3")
+	assert.Equal(t, 2, c.Len())
+	_, ok = c.Touch("k6")
+	assert.False(t, ok)
+	assert.Equal(t, 3, c.Len())
+}
+
+func TestGhosts(t *testing.T) {
+	g := NewGhosts[int](2)
+	g.Put("k1", 1)
+	g.Put("k2", 2)
+	g.Put("k3", 3)
+
+	// the oldest one is forgotten
+	_, ok := g.Take("k1")
+	assert.False(t, ok)
+	v, ok := g.Take("k2")
+	assert.True(t, ok)
+	assert.Equal(t, 2, v)
+	_, ok = g.Take("k2")
+	assert.False(t, ok)
+
+	g.Put("k3", 4)
+	g.Put("k4", 5)
+	v, _ = g.Take("k3")
+	assert.Equal(t, 4, v)
+}
@@ -0,0 +1,18 @@
+// Package keyhash hashes keys of limiters, it's shared by in-memory stores picking lock stripe of a key and by
+// telemetry fingerprinting keys
+package keyhash
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// Sum64 returns 64-bit FNV-1a hash of key without allocation
+func Sum64(key string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < len(key); i++ {
+		h ^= uint64(key[i])
+		h *= fnvPrime64
+	}
+	return h
+}
@@ -0,0 +1,15 @@
+package keyhash
+
+import (
+	"github.com/stretchr/testify/assert"
+	"hash/fnv"
+	"testing"
+)
+
+func TestSum64(t *testing.T) {
+	for _, k := range []string{"", "k1", "192.168.0.1", "user:42"} {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(k))
+		assert.Equal(t, h.Sum64(), Sum64(k), k)
+	}
+}
@@ -0,0 +1,186 @@
+package keytable
+
+import (
+	"ratelimit/util/ratelimit/internal/keyhash"
+	"sync"
+)
+
+// backend is map implementation used by Table
+type backend[V any] interface {
+	load(key string) (*V, bool)
+	// loadOrCreate returns value of key, value is created by create if key does not exist
+	loadOrCreate(key string, create func(key string) *V) (v *V, created bool)
+	// loadOrStore returns existing value of key, v is stored if key does not exist
+	loadOrStore(key string, v *V) (actual *V, loaded bool)
+	swap(key string, v *V) (loaded bool)
+	loadAndDelete(key string) (*V, bool)
+	rangeAll(f func(key string, v *V) bool)
+}
+
+// syncMap is backend built on sync.Map, it suits keys which are written once and read many times
+type syncMap[V any] struct {
+	m sync.Map
+}
+
+func (s *syncMap[V]) load(key string) (*V, bool) {
+	v, ok := s.m.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*V), true
+}
+
+func (s *syncMap[V]) loadOrCreate(key string, create func(key string) *V) (*V, bool) {
+	if v, ok := s.m.Load(key); ok {
+		return v.(*V), false
+	}
+	v, loaded := s.m.LoadOrStore(key, create(key))
+	return v.(*V), !loaded
+}
+
+func (s *syncMap[V]) loadOrStore(key string, v *V) (*V, bool) {
+	actual, loaded := s.m.LoadOrStore(key, v)
+	return actual.(*V), loaded
+}
+
+func (s *syncMap[V]) swap(key string, v *V) bool {
+	_, loaded := s.m.Swap(key, v)
+	return loaded
+}
+
+func (s *syncMap[V]) loadAndDelete(key string) (*V, bool) {
+	v, loaded := s.m.LoadAndDelete(key)
+	if !loaded {
+		return nil, false
+	}
+	return v.(*V), true
+}
+
+func (s *syncMap[V]) rangeAll(f func(key string, v *V) bool) {
+	s.m.Range(func(key, value interface{}) bool {
+		return f(key.(string), value.(*V))
+	})
+}
+
+// shardedMap is backend splitting keys into a fixed number of lock stripes,
+// looking up an existing key does not allocate
+type shardedMap[V any] struct {
+	shards []shard[V]
+	mask   uint64
+}
+
+type shard[V any] struct {
+	lock  sync.RWMutex
+	items map[string]*V
+	// pad shard to its own cache line to avoid false sharing between stripes
+	_ [40]byte
+}
+
+func newShardedMap[V any](n int) *shardedMap[V] {
+	// round number of shards up to power of two so shard is picked by mask
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	s := &shardedMap[V]{
+		shards: make([]shard[V], size),
+		mask:   uint64(size - 1),
+	}
+	for i := range s.shards {
+		s.shards[i].items = make(map[string]*V)
+	}
+	return s
+}
+
+func (s *shardedMap[V]) shardOf(key string) *shard[V] {
+	return &s.shards[keyhash.Sum64(key)&s.mask]
+}
+
+func (s *shardedMap[V]) load(key string) (*V, bool) {
+	sh := s.shardOf(key)
+	sh.lock.RLock()
+	v, ok := sh.items[key]
+	sh.lock.RUnlock()
+	return v, ok
+}
+
+func (s *shardedMap[V]) loadOrCreate(key string, create func(key string) *V) (*V, bool) {
+	sh := s.shardOf(key)
+	sh.lock.RLock()
+	v, ok := sh.items[key]
+	sh.lock.RUnlock()
+	if ok {
+		return v, false
+	}
+
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if v, ok = sh.items[key]; ok {
+		return v, false
+	}
+	v = create(key)
+	sh.items[key] = v
+	return v, true
+}
+
+func (s *shardedMap[V]) loadOrStore(key string, v *V) (*V, bool) {
+	sh := s.shardOf(key)
+	sh.lock.RLock()
+	actual, ok := sh.items[key]
+	sh.lock.RUnlock()
+	if ok {
+		return actual, true
+	}
+
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if actual, ok = sh.items[key]; ok {
+		return actual, true
+	}
+	sh.items[key] = v
+	return v, false
+}
+
+func (s *shardedMap[V]) swap(key string, v *V) bool {
+	sh := s.shardOf(key)
+	sh.lock.Lock()
+	_, loaded := sh.items[key]
+	sh.items[key] = v
+	sh.lock.Unlock()
+	return loaded
+}
+
+func (s *shardedMap[V]) loadAndDelete(key string) (*V, bool) {
+	sh := s.shardOf(key)
+	sh.lock.Lock()
+	v, ok := sh.items[key]
+	if ok {
+		delete(sh.items, key)
+	}
+	sh.lock.Unlock()
+	return v, ok
+}
+
+// rangeAll iterates over snapshot of each shard, so f is free to modify map
+func (s *shardedMap[V]) rangeAll(f func(key string, v *V) bool) {
+	type entry struct {
+		key string
+		v   *V
+	}
+	var entries []entry
+	for i := range s.shards {
+		sh := &s.shards[i]
+		entries = entries[:0]
+		sh.lock.RLock()
+		for k, v := range sh.items {
+			entries = append(entries, entry{key: k, v: v})
+		}
+		sh.lock.RUnlock()
+
+		for _, e := range entries {
+			if !f(e.key, e.v) {
+				return
+			}
+		}
+	}
+}
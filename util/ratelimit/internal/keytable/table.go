@@ -0,0 +1,172 @@
+// Package keytable is key-value table of in-memory stores which keeps count of keys and bounds it if needed
+package keytable
+
+import (
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/internal/evict"
+	"ratelimit/util/ratelimit/internal/keyhash"
+	"sort"
+	"sync/atomic"
+)
+
+type Options[V any] struct {
+	// MaxKeys bounds number of keys, zero means unbounded. Keys of a sharded table are bounded per shard, each
+	// shard keeps an even share of MaxKeys and evicts its own keys
+	MaxKeys int
+	// Eviction selects victim once table has more than MaxKeys keys
+	Eviction ratelimit.EvictionPolicy
+	// Shards is number of lock stripes, zero means table is built on sync.Map
+	Shards int
+	// New builds value of a new key
+	New func(key string) *V
+	// OnEvict is called with value of key evicted because table is full
+	OnEvict func(key string, v *V)
+}
+
+// Table maps key to value of type V
+type Table[V any] struct {
+	mMap  backend[V]
+	count atomic.Int64
+	// trackers has a tracker per shard picked by the same hash as shard of key, so tracking usage of a key
+	// only contends with keys of its shard
+	trackers    []evict.Tracker
+	trackerMask uint64
+	newValue    func(key string) *V
+	onEvict     func(key string, v *V)
+	evictions   atomic.Uint64
+}
+
+func New[V any](o Options[V]) *Table[V] {
+	t := &Table[V]{
+		newValue: o.New,
+		onEvict:  o.OnEvict,
+	}
+	shards := 1
+	if o.Shards > 0 {
+		s := newShardedMap[V](o.Shards)
+		t.mMap = s
+		shards = len(s.shards)
+	} else {
+		t.mMap = &syncMap[V]{}
+	}
+	if o.MaxKeys > 0 {
+		capacity := (o.MaxKeys + shards - 1) / shards
+		t.trackers = make([]evict.Tracker, shards)
+		t.trackerMask = uint64(shards - 1)
+		for i := range t.trackers {
+			t.trackers[i] = newTracker(o.Eviction, capacity)
+		}
+	}
+	return t
+}
+
+func newTracker(p ratelimit.EvictionPolicy, capacity int) evict.Tracker {
+	switch p {
+	case ratelimit.EvictionCLOCK:
+		return evict.NewCLOCK(capacity)
+	default:
+		return evict.NewLRU(capacity)
+	}
+}
+
+// trackerOf returns tracker of key, it's nil if number of keys is unbounded
+func (t *Table[V]) trackerOf(key string) evict.Tracker {
+	switch len(t.trackers) {
+	case 0:
+		return nil
+	case 1:
+		return t.trackers[0]
+	}
+	return t.trackers[keyhash.Sum64(key)&t.trackerMask]
+}
+
+// Load returns value of key
+func (t *Table[V]) Load(key string) (*V, bool) {
+	return t.mMap.load(key)
+}
+
+// LoadOrCreate returns value of key, value is built by Options.New if key does not exist
+func (t *Table[V]) LoadOrCreate(key string) *V {
+	v, created := t.mMap.loadOrCreate(key, t.newValue)
+	if created {
+		t.count.Add(1)
+	}
+	t.touch(key)
+	return v
+}
+
+// Keep stores v again if key has been removed by sweeper or eviction while v was being updated
+func (t *Table[V]) Keep(key string, v *V) {
+	if _, loaded := t.mMap.loadOrStore(key, v); !loaded {
+		t.count.Add(1)
+		t.touch(key)
+	}
+}
+
+// Store set value of key
+func (t *Table[V]) Store(key string, v *V) {
+	if loaded := t.mMap.swap(key, v); !loaded {
+		t.count.Add(1)
+	}
+	t.touch(key)
+}
+
+// Delete removes key
+func (t *Table[V]) Delete(key string) {
+	if _, loaded := t.mMap.loadAndDelete(key); loaded {
+		t.count.Add(-1)
+		if tracker := t.trackerOf(key); tracker != nil {
+			tracker.Remove(key)
+		}
+	}
+}
+
+// Range calls f for every key until f returns false
+func (t *Table[V]) Range(f func(key string, v *V) bool) {
+	t.mMap.rangeAll(f)
+}
+
+// Page returns at most limit keys greater than after in sorted order, more is true if there are keys left,
+// keys are collected on every call so it's meant for administration rather than hot path
+func (t *Table[V]) Page(after string, limit int) (keys []string, more bool) {
+	t.mMap.rangeAll(func(key string, v *V) bool {
+		if key > after {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	if len(keys) > limit {
+		return keys[:limit], true
+	}
+	return keys, false
+}
+
+// Len returns number of keys
+func (t *Table[V]) Len() int64 {
+	return t.count.Load()
+}
+
+// Evictions returns number of keys evicted because table is full
+func (t *Table[V]) Evictions() uint64 {
+	return t.evictions.Load()
+}
+
+func (t *Table[V]) touch(key string) {
+	tracker := t.trackerOf(key)
+	if tracker == nil {
+		return
+	}
+
+	evicted, ok := tracker.Touch(key)
+	if !ok {
+		return
+	}
+	if v, loaded := t.mMap.loadAndDelete(evicted); loaded {
+		t.count.Add(-1)
+		t.evictions.Add(1)
+		if t.onEvict != nil {
+			t.onEvict(evicted, v)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package keytable
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"ratelimit/util/ratelimit"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type counter struct {
+	val atomic.Int64
+}
+
+func TestTable(t *testing.T) {
+	tests := []struct {
+		name   string
+		shards int
+	}{
+		{name: "sync map", shards: 0},
+		// keys of a single shard are bounded as a whole
+		{name: "sharded", shards: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var evicted []string
+			tbl := New(Options[counter]{
+				MaxKeys:  8,
+				Eviction: ratelimit.EvictionLRU,
+				Shards:   tt.shards,
+				New: func(key string) *counter {
+					return &counter{}
+				},
+				OnEvict: func(key string, v *counter) {
+					evicted = append(evicted, key)
+				},
+			})
+
+			wg := sync.WaitGroup{}
+			for i := 0; i < 100; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					tbl.LoadOrCreate(fmt.Sprintf("k%d", i%4)).val.Add(1)
+				}(i)
+			}
+			wg.Wait()
+			assert.Equal(t, int64(4), tbl.Len())
+			for i := 0; i < 4; i++ {
+				v, ok := tbl.Load(fmt.Sprintf("k%d", i))
+				assert.True(t, ok)
+				assert.Equal(t, int64(25), v.val.Load())
+			}
+
+			// least recently used key is k0
+			for i := 0; i < 10; i++ {
+				tbl.LoadOrCreate(fmt.Sprintf("k%d", i))
+			}
+			assert.Equal(t, int64(8), tbl.Len())
+			assert.Equal(t, uint64(2), tbl.Evictions())
+			assert.ElementsMatch(t, []string{"k0", "k1"}, evicted)
+
+			tbl.Delete("k9")
+			tbl.Delete("k9")
+			tbl.Store("k1", &counter{})
+			tbl.Keep("k2", &counter{})
+			v, _ := tbl.Load("k2")
+			assert.Equal(t, int64(25), v.val.Load())
+
+			var keys int
+			tbl.Range(func(key string, v *counter) bool {
+				keys++
+				tbl.Delete(key)
+				return true
+			})
+			assert.Equal(t, 8, keys)
+			assert.Equal(t, int64(0), tbl.Len())
+		})
+	}
+}
+
+func TestTable_Sharded_Eviction(t *testing.T) {
+	var evictions atomic.Int64
+	tbl := New(Options[counter]{
+		MaxKeys:  8,
+		Eviction: ratelimit.EvictionLRU,
+		Shards:   4,
+		New: func(key string) *counter {
+			return &counter{}
+		},
+		OnEvict: func(key string, v *counter) {
+			evictions.Add(1)
+		},
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				tbl.LoadOrCreate(fmt.Sprintf("k%d", i*25+j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// every shard keeps its share of keys
+	assert.Equal(t, int64(8), tbl.Len())
+	assert.Equal(t, uint64(92), tbl.Evictions())
+	assert.Equal(t, int64(92), evictions.Load())
+	for i := range tbl.trackers {
+		assert.Equal(t, 2, tbl.trackers[i].Len())
+	}
+	sharded := tbl.mMap.(*shardedMap[counter])
+	for i := range sharded.shards {
+		assert.Len(t, sharded.shards[i].items, 2)
+	}
+}
+
+func TestTable_Sharded_No_Alloc(t *testing.T) {
+	tbl := New(Options[counter]{
+		Shards: 16,
+		New: func(key string) *counter {
+			return &counter{}
+		},
+	})
+	v := tbl.LoadOrCreate("k1")
+
+	allocs := testing.AllocsPerRun(100, func() {
+		tbl.LoadOrCreate("k1").val.Add(1)
+		tbl.Keep("k1", v)
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+func TestTable_Page(t *testing.T) {
+	tbl := New(Options[counter]{
+		Shards: 4,
+		New: func(key string) *counter {
+			return &counter{}
+		},
+	})
+	for _, k := range []string{"k3", "k1", "k4", "k0", "k2"} {
+		tbl.LoadOrCreate(k)
+	}
+
+	keys, more := tbl.Page("", 2)
+	assert.Equal(t, []string{"k0", "k1"}, keys)
+	assert.True(t, more)
+	keys, more = tbl.Page("k1", 3)
+	assert.Equal(t, []string{"k2", "k3", "k4"}, keys)
+	assert.False(t, more)
+}
@@ -0,0 +1,45 @@
+// Package memstore is configuration and sweeper shared by in-memory stores of limiters
+package memstore
+
+import (
+	"context"
+	"log/slog"
+	"ratelimit/util/ratelimit"
+	"time"
+)
+
+// Options is configuration of an in-memory store
+type Options struct {
+	// SweepInterval is how often expired keys are swept
+	SweepInterval time.Duration
+	// Ctx stops sweeper once it's done
+	Ctx context.Context
+	// MaxKeys bounds number of keys, zero means unbounded
+	MaxKeys int
+	// Eviction selects key evicted once store has more than MaxKeys keys
+	Eviction ratelimit.EvictionPolicy
+	// EvictedKeys decides how a key coming back after being evicted is treated
+	EvictedKeys ratelimit.EvictedKeyPolicy
+	// Shards is number of lock stripes of key table
+	Shards int
+	Clock  ratelimit.Clock
+	Logger *slog.Logger
+}
+
+// NewOptions applies opts of a store keeping keys for ttl, keys are swept every ttl by default
+func NewOptions[O ~func(o *Options)](ttl time.Duration, opts ...O) Options {
+	o := Options{
+		SweepInterval: ttl,
+		Ctx:           context.Background(),
+		Clock:         ratelimit.SystemClock,
+		Logger:        slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.SweepInterval <= 0 {
+		o.SweepInterval = ttl
+	}
+	return o
+}
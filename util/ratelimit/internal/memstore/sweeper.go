@@ -0,0 +1,55 @@
+package memstore
+
+import (
+	"context"
+	"ratelimit/util/ratelimit"
+	"time"
+)
+
+// Sweeper runs sweep function of in-memory store periodically until it's closed
+type Sweeper struct {
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+func NewSweeper(o Options, sweep func()) *Sweeper {
+	s := &Sweeper{
+		done: make(chan struct{}),
+	}
+
+	var ctx context.Context
+	ctx, s.stop = context.WithCancel(o.Ctx)
+	go s.run(ctx, o.Clock, o.SweepInterval, sweep)
+	return s
+}
+
+func (s *Sweeper) run(ctx context.Context, clock ratelimit.Clock, interval time.Duration, sweep func()) {
+	defer close(s.done)
+
+	if interval <= 0 {
+		<-ctx.Done()
+		return
+	}
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			sweep()
+		}
+	}
+}
+
+// Done is closed once sweeper exits
+func (s *Sweeper) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops sweeper and waits for it to exit
+func (s *Sweeper) Close() error {
+	s.stop()
+	<-s.done
+	return nil
+}
@@ -0,0 +1,42 @@
+package memstore
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit/clocktest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSweeper(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	var sweeps atomic.Int32
+	s := NewSweeper(NewOptions[func(o *Options)](time.Minute, func(o *Options) { o.Clock = clock }),
+		func() { sweeps.Add(1) })
+
+	assert.Eventually(t, func() bool { return clock.Waiters() == 1 }, time.Second, time.Millisecond)
+	clock.Advance(time.Minute)
+	assert.Eventually(t, func() bool { return sweeps.Load() == 1 }, time.Second, time.Millisecond)
+
+	require.Nil(t, s.Close())
+	assert.Equal(t, 0, clock.Waiters())
+	// close is idempotent
+	require.Nil(t, s.Close())
+}
+
+func TestSweeper_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewSweeper(NewOptions[func(o *Options)](time.Hour, func(o *Options) { o.Ctx = ctx }), func() {})
+	cancel()
+	<-s.Done()
+	require.Nil(t, s.Close())
+}
+
+func TestNewOptions(t *testing.T) {
+	o := NewOptions[func(o *Options)](time.Minute, func(o *Options) { o.SweepInterval = -1 })
+	assert.Equal(t, time.Minute, o.SweepInterval)
+	assert.NotNil(t, o.Clock)
+	assert.NotNil(t, o.Logger)
+}
@@ -0,0 +1,134 @@
+// Package wrap forwards optional interfaces of a limiter through a limiter instrumenting it, so an instrumented
+// limiter can still be updated, peeked and unbanned like the limiter it wraps
+package wrap
+
+import (
+	"context"
+	"io"
+	"ratelimit/util/ratelimit"
+	"time"
+)
+
+// Wrapper is limiter instrumenting another one, Close closes wrapped limiter if it's closable
+type Wrapper interface {
+	ratelimit.Limiter
+	io.Closer
+}
+
+// WindowUpdater is implemented by limiters whose window and quota can be changed, e.g. fixedwindow.Limiter
+type WindowUpdater interface {
+	Update(windowTime time.Duration, quota int64) error
+}
+
+// BucketUpdater is implemented by limiters whose rate and bucket can be changed, e.g. leakybucket.Limiter
+type BucketUpdater interface {
+	Update(rate float64, period time.Duration, bucket int64) error
+}
+
+// Bans is implemented by limiters banning keys, e.g. penaltybox.Box
+type Bans interface {
+	BannedUntil(ctx context.Context, k string) (until time.Time, ok bool, err error)
+	Unban(ctx context.Context, k string) error
+}
+
+// Limiter returns w extended by WindowUpdater or BucketUpdater, ratelimit.Peeker and Bans if l implements them,
+// calls of these interfaces go straight to l
+func Limiter(w Wrapper, l ratelimit.Limiter) ratelimit.Limiter {
+	p, peeker := l.(ratelimit.Peeker)
+	b, bans := l.(Bans)
+	if u, ok := l.(WindowUpdater); ok {
+		switch {
+		case peeker && bans:
+			return &windowPeekBans{w, u, p, b}
+		case peeker:
+			return &windowPeek{w, u, p}
+		case bans:
+			return &windowBans{w, u, b}
+		}
+		return &window{w, u}
+	}
+	if u, ok := l.(BucketUpdater); ok {
+		switch {
+		case peeker && bans:
+			return &bucketPeekBans{w, u, p, b}
+		case peeker:
+			return &bucketPeek{w, u, p}
+		case bans:
+			return &bucketBans{w, u, b}
+		}
+		return &bucket{w, u}
+	}
+	switch {
+	case peeker && bans:
+		return &peekBans{w, p, b}
+	case peeker:
+		return &peek{w, p}
+	case bans:
+		return &bansOnly{w, b}
+	}
+	return w
+}
+
+type window struct {
+	Wrapper
+	WindowUpdater
+}
+
+type windowPeek struct {
+	Wrapper
+	WindowUpdater
+	ratelimit.Peeker
+}
+
+type windowBans struct {
+	Wrapper
+	WindowUpdater
+	Bans
+}
+
+type windowPeekBans struct {
+	Wrapper
+	WindowUpdater
+	ratelimit.Peeker
+	Bans
+}
+
+type bucket struct {
+	Wrapper
+	BucketUpdater
+}
+
+type bucketPeek struct {
+	Wrapper
+	BucketUpdater
+	ratelimit.Peeker
+}
+
+type bucketBans struct {
+	Wrapper
+	BucketUpdater
+	Bans
+}
+
+type bucketPeekBans struct {
+	Wrapper
+	BucketUpdater
+	ratelimit.Peeker
+	Bans
+}
+
+type peek struct {
+	Wrapper
+	ratelimit.Peeker
+}
+
+type bansOnly struct {
+	Wrapper
+	Bans
+}
+
+type peekBans struct {
+	Wrapper
+	ratelimit.Peeker
+	Bans
+}
@@ -0,0 +1,163 @@
+package wrap
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"testing"
+	"time"
+)
+
+var (
+	errWindow = errors.New("window updated")
+	errBucket = errors.New("bucket updated")
+	errPeek   = errors.New("peeked")
+	errBans   = errors.New("unbanned")
+)
+
+type base struct{}
+
+func (base) Allow(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, nil
+}
+
+func (base) Reset(context.Context, string, int64) error {
+	return nil
+}
+
+type windowUpdater struct{}
+
+func (windowUpdater) Update(time.Duration, int64) error {
+	return errWindow
+}
+
+type bucketUpdater struct{}
+
+func (bucketUpdater) Update(float64, time.Duration, int64) error {
+	return errBucket
+}
+
+type peeker struct{}
+
+func (peeker) Peek(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, errPeek
+}
+
+type bans struct{}
+
+func (bans) BannedUntil(context.Context, string) (time.Time, bool, error) {
+	return time.Time{}, true, nil
+}
+
+func (bans) Unban(context.Context, string) error {
+	return errBans
+}
+
+// wrapper allows every event, so its decisions are told from those of wrapped limiter
+type wrapper struct {
+	ratelimit.Limiter
+}
+
+func (wrapper) Allow(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	return nil, true, nil
+}
+
+func (wrapper) Close() error {
+	return nil
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name                       string
+		l                          ratelimit.Limiter
+		window, bucket, peek, bans bool
+	}{
+		{name: "none", l: base{}},
+		{name: "window", l: struct {
+			base
+			windowUpdater
+		}{}, window: true},
+		{name: "window peek", l: struct {
+			base
+			windowUpdater
+			peeker
+		}{}, window: true, peek: true},
+		{name: "window bans", l: struct {
+			base
+			windowUpdater
+			bans
+		}{}, window: true, bans: true},
+		{name: "window peek bans", l: struct {
+			base
+			windowUpdater
+			peeker
+			bans
+		}{}, window: true, peek: true, bans: true},
+		{name: "bucket", l: struct {
+			base
+			bucketUpdater
+		}{}, bucket: true},
+		{name: "bucket peek", l: struct {
+			base
+			bucketUpdater
+			peeker
+		}{}, bucket: true, peek: true},
+		{name: "bucket bans", l: struct {
+			base
+			bucketUpdater
+			bans
+		}{}, bucket: true, bans: true},
+		{name: "bucket peek bans", l: struct {
+			base
+			bucketUpdater
+			peeker
+			bans
+		}{}, bucket: true, peek: true, bans: true},
+		{name: "peek", l: struct {
+			base
+			peeker
+		}{}, peek: true},
+		{name: "bans", l: struct {
+			base
+			bans
+		}{}, bans: true},
+		{name: "peek bans", l: struct {
+			base
+			peeker
+			bans
+		}{}, peek: true, bans: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := Limiter(wrapper{Limiter: tt.l}, tt.l)
+			_, allowed, err := l.Allow(ctx, "k1", 1)
+			require.Nil(t, err)
+			assert.True(t, allowed, "events must be checked by wrapper")
+			_, ok := l.(interface{ Close() error })
+			assert.True(t, ok)
+
+			u, ok := l.(WindowUpdater)
+			if assert.Equal(t, tt.window, ok) && ok {
+				assert.Equal(t, errWindow, u.Update(time.Minute, 1))
+			}
+			bu, ok := l.(BucketUpdater)
+			if assert.Equal(t, tt.bucket, ok) && ok {
+				assert.Equal(t, errBucket, bu.Update(1, time.Second, 1))
+			}
+			p, ok := l.(ratelimit.Peeker)
+			if assert.Equal(t, tt.peek, ok) && ok {
+				_, _, err = p.Peek(ctx, "k1", 1)
+				assert.Equal(t, errPeek, err)
+			}
+			b, ok := l.(Bans)
+			if assert.Equal(t, tt.bans, ok) && ok {
+				_, banned, _ := b.BannedUntil(ctx, "k1")
+				assert.True(t, banned)
+				assert.Equal(t, errBans, b.Unban(ctx, "k1"))
+			}
+		})
+	}
+}
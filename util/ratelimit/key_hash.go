@@ -0,0 +1,12 @@
+package ratelimit
+
+import (
+	"ratelimit/util/ratelimit/internal/keyhash"
+	"strconv"
+)
+
+// HashKey returns fingerprint of key k, it lets telemetry correlate events of a key without exporting the key,
+// it's not a cryptographic hash so low entropy keys such as IP addresses can still be guessed
+func HashKey(k string) string {
+	return strconv.FormatUint(keyhash.Sum64(k), 16)
+}
@@ -0,0 +1,52 @@
+package leakybucket_test
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"ratelimit/driver/redis"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/leakybucket"
+	"ratelimit/util/ratelimit/ratelimittest"
+	"testing"
+	"time"
+)
+
+func TestInMemStore_Conformance(t *testing.T) {
+	ratelimittest.TestLeakyBucketStore(t, func(t *testing.T, ttl time.Duration,
+		clock *clocktest.FakeClock) ratelimittest.Harness[leakybucket.Store] {
+		s := leakybucket.NewMemStore(ttl, leakybucket.MemWithClock(clock))
+		t.Cleanup(func() { _ = s.Close() })
+		return ratelimittest.Harness[leakybucket.Store]{Store: s}
+	})
+}
+
+func TestInMemStore_Sharded_Conformance(t *testing.T) {
+	ratelimittest.TestLeakyBucketStore(t, func(t *testing.T, ttl time.Duration,
+		clock *clocktest.FakeClock) ratelimittest.Harness[leakybucket.Store] {
+		s := leakybucket.NewMemStore(ttl, leakybucket.MemWithClock(clock), leakybucket.MemWithShards(4),
+			leakybucket.MemWithMaxKeys(100, ratelimit.EvictionCLOCK))
+		t.Cleanup(func() { _ = s.Close() })
+		return ratelimittest.Harness[leakybucket.Store]{Store: s}
+	})
+}
+
+func TestRedisStore_Conformance(t *testing.T) {
+	ratelimittest.TestLeakyBucketStore(t, func(t *testing.T, ttl time.Duration,
+		clock *clocktest.FakeClock) ratelimittest.Harness[leakybucket.Store] {
+		mr := miniredis.RunT(t)
+		client, err := redis.NewConnection(&redis.SingleConnection{
+			Address: mr.Addr(),
+		})
+		require.Nil(t, err)
+		t.Cleanup(func() { _ = client.Close() })
+
+		// enough retries to not fall back under concurrent updates
+		s := leakybucket.NewRedisStore(client, ttl, 1000, nil, leakybucket.RedisWithClock(clock))
+		t.Cleanup(func() { _ = s.Close() })
+		return ratelimittest.Harness[leakybucket.Store]{
+			Store:   s,
+			Advance: mr.FastForward,
+		}
+	})
+}
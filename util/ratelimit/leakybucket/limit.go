@@ -3,17 +3,59 @@ package leakybucket
 import (
 	"context"
 	"errors"
+	"io"
+	"log/slog"
 	"math"
 	"ratelimit/util/ratelimit"
+	"sync/atomic"
 	"time"
 )
 
-type Limiter struct {
+// limits is rate of limiter, bucket leaks rate events per period
+type limits struct {
 	rate   float64
 	period time.Duration
 	bucket int64
+}
+
+func (c *limits) leakyToDuration(f float64) time.Duration {
+	return time.Duration(int64(f / c.rate * float64(c.period)))
+}
+
+// scale returns limits with rate and bucket scaled down by scale
+func (c *limits) scale(scale float64) *limits {
+	rate, bucket := scaleLimits(c.rate, c.bucket, scale)
+	return &limits{rate: rate, period: c.period, bucket: bucket}
+}
+
+// storeTTL returns how long rate data is kept, it's time for a full bucket to leak
+func (c *limits) storeTTL() time.Duration {
+	return c.period * time.Duration(int64(math.Ceil(float64(c.bucket)/c.rate)))
+}
+
+type Limiter struct {
+	// limits is replaced by Update, Allow loads it once so an event is checked against a single config
+	limits atomic.Pointer[limits]
 
 	store Store
+	// ownStore is true if store is created by limiter, which is closed with limiter
+	ownStore bool
+
+	errPolicy     ratelimit.ErrorPolicy
+	errHandler    ratelimit.ErrorHandler
+	fallbackScale float64
+	fallback      *Limiter
+
+	provider LimitProvider
+	// storeTTL is minimum ttl of store created by limiter
+	storeTTL time.Duration
+
+	clock  ratelimit.Clock
+	logger *slog.Logger
+
+	name     string
+	observer ratelimit.Observer
+	notifier *ratelimit.Notifier
 }
 
 type LimiterOption func(l *Limiter)
@@ -24,84 +66,328 @@ func WithStore(s Store) LimiterOption {
 	}
 }
 
+// WithClock set clock used to timestamp events, it's passed to store created by limiter as well
+func WithClock(c ratelimit.Clock) LimiterOption {
+	return func(l *Limiter) {
+		l.clock = c
+	}
+}
+
+// WithLogger set logger of limiter, it's passed to store created by limiter as well
+// Denied events and store errors are logged at debug level, by default slog.Default() is used
+func WithLogger(logger *slog.Logger) LimiterOption {
+	return func(l *Limiter) {
+		l.logger = logger
+	}
+}
+
+// WithName set name of limiter, it's reported as policy of events
+func WithName(name string) LimiterOption {
+	return func(l *Limiter) {
+		l.name = name
+	}
+}
+
+// WithObserver set observer notified when a key gets limited, recovers or is reset and when store starts failing,
+// events are delivered asynchronously until limiter is closed
+func WithObserver(o ratelimit.Observer) LimiterOption {
+	return func(l *Limiter) {
+		l.observer = o
+	}
+}
+
+// WithErrorPolicy set how limiter handles event when store returns error
+// By default, store error is returned to caller
+func WithErrorPolicy(p ratelimit.ErrorPolicy) LimiterOption {
+	return func(l *Limiter) {
+		l.errPolicy = p
+	}
+}
+
+// WithErrorHandler set callback which is notified on every store error
+func WithErrorHandler(h ratelimit.ErrorHandler) LimiterOption {
+	return func(l *Limiter) {
+		l.errHandler = h
+	}
+}
+
+// WithFallbackScale set ratio of rate and bucket used by local limiter of ErrorPolicyFallback,
+// e.g. 0.25 for a service running 4 instances sharing the same store
+func WithFallbackScale(scale float64) LimiterOption {
+	return func(l *Limiter) {
+		l.fallbackScale = scale
+	}
+}
+
+// WithLimitProvider set provider resolving limits of keys, keys it has no limits for and keys whose limits
+// can not be resolved are limited by rate, period and bucket of limiter.
+// Keys are kept by store for a fixed ttl. Store created by limiter keeps them until a full bucket of the slowest
+// limits listed by a LimitsLister leaks, ttl of other providers must be set by WithStoreTTL. Store set by
+// WithStore should keep them as long, otherwise such keys are forgotten before their bucket is empty
+func WithLimitProvider(p LimitProvider) LimiterOption {
+	return func(l *Limiter) {
+		l.provider = p
+	}
+}
+
+// WithStoreTTL set how long store created by limiter keeps a key after its last event at least, by default
+// keys are kept until a full bucket of limiter leaks
+func WithStoreTTL(ttl time.Duration) LimiterOption {
+	return func(l *Limiter) {
+		l.storeTTL = ttl
+	}
+}
+
 func New(rate float64, period time.Duration, bucket int64, opts ...LimiterOption) *Limiter {
 	l := &Limiter{
-		rate:   rate,
-		period: period,
-		bucket: bucket,
+		fallbackScale: 1,
+		clock:         ratelimit.SystemClock,
+		logger:        slog.Default(),
 	}
+	l.limits.Store(&limits{rate: rate, period: period, bucket: bucket})
 	for _, opt := range opts {
 		opt(l)
 	}
 
 	if l.store == nil {
-		l.store = NewMemStore(period * time.Duration(int64(math.Ceil(float64(bucket)/rate))))
+		l.store = NewMemStore(l.storeTTLOf(l.limits.Load()), MemWithClock(l.clock), MemWithLogger(l.logger))
+		l.ownStore = true
+	}
+	if l.observer != nil {
+		l.notifier = ratelimit.NewNotifier(l.observer, ratelimit.NotifierWithClock(l.clock))
+	}
+	if l.errPolicy == ratelimit.ErrorPolicyFallback {
+		l.fallback = newFallback(rate, period, bucket, l.fallbackScale, WithClock(l.clock), WithLogger(l.logger),
+			WithStoreTTL(l.storeTTLOf(l.limits.Load())))
 	}
 
 	return l
 }
 
+// newFallback create local limiter with rate and bucket scaled down by scale
+func newFallback(rate float64, period time.Duration, bucket int64, scale float64,
+	opts ...LimiterOption) *Limiter {
+	c := (&limits{rate: rate, period: period, bucket: bucket}).scale(scale)
+	return New(c.rate, c.period, c.bucket, opts...)
+}
+
+func scaleLimits(rate float64, bucket int64, scale float64) (float64, int64) {
+	if scale <= 0 || scale > 1 {
+		scale = 1
+	}
+	fbBucket := int64(math.Floor(float64(bucket) * scale))
+	if fbBucket < 1 {
+		fbBucket = 1
+	}
+	return rate * scale, fbBucket
+}
+
+// Update changes rate, period and bucket of limiter while it's in use. Rate data of keys is kept,
+// so usage counted before update still fills bucket and leaks at the new rate from now on.
+// Store created by limiter keeps keys until a full bucket of new limits leaks, ttl of store set by
+// WithStore is left to caller
+func (l *Limiter) Update(rate float64, period time.Duration, bucket int64) error {
+	if rate <= 0 || period <= 0 || bucket <= 0 {
+		return errors.New("rate, period and bucket must be positive")
+	}
+
+	c := &limits{rate: rate, period: period, bucket: bucket}
+	if u, ok := l.store.(TTLUpdater); ok && l.ownStore {
+		u.UpdateTTL(l.storeTTLOf(c))
+	}
+	l.limits.Store(c)
+	if l.fallback != nil {
+		fb := c.scale(l.fallbackScale)
+		return l.fallback.Update(fb.rate, fb.period, fb.bucket)
+	}
+	return nil
+}
+
+// storeTTLOf returns ttl of store created by limiter with default limits c, it covers a full bucket of c and
+// of every limits listed by provider
+func (l *Limiter) storeTTLOf(c *limits) time.Duration {
+	ttl := max(c.storeTTL(), l.storeTTL)
+	if lister, ok := l.provider.(LimitsLister); ok {
+		for _, lim := range lister.ListLimits() {
+			if lim.valid() {
+				ttl = max(ttl, (&limits{rate: lim.Rate, period: lim.Period, bucket: lim.Bucket}).storeTTL())
+			}
+		}
+	}
+	return ttl
+}
+
+// limitsOf returns limits of key k
+func (l *Limiter) limitsOf(ctx context.Context, k string) *limits {
+	c := l.limits.Load()
+	if l.provider == nil {
+		return c
+	}
+	lim, ok, err := l.provider.Limits(ctx, k)
+	if err != nil {
+		l.logger.DebugContext(ctx, "limits of key are not resolved, default limits are used", ratelimit.LogKey(k),
+			slog.Any("error", err))
+		return c
+	}
+	if !ok {
+		return c
+	}
+	if !lim.valid() {
+		l.logger.DebugContext(ctx, "limits of key are invalid, default limits are used", ratelimit.LogKey(k),
+			slog.Float64("rate", lim.Rate), slog.Duration("period", lim.Period), slog.Int64("bucket", lim.Bucket))
+		return c
+	}
+	return &limits{rate: lim.Rate, period: lim.Period, bucket: lim.Bucket}
+}
+
+// Allow checks event of key k against limits of k, Reservation.Bucket is bucket size of k
 func (l *Limiter) Allow(ctx context.Context, k string, weight int64) (r *ratelimit.Reservation,
 	allowed bool, err error) {
-	now := time.Now()
+	return l.allow(ctx, k, weight, l.limitsOf(ctx, k))
+}
+
+func (l *Limiter) allow(ctx context.Context, k string, weight int64, c *limits) (r *ratelimit.Reservation,
+	allowed bool, err error) {
+	now := l.clock.Now()
 	reservation, err := l.store.Incr(ctx, k, weight, now,
 		func(remain float64, last time.Time, now time.Time, incr int64) (ratelimit.Reservation, error) {
 			if now.Before(last) {
 				return ratelimit.Reservation{
 					Req:       float64(incr),
-					Bucket:    l.bucket,
+					Bucket:    c.bucket,
 					TimeToAct: now,
 					Last:      now,
 				}, nil
 			}
 
-			currentLeak := remain - l.rate*float64(now.Sub(last))/float64(l.period)
+			currentLeak := remain - c.rate*float64(now.Sub(last))/float64(c.period)
 			// reset leak if it's less than zero
 			if currentLeak < 0 {
 				currentLeak = 0
 			}
 			currentLeak += float64(incr)
-			if currentLeak > float64(l.bucket) {
+			if currentLeak > float64(c.bucket) {
 				return ratelimit.Reservation{
-					Req:       float64(l.bucket),
-					Bucket:    l.bucket,
-					TimeToAct: now.Add(l.leakyToDuration(currentLeak - float64(l.bucket))),
+					Req:       float64(c.bucket),
+					Bucket:    c.bucket,
+					TimeToAct: now.Add(c.leakyToDuration(currentLeak - float64(c.bucket))),
 					Last:      last,
 				}, ratelimit.ErrLimitReached
 			}
 
 			return ratelimit.Reservation{
 				Req:       currentLeak,
-				Bucket:    l.bucket,
+				Bucket:    c.bucket,
 				TimeToAct: now,
 				Last:      now,
 			}, nil
 		})
 
+	if err != nil && err != ratelimit.ErrLimitReached {
+		return l.handleStoreErr(ctx, k, weight, c, now, err)
+	}
+	l.notifier.StoreRecovered()
+
+	if err == ratelimit.ErrLimitReached {
+		l.logger.DebugContext(ctx, "event denied", ratelimit.LogKey(k),
+			slog.Duration("delay", reservation.DelayFrom(now)))
+		l.notifier.Decision(l.name, k, &reservation, false)
+		return &reservation, false, nil
+	}
+
+	l.notifier.Decision(l.name, k, &reservation, true)
+	return &reservation, true, nil
+}
+
+// Peek checks event k with weight of weight against level of bucket of k leaked up to now without adding it,
+// store must implement ratelimit.Inspector. Store errors are returned regardless of error policy
+func (l *Limiter) Peek(ctx context.Context, k string, weight int64) (*ratelimit.Reservation, bool, error) {
+	inspector, ok := l.store.(ratelimit.Inspector)
+	if !ok {
+		return nil, false, ratelimit.ErrPeekNotSupported
+	}
+	c := l.limitsOf(ctx, k)
+	now := l.clock.Now()
+	state, ok, err := inspector.State(ctx, k)
 	if err != nil {
-		if err == ratelimit.ErrLimitReached {
-			return &reservation, false, nil
+		return nil, false, err
+	}
+
+	var level float64
+	if ok {
+		level = state.Value
+		if state.Last != nil && now.After(*state.Last) {
+			level = max(0, level-c.rate*float64(now.Sub(*state.Last))/float64(c.period))
 		}
+	}
+	r := &ratelimit.Reservation{Req: level, Bucket: c.bucket, TimeToAct: now, Last: now}
+	if over := level + float64(weight) - float64(c.bucket); over > 0 {
+		r.TimeToAct = now.Add(c.leakyToDuration(over))
+		return r, false, nil
+	}
+	return r, true, nil
+}
 
-		return nil, false, err
+// handleStoreErr resolve result of event k when store fails by configured error policy
+func (l *Limiter) handleStoreErr(ctx context.Context, k string, weight int64, c *limits, now time.Time,
+	err error) (*ratelimit.Reservation, bool, error) {
+	if l.errHandler != nil {
+		l.errHandler(ctx, k, err)
 	}
+	l.notifier.StoreFailed(l.name, k, err)
+	l.logger.DebugContext(ctx, "store failed, event is resolved by error policy", ratelimit.LogKey(k),
+		slog.String("error_policy", l.errPolicy.String()), slog.Any("error", err))
 
-	return &reservation, true, nil
+	switch l.errPolicy {
+	case ratelimit.ErrorPolicyFailOpen:
+		return &ratelimit.Reservation{
+			Req:       0,
+			Bucket:    c.bucket,
+			TimeToAct: now,
+			Last:      now,
+		}, true, nil
+	case ratelimit.ErrorPolicyFailClosed:
+		return &ratelimit.Reservation{
+			Req:       float64(c.bucket),
+			Bucket:    c.bucket,
+			TimeToAct: now.Add(c.leakyToDuration(float64(weight))),
+			Last:      now,
+		}, false, nil
+	case ratelimit.ErrorPolicyFallback:
+		if l.fallback != nil {
+			return l.fallback.allow(ctx, k, weight, c.scale(l.fallbackScale))
+		}
+	}
+
+	return nil, false, err
 }
 
 func (l *Limiter) Reset(ctx context.Context, k string, value int64) error {
-	return l.store.Reset(ctx, k, value)
+	if err := l.store.Reset(ctx, k, value); err != nil {
+		return err
+	}
+	l.notifier.Reset(l.name, k)
+	return nil
 }
 
-func (l *Limiter) leakyToDuration(f float64) time.Duration {
-	return time.Duration(int64(f / l.rate * float64(l.period)))
+// Close releases store created by limiter and local fallback limiter, store set by WithStore is left open
+func (l *Limiter) Close() error {
+	var err error
+	if closer, ok := l.store.(io.Closer); ok && l.ownStore {
+		err = closer.Close()
+	}
+	if l.fallback != nil {
+		err = errors.Join(err, l.fallback.Close())
+	}
+	return errors.Join(err, l.notifier.Close())
 }
 
 func (l *Limiter) Valid() error {
-	if l.rate <= 0 {
+	c := l.limits.Load()
+	if c.rate <= 0 {
 		return errors.New("missing rate limit config")
 	}
-	if rate := int64(l.rate); rate > l.bucket {
+	if rate := int64(c.rate); rate > c.bucket {
 		return errors.New("invalid bucket size")
 	}
 	if l.store == nil {
@@ -0,0 +1,285 @@
+package leakybucket
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errStoreDown = errors.New("store is down")
+
+type failedStore struct{}
+
+func (s failedStore) Incr(ctx context.Context, key string, value int64, now time.Time,
+	handler RateFunc) (ratelimit.Reservation, error) {
+	return ratelimit.Reservation{}, errStoreDown
+}
+
+func (s failedStore) Reset(ctx context.Context, key string, value int64) error {
+	return errStoreDown
+}
+
+func TestLimiter_Allow_Error_Policy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      ratelimit.ErrorPolicy
+		wantAllowed []bool
+		wantErr     error
+	}{
+		{name: "propagate", policy: ratelimit.ErrorPolicyPropagate, wantAllowed: []bool{false}, wantErr: errStoreDown},
+		{name: "fail open", policy: ratelimit.ErrorPolicyFailOpen, wantAllowed: []bool{true, true, true, true, true}},
+		{name: "fail closed", policy: ratelimit.ErrorPolicyFailClosed, wantAllowed: []bool{false}},
+		// local limiter has half of bucket size
+		{name: "fallback", policy: ratelimit.ErrorPolicyFallback, wantAllowed: []bool{true, true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var notified []error
+			l := New(1, time.Minute, 4, WithStore(failedStore{}), WithErrorPolicy(tt.policy),
+				WithFallbackScale(0.5),
+				WithErrorHandler(func(ctx context.Context, k string, err error) {
+					notified = append(notified, err)
+				}))
+
+			for i, want := range tt.wantAllowed {
+				r, allowed, err := l.Allow(context.Background(), "k1", 1)
+				if tt.wantErr != nil {
+					assert.ErrorIs(t, err, tt.wantErr)
+					assert.Nil(t, r)
+					continue
+				}
+				require.Nil(t, err)
+				require.NotNil(t, r)
+				assert.Equal(t, want, allowed, "event %d", i)
+				assert.Equal(t, allowed, r.Delay() == 0)
+			}
+			assert.Len(t, notified, len(tt.wantAllowed))
+		})
+	}
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	// leak 1 event every 10 seconds
+	l := New(1, 10*time.Second, 2, WithClock(clock))
+	defer l.Close()
+
+	for i := 0; i < 2; i++ {
+		_, allowed, err := l.Allow(context.Background(), "k1", 1)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	r, allowed, err := l.Allow(context.Background(), "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 10*time.Second, r.DelayFrom(clock.Now()))
+
+	clock.Advance(5 * time.Second)
+	r, allowed, _ = l.Allow(context.Background(), "k1", 1)
+	assert.False(t, allowed)
+	assert.Equal(t, 5*time.Second, r.DelayFrom(clock.Now()))
+
+	clock.Advance(5 * time.Second)
+	r, allowed, _ = l.Allow(context.Background(), "k1", 1)
+	assert.True(t, allowed)
+	assert.Equal(t, float64(2), r.Req)
+}
+
+// lastlessStore reports level of keys without time of last event
+type lastlessStore struct {
+	failedStore
+	level float64
+}
+
+func (s lastlessStore) Keys(ctx context.Context, cursor string, limit int) (ratelimit.KeyPage, error) {
+	return ratelimit.KeyPage{}, nil
+}
+
+func (s lastlessStore) State(ctx context.Context, key string) (ratelimit.KeyState, bool, error) {
+	return ratelimit.KeyState{Key: key, Value: s.level}, true, nil
+}
+
+func TestLimiter_Peek(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	l := New(1, 10*time.Second, 2, WithClock(clock))
+	defer l.Close()
+
+	_, _, err := l.Allow(context.Background(), "k1", 2)
+	require.Nil(t, err)
+	clock.Advance(5 * time.Second)
+	r, allowed, err := l.Peek(context.Background(), "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 1.5, r.Req)
+	assert.Equal(t, 5*time.Second, r.DelayFrom(clock.Now()))
+
+	// level of a key without time of last event is not leaked
+	l = New(1, 10*time.Second, 2, WithClock(clock), WithStore(lastlessStore{level: 1}))
+	r, allowed, err = l.Peek(context.Background(), "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, float64(1), r.Req)
+}
+
+func TestLimiter_Update(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	l := New(1, 10*time.Second, 2, WithClock(clock))
+	defer l.Close()
+
+	for i := 0; i < 2; i++ {
+		_, allowed, err := l.Allow(context.Background(), "k1", 1)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+	}
+
+	// level of bucket is kept and leaks at the new rate
+	require.Nil(t, l.Update(2, 10*time.Second, 3))
+	r, allowed, _ := l.Allow(context.Background(), "k1", 1)
+	assert.True(t, allowed)
+	assert.Equal(t, float64(3), r.Req)
+	assert.Equal(t, int64(3), r.Bucket)
+
+	r, allowed, _ = l.Allow(context.Background(), "k1", 1)
+	assert.False(t, allowed)
+	assert.Equal(t, 5*time.Second, r.DelayFrom(clock.Now()))
+
+	clock.Advance(5 * time.Second)
+	_, allowed, _ = l.Allow(context.Background(), "k1", 1)
+	assert.True(t, allowed)
+
+	assert.NotNil(t, l.Update(0, 10*time.Second, 3))
+}
+
+func TestLimiter_Update_Concurrent(t *testing.T) {
+	l := New(100, time.Second, 100, WithErrorPolicy(ratelimit.ErrorPolicyFallback))
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r, _, err := l.Allow(context.Background(), "k1", 1)
+				assert.Nil(t, err)
+				assert.Contains(t, []int64{100, 200}, r.Bucket)
+			}
+		}()
+	}
+	for i := 0; i < 50; i++ {
+		n := int64(100 + 100*(i%2))
+		require.Nil(t, l.Update(float64(n), time.Second, n))
+	}
+	wg.Wait()
+}
+
+func TestLimiter_LimitProvider(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	tiers := &Tiers{
+		ByTier: map[string]Limits{
+			"pro":    {Rate: 2, Period: 10 * time.Second, Bucket: 4},
+			"broken": {Rate: 0, Period: 10 * time.Second, Bucket: 4},
+		},
+		TierOf: func(ctx context.Context, key string) (string, error) {
+			if key == "down" {
+				return "", errStoreDown
+			}
+			return key, nil
+		},
+	}
+	l := New(1, 10*time.Second, 1, WithClock(clock), WithLimitProvider(tiers))
+	defer l.Close()
+
+	tests := []struct {
+		key        string
+		wantBucket int64
+	}{
+		{key: "pro", wantBucket: 4},
+		{key: "free", wantBucket: 1},
+		{key: "broken", wantBucket: 1},
+		{key: "down", wantBucket: 1},
+	}
+	for _, tt := range tests {
+		for i := int64(0); i < tt.wantBucket; i++ {
+			r, allowed, err := l.Allow(context.Background(), tt.key, 1)
+			require.Nil(t, err)
+			assert.True(t, allowed, tt.key)
+			assert.Equal(t, tt.wantBucket, r.Bucket, tt.key)
+		}
+		r, allowed, _ := l.Allow(context.Background(), tt.key, 1)
+		assert.False(t, allowed, tt.key)
+		assert.Equal(t, tt.wantBucket, r.Bucket, tt.key)
+	}
+
+	// pro leaks 2 events every 10 seconds
+	clock.Advance(5 * time.Second)
+	_, allowed, _ := l.Allow(context.Background(), "pro", 1)
+	assert.True(t, allowed)
+}
+
+func TestLimiter_LimitProvider_StoreTTL(t *testing.T) {
+	slow := Limits{Rate: 1, Period: time.Minute, Bucket: 5}
+	tests := []struct {
+		name string
+		opts []LimiterOption
+	}{
+		{
+			name: "listed limits",
+			opts: []LimiterOption{WithLimitProvider(&Tiers{
+				ByTier: map[string]Limits{"slow": slow},
+				TierOf: func(ctx context.Context, key string) (string, error) { return key, nil },
+			})},
+		},
+		{
+			name: "store ttl",
+			opts: []LimiterOption{WithStoreTTL(5 * time.Minute), WithLimitProvider(LimitProviderFunc(
+				func(ctx context.Context, key string) (Limits, bool, error) { return slow, key == "slow", nil }))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+			l := New(1, time.Second, 1, append(tt.opts, WithClock(clock))...)
+			defer l.Close()
+
+			for i := 0; i < 5; i++ {
+				_, allowed, err := l.Allow(ctx, "slow", 1)
+				require.Nil(t, err)
+				require.True(t, allowed)
+			}
+
+			// key outlives ttl of default limits, so it's not swept before its bucket leaks
+			clock.Advance(2 * time.Minute)
+			l.store.(*InMemStore).sweep()
+			for i := 0; i < 2; i++ {
+				_, allowed, _ := l.Allow(ctx, "slow", 1)
+				assert.True(t, allowed)
+			}
+			_, allowed, _ := l.Allow(ctx, "slow", 1)
+			assert.False(t, allowed)
+		})
+	}
+}
+
+func TestLimiter_LimitProvider_Fallback(t *testing.T) {
+	l := New(1, time.Minute, 2, WithStore(failedStore{}), WithErrorPolicy(ratelimit.ErrorPolicyFallback),
+		WithFallbackScale(0.5), WithLimitProvider(StaticLimits{"pro": {Rate: 1, Period: time.Minute, Bucket: 8}}))
+	defer l.Close()
+
+	for i := 0; i < 4; i++ {
+		r, allowed, err := l.Allow(context.Background(), "pro", 1)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, int64(4), r.Bucket)
+	}
+	_, allowed, _ := l.Allow(context.Background(), "pro", 1)
+	assert.False(t, allowed)
+}
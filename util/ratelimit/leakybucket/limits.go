@@ -0,0 +1,151 @@
+package leakybucket
+
+import (
+	"context"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/internal/keytable"
+	"time"
+)
+
+var defaultCacheMaxKeys = 10000
+
+// Limits is rate limit of a key, bucket of Bucket events leaks Rate events per Period
+type Limits struct {
+	Rate   float64       `json:"rate"`
+	Period time.Duration `json:"period"`
+	Bucket int64         `json:"bucket"`
+}
+
+func (l Limits) valid() bool {
+	return l.Rate > 0 && l.Period > 0 && l.Bucket > 0
+}
+
+// LimitProvider resolves limits of keys, e.g. by plan of customer owning the key
+type LimitProvider interface {
+	// Limits returns limits of key, ok is false if key is limited by default limits of limiter
+	Limits(ctx context.Context, key string) (limits Limits, ok bool, err error)
+}
+
+// LimitsLister is implemented by providers knowing every limits they resolve, so store created by limiter keeps
+// keys until a full bucket of the slowest of them leaks
+type LimitsLister interface {
+	ListLimits() []Limits
+}
+
+// LimitProviderFunc is a function resolving limits of keys
+type LimitProviderFunc func(ctx context.Context, key string) (Limits, bool, error)
+
+func (f LimitProviderFunc) Limits(ctx context.Context, key string) (Limits, bool, error) {
+	return f(ctx, key)
+}
+
+// StaticLimits maps keys to their limits, keys missing from the map have default limits
+type StaticLimits map[string]Limits
+
+func (s StaticLimits) Limits(ctx context.Context, key string) (Limits, bool, error) {
+	l, ok := s[key]
+	return l, ok, nil
+}
+
+func (s StaticLimits) ListLimits() []Limits {
+	list := make([]Limits, 0, len(s))
+	for _, l := range s {
+		list = append(list, l)
+	}
+	return list
+}
+
+// Tiers resolves limits of key by its tier, e.g. free, pro or enterprise plan
+type Tiers struct {
+	// ByTier maps name of tier to its limits, keys of a tier missing from the map have default limits
+	ByTier map[string]Limits
+	// TierOf returns name of tier of key
+	TierOf func(ctx context.Context, key string) (string, error)
+}
+
+func (t *Tiers) Limits(ctx context.Context, key string) (Limits, bool, error) {
+	tier, err := t.TierOf(ctx, key)
+	if err != nil {
+		return Limits{}, false, err
+	}
+	l, ok := t.ByTier[tier]
+	return l, ok, nil
+}
+
+func (t *Tiers) ListLimits() []Limits {
+	return StaticLimits(t.ByTier).ListLimits()
+}
+
+type CacheOption func(c *CachedLimits)
+
+// CacheWithClock set clock used to expire cached limits
+func CacheWithClock(clock ratelimit.Clock) CacheOption {
+	return func(c *CachedLimits) {
+		c.clock = clock
+	}
+}
+
+// CacheWithMaxKeys bounds number of cached keys, least recently used key is evicted once there are more than
+// n keys, 10000 by default
+func CacheWithMaxKeys(n int) CacheOption {
+	return func(c *CachedLimits) {
+		c.maxKeys = n
+	}
+}
+
+type cachedLimits struct {
+	limits Limits
+	ok     bool
+	expire time.Time
+}
+
+// CachedLimits caches limits resolved by a slow provider, e.g. a database lookup, for ttl.
+// Errors of provider are not cached so lookup is retried by the next event of key
+type CachedLimits struct {
+	provider LimitProvider
+	ttl      time.Duration
+	clock    ratelimit.Clock
+	maxKeys  int
+	cache    *keytable.Table[cachedLimits]
+}
+
+func NewCachedLimits(p LimitProvider, ttl time.Duration, opts ...CacheOption) *CachedLimits {
+	c := &CachedLimits{
+		provider: p,
+		ttl:      ttl,
+		clock:    ratelimit.SystemClock,
+		maxKeys:  defaultCacheMaxKeys,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.cache = keytable.New(keytable.Options[cachedLimits]{MaxKeys: c.maxKeys, Eviction: ratelimit.EvictionLRU})
+	return c
+}
+
+func (c *CachedLimits) Limits(ctx context.Context, key string) (Limits, bool, error) {
+	now := c.clock.Now()
+	if v, ok := c.cache.Load(key); ok && now.Before(v.expire) {
+		return v.limits, v.ok, nil
+	}
+
+	l, ok, err := c.provider.Limits(ctx, key)
+	if err != nil {
+		return l, ok, err
+	}
+	c.cache.Store(key, &cachedLimits{limits: l, ok: ok, expire: now.Add(c.ttl)})
+	return l, ok, nil
+}
+
+// ListLimits returns limits listed by cached provider, it's nil if provider is not a LimitsLister
+func (c *CachedLimits) ListLimits() []Limits {
+	if lister, ok := c.provider.(LimitsLister); ok {
+		return lister.ListLimits()
+	}
+	return nil
+}
+
+// Invalidate drops cached limits of key, e.g. when plan of customer changes
+func (c *CachedLimits) Invalidate(key string) {
+	c.cache.Delete(key)
+}
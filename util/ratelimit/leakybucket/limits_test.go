@@ -0,0 +1,60 @@
+package leakybucket
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit/clocktest"
+	"testing"
+	"time"
+)
+
+func TestCachedLimits(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	pro := Limits{Rate: 10, Period: time.Second, Bucket: 20}
+	var lookups int
+	var fail bool
+	c := NewCachedLimits(LimitProviderFunc(func(ctx context.Context, key string) (Limits, bool, error) {
+		lookups++
+		if fail {
+			return Limits{}, false, errStoreDown
+		}
+		if key == "pro" {
+			return pro, true, nil
+		}
+		return Limits{}, false, nil
+	}), time.Minute, CacheWithClock(clock), CacheWithMaxKeys(2))
+
+	for i := 0; i < 3; i++ {
+		l, ok, err := c.Limits(context.Background(), "pro")
+		require.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, pro, l)
+		// keys without limits are cached as well
+		_, ok, err = c.Limits(context.Background(), "free")
+		require.Nil(t, err)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, 2, lookups)
+
+	c.Invalidate("pro")
+	_, _, _ = c.Limits(context.Background(), "pro")
+	assert.Equal(t, 3, lookups)
+
+	// errors are not cached
+	clock.Advance(time.Minute)
+	fail = true
+	_, _, err := c.Limits(context.Background(), "pro")
+	assert.ErrorIs(t, err, errStoreDown)
+	fail = false
+	_, ok, err := c.Limits(context.Background(), "pro")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 5, lookups)
+
+	// least recently used key is evicted
+	_, _, _ = c.Limits(context.Background(), "k3")
+	_, _, _ = c.Limits(context.Background(), "pro")
+	assert.Equal(t, 6, lookups)
+	assert.Equal(t, int64(2), c.cache.Len())
+}
@@ -2,10 +2,13 @@ package leakybucket
 
 import (
 	"context"
-	"errors"
-	"fmt"
+	"log/slog"
 	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/internal/evict"
+	"ratelimit/util/ratelimit/internal/keytable"
+	"ratelimit/util/ratelimit/internal/memstore"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,44 +18,124 @@ type memRateData struct {
 }
 
 type InMemStore struct {
-	mMap sync.Map
-	ttl  time.Duration
+	mMap *keytable.Table[memRateData]
+	// ttl is how long a key is kept after its last update, it's changed by UpdateTTL
+	ttl atomic.Int64
+
+	// ghosts keeps rate data of evicted keys if EvictedKeyRestore policy is used
+	ghosts   *evict.Ghosts[RateData]
+	restores atomic.Uint64
+
+	clock   ratelimit.Clock
+	logger  *slog.Logger
+	sweeper *memstore.Sweeper
 }
 
-func NewMemStore(maxTTL time.Duration) *InMemStore {
+func NewMemStore(maxTTL time.Duration, opts ...MemStoreOption) *InMemStore {
+	o := memstore.NewOptions(maxTTL, opts...)
 	m := &InMemStore{
-		ttl: maxTTL,
+		clock:  o.Clock,
+		logger: o.Logger,
 	}
-	go func() {
-		for {
-			time.Sleep(m.ttl)
-			m.mMap.Range(func(key, value interface{}) bool {
-				rData, ok := value.(*memRateData)
-				if !ok {
-					log.Errorw("malformed rate data", "context", fmt.Sprintf("key: %v", key))
-					m.mMap.Delete(key)
-					return true
-				}
-				rData.lock.Lock()
-				last := time.Unix(rData.LastSec, rData.LastNSec)
-				if time.Since(last) > m.ttl {
-					m.mMap.Delete(key)
-				}
-				rData.lock.Unlock()
-				return true
-			})
-		}
-	}()
+	m.ttl.Store(int64(maxTTL))
+	tableOpts := keytable.Options[memRateData]{
+		MaxKeys:  o.MaxKeys,
+		Eviction: o.Eviction,
+		Shards:   o.Shards,
+		New:      m.newRateData,
+	}
+	if o.MaxKeys > 0 && o.EvictedKeys == ratelimit.EvictedKeyRestore {
+		m.ghosts = evict.NewGhosts[RateData](o.MaxKeys)
+		tableOpts.OnEvict = m.rememberEvicted
+	}
+	m.mMap = keytable.New(tableOpts)
+	m.sweeper = memstore.NewSweeper(o, m.sweep)
 	return m
 }
 
-func (m *InMemStore) Incr(ctx context.Context, key string, value int64, now time.Time,
-	handler RateFunc) (ratelimit.Reservation, error) {
-	data, _ := m.mMap.LoadOrStore(key, &memRateData{})
-	rData, ok := data.(*memRateData)
+// sweep removes keys which are not updated for more than ttl
+func (m *InMemStore) sweep() {
+	now := m.clock.Now()
+	ttl := time.Duration(m.ttl.Load())
+	m.mMap.Range(func(key string, rData *memRateData) bool {
+		rData.lock.Lock()
+		last := time.Unix(rData.LastSec, rData.LastNSec)
+		if now.Sub(last) > ttl {
+			m.mMap.Delete(key)
+			m.logger.Debug("swept expired key", ratelimit.LogKey(key))
+		}
+		rData.lock.Unlock()
+		return true
+	})
+}
+
+func (m *InMemStore) rememberEvicted(key string, rData *memRateData) {
+	rData.lock.Lock()
+	data := rData.RateData
+	rData.lock.Unlock()
+	m.ghosts.Put(key, data)
+}
+
+// newRateData create rate data of new key, it's restored if key has been evicted recently
+func (m *InMemStore) newRateData(key string) *memRateData {
+	if m.ghosts != nil {
+		if data, ok := m.ghosts.Take(key); ok {
+			m.restores.Add(1)
+			return &memRateData{RateData: data}
+		}
+	}
+	return &memRateData{}
+}
+
+// Stats returns number of keys and evictions of store
+func (m *InMemStore) Stats() ratelimit.StoreStats {
+	return ratelimit.StoreStats{
+		Keys:      m.mMap.Len(),
+		Evictions: m.mMap.Evictions(),
+		Restores:  m.restores.Load(),
+	}
+}
+
+// Keys lists keys updated within ttl in sorted order, cursor is last key of previous page
+func (m *InMemStore) Keys(ctx context.Context, cursor string, limit int) (ratelimit.KeyPage, error) {
+	now := m.clock.Now()
+	keys, more := m.mMap.Page(cursor, limit)
+	page := ratelimit.KeyPage{Keys: make([]ratelimit.KeyState, 0, len(keys))}
+	for _, key := range keys {
+		if state, ok := m.state(key, now); ok {
+			page.Keys = append(page.Keys, state)
+		}
+	}
+	if more {
+		page.Next = keys[len(keys)-1]
+	}
+	return page, nil
+}
+
+// State returns rate data of key if it's updated within ttl
+func (m *InMemStore) State(ctx context.Context, key string) (ratelimit.KeyState, bool, error) {
+	state, ok := m.state(key, m.clock.Now())
+	return state, ok, nil
+}
+
+func (m *InMemStore) state(key string, now time.Time) (ratelimit.KeyState, bool) {
+	rData, ok := m.mMap.Load(key)
 	if !ok {
-		return ratelimit.Reservation{}, errors.New("malformed data")
+		return ratelimit.KeyState{}, false
 	}
+	rData.lock.Lock()
+	data := rData.RateData
+	rData.lock.Unlock()
+	last := time.Unix(data.LastSec, data.LastNSec)
+	if now.Sub(last) > time.Duration(m.ttl.Load()) {
+		return ratelimit.KeyState{}, false
+	}
+	return ratelimit.KeyState{Key: key, Value: data.Remain, Last: &last}, true
+}
+
+func (m *InMemStore) Incr(ctx context.Context, key string, value int64, now time.Time,
+	handler RateFunc) (ratelimit.Reservation, error) {
+	rData := m.mMap.LoadOrCreate(key)
 
 	rData.lock.Lock()
 	r, err := handler(rData.Remain, time.Unix(rData.LastSec, rData.LastNSec), now, value)
@@ -66,13 +149,16 @@ func (m *InMemStore) Incr(ctx context.Context, key string, value int64, now time
 	rData.lock.Unlock()
 
 	// set again to avoid race condition with sweep routine
-	m.mMap.LoadOrStore(key, rData)
+	m.mMap.Keep(key, rData)
 
 	return r, nil
 }
 
 func (m *InMemStore) Reset(ctx context.Context, key string, value int64) error {
-	now := time.Now()
+	if m.ghosts != nil {
+		m.ghosts.Take(key)
+	}
+	now := m.clock.Now()
 	m.mMap.Store(key, &memRateData{
 		RateData: RateData{
 			Remain:   float64(value),
@@ -82,3 +168,44 @@ func (m *InMemStore) Reset(ctx context.Context, key string, value int64) error {
 	})
 	return nil
 }
+
+// take swaps level of key to zero and returns level and time of last event it had, so usage of a fallback store
+// is handed over to redis once while events counted meanwhile are kept for the next merge
+func (m *InMemStore) take(key string) (float64, time.Time, bool) {
+	rData, ok := m.mMap.Load(key)
+	if !ok {
+		return 0, time.Time{}, false
+	}
+	rData.lock.Lock()
+	defer rData.lock.Unlock()
+	remain := rData.Remain
+	rData.Remain = 0
+	return remain, time.Unix(rData.LastSec, rData.LastNSec), true
+}
+
+// putBack adds level taken by take, leaked up to now, back to bucket of key leaked up to now by rate
+func (m *InMemStore) putBack(key string, level float64, now time.Time, rate RateFunc) {
+	rData := m.mMap.LoadOrCreate(key)
+	rData.lock.Lock()
+	last := time.Unix(rData.LastSec, rData.LastNSec)
+	cur, _ := leakTo(rate, rData.Remain, last, now)
+	rData.Remain = cur + level
+	if now.After(last) {
+		rData.LastSec = now.Unix()
+		rData.LastNSec = int64(now.Nanosecond())
+	}
+	rData.lock.Unlock()
+
+	// set again to avoid race condition with sweep routine
+	m.mMap.Keep(key, rData)
+}
+
+// Close stops sweeper and waits for it to exit, store keeps working without expiring keys
+func (m *InMemStore) Close() error {
+	return m.sweeper.Close()
+}
+
+// UpdateTTL changes how long a key is kept after its last update
+func (m *InMemStore) UpdateTTL(ttl time.Duration) {
+	m.ttl.Store(int64(ttl))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 	"math"
 	"math/rand"
 	"ratelimit/util/ratelimit"
@@ -14,6 +15,7 @@ import (
 
 func TestInMemStore_Incr(t *testing.T) {
 	mstore := NewMemStore(time.Second * 5)
+	defer mstore.Close()
 
 	bucketSize := int64(5)
 	handleRateFunc := func(remain float64, last time.Time, _ time.Time, _ int64) (ratelimit.Reservation, error) {
@@ -37,14 +39,12 @@ func TestInMemStore_Incr(t *testing.T) {
 	}
 
 	mstore.Incr(context.Background(), "k1", 1, time.Now(), handleRateFunc)
-	data, _ := mstore.mMap.Load("k1")
-	rData := data.(*memRateData)
+	rData, _ := mstore.mMap.Load("k1")
 	assert.Equal(t, float64(1), rData.Remain)
 
 	_, err := mstore.Incr(context.Background(), "k1", 1, time.Now(), handleRateFunc)
 	require.Nil(t, err)
-	data, _ = mstore.mMap.Load("k1")
-	rData = data.(*memRateData)
+	rData, _ = mstore.mMap.Load("k1")
 	assert.Equal(t, float64(2), rData.Remain)
 
 	// test with multi routine
@@ -58,21 +58,28 @@ func TestInMemStore_Incr(t *testing.T) {
 	}
 	wg.Wait()
 
-	data, _ = mstore.mMap.Load("k1")
-	rData = data.(*memRateData)
+	rData, _ = mstore.mMap.Load("k1")
 	assert.Equal(t, float64(2), rData.Remain)
 
 	err = mstore.Reset(context.Background(), "k1", 15)
 	require.Nil(t, err)
-	data, _ = mstore.mMap.Load("k1")
-	rData = data.(*memRateData)
+	rData, _ = mstore.mMap.Load("k1")
 	assert.Equal(t, float64(15), rData.Remain)
 
 	time.Sleep(time.Second * 1)
 }
 
 func BenchmarkInMemStore_Incr(b *testing.B) {
-	mstore := NewMemStore(time.Minute)
+	b.Run("sync map", func(b *testing.B) {
+		benchmarkInMemStoreIncr(b, NewMemStore(time.Minute))
+	})
+	b.Run("sharded", func(b *testing.B) {
+		benchmarkInMemStoreIncr(b, NewMemStore(time.Minute, MemWithShards(64)))
+	})
+}
+
+func benchmarkInMemStoreIncr(b *testing.B, mstore *InMemStore) {
+	defer mstore.Close()
 
 	bucketSize := int64(50)
 	handleRateFunc := func(remain float64, last time.Time, now time.Time, _ int64) (ratelimit.Reservation, error) {
@@ -97,6 +104,7 @@ func BenchmarkInMemStore_Incr(b *testing.B) {
 
 	keyList := [...]string{"k1", "k2", "k3", "k4", "k5", "k6"}
 
+	b.ReportAllocs()
 	b.ResetTimer()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
@@ -104,3 +112,65 @@ func BenchmarkInMemStore_Incr(b *testing.B) {
 		}
 	})
 }
+
+func TestInMemStore_Close(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mstore := NewMemStore(time.Hour, MemWithContext(ctx))
+	cancel()
+	<-mstore.sweeper.Done()
+	require.Nil(t, mstore.Close())
+
+	mstore = NewMemStore(20*time.Millisecond, MemWithSweepInterval(5*time.Millisecond))
+	_, err := mstore.Incr(context.Background(), "k1", 1, time.Now(),
+		func(remain float64, last time.Time, now time.Time, incr int64) (ratelimit.Reservation, error) {
+			return ratelimit.Reservation{Req: remain + float64(incr), Last: now}, nil
+		})
+	require.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := mstore.mMap.Load("k1")
+		return !ok
+	}, time.Second, 5*time.Millisecond)
+	require.Nil(t, mstore.Close())
+	// close is idempotent
+	require.Nil(t, mstore.Close())
+
+	l := New(1, time.Second, 1, WithErrorPolicy(ratelimit.ErrorPolicyFallback))
+	require.Nil(t, l.Close())
+}
+
+func TestInMemStore_MaxKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		evictedKeys ratelimit.EvictedKeyPolicy
+		wantRemain  float64
+		wantRestore uint64
+	}{
+		{name: "fresh", evictedKeys: ratelimit.EvictedKeyFresh, wantRemain: 1},
+		{name: "restore", evictedKeys: ratelimit.EvictedKeyRestore, wantRemain: 2, wantRestore: 1},
+	}
+
+	handleRateFunc := func(remain float64, last time.Time, now time.Time, incr int64) (ratelimit.Reservation, error) {
+		return ratelimit.Reservation{Req: remain + float64(incr), Last: now}, nil
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mstore := NewMemStore(time.Minute, MemWithMaxKeys(2, ratelimit.EvictionCLOCK),
+				MemWithEvictedKeyPolicy(tt.evictedKeys))
+			defer mstore.Close()
+
+			for _, k := range []string{"k1", "k2", "k2", "k3"} {
+				_, err := mstore.Incr(context.Background(), k, 1, time.Now(), handleRateFunc)
+				require.Nil(t, err)
+			}
+			_, ok := mstore.mMap.Load("k1")
+			assert.False(t, ok)
+
+			r, err := mstore.Incr(context.Background(), "k1", 1, time.Now(), handleRateFunc)
+			require.Nil(t, err)
+			assert.Equal(t, tt.wantRemain, r.Req)
+			assert.Equal(t, ratelimit.StoreStats{Keys: 2, Evictions: 2, Restores: tt.wantRestore}, mstore.Stats())
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package leakybucket
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// fallbackUsage marks a key counted on fallback store which has not been merged to redis yet, rate is handler of
+// its last event which leaks bucket of key by its limits
+type fallbackUsage struct {
+	Last time.Time
+	rate RateFunc
+}
+
+// fallbackLedger records usage counted on fallback store while redis is unavailable
+type fallbackLedger struct {
+	lock sync.Mutex
+	keys map[string]fallbackUsage
+	// size is number of keys, used to check ledger without locking
+	size atomic.Int64
+}
+
+func newFallbackLedger() *fallbackLedger {
+	return &fallbackLedger{
+		keys: make(map[string]fallbackUsage),
+	}
+}
+
+func (l *fallbackLedger) add(key string, rate RateFunc, now time.Time) {
+	l.lock.Lock()
+	u, ok := l.keys[key]
+	if !ok {
+		l.size.Add(1)
+	}
+	if !now.Before(u.Last) {
+		u.Last = now
+		u.rate = rate
+	}
+	l.keys[key] = u
+	l.lock.Unlock()
+}
+
+// take removes all recorded usage from ledger
+func (l *fallbackLedger) take() map[string]fallbackUsage {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.keys) == 0 {
+		return nil
+	}
+	keys := l.keys
+	l.keys = make(map[string]fallbackUsage)
+	l.size.Store(0)
+	return keys
+}
+
+// putBack merges usage taken from ledger back
+func (l *fallbackLedger) putBack(keys map[string]fallbackUsage) {
+	for key, u := range keys {
+		l.add(key, u.rate, u.Last)
+	}
+}
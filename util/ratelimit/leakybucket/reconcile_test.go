@@ -0,0 +1,29 @@
+package leakybucket
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFallbackLedger(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newFallbackLedger()
+	l.add("k1", countRateFunc, now)
+	l.add("k1", countRateFunc, now.Add(time.Second))
+	l.add("k2", countRateFunc, now)
+	assert.Equal(t, int64(2), l.size.Load())
+
+	pending := l.take()
+	assert.Len(t, pending, 2)
+	assert.Equal(t, now.Add(time.Second), pending["k1"].Last)
+	assert.Equal(t, now, pending["k2"].Last)
+	assert.NotNil(t, pending["k1"].rate)
+	assert.Equal(t, int64(0), l.size.Load())
+	assert.Nil(t, l.take())
+
+	l.add("k1", countRateFunc, now.Add(2*time.Second))
+	l.putBack(pending)
+	assert.Equal(t, now.Add(2*time.Second), l.keys["k1"].Last)
+	assert.Equal(t, int64(2), l.size.Load())
+}
@@ -2,9 +2,16 @@ package leakybucket
 
 import (
 	"context"
+	"fmt"
 	goredis "github.com/go-redis/redis/v7"
+	"log/slog"
+	"math"
 	"ratelimit/driver/redis"
 	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/circuitbreaker"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,26 +22,102 @@ var (
 type RedisStore struct {
 	client        *redis.McRedis
 	fallbackInMem *InMemStore
-	ttl           time.Duration
-	numRetry      int
+	// ttl is how long a key is kept after its last update, it's changed by UpdateTTL
+	ttl        atomic.Int64
+	numRetry   int
+	breaker    *circuitbreaker.Breaker
+	errHandler ratelimit.ErrorHandler
+	clock      ratelimit.Clock
+	logger     *slog.Logger
+	notifier   *ratelimit.Notifier
+
+	// usage counted on fallback store, merged back to redis once it's healthy
+	ledger      *fallbackLedger
+	reconciling atomic.Bool
+
+	retries   atomic.Uint64
+	fallbacks atomic.Uint64
+	// degraded is set while redis is failing, so outage is logged once
+	degraded atomic.Bool
+
+	closeLock   sync.Mutex
+	closed      bool
+	reconcileWG sync.WaitGroup
+}
+
+type RedisStoreOption func(s *RedisStore)
+
+// RedisWithBreaker set circuit breaker guarding redis calls, while breaker is open
+// events are counted on fallback store without touching redis
+func RedisWithBreaker(b *circuitbreaker.Breaker) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.breaker = b
+	}
+}
+
+// RedisWithErrorHandler set callback which is notified when usage counted on fallback store
+// can not be merged back to redis
+func RedisWithErrorHandler(h ratelimit.ErrorHandler) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.errHandler = h
+	}
+}
+
+// RedisWithClock set clock used to timestamp reset data and expire fallback usage
+func RedisWithClock(c ratelimit.Clock) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.clock = c
+	}
+}
+
+// RedisWithLogger set logger of store, redis outage and recovery are logged once rather than per event
+// By default, slog.Default() is used
+func RedisWithLogger(l *slog.Logger) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.logger = l
+	}
+}
+
+// RedisWithObserver set observer notified with EventStoreFallback when redis starts failing,
+// events are delivered asynchronously until store is closed
+func RedisWithObserver(o ratelimit.Observer) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.notifier = ratelimit.NewNotifier(o)
+	}
 }
 
-func NewRedisStore(client *redis.McRedis, ttl time.Duration, numRetry int, fallbackInMem *InMemStore) *RedisStore {
+func NewRedisStore(client *redis.McRedis, ttl time.Duration, numRetry int, fallbackInMem *InMemStore,
+	opts ...RedisStoreOption) *RedisStore {
 	if numRetry < 0 {
 		numRetry = defaultRedisRetry
 	}
 	s := &RedisStore{
 		client:        client,
 		fallbackInMem: fallbackInMem,
-		ttl:           ttl,
 		numRetry:      numRetry,
+		ledger:        newFallbackLedger(),
+		clock:         ratelimit.SystemClock,
+		logger:        slog.Default(),
+	}
+	s.ttl.Store(int64(ttl))
+	for _, opt := range opts {
+		opt(s)
 	}
 	return s
 }
 
-func (m *RedisStore) redisIncr(k string, v int64, now time.Time, handler RateFunc) (ratelimit.Reservation, error) {
-	var reservation ratelimit.Reservation
-	var rateErr error
+// UpdateTTL changes how long a key is kept after its last update, on redis and fallback store
+func (m *RedisStore) UpdateTTL(ttl time.Duration) {
+	m.ttl.Store(int64(ttl))
+	if m.fallbackInMem != nil {
+		m.fallbackInMem.UpdateTTL(ttl)
+	}
+}
+
+// redisIncr applies handler to rate data of key k, rateErr is error returned by handler
+// while err is only set if redis can not be updated
+func (m *RedisStore) redisIncr(k string, v int64, now time.Time,
+	handler RateFunc) (reservation ratelimit.Reservation, rateErr error, err error) {
 	var redisIncrFunc = func(tx *goredis.Tx) error {
 		var rData *RateData
 		sData, err := tx.Get(k).Result()
@@ -56,13 +139,17 @@ func (m *RedisStore) redisIncr(k string, v int64, now time.Time, handler RateFun
 		}
 
 		reservation, rateErr = handler(rData.Remain, time.Unix(rData.LastSec, rData.LastNSec), now, v)
+		if rateErr != nil {
+			// rejected event must not consume bucket
+			return nil
+		}
 		rData.Remain = reservation.Req
 		rData.LastSec = reservation.Last.Unix()
 		rData.LastNSec = int64(reservation.Last.Nanosecond())
 
 		// Operation is committed only if the watched keys remain unchanged.
 		_, err = tx.TxPipelined(func(pipeliner goredis.Pipeliner) error {
-			pipeliner.Set(k, rData.String(), m.ttl)
+			pipeliner.Set(k, rData.String(), time.Duration(m.ttl.Load()))
 			return nil
 		})
 
@@ -70,48 +157,352 @@ func (m *RedisStore) redisIncr(k string, v int64, now time.Time, handler RateFun
 	}
 
 	for retry := 0; retry < m.numRetry; retry++ {
+		if retry > 0 {
+			m.retries.Add(1)
+		}
 		if err := m.client.Watch(redisIncrFunc, k); err != nil {
 			if err != goredis.TxFailedErr {
-				return ratelimit.Reservation{}, err
+				return ratelimit.Reservation{}, nil, err
 			}
 
 			continue
 		}
-		return reservation, rateErr
+		return reservation, rateErr, nil
 	}
 
-	return ratelimit.Reservation{}, goredis.TxFailedErr
+	return ratelimit.Reservation{}, nil, goredis.TxFailedErr
 }
 
 func (m *RedisStore) Incr(ctx context.Context, key string, value int64, now time.Time,
 	handler RateFunc) (ratelimit.Reservation, error) {
-	r, err := m.redisIncr(key, value, now, handler)
+	var gen uint64
+	if m.breaker != nil {
+		var err error
+		if gen, err = m.breaker.Allow(); err != nil {
+			return m.fallbackIncr(ctx, key, value, now, handler, err)
+		}
+	}
+
+	start := time.Now()
+	r, rateErr, err := m.redisIncr(key, value, now, handler)
+	if m.breaker != nil {
+		m.breaker.Done(gen, redisFailure(err), time.Since(start))
+	}
+	m.reportHealth(key, redisFailure(err))
 	if err != nil {
-		if err == ratelimit.ErrLimitReached {
-			return r, err
+		return m.fallbackIncr(ctx, key, value, now, handler, err)
+	}
+	m.triggerReconcile()
+	return r, rateErr
+}
+
+func (m *RedisStore) fallbackIncr(ctx context.Context, key string, value int64, now time.Time,
+	handler RateFunc, err error) (ratelimit.Reservation, error) {
+	m.fallbacks.Add(1)
+	// fallback to use memory
+	if m.fallbackInMem != nil {
+		r, fbErr := m.fallbackInMem.Incr(ctx, key, value, now, handler)
+		if fbErr == nil {
+			m.ledger.add(key, handler, now)
 		}
+		return r, fbErr
+	}
+
+	// let limiter decide by its error policy
+	return ratelimit.Reservation{}, fmt.Errorf("%w: %w", ratelimit.ErrStoreUnavailable, err)
+}
 
-		// fallback to use memory
-		if m.fallbackInMem != nil {
-			return m.fallbackInMem.Incr(ctx, key, value, now, handler)
+func (m *RedisStore) Reset(ctx context.Context, key string, value int64) error {
+	var gen uint64
+	if m.breaker != nil {
+		var err error
+		if gen, err = m.breaker.Allow(); err != nil {
+			return fmt.Errorf("%w: %w", ratelimit.ErrStoreUnavailable, err)
 		}
+	}
 
-		// as default behaviour, limit if race condition on specified key
-		return ratelimit.Reservation{}, ratelimit.ErrLimitReached
+	start := time.Now()
+	err := m.redisReset(key, value)
+	if m.breaker != nil {
+		m.breaker.Done(gen, redisFailure(err), time.Since(start))
 	}
-	return r, nil
+	m.reportHealth(key, redisFailure(err))
+	return err
 }
 
-func (m *RedisStore) Reset(ctx context.Context, key string, value int64) error {
+func (m *RedisStore) redisReset(key string, value int64) error {
 	if value == 0 {
 		return m.client.Del(key).Err()
 	}
 
-	now := time.Now()
+	now := m.clock.Now()
 	data := &RateData{
 		Remain:   float64(value),
 		LastSec:  now.Unix(),
 		LastNSec: int64(now.Nanosecond()),
 	}
-	return m.client.Set(key, data.String(), m.ttl).Err()
+	return m.client.Set(key, data.String(), time.Duration(m.ttl.Load())).Err()
+}
+
+// Keys lists keys of redis with SCAN, cursor is SCAN cursor returned by previous page and limit is passed as
+// COUNT hint. Keys holding other data are skipped, usage counted on fallback store is not listed
+func (m *RedisStore) Keys(ctx context.Context, cursor string, limit int) (ratelimit.KeyPage, error) {
+	var scanCursor uint64
+	if cursor != "" {
+		c, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return ratelimit.KeyPage{}, fmt.Errorf("invalid cursor %q", cursor)
+		}
+		scanCursor = c
+	}
+
+	keys, next, err := m.client.Scan(scanCursor, "", int64(limit)).Result()
+	if err != nil {
+		return ratelimit.KeyPage{}, err
+	}
+	states, err := m.states(keys)
+	if err != nil {
+		return ratelimit.KeyPage{}, err
+	}
+	page := ratelimit.KeyPage{Keys: states}
+	if next != 0 {
+		page.Next = strconv.FormatUint(next, 10)
+	}
+	return page, nil
+}
+
+// State returns state of key kept on redis
+func (m *RedisStore) State(ctx context.Context, key string) (ratelimit.KeyState, bool, error) {
+	states, err := m.states([]string{key})
+	if err != nil || len(states) == 0 {
+		return ratelimit.KeyState{}, false, err
+	}
+	return states[0], true, nil
+}
+
+// states reads rate data of keys in a pipeline, keys which are missing or not rate data are skipped
+func (m *RedisStore) states(keys []string) ([]ratelimit.KeyState, error) {
+	gets := make([]*goredis.StringCmd, len(keys))
+	_, err := m.client.Pipelined(func(pipeliner goredis.Pipeliner) error {
+		for i, k := range keys {
+			gets[i] = pipeliner.Get(k)
+		}
+		return nil
+	})
+	if err != nil && !isReplyError(err) {
+		return nil, err
+	}
+
+	states := make([]ratelimit.KeyState, 0, len(keys))
+	for i, k := range keys {
+		sData, err := gets[i].Result()
+		if err != nil {
+			continue
+		}
+		data, err := RateDataFromJSON(sData)
+		if err != nil {
+			continue
+		}
+		last := time.Unix(data.LastSec, data.LastNSec)
+		states = append(states, ratelimit.KeyState{Key: k, Value: data.Remain, Last: &last})
+	}
+	return states, nil
+}
+
+// isReplyError reports if err is replied by redis for a single command rather than a connection failure
+func isReplyError(err error) bool {
+	if err == goredis.Nil {
+		return true
+	}
+	_, ok := err.(goredis.Error)
+	return ok
+}
+
+// reportHealth logs and notifies transition of redis between healthy and failing, err is nil if redis responded
+func (m *RedisStore) reportHealth(key string, err error) {
+	if err != nil {
+		m.notifier.StoreFailed("", key, err)
+		if m.degraded.CompareAndSwap(false, true) {
+			m.logger.Warn("redis store is unavailable", slog.Bool("fallback", m.fallbackInMem != nil),
+				slog.Any("error", err))
+		}
+		return
+	}
+	m.notifier.StoreRecovered()
+	if m.degraded.CompareAndSwap(true, false) {
+		m.logger.Info("redis store recovered")
+	}
+}
+
+// Stats returns number of retried transactions and events counted on fallback store
+func (m *RedisStore) Stats() ratelimit.RedisStoreStats {
+	return ratelimit.RedisStoreStats{
+		Retries:     m.retries.Load(),
+		Fallbacks:   m.fallbacks.Load(),
+		PendingKeys: m.ledger.size.Load(),
+	}
+}
+
+// triggerReconcile starts merging fallback usage in background if there is any
+func (m *RedisStore) triggerReconcile() {
+	if m.ledger.size.Load() == 0 || !m.reconciling.CompareAndSwap(false, true) {
+		return
+	}
+
+	m.closeLock.Lock()
+	defer m.closeLock.Unlock()
+	if m.closed {
+		m.reconciling.Store(false)
+		return
+	}
+	m.reconcileWG.Add(1)
+	go func() {
+		defer m.reconcileWG.Done()
+		defer m.reconciling.Store(false)
+		_ = m.Reconcile(context.Background())
+	}()
+}
+
+// Close waits for background reconciliation and queued events to finish, redis client and fallback store are not closed
+// since they are owned by caller
+func (m *RedisStore) Close() error {
+	m.closeLock.Lock()
+	m.closed = true
+	m.closeLock.Unlock()
+
+	m.reconcileWG.Wait()
+	return m.notifier.Close()
+}
+
+// Reconcile merges usage counted on fallback store while redis was unavailable back into redis,
+// so clients do not get a free burst once redis recovers. Usage which can not be merged is kept for next call
+func (m *RedisStore) Reconcile(ctx context.Context) error {
+	pending := m.ledger.take()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var gen uint64
+	if m.breaker != nil {
+		var err error
+		if gen, err = m.breaker.Allow(); err != nil {
+			m.ledger.putBack(pending)
+			return fmt.Errorf("%w: %w", ratelimit.ErrStoreUnavailable, err)
+		}
+	}
+
+	var firstErr error
+	var failed int
+	now := m.clock.Now()
+	for key, u := range pending {
+		if ctx.Err() != nil {
+			m.ledger.add(key, u.rate, u.Last)
+			continue
+		}
+		// redis data would have expired already
+		if ttl := time.Duration(m.ttl.Load()); ttl > 0 && now.Sub(u.Last) > ttl {
+			continue
+		}
+
+		if err := m.mergeUsage(key, u, now); err != nil {
+			failed++
+			m.ledger.add(key, u.rate, u.Last)
+			if m.errHandler != nil {
+				m.errHandler(ctx, key, err)
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	if m.breaker != nil {
+		m.breaker.Done(gen, redisFailure(firstErr), 0)
+	}
+	if firstErr != nil {
+		m.logger.Warn("failed to merge fallback usage into redis", slog.Int("keys", failed),
+			slog.Any("error", firstErr))
+	} else {
+		firstErr = ctx.Err()
+	}
+
+	return firstErr
+}
+
+// mergeUsage adds level of key k on fallback store to its rate data on redis. Both levels are leaked up to now
+// by limits of k, so an outage longer than a drain period does not leave a full bucket behind, and their sum is
+// capped at bucket size. Level of k is taken from fallback store before it's merged, so events counted on
+// fallback store meanwhile are merged next time, and it's put back if it can not be merged
+func (m *RedisStore) mergeUsage(k string, u fallbackUsage, now time.Time) error {
+	remain, last, ok := m.fallbackInMem.take(k)
+	if !ok {
+		return nil
+	}
+	fbLevel, bucket := leakTo(u.rate, remain, last, now)
+	if err := m.mergeLevel(k, u.rate, fbLevel, bucket, now); err != nil {
+		m.fallbackInMem.putBack(k, fbLevel, now, u.rate)
+		return err
+	}
+	return nil
+}
+
+// mergeLevel adds level leaked up to now to rate data of key k on redis
+func (m *RedisStore) mergeLevel(k string, rate RateFunc, fbLevel float64, bucket int64, now time.Time) error {
+	var mergeFunc = func(tx *goredis.Tx) error {
+		var level float64
+		sData, err := tx.Get(k).Result()
+		if err != nil {
+			if err.Error() != goredis.Nil.Error() {
+				return err
+			}
+		} else {
+			rData, err := RateDataFromJSON(sData)
+			if err != nil {
+				return err
+			}
+			level, _ = leakTo(rate, rData.Remain, time.Unix(rData.LastSec, rData.LastNSec), now)
+		}
+		level = math.Min(level+fbLevel, float64(bucket))
+		rData := &RateData{
+			Remain:   level,
+			LastSec:  now.Unix(),
+			LastNSec: int64(now.Nanosecond()),
+		}
+
+		_, err = tx.TxPipelined(func(pipeliner goredis.Pipeliner) error {
+			pipeliner.Set(k, rData.String(), time.Duration(m.ttl.Load()))
+			return nil
+		})
+		return err
+	}
+
+	for retry := 0; retry < m.numRetry; retry++ {
+		if err := m.client.Watch(mergeFunc, k); err != nil {
+			if err != goredis.TxFailedErr {
+				return err
+			}
+
+			continue
+		}
+		return nil
+	}
+
+	return goredis.TxFailedErr
+}
+
+// leakTo returns level of a bucket holding remain at last once it's leaked up to now by rate, and size of bucket
+func leakTo(rate RateFunc, remain float64, last, now time.Time) (float64, int64) {
+	// rate func with no increment only leaks bucket, it's denied if bucket is already overfull
+	r, _ := rate(remain, last, now, 0)
+	if now.Before(last) {
+		return remain, r.Bucket
+	}
+	return r.Req, r.Bucket
+}
+
+// redisFailure filter errors which are not caused by redis health, e.g. transaction conflict
+func redisFailure(err error) error {
+	if err == nil || err == goredis.TxFailedErr {
+		return nil
+	}
+	return err
 }
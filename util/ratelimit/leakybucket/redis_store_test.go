@@ -1,23 +1,57 @@
 package leakybucket
 
 import (
+	"bytes"
 	"context"
+	"github.com/alicebob/miniredis/v2"
+	goredis "github.com/go-redis/redis/v7"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"log/slog"
 	"math"
 	"ratelimit/driver/redis"
 	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/circuitbreaker"
+	"ratelimit/util/ratelimit/clocktest"
+	"strings"
 	"testing"
 	"time"
 )
 
-func TestRedisStore_Incr(t *testing.T) {
-	client, _ := redis.NewConnection(&redis.SingleConnection{
-		Address: "localhost:6379",
+// newTestRedis starts in-process redis server which is closed with test
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.McRedis) {
+	mr := miniredis.RunT(t)
+	client, err := redis.NewConnection(&redis.SingleConnection{
+		Address: mr.Addr(),
 	})
-	defer client.Close()
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return mr, client
+}
+
+func getRateData(t *testing.T, mr *miniredis.Miniredis, key string) *RateData {
+	sData, err := mr.Get(key)
+	require.Nil(t, err)
+	rData, err := RateDataFromJSON(sData)
+	require.Nil(t, err)
+	return rData
+}
+
+// countRateFunc adds every event to bucket without limit
+func countRateFunc(remain float64, _ time.Time, now time.Time, incr int64) (ratelimit.Reservation, error) {
+	return ratelimit.Reservation{
+		Req:       remain + float64(incr),
+		Bucket:    math.MaxInt64,
+		TimeToAct: now,
+		Last:      now,
+	}, nil
+}
+
+func TestRedisStore_Incr(t *testing.T) {
+	_, client := newTestRedis(t)
 
 	mstore := NewMemStore(time.Second * 5)
+	defer mstore.Close()
 	rstore := NewRedisStore(client, time.Second*5, defaultRedisRetry, mstore)
 
 	bucketSize := int64(2)
@@ -46,12 +80,290 @@ func TestRedisStore_Incr(t *testing.T) {
 
 	_, _ = rstore.Incr(context.Background(), "k3", 1, time.Now(), handleRateFunc)
 	reserv, err := rstore.Incr(context.Background(), "k3", 1, time.Now(), handleRateFunc)
-	assert.Error(t, err, ratelimit.ErrLimitReached)
+	assert.ErrorIs(t, err, ratelimit.ErrLimitReached)
 	assert.True(t, reserv.Delay() > time.Duration(1))
 
+	// rejected event is not counted
+	rsDataStr, _ = rstore.client.Get("k3").Result()
+	rData, _ = RateDataFromJSON(rsDataStr)
+	assert.Equal(t, float64(2), rData.Remain)
+
 	err = rstore.Reset(context.Background(), "k3", 12)
 	require.Nil(t, err)
 	rsDataStr, _ = rstore.client.Get("k3").Result()
 	rData, _ = RateDataFromJSON(rsDataStr)
 	assert.Equal(t, float64(12), rData.Remain)
 }
+
+func TestRedisStore_Incr_Denied(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	breaker := circuitbreaker.New(circuitbreaker.WithMaxFailures(1))
+	rstore := NewRedisStore(client, time.Minute, defaultRedisRetry, nil, RedisWithBreaker(breaker))
+
+	stored := (&RateData{Remain: 2, LastSec: 1700000000}).String()
+	require.Nil(t, client.Set("k1", stored, time.Minute).Err())
+	mr.FastForward(30 * time.Second)
+
+	denyRateFunc := func(remain float64, last time.Time, now time.Time, incr int64) (ratelimit.Reservation, error) {
+		return ratelimit.Reservation{Req: remain + float64(incr), Bucket: 2, TimeToAct: now.Add(time.Second),
+			Last: now}, ratelimit.ErrLimitReached
+	}
+	r, err := rstore.Incr(ctx, "k1", 1, time.Unix(1700000001, 0), denyRateFunc)
+	assert.ErrorIs(t, err, ratelimit.ErrLimitReached)
+	assert.Equal(t, int64(2), r.Bucket)
+
+	// denied event neither updates rate data nor extends its ttl
+	got, err := mr.Get("k1")
+	require.Nil(t, err)
+	assert.Equal(t, stored, got)
+	assert.Equal(t, 30*time.Second, mr.TTL("k1"))
+	// and it's not a failure of redis
+	assert.Equal(t, circuitbreaker.StateClosed, breaker.State())
+	assert.Equal(t, ratelimit.RedisStoreStats{}, rstore.Stats())
+}
+
+func TestRedisStore_Incr_Watch_Conflict(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+
+	// conflictRateFunc writes key while it's watched on first conflicts calls
+	conflictRateFunc := func(conflicts int, calls *int) RateFunc {
+		return func(remain float64, last time.Time, now time.Time, incr int64) (ratelimit.Reservation, error) {
+			*calls++
+			if *calls <= conflicts {
+				require.Nil(t, client.Set("k1", (&RateData{Remain: 10}).String(), 0).Err())
+			}
+			return countRateFunc(remain, last, now, incr)
+		}
+	}
+
+	t.Run("retry", func(t *testing.T) {
+		mr.FlushAll()
+		rstore := NewRedisStore(client, time.Minute, 3, nil)
+		calls := 0
+		r, err := rstore.Incr(ctx, "k1", 1, time.Now(), conflictRateFunc(1, &calls))
+		require.Nil(t, err)
+		assert.Equal(t, 2, calls)
+		// retry is applied on top of conflicting write
+		assert.Equal(t, float64(11), r.Req)
+		assert.Equal(t, float64(11), getRateData(t, mr, "k1").Remain)
+		assert.Equal(t, ratelimit.RedisStoreStats{Retries: 1}, rstore.Stats())
+	})
+
+	t.Run("retry exhausted", func(t *testing.T) {
+		mr.FlushAll()
+		breaker := circuitbreaker.New(circuitbreaker.WithMaxFailures(1))
+		rstore := NewRedisStore(client, time.Minute, 3, nil, RedisWithBreaker(breaker))
+		calls := 0
+		_, err := rstore.Incr(ctx, "k1", 1, time.Now(), conflictRateFunc(math.MaxInt, &calls))
+		assert.ErrorIs(t, err, ratelimit.ErrStoreUnavailable)
+		assert.ErrorIs(t, err, goredis.TxFailedErr)
+		assert.Equal(t, 3, calls)
+		// conflicts do not mean redis is unhealthy
+		assert.Equal(t, circuitbreaker.StateClosed, breaker.State())
+		assert.Equal(t, ratelimit.RedisStoreStats{Retries: 2, Fallbacks: 1}, rstore.Stats())
+	})
+
+	t.Run("retry exhausted with fallback", func(t *testing.T) {
+		mr.FlushAll()
+		mstore := NewMemStore(time.Minute)
+		defer mstore.Close()
+		rstore := NewRedisStore(client, time.Minute, 3, mstore)
+		calls := 0
+		r, err := rstore.Incr(ctx, "k1", 1, time.Now(), conflictRateFunc(3, &calls))
+		require.Nil(t, err)
+		assert.Equal(t, float64(1), r.Req)
+		assert.Equal(t, 4, calls)
+		assert.Equal(t, ratelimit.RedisStoreStats{Retries: 2, Fallbacks: 1, PendingKeys: 1}, rstore.Stats())
+	})
+}
+
+func TestRedisStore_Fallback(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+
+	mstore := NewMemStore(time.Minute, MemWithClock(clock))
+	defer mstore.Close()
+	breaker := circuitbreaker.New(circuitbreaker.WithMaxFailures(2), circuitbreaker.WithOpenTimeout(time.Second),
+		circuitbreaker.WithClock(clock))
+	var buf bytes.Buffer
+	rstore := NewRedisStore(client, time.Minute, defaultRedisRetry, mstore,
+		RedisWithBreaker(breaker), RedisWithClock(clock), RedisWithLogger(slog.New(slog.NewTextHandler(&buf, nil))))
+
+	require.Nil(t, client.Set("k1", (&RateData{Remain: 1, LastSec: clock.Now().Unix()}).String(), time.Minute).Err())
+
+	mr.SetError("ERR down")
+	for i := 1; i <= 3; i++ {
+		r, err := rstore.Incr(ctx, "k1", 1, clock.Now(), countRateFunc)
+		require.Nil(t, err)
+		assert.Equal(t, float64(i), r.Req)
+	}
+	assert.Equal(t, circuitbreaker.StateOpen, breaker.State())
+	assert.ErrorIs(t, rstore.Reset(ctx, "k1", 0), ratelimit.ErrStoreUnavailable)
+
+	// fallback usage is merged back once redis recovers
+	mr.SetError("")
+	clock.Advance(time.Second)
+	_, err := rstore.Incr(ctx, "k2", 1, clock.Now(), countRateFunc)
+	require.Nil(t, err)
+	require.Nil(t, rstore.Close())
+	assert.Equal(t, circuitbreaker.StateClosed, breaker.State())
+	assert.Equal(t, int64(0), rstore.ledger.size.Load())
+	assert.Equal(t, float64(4), getRateData(t, mr, "k1").Remain)
+
+	// outage is logged once rather than per event
+	assert.Equal(t, 1, strings.Count(buf.String(), "msg=\"redis store is unavailable\""))
+	assert.Equal(t, 1, strings.Count(buf.String(), "msg=\"redis store recovered\""))
+}
+
+func TestRedisStore_Fallback_Missing(t *testing.T) {
+	mr, client := newTestRedis(t)
+	rstore := NewRedisStore(client, time.Minute, defaultRedisRetry, nil)
+
+	mr.SetError("ERR down")
+	_, err := rstore.Incr(context.Background(), "k1", 1, time.Now(), countRateFunc)
+	assert.ErrorIs(t, err, ratelimit.ErrStoreUnavailable)
+}
+
+func TestRedisStore_Fallback_LongOutage(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+
+	mstore := NewMemStore(time.Minute, MemWithClock(clock))
+	defer mstore.Close()
+	rstore := NewRedisStore(client, time.Minute, defaultRedisRetry, mstore, RedisWithClock(clock))
+	l := New(1, time.Second, 5, WithStore(rstore), WithClock(clock))
+	defer l.Close()
+
+	allow := func(k string, n int) {
+		for i := 0; i < n; i++ {
+			_, allowed, err := l.Allow(ctx, k, 1)
+			require.Nil(t, err)
+			require.True(t, allowed)
+		}
+	}
+	allow("k1", 5)
+	// outage lasts longer than a full bucket takes to leak
+	clock.Advance(10 * time.Second)
+	allow("k2", 4)
+
+	mr.SetError("ERR down")
+	allow("k1", 2)
+	allow("k2", 4)
+
+	mr.SetError("")
+	clock.Advance(time.Second)
+	allow("k3", 1)
+	require.Nil(t, rstore.Close())
+
+	// k1 has drained on redis, only fallback level leaked by 1s is left
+	rData := getRateData(t, mr, "k1")
+	assert.InDelta(t, 1, rData.Remain, 1e-9)
+	assert.Equal(t, clock.Now().Unix(), rData.LastSec)
+	// k2 levels leaked by 1s sum up to 6, it's capped by bucket
+	assert.InDelta(t, 5, getRateData(t, mr, "k2").Remain, 1e-9)
+
+	// merged level is not merged again by next outage
+	state, ok, err := mstore.State(ctx, "k1")
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, float64(0), state.Value)
+}
+
+func TestRedisStore_Reconcile_Failure(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+
+	mstore := NewMemStore(time.Minute, MemWithClock(clock))
+	defer mstore.Close()
+	rstore := NewRedisStore(client, time.Minute, defaultRedisRetry, mstore, RedisWithClock(clock))
+	defer rstore.Close()
+
+	mr.SetError("ERR down")
+	for i := 0; i < 2; i++ {
+		_, err := rstore.Incr(ctx, "k1", 1, clock.Now(), countRateFunc)
+		require.Nil(t, err)
+	}
+
+	// level which fails to be merged is put back to fallback store and kept for next merge
+	assert.NotNil(t, rstore.Reconcile(ctx))
+	state, ok, err := mstore.State(ctx, "k1")
+	require.Nil(t, err)
+	require.True(t, ok)
+	assert.Equal(t, float64(2), state.Value)
+	assert.Equal(t, int64(1), rstore.ledger.size.Load())
+
+	mr.SetError("")
+	require.Nil(t, rstore.Reconcile(ctx))
+	assert.Equal(t, float64(2), getRateData(t, mr, "k1").Remain)
+	state, _, _ = mstore.State(ctx, "k1")
+	assert.Equal(t, float64(0), state.Value)
+}
+
+func TestRedisStore_TTL(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	rstore := NewRedisStore(client, time.Minute, defaultRedisRetry, nil)
+
+	_, err := rstore.Incr(ctx, "k1", 1, time.Now(), countRateFunc)
+	require.Nil(t, err)
+	assert.Equal(t, time.Minute, mr.TTL("k1"))
+
+	// every update extends ttl
+	mr.FastForward(30 * time.Second)
+	_, err = rstore.Incr(ctx, "k1", 1, time.Now(), countRateFunc)
+	require.Nil(t, err)
+	assert.Equal(t, time.Minute, mr.TTL("k1"))
+
+	mr.FastForward(time.Minute)
+	assert.False(t, mr.Exists("k1"))
+}
+
+func TestRedisStore_Reset(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	rstore := NewRedisStore(client, time.Minute, defaultRedisRetry, nil, RedisWithClock(clock))
+
+	require.Nil(t, rstore.Reset(ctx, "k1", 12))
+	rData := getRateData(t, mr, "k1")
+	assert.Equal(t, float64(12), rData.Remain)
+	assert.Equal(t, clock.Now().Unix(), rData.LastSec)
+	assert.Equal(t, time.Minute, mr.TTL("k1"))
+
+	// reset to zero deletes key
+	require.Nil(t, rstore.Reset(ctx, "k1", 0))
+	assert.False(t, mr.Exists("k1"))
+}
+
+func TestRedisStore_Keys(t *testing.T) {
+	ctx := context.Background()
+	mr, client := newTestRedis(t)
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	rstore := NewRedisStore(client, time.Minute, defaultRedisRetry, nil, RedisWithClock(clock))
+
+	require.Nil(t, rstore.Reset(ctx, "k1", 3))
+	require.Nil(t, rstore.Reset(ctx, "k2", 5))
+	require.Nil(t, mr.Set("counter", "12"))
+
+	page, err := rstore.Keys(ctx, "", 10)
+	require.Nil(t, err)
+	assert.Empty(t, page.Next)
+	last := clock.Now()
+	assert.ElementsMatch(t, []ratelimit.KeyState{
+		{Key: "k1", Value: 3, Last: &last},
+		{Key: "k2", Value: 5, Last: &last},
+	}, page.Keys)
+
+	state, ok, err := rstore.State(ctx, "k2")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float64(5), state.Value)
+	_, ok, err = rstore.State(ctx, "counter")
+	require.Nil(t, err)
+	assert.False(t, ok)
+}
@@ -37,3 +37,8 @@ type Store interface {
 	// Reset set counter of key to value
 	Reset(ctx context.Context, key string, value int64) error
 }
+
+// TTLUpdater is implemented by stores whose ttl can be changed while they are in use
+type TTLUpdater interface {
+	UpdateTTL(ttl time.Duration)
+}
@@ -8,6 +8,8 @@ import (
 
 var (
 	ErrLimitReached = errors.New("exceed rate limit")
+	// ErrPeekNotSupported is returned by Peeker which can not read usage of keys without writing it
+	ErrPeekNotSupported = errors.New("peek is not supported")
 )
 
 type Reservation struct {
@@ -35,3 +37,9 @@ type Limiter interface {
 	// check if event k with weight of v is allowed to passing or not
 	Allow(ctx context.Context, k string, v int64) (*Reservation, bool, error)
 }
+
+// Peeker is implemented by limiters which can check an event without counting it
+type Peeker interface {
+	// Peek checks if event k with weight of v would be allowed, Reservation.Req is current usage of key k
+	Peek(ctx context.Context, k string, v int64) (*Reservation, bool, error)
+}
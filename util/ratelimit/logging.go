@@ -0,0 +1,17 @@
+package ratelimit
+
+import (
+	"log/slog"
+)
+
+// LogKey returns log attribute of key k, key is logged as its hash so logs do not leak client identities
+// Hash is only computed if record is actually logged
+func LogKey(k string) slog.Attr {
+	return slog.Any("key_hash", redactedKey(k))
+}
+
+type redactedKey string
+
+func (k redactedKey) LogValue() slog.Value {
+	return slog.StringValue(HashKey(string(k)))
+}
@@ -0,0 +1,162 @@
+package penaltybox
+
+import (
+	"context"
+	"ratelimit/util/ratelimit"
+	"sync"
+	"time"
+)
+
+var defaultSweepInterval = time.Minute
+
+type MemStoreOption func(m *InMemStore)
+
+// MemWithSweepInterval set how often keys without violations, strikes nor ban are swept, 1 minute by default
+func MemWithSweepInterval(d time.Duration) MemStoreOption {
+	return func(m *InMemStore) {
+		m.sweepInterval = d
+	}
+}
+
+// MemWithClock set clock used to sweep keys
+func MemWithClock(c ratelimit.Clock) MemStoreOption {
+	return func(m *InMemStore) {
+		m.clock = c
+	}
+}
+
+// penalty is state of a key, fields are stale once their expire time has passed
+type penalty struct {
+	violations      int64
+	violationsUntil time.Time
+	strikes         int64
+	strikesUntil    time.Time
+	bannedUntil     time.Time
+}
+
+func (p *penalty) expired(now time.Time) bool {
+	return !now.Before(p.violationsUntil) && !now.Before(p.strikesUntil) && !now.Before(p.bannedUntil)
+}
+
+// InMemStore keeps penalties of keys of a single instance
+type InMemStore struct {
+	lock      sync.Mutex
+	penalties map[string]*penalty
+
+	sweepInterval time.Duration
+	clock         ratelimit.Clock
+	stop          chan struct{}
+	done          chan struct{}
+}
+
+func NewMemStore(opts ...MemStoreOption) *InMemStore {
+	m := &InMemStore{
+		penalties:     make(map[string]*penalty),
+		sweepInterval: defaultSweepInterval,
+		clock:         ratelimit.SystemClock,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.sweepInterval <= 0 {
+		m.sweepInterval = defaultSweepInterval
+	}
+
+	go m.runSweeper()
+	return m
+}
+
+func (m *InMemStore) runSweeper() {
+	defer close(m.done)
+	ticker := m.clock.NewTicker(m.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C():
+			m.sweep()
+		}
+	}
+}
+
+func (m *InMemStore) sweep() {
+	now := m.clock.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key, p := range m.penalties {
+		if p.expired(now) {
+			delete(m.penalties, key)
+		}
+	}
+}
+
+// get returns penalty of key, it's created if missing. It's called with lock held
+func (m *InMemStore) get(key string) *penalty {
+	p, ok := m.penalties[key]
+	if !ok {
+		p = &penalty{}
+		m.penalties[key] = p
+	}
+	return p
+}
+
+func (m *InMemStore) Violate(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p := m.get(key)
+	if !now.Before(p.violationsUntil) {
+		p.violations = 0
+		p.violationsUntil = now.Add(window)
+	}
+	p.violations++
+	return p.violations, nil
+}
+
+func (m *InMemStore) Strike(ctx context.Context, key string, now time.Time, memory time.Duration) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p := m.get(key)
+	if !now.Before(p.strikesUntil) {
+		p.strikes = 0
+	}
+	p.strikes++
+	p.strikesUntil = now.Add(memory)
+	return p.strikes, nil
+}
+
+func (m *InMemStore) Ban(ctx context.Context, key string, now time.Time, until time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p := m.get(key)
+	p.bannedUntil = until
+	p.violations = 0
+	p.violationsUntil = time.Time{}
+	return nil
+}
+
+func (m *InMemStore) BannedUntil(ctx context.Context, key string, now time.Time) (time.Time, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	p, ok := m.penalties[key]
+	if !ok || !now.Before(p.bannedUntil) {
+		return time.Time{}, false, nil
+	}
+	return p.bannedUntil, true, nil
+}
+
+func (m *InMemStore) Unban(ctx context.Context, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.penalties, key)
+	return nil
+}
+
+// Close stops sweeper, store keeps working without sweeping keys
+func (m *InMemStore) Close() error {
+	close(m.stop)
+	<-m.done
+	return nil
+}
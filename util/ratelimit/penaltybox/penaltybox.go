@@ -0,0 +1,279 @@
+// Package penaltybox escalates limits of keys which keep sending events after being limited, fail2ban style.
+// Denied events of a key are counted as violations and a key reaching threshold of violations is banned for a
+// duration growing with every ban in a row, so hammering clients get banned for longer and longer
+package penaltybox
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"ratelimit/util/ratelimit"
+	"time"
+)
+
+var (
+	defaultThreshold    = int64(10)
+	defaultWindow       = time.Minute
+	defaultBanDuration  = time.Minute
+	defaultMaxBan       = 24 * time.Hour
+	defaultBanFactor    = 2.0
+	defaultStrikeMemory = 24 * time.Hour
+)
+
+type Option func(b *Box)
+
+// WithThreshold set number of violations within window which bans key, 10 violations within a minute by default.
+// Zero n or window keeps its default
+func WithThreshold(n int64, window time.Duration) Option {
+	return func(b *Box) {
+		b.threshold = n
+		b.window = window
+	}
+}
+
+// WithBanDuration set duration of first ban of key and maximum duration of a ban, 1 minute and 24 hours by default.
+// Zero first or max keeps its default
+func WithBanDuration(first, max time.Duration) Option {
+	return func(b *Box) {
+		b.banDuration = first
+		b.maxBan = max
+	}
+}
+
+// WithBanFactor set how much every ban in a row is longer than previous one, 2 by default
+func WithBanFactor(f float64) Option {
+	return func(b *Box) {
+		b.banFactor = f
+	}
+}
+
+// WithStrikeMemory set how long bans of key are remembered to escalate its next ban, 24 hours by default
+func WithStrikeMemory(d time.Duration) Option {
+	return func(b *Box) {
+		b.strikeMemory = d
+	}
+}
+
+// WithStore set store of penalties, e.g. RedisStore to share bans between instances
+// By default, penalties are kept in memory of box
+func WithStore(s Store) Option {
+	return func(b *Box) {
+		b.store = s
+	}
+}
+
+// WithClock set clock used to count violations and expire bans
+func WithClock(c ratelimit.Clock) Option {
+	return func(b *Box) {
+		b.clock = c
+	}
+}
+
+// WithLogger set logger of box, bans are logged at info level and store errors at error level
+// By default, slog.Default() is used
+func WithLogger(l *slog.Logger) Option {
+	return func(b *Box) {
+		b.logger = l
+	}
+}
+
+// Decision is result of an event checked by Box
+type Decision struct {
+	// Reservation and Allowed are decision of wrapped limiter, Reservation of a banned key has TimeToAct at end of
+	// ban
+	Reservation *ratelimit.Reservation
+	Allowed     bool
+	// BannedUntil is end of ban of key, it's zero if key is not banned
+	BannedUntil time.Time
+	// CheckedAt is time of clock of box when event is checked
+	CheckedAt time.Time
+}
+
+// Banned reports if event is denied because its key is banned
+func (d Decision) Banned() bool {
+	return !d.BannedUntil.IsZero()
+}
+
+// BanRemaining returns how long key is still banned from time event is checked, it's zero if key is not banned
+func (d Decision) BanRemaining() time.Duration {
+	if !d.Banned() {
+		return 0
+	}
+	return d.BannedUntil.Sub(d.CheckedAt)
+}
+
+// Box is ratelimit.Limiter banning keys which keep violating limits of wrapped limiter
+type Box struct {
+	limiter      ratelimit.Limiter
+	store        Store
+	ownStore     bool
+	threshold    int64
+	window       time.Duration
+	banDuration  time.Duration
+	maxBan       time.Duration
+	banFactor    float64
+	strikeMemory time.Duration
+	clock        ratelimit.Clock
+	logger       *slog.Logger
+}
+
+var _ ratelimit.Limiter = (*Box)(nil)
+
+// New wraps limiter l with penalty box
+func New(l ratelimit.Limiter, opts ...Option) *Box {
+	b := &Box{
+		limiter:      l,
+		threshold:    defaultThreshold,
+		window:       defaultWindow,
+		banDuration:  defaultBanDuration,
+		maxBan:       defaultMaxBan,
+		banFactor:    defaultBanFactor,
+		strikeMemory: defaultStrikeMemory,
+		clock:        ratelimit.SystemClock,
+		logger:       slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.store == nil {
+		b.store = NewMemStore(MemWithClock(b.clock))
+		b.ownStore = true
+	}
+	if b.threshold <= 0 {
+		b.threshold = defaultThreshold
+	}
+	if b.window <= 0 {
+		b.window = defaultWindow
+	}
+	if b.banDuration <= 0 {
+		b.banDuration = defaultBanDuration
+	}
+	if b.maxBan <= 0 {
+		b.maxBan = defaultMaxBan
+	}
+	if b.banFactor < 1 {
+		b.banFactor = 1
+	}
+	return b
+}
+
+// Allow denies event of a banned key until its ban ends, other events are checked by wrapped limiter
+func (b *Box) Allow(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	d, err := b.Check(ctx, k, v)
+	return d.Reservation, d.Allowed, err
+}
+
+// Check checks event k with weight of v like Allow and tells if key is banned. A key whose ban can not be got
+// is checked by wrapped limiter, so error policy of limiter still applies while only store of box fails
+func (b *Box) Check(ctx context.Context, k string, v int64) (Decision, error) {
+	now := b.clock.Now()
+	if until, banned := b.bannedUntil(ctx, k, now); banned {
+		return b.banned(now, until), nil
+	}
+
+	r, allowed, err := b.limiter.Allow(ctx, k, v)
+	if err != nil || allowed {
+		return Decision{Reservation: r, Allowed: allowed, CheckedAt: now}, err
+	}
+
+	// a key failing to be penalized is still denied by limiter
+	until, banned, err := b.violate(ctx, k, now)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "failed to count violation", ratelimit.LogKey(k), slog.Any("error", err))
+		return Decision{Reservation: r, CheckedAt: now}, nil
+	}
+	if banned {
+		return b.banned(now, until), nil
+	}
+	return Decision{Reservation: r, CheckedAt: now}, nil
+}
+
+// Peek checks event k with weight of v without counting it nor a violation, wrapped limiter must implement
+// ratelimit.Peeker
+func (b *Box) Peek(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	now := b.clock.Now()
+	if until, banned := b.bannedUntil(ctx, k, now); banned {
+		return b.banned(now, until).Reservation, false, nil
+	}
+	p, ok := b.limiter.(ratelimit.Peeker)
+	if !ok {
+		return nil, false, ratelimit.ErrPeekNotSupported
+	}
+	return p.Peek(ctx, k, v)
+}
+
+// bannedUntil returns end of ban of k, a key whose ban can not be got is not banned
+func (b *Box) bannedUntil(ctx context.Context, k string, now time.Time) (time.Time, bool) {
+	until, banned, err := b.store.BannedUntil(ctx, k, now)
+	if err != nil {
+		b.logger.ErrorContext(ctx, "failed to get ban", ratelimit.LogKey(k), slog.Any("error", err))
+		return time.Time{}, false
+	}
+	return until, banned
+}
+
+// violate counts a violation of k and bans it once it reaches threshold
+func (b *Box) violate(ctx context.Context, k string, now time.Time) (time.Time, bool, error) {
+	n, err := b.store.Violate(ctx, k, now, b.window)
+	if err != nil || n < b.threshold {
+		return time.Time{}, false, err
+	}
+
+	strikes, err := b.store.Strike(ctx, k, now, b.strikeMemory)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	d := b.banDurationOf(strikes)
+	until := now.Add(d)
+	if err := b.store.Ban(ctx, k, now, until); err != nil {
+		return time.Time{}, false, err
+	}
+	b.logger.InfoContext(ctx, "key is banned", ratelimit.LogKey(k), slog.Int64("strikes", strikes),
+		slog.Duration("duration", d))
+	return until, true, nil
+}
+
+// banDurationOf returns duration of ban number n of a key in a row
+func (b *Box) banDurationOf(n int64) time.Duration {
+	d := float64(b.banDuration) * math.Pow(b.banFactor, float64(n-1))
+	if d > float64(b.maxBan) {
+		return b.maxBan
+	}
+	return time.Duration(d)
+}
+
+func (b *Box) banned(now, until time.Time) Decision {
+	return Decision{
+		Reservation: &ratelimit.Reservation{TimeToAct: until, Last: now},
+		BannedUntil: until,
+		CheckedAt:   now,
+	}
+}
+
+// BannedUntil returns end of ban of key k, ok is false if k is not banned
+func (b *Box) BannedUntil(ctx context.Context, k string) (until time.Time, ok bool, err error) {
+	return b.store.BannedUntil(ctx, k, b.clock.Now())
+}
+
+// Unban lifts ban of key k and forgets its violations, so its next ban starts from the first duration again
+func (b *Box) Unban(ctx context.Context, k string) error {
+	if err := b.store.Unban(ctx, k); err != nil {
+		return err
+	}
+	b.logger.InfoContext(ctx, "key is unbanned", ratelimit.LogKey(k))
+	return nil
+}
+
+// Reset resets key k of wrapped limiter, ban of k is kept
+func (b *Box) Reset(ctx context.Context, k string, v int64) error {
+	return b.limiter.Reset(ctx, k, v)
+}
+
+// Close releases store created by box, store set by WithStore and wrapped limiter are left open
+func (b *Box) Close() error {
+	if closer, ok := b.store.(io.Closer); ok && b.ownStore {
+		return closer.Close()
+	}
+	return nil
+}
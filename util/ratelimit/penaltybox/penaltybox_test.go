@@ -0,0 +1,206 @@
+package penaltybox
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"testing"
+	"time"
+)
+
+var errStoreDown = errors.New("store is down")
+
+// failedStore fails every call
+type failedStore struct{}
+
+func (failedStore) Violate(context.Context, string, time.Time, time.Duration) (int64, error) {
+	return 0, errStoreDown
+}
+
+func (failedStore) Strike(context.Context, string, time.Time, time.Duration) (int64, error) {
+	return 0, errStoreDown
+}
+
+func (failedStore) Ban(context.Context, string, time.Time, time.Time) error {
+	return errStoreDown
+}
+
+func (failedStore) BannedUntil(context.Context, string, time.Time) (time.Time, bool, error) {
+	return time.Time{}, false, errStoreDown
+}
+
+func (failedStore) Unban(context.Context, string) error {
+	return errStoreDown
+}
+
+// newTestBox bans keys after 3 violations of 1 event per minute within a minute, bans start at 10 minutes
+func newTestBox(t *testing.T, opts ...Option) (*Box, *clocktest.FakeClock) {
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	l := fixedwindow.New(time.Minute, 1, fixedwindow.WithClock(clock))
+	b := New(l, append([]Option{WithClock(clock), WithThreshold(3, time.Minute),
+		WithBanDuration(10*time.Minute, time.Hour)}, opts...)...)
+	t.Cleanup(func() {
+		_ = b.Close()
+		_ = l.Close()
+	})
+	return b, clock
+}
+
+// hammer sends events of k until it's banned and returns the banning decision
+func hammer(t *testing.T, b *Box, k string) Decision {
+	for i := 0; i < 10; i++ {
+		d, err := b.Check(context.Background(), k, 1)
+		require.Nil(t, err)
+		if d.Banned() {
+			return d
+		}
+	}
+	require.FailNow(t, "key is not banned")
+	return Decision{}
+}
+
+func TestBox_Ban(t *testing.T) {
+	b, clock := newTestBox(t)
+	ctx := context.Background()
+
+	d, err := b.Check(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, d.Allowed)
+	assert.False(t, d.Banned())
+
+	// 3rd denied event bans key
+	for i := 0; i < 2; i++ {
+		d, err = b.Check(ctx, "k1", 1)
+		require.Nil(t, err)
+		assert.False(t, d.Allowed)
+		assert.False(t, d.Banned())
+	}
+	d, err = b.Check(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, d.Banned())
+	assert.Equal(t, clock.Now().Add(10*time.Minute), d.BannedUntil)
+	assert.Equal(t, 10*time.Minute, d.BanRemaining())
+
+	// banned key is denied even in a new window of limiter
+	clock.Advance(time.Minute)
+	d, err = b.Check(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.Equal(t, 9*time.Minute, d.BanRemaining())
+	r, allowed, err := b.Allow(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 9*time.Minute, r.DelayFrom(clock.Now()))
+
+	// other keys are not affected
+	_, allowed, _ = b.Allow(ctx, "k2", 1)
+	assert.True(t, allowed)
+
+	clock.Advance(9 * time.Minute)
+	_, allowed, _ = b.Allow(ctx, "k1", 1)
+	assert.True(t, allowed)
+}
+
+func TestBox_Escalation(t *testing.T) {
+	b, clock := newTestBox(t)
+
+	var durations []time.Duration
+	for i := 0; i < 4; i++ {
+		d := hammer(t, b, "k1")
+		durations = append(durations, d.BannedUntil.Sub(clock.Now()))
+		clock.Set(d.BannedUntil)
+	}
+	// bans double until max ban
+	assert.Equal(t, []time.Duration{10 * time.Minute, 20 * time.Minute, 40 * time.Minute, time.Hour}, durations)
+
+	// strikes are forgotten after memory
+	clock.Advance(24 * time.Hour)
+	d := hammer(t, b, "k1")
+	assert.Equal(t, 10*time.Minute, d.BannedUntil.Sub(clock.Now()))
+}
+
+func TestBox_ZeroOptions(t *testing.T) {
+	b, _ := newTestBox(t, WithThreshold(0, 0), WithBanDuration(0, 0))
+	assert.Equal(t, defaultThreshold, b.threshold)
+	assert.Equal(t, defaultWindow, b.window)
+	assert.Equal(t, defaultBanDuration, b.banDuration)
+	assert.Equal(t, defaultMaxBan, b.maxBan)
+}
+
+func TestBox_Peek(t *testing.T) {
+	b, clock := newTestBox(t)
+	ctx := context.Background()
+
+	_, allowed, err := b.Peek(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+
+	// peek counts neither event nor violation
+	for i := 0; i < 5; i++ {
+		_, _, _ = b.Peek(ctx, "k1", 2)
+	}
+	_, ok, _ := b.BannedUntil(ctx, "k1")
+	assert.False(t, ok)
+	_, allowed, _ = b.Allow(ctx, "k1", 1)
+	assert.True(t, allowed)
+
+	hammer(t, b, "k1")
+	r, allowed, err := b.Peek(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 10*time.Minute, r.DelayFrom(clock.Now()))
+}
+
+func TestBox_Unban(t *testing.T) {
+	b, clock := newTestBox(t)
+	ctx := context.Background()
+
+	hammer(t, b, "k1")
+	until, ok, err := b.BannedUntil(ctx, "k1")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, clock.Now().Add(10*time.Minute), until)
+
+	require.Nil(t, b.Unban(ctx, "k1"))
+	_, ok, _ = b.BannedUntil(ctx, "k1")
+	assert.False(t, ok)
+
+	// unbanned key starts over from first ban
+	clock.Advance(time.Minute)
+	d := hammer(t, b, "k1")
+	assert.Equal(t, 10*time.Minute, d.BannedUntil.Sub(clock.Now()))
+}
+
+func TestBox_StoreError(t *testing.T) {
+	// key whose ban can not be got is left to wrapped limiter
+	b, _ := newTestBox(t, WithStore(failedStore{}))
+	_, allowed, err := b.Allow(context.Background(), "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	_, allowed, err = b.Allow(context.Background(), "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+
+	// limiter still denies key which can not be penalized
+	store := NewMemStore()
+	defer store.Close()
+	b, _ = newTestBox(t, WithStore(&flakyStore{Store: store}))
+	for i := 0; i < 5; i++ {
+		_, _, err = b.Allow(context.Background(), "k1", 1)
+		require.Nil(t, err)
+	}
+	_, allowed, err = b.Allow(context.Background(), "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+}
+
+// flakyStore gets bans but fails to count violations
+type flakyStore struct {
+	Store
+}
+
+func (flakyStore) Violate(context.Context, string, time.Time, time.Duration) (int64, error) {
+	return 0, errStoreDown
+}
@@ -0,0 +1,100 @@
+package penaltybox
+
+import (
+	"context"
+	goredis "github.com/go-redis/redis/v7"
+	"ratelimit/driver/redis"
+	"strconv"
+	"time"
+)
+
+var defaultRedisPrefix = "penalty:"
+
+// incrScript increments counter of KEYS[1] and sets it to expire in ARGV[1] ms, expiry of an existing counter is
+// only refreshed if ARGV[2] is "1"
+var incrScript = goredis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 or ARGV[2] == "1" then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return n`)
+
+type RedisStoreOption func(s *RedisStore)
+
+// RedisWithPrefix set prefix of redis keys of store, "penalty:" by default
+func RedisWithPrefix(prefix string) RedisStoreOption {
+	return func(s *RedisStore) {
+		s.prefix = prefix
+	}
+}
+
+// RedisStore shares penalties of keys between instances, every key is kept in up to 3 redis keys expiring
+// with violations, strikes and ban of key
+type RedisStore struct {
+	client *redis.McRedis
+	prefix string
+}
+
+func NewRedisStore(client *redis.McRedis, opts ...RedisStoreOption) *RedisStore {
+	s := &RedisStore{
+		client: client,
+		prefix: defaultRedisPrefix,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+func (s *RedisStore) violationsKey(key string) string {
+	return s.prefix + key + ":violations"
+}
+
+func (s *RedisStore) strikesKey(key string) string {
+	return s.prefix + key + ":strikes"
+}
+
+func (s *RedisStore) banKey(key string) string {
+	return s.prefix + key + ":ban"
+}
+
+func (s *RedisStore) Violate(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error) {
+	return incrScript.Run(s.client, []string{s.violationsKey(key)}, window.Milliseconds(), "0").Int64()
+}
+
+func (s *RedisStore) Strike(ctx context.Context, key string, now time.Time, memory time.Duration) (int64, error) {
+	return incrScript.Run(s.client, []string{s.strikesKey(key)}, memory.Milliseconds(), "1").Int64()
+}
+
+// Ban stores end of ban as unix nano time in a key expiring at end of ban
+func (s *RedisStore) Ban(ctx context.Context, key string, now time.Time, until time.Time) error {
+	_, err := s.client.TxPipelined(func(pipeliner goredis.Pipeliner) error {
+		pipeliner.Set(s.banKey(key), until.UnixNano(), until.Sub(now))
+		pipeliner.Del(s.violationsKey(key))
+		return nil
+	})
+	return err
+}
+
+func (s *RedisStore) BannedUntil(ctx context.Context, key string, now time.Time) (time.Time, bool, error) {
+	val, err := s.client.Get(s.banKey(key)).Result()
+	if err == goredis.Nil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	nanos, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	until := time.Unix(0, nanos)
+	if !now.Before(until) {
+		return time.Time{}, false, nil
+	}
+	return until, true, nil
+}
+
+func (s *RedisStore) Unban(ctx context.Context, key string) error {
+	return s.client.Del(s.violationsKey(key), s.strikesKey(key), s.banKey(key)).Err()
+}
@@ -0,0 +1,64 @@
+package penaltybox
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/driver/redis"
+	"testing"
+	"time"
+)
+
+func newTestRedisStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client, err := redis.NewConnection(&redis.SingleConnection{
+		Address: mr.Addr(),
+	})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return NewRedisStore(client, RedisWithPrefix("test:")), mr
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	s, mr := newTestRedisStore(t)
+	now := time.Unix(1700000000, 0)
+
+	for i := int64(1); i <= 3; i++ {
+		n, err := s.Violate(ctx, "k1", now, time.Minute)
+		require.Nil(t, err)
+		assert.Equal(t, i, n)
+	}
+	// violations expire a window after the first one
+	mr.FastForward(time.Minute)
+	n, err := s.Violate(ctx, "k1", now, time.Minute)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+
+	n, err = s.Strike(ctx, "k1", now, time.Hour)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+	until := now.Add(10 * time.Minute)
+	require.Nil(t, s.Ban(ctx, "k1", now, until))
+	assert.False(t, mr.Exists("test:k1:violations"))
+	assert.Equal(t, 10*time.Minute, mr.TTL("test:k1:ban"))
+
+	got, ok, err := s.BannedUntil(ctx, "k1", now)
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.True(t, until.Equal(got))
+	_, ok, _ = s.BannedUntil(ctx, "k1", until)
+	assert.False(t, ok)
+
+	// strikes are remembered from the last one
+	mr.FastForward(30 * time.Minute)
+	n, _ = s.Strike(ctx, "k1", now, time.Hour)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, time.Hour, mr.TTL("test:k1:strikes"))
+
+	require.Nil(t, s.Unban(ctx, "k1"))
+	assert.False(t, mr.Exists("test:k1:strikes"))
+	_, ok, _ = s.BannedUntil(ctx, "k1", now)
+	assert.False(t, ok)
+}
@@ -0,0 +1,21 @@
+package penaltybox
+
+import (
+	"context"
+	"time"
+)
+
+// Store keeps violations, strikes and bans of keys
+type Store interface {
+	// Violate counts a violation of key, counter expires window after first violation of key
+	Violate(ctx context.Context, key string, now time.Time, window time.Duration) (int64, error)
+	// Strike counts a ban of key and returns number of bans of key, they are forgotten once key is not banned
+	// again within memory
+	Strike(ctx context.Context, key string, now time.Time, memory time.Duration) (int64, error)
+	// Ban bans key until end of ban and clears its violations
+	Ban(ctx context.Context, key string, now time.Time, until time.Time) error
+	// BannedUntil returns end of ban of key, ok is false if key is not banned at now
+	BannedUntil(ctx context.Context, key string, now time.Time) (until time.Time, ok bool, err error)
+	// Unban lifts ban of key and forgets its violations and strikes
+	Unban(ctx context.Context, key string) error
+}
@@ -0,0 +1,339 @@
+// Package ratelimitadmin provides an embeddable HTTP handler to inspect and reset keys of rate limit policies
+package ratelimitadmin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"ratelimit/util/ratelimit"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// ErrForbidden is returned by Authorizer to reject a request
+var ErrForbidden = errors.New("forbidden")
+
+// Action is kind of operation authorized by Authorizer
+type Action int
+
+const (
+	// ActionRead lists policies and keys
+	ActionRead Action = iota
+	// ActionWrite resets or sets value of a key
+	ActionWrite
+)
+
+func (a Action) String() string {
+	if a == ActionWrite {
+		return "write"
+	}
+	return "read"
+}
+
+// Authorizer decides if request r may perform action a on policy, policy is empty when policies are listed.
+// Request is rejected with 403 if it returns error
+type Authorizer func(r *http.Request, a Action, policy string) error
+
+// AllowAll authorizes every request, it's meant for handler mounted behind an authenticating middleware
+func AllowAll(*http.Request, Action, string) error {
+	return nil
+}
+
+// BearerToken authorizes requests carrying token in Authorization header
+func BearerToken(token string) Authorizer {
+	return func(r *http.Request, _ Action, _ string) error {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return ErrForbidden
+		}
+		return nil
+	}
+}
+
+// Bans shows and lifts bans of keys, e.g. penaltybox.Box
+type Bans interface {
+	BannedUntil(ctx context.Context, k string) (until time.Time, ok bool, err error)
+	Unban(ctx context.Context, k string) error
+}
+
+// Policy is a rate limit policy managed by Handler
+type Policy struct {
+	Name string
+	// Algorithm, Limit and Period describe policy to operators, e.g. "fixed_window", 100 and time.Minute
+	Algorithm string
+	Limit     int64
+	Period    time.Duration
+	// Limiter resets and sets value of keys
+	Limiter ratelimit.Limiter
+	// Store lists and shows keys, keys of policy without Store can only be reset or set
+	Store ratelimit.Inspector
+	// Bans shows and lifts bans of keys of policy guarded by a penalty box
+	Bans Bans
+}
+
+type policyView struct {
+	Name        string `json:"name"`
+	Algorithm   string `json:"algorithm,omitempty"`
+	Limit       int64  `json:"limit"`
+	Period      string `json:"period"`
+	Inspectable bool   `json:"inspectable"`
+}
+
+func (p Policy) view() policyView {
+	return policyView{
+		Name:        p.Name,
+		Algorithm:   p.Algorithm,
+		Limit:       p.Limit,
+		Period:      p.Period.String(),
+		Inspectable: p.Store != nil,
+	}
+}
+
+type Option func(h *Handler)
+
+// WithAuthorizer set authorizer of requests, by default every request is rejected
+func WithAuthorizer(a Authorizer) Option {
+	return func(h *Handler) {
+		h.authorizer = a
+	}
+}
+
+// WithLogger set logger of handler, changes of keys are logged at info level and store errors at error level.
+// By default, slog.Default() is used
+func WithLogger(l *slog.Logger) Option {
+	return func(h *Handler) {
+		h.logger = l
+	}
+}
+
+// Handler serves admin API of policies, paths are relative so it's mounted with http.StripPrefix:
+//
+//	GET    /policies                         list policies
+//	GET    /policies/{policy}                show a policy
+//	GET    /policies/{policy}/keys           list keys, paginated by cursor and limit query parameters
+//	GET    /policies/{policy}/keys/{key}     show state of a key
+//	PUT    /policies/{policy}/keys/{key}     set value of a key from body {"value": n}
+//	DELETE /policies/{policy}/keys/{key}     reset a key
+//	GET    /policies/{policy}/bans/{key}     show ban of a key
+//	DELETE /policies/{policy}/bans/{key}     unban a key
+type Handler struct {
+	policies   func() []Policy
+	authorizer Authorizer
+	logger     *slog.Logger
+	mux        *http.ServeMux
+}
+
+// New creates handler of a fixed set of policies
+func New(policies []Policy, opts ...Option) *Handler {
+	return NewWithSource(func() []Policy {
+		return policies
+	}, opts...)
+}
+
+// NewWithSource creates handler of policies returned by source, they are resolved on every request so
+// policies changed at runtime are served as they are now, e.g. source is ratelimitconfig.Registry.AdminPolicies
+func NewWithSource(source func() []Policy, opts ...Option) *Handler {
+	h := &Handler{
+		policies: source,
+		authorizer: func(*http.Request, Action, string) error {
+			return ErrForbidden
+		},
+		logger: slog.Default(),
+		mux:    http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.mux.HandleFunc("GET /policies", h.listPolicies)
+	h.mux.HandleFunc("GET /policies/{policy}", h.withPolicy(ActionRead, h.showPolicy))
+	h.mux.HandleFunc("GET /policies/{policy}/keys", h.withPolicy(ActionRead, h.listKeys))
+	h.mux.HandleFunc("GET /policies/{policy}/keys/{key}", h.withPolicy(ActionRead, h.showKey))
+	h.mux.HandleFunc("PUT /policies/{policy}/keys/{key}", h.withPolicy(ActionWrite, h.setKey))
+	h.mux.HandleFunc("DELETE /policies/{policy}/keys/{key}", h.withPolicy(ActionWrite, h.resetKey))
+	h.mux.HandleFunc("GET /policies/{policy}/bans/{key}", h.withPolicy(ActionRead, h.showBan))
+	h.mux.HandleFunc("DELETE /policies/{policy}/bans/{key}", h.withPolicy(ActionWrite, h.unban))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) listPolicies(w http.ResponseWriter, r *http.Request) {
+	if err := h.authorizer(r, ActionRead, ""); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	policies := h.policies()
+	views := make([]policyView, 0, len(policies))
+	for _, p := range policies {
+		views = append(views, p.view())
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// withPolicy resolves policy of request and authorizes action a on it before calling next
+func (h *Handler) withPolicy(a Action, next func(w http.ResponseWriter, r *http.Request, p Policy)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("policy")
+		if err := h.authorizer(r, a, name); err != nil {
+			writeError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		p, ok := h.policy(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, "policy not found")
+			return
+		}
+		next(w, r, p)
+	}
+}
+
+// policy returns policy by name from policies of the time of request
+func (h *Handler) policy(name string) (Policy, bool) {
+	for _, p := range h.policies() {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Policy{}, false
+}
+
+func (h *Handler) showPolicy(w http.ResponseWriter, r *http.Request, p Policy) {
+	writeJSON(w, http.StatusOK, p.view())
+}
+
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request, p Policy) {
+	if p.Store == nil {
+		writeError(w, http.StatusNotImplemented, "keys of policy can not be listed")
+		return
+	}
+	limit := defaultPageSize
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxPageSize)
+	}
+
+	page, err := p.Store.Keys(r.Context(), r.URL.Query().Get("cursor"), limit)
+	if err != nil {
+		h.logger.Error("failed to list keys", slog.String("policy", p.Name), slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to list keys")
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (h *Handler) showKey(w http.ResponseWriter, r *http.Request, p Policy) {
+	if p.Store == nil {
+		writeError(w, http.StatusNotImplemented, "keys of policy can not be listed")
+		return
+	}
+	key := r.PathValue("key")
+	state, ok, err := p.Store.State(r.Context(), key)
+	if err != nil {
+		h.logger.Error("failed to get key state", slog.String("policy", p.Name), ratelimit.LogKey(key),
+			slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to get key state")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "key not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+type setKeyRequest struct {
+	Value *int64 `json:"value"`
+}
+
+func (h *Handler) setKey(w http.ResponseWriter, r *http.Request, p Policy) {
+	var req setKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Value == nil || *req.Value < 0 {
+		writeError(w, http.StatusBadRequest, "body must be {\"value\": n} with n >= 0")
+		return
+	}
+	h.reset(w, r, p, *req.Value)
+}
+
+func (h *Handler) resetKey(w http.ResponseWriter, r *http.Request, p Policy) {
+	h.reset(w, r, p, 0)
+}
+
+func (h *Handler) reset(w http.ResponseWriter, r *http.Request, p Policy, value int64) {
+	key := r.PathValue("key")
+	if err := p.Limiter.Reset(r.Context(), key, value); err != nil {
+		h.logger.Error("failed to reset key", slog.String("policy", p.Name), ratelimit.LogKey(key),
+			slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to reset key")
+		return
+	}
+	h.logger.Info("key is reset by admin", slog.String("policy", p.Name), ratelimit.LogKey(key),
+		slog.Int64("value", value))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type banView struct {
+	Key         string    `json:"key"`
+	BannedUntil time.Time `json:"banned_until"`
+}
+
+func (h *Handler) showBan(w http.ResponseWriter, r *http.Request, p Policy) {
+	if p.Bans == nil {
+		writeError(w, http.StatusNotImplemented, "policy has no penalty box")
+		return
+	}
+	key := r.PathValue("key")
+	until, ok, err := p.Bans.BannedUntil(r.Context(), key)
+	if err != nil {
+		h.logger.Error("failed to get ban of key", slog.String("policy", p.Name), ratelimit.LogKey(key),
+			slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to get ban of key")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "key is not banned")
+		return
+	}
+	writeJSON(w, http.StatusOK, banView{Key: key, BannedUntil: until})
+}
+
+func (h *Handler) unban(w http.ResponseWriter, r *http.Request, p Policy) {
+	if p.Bans == nil {
+		writeError(w, http.StatusNotImplemented, "policy has no penalty box")
+		return
+	}
+	key := r.PathValue("key")
+	if err := p.Bans.Unban(r.Context(), key); err != nil {
+		h.logger.Error("failed to unban key", slog.String("policy", p.Name), ratelimit.LogKey(key),
+			slog.Any("error", err))
+		writeError(w, http.StatusInternalServerError, "failed to unban key")
+		return
+	}
+	h.logger.Info("key is unbanned by admin", slog.String("policy", p.Name), ratelimit.LogKey(key))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
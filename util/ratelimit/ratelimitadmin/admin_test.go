@@ -0,0 +1,190 @@
+package ratelimitadmin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHandler(t *testing.T, opts ...Option) (*Handler, *fixedwindow.Limiter) {
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	store := fixedwindow.NewMemStore(time.Minute, fixedwindow.MemWithClock(clock))
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	l := fixedwindow.New(time.Minute, 10, fixedwindow.WithStore(store), fixedwindow.WithClock(clock))
+	h := New([]Policy{
+		{Name: "api", Algorithm: "fixed_window", Limit: 10, Period: time.Minute, Limiter: l, Store: store},
+		{Name: "login", Limiter: l},
+	}, append([]Option{WithAuthorizer(AllowAll)}, opts...)...)
+	return h, l
+}
+
+func serve(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return res
+}
+
+func TestHandler_Policies(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	res := serve(h, http.MethodGet, "/policies", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `[
+		{"name":"api","algorithm":"fixed_window","limit":10,"period":"1m0s","inspectable":true},
+		{"name":"login","limit":0,"period":"0s","inspectable":false}
+	]`, res.Body.String())
+
+	res = serve(h, http.MethodGet, "/policies/login", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	res = serve(h, http.MethodGet, "/policies/unknown", "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	res = serve(h, http.MethodGet, "/policies/login/keys", "")
+	assert.Equal(t, http.StatusNotImplemented, res.Code)
+}
+
+func TestHandler_Keys(t *testing.T) {
+	h, l := newTestHandler(t)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_, _, err := l.Allow(ctx, fmt.Sprintf("k%d", i), int64(i+1))
+		require.Nil(t, err)
+	}
+
+	var keys []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		res := serve(h, http.MethodGet, "/policies/api/keys?limit=2&cursor="+cursor, "")
+		require.Equal(t, http.StatusOK, res.Code)
+		var page ratelimit.KeyPage
+		require.Nil(t, json.Unmarshal(res.Body.Bytes(), &page))
+		for _, s := range page.Keys {
+			keys = append(keys, s.Key)
+		}
+		if page.Next == "" {
+			break
+		}
+		cursor = page.Next
+	}
+	assert.Equal(t, []string{"k0", "k1", "k2", "k3", "k4"}, keys)
+
+	res := serve(h, http.MethodGet, "/policies/api/keys?limit=0", "")
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = serve(h, http.MethodGet, "/policies/api/keys/k3", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"key":"k3","value":4,"expire":"`+time.Unix(1700000040, 0).Format(time.RFC3339)+`"}`,
+		res.Body.String())
+}
+
+func TestHandler_Reset(t *testing.T) {
+	h, l := newTestHandler(t)
+	ctx := context.Background()
+	_, _, err := l.Allow(ctx, "a/b", 10)
+	require.Nil(t, err)
+
+	// key is escaped as a single path segment
+	res := serve(h, http.MethodPut, "/policies/api/keys/a%2Fb", `{"value": 3}`)
+	require.Equal(t, http.StatusNoContent, res.Code)
+	res = serve(h, http.MethodGet, "/policies/api/keys/a%2Fb", "")
+	assert.Contains(t, res.Body.String(), `"value":3`)
+
+	res = serve(h, http.MethodPut, "/policies/api/keys/a%2Fb", `{"value": -1}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+	res = serve(h, http.MethodPut, "/policies/api/keys/a%2Fb", `{}`)
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = serve(h, http.MethodDelete, "/policies/api/keys/a%2Fb", "")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	_, allowed, err := l.Allow(ctx, "a/b", 10)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+}
+
+func TestHandler_Authorizer(t *testing.T) {
+	readOnly := func(r *http.Request, a Action, policy string) error {
+		if a == ActionWrite {
+			return ErrForbidden
+		}
+		return nil
+	}
+	h, _ := newTestHandler(t, WithAuthorizer(readOnly))
+	assert.Equal(t, http.StatusOK, serve(h, http.MethodGet, "/policies/api/keys", "").Code)
+	assert.Equal(t, http.StatusForbidden, serve(h, http.MethodDelete, "/policies/api/keys/k1", "").Code)
+
+	h = New(nil)
+	assert.Equal(t, http.StatusForbidden, serve(h, http.MethodGet, "/policies", "").Code)
+
+	h = New(nil, WithAuthorizer(BearerToken("secret")))
+	req := httptest.NewRequest(http.MethodGet, "/policies", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res := httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, http.StatusForbidden, serve(h, http.MethodGet, "/policies", "").Code)
+}
+
+// testBans bans keys until their time
+type testBans map[string]time.Time
+
+func (b testBans) BannedUntil(ctx context.Context, k string) (time.Time, bool, error) {
+	until, ok := b[k]
+	return until, ok, nil
+}
+
+func (b testBans) Unban(ctx context.Context, k string) error {
+	delete(b, k)
+	return nil
+}
+
+func TestHandler_Bans(t *testing.T) {
+	_, l := newTestHandler(t)
+	until := time.Unix(1700000040, 0)
+	bans := testBans{"k1": until}
+	h := New([]Policy{{Name: "api", Limiter: l, Bans: bans}, {Name: "login", Limiter: l}},
+		WithAuthorizer(AllowAll))
+
+	res := serve(h, http.MethodGet, "/policies/api/bans/k1", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"key":"k1","banned_until":"`+until.Format(time.RFC3339)+`"}`, res.Body.String())
+
+	res = serve(h, http.MethodDelete, "/policies/api/bans/k1", "")
+	require.Equal(t, http.StatusNoContent, res.Code)
+	assert.Empty(t, bans)
+	res = serve(h, http.MethodGet, "/policies/api/bans/k1", "")
+	assert.Equal(t, http.StatusNotFound, res.Code)
+
+	res = serve(h, http.MethodDelete, "/policies/login/bans/k1", "")
+	assert.Equal(t, http.StatusNotImplemented, res.Code)
+}
+
+func TestHandler_Source(t *testing.T) {
+	policies := []Policy{{Name: "api", Limit: 10}}
+	h := NewWithSource(func() []Policy {
+		return policies
+	}, WithAuthorizer(AllowAll))
+
+	res := serve(h, http.MethodGet, "/policies/api", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"name":"api","limit":10,"period":"0s","inspectable":false}`, res.Body.String())
+
+	// policies changed after handler is created are served as they are now
+	policies = []Policy{{Name: "api", Limit: 20}, {Name: "login"}}
+	res = serve(h, http.MethodGet, "/policies/api", "")
+	require.Equal(t, http.StatusOK, res.Code)
+	assert.JSONEq(t, `{"name":"api","limit":20,"period":"0s","inspectable":false}`, res.Body.String())
+	res = serve(h, http.MethodGet, "/policies/login", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+}
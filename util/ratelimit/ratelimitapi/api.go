@@ -0,0 +1,81 @@
+// Package ratelimitapi exposes limiters over an HTTP/JSON decision API and provides a Go client implementing
+// ratelimit.Limiter by calling it, so services written in any language share the same quotas.
+//
+// Every endpoint accepts a single Request and responds with a single Result, or a batch
+// {"requests": [...]} answered by {"results": [...]} in the same order:
+//
+//	POST /v1/allow    check and consume events of keys
+//	POST /v1/peek     check keys without consuming events
+//	POST /v1/reset    set counter of keys to value, zero by default
+package ratelimitapi
+
+import (
+	"fmt"
+	"ratelimit/util/ratelimit"
+	"time"
+)
+
+// Request is a check or reset of key of policy
+type Request struct {
+	Policy string `json:"policy"`
+	Key    string `json:"key"`
+	// Weight of event checked by allow and peek, 1 if it's omitted. An explicit zero checks key without
+	// consuming events
+	Weight *int64 `json:"weight,omitempty"`
+	// Value of counter set by reset
+	Value int64 `json:"value,omitempty"`
+}
+
+// Result is result of a Request, decision fields are left zero by reset and by failed requests
+type Result struct {
+	Policy  string `json:"policy"`
+	Key     string `json:"key"`
+	Allowed bool   `json:"allowed"`
+	// Limit is bucket size or quota of key and Remaining is number of events still allowed
+	Limit     int64 `json:"limit"`
+	Remaining int64 `json:"remaining"`
+	// RetryAfterMs is time until event is allowed, zero if it's allowed
+	RetryAfterMs int64        `json:"retry_after_ms"`
+	Reservation  *Reservation `json:"reservation,omitempty"`
+	// Status and Error are HTTP status and message of a failed request
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Err returns error of failed result, it's nil if request succeeded
+func (r *Result) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	return &Error{Status: r.Status, Message: r.Error}
+}
+
+// Reservation is ratelimit.Reservation on the wire
+type Reservation struct {
+	Req       float64   `json:"req"`
+	Bucket    int64     `json:"bucket"`
+	TimeToAct time.Time `json:"time_to_act"`
+	Last      time.Time `json:"last"`
+}
+
+func (r *Reservation) reservation() *ratelimit.Reservation {
+	return &ratelimit.Reservation{Req: r.Req, Bucket: r.Bucket, TimeToAct: r.TimeToAct, Last: r.Last}
+}
+
+type batchRequest struct {
+	Requests []Request `json:"requests"`
+}
+
+type batchResponse struct {
+	Results []Result `json:"results"`
+}
+
+// Error is error reported by server, Status is HTTP status of request or of the failed item of a batch
+type Error struct {
+	Status  int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ratelimitapi: %s (status %d)", e.Message, e.Status)
+}
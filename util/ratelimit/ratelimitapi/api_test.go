@@ -0,0 +1,218 @@
+package ratelimitapi
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"ratelimit/util/ratelimit/leakybucket"
+	"ratelimit/util/ratelimit/ratelimitadmin"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errStoreDown = errors.New("store is down")
+
+type failedLimiter struct{}
+
+func (failedLimiter) Allow(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, errStoreDown
+}
+
+func (failedLimiter) Reset(context.Context, string, int64) error {
+	return errStoreDown
+}
+
+func newTestServer(t *testing.T, opts ...Option) (*Client, *clocktest.FakeClock) {
+	// start of a minute window
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	fixed := fixedwindow.New(time.Minute, 3, fixedwindow.WithClock(clock))
+	leaky := leakybucket.New(1, 10*time.Second, 2, leakybucket.WithClock(clock))
+	t.Cleanup(func() {
+		_ = fixed.Close()
+		_ = leaky.Close()
+	})
+
+	h := New(map[string]ratelimit.Limiter{"fixed": fixed, "leaky": leaky, "down": failedLimiter{}},
+		append([]Option{WithClock(clock)}, opts...)...)
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	return NewClient(srv.URL+"/", ClientWithToken("secret")), clock
+}
+
+func TestClient_Limiter(t *testing.T) {
+	c, clock := newTestServer(t)
+	ctx := context.Background()
+	l := c.Limiter("leaky")
+
+	for i := 0; i < 2; i++ {
+		r, allowed, err := l.Allow(ctx, "k1", 1)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+		assert.Equal(t, int64(2), r.Bucket)
+	}
+	r, allowed, err := l.Allow(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 10*time.Second, r.DelayFrom(clock.Now()))
+
+	// peek does not consume events
+	clock.Advance(10 * time.Second)
+	for i := 0; i < 2; i++ {
+		_, allowed, err = l.Peek(ctx, "k1", 1)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	_, allowed, _ = l.Peek(ctx, "k1", 2)
+	assert.False(t, allowed)
+
+	// explicit zero weight is not defaulted to 1
+	_, _, _ = l.Allow(ctx, "k1", 1)
+	r, allowed, err = l.Allow(ctx, "k1", 0)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, float64(2), r.Req)
+
+	require.Nil(t, l.Reset(ctx, "k1", 0))
+	_, allowed, _ = l.Allow(ctx, "k1", 2)
+	assert.True(t, allowed)
+
+	var apiErr *Error
+	_, _, err = c.Limiter("missing").Allow(ctx, "k1", 1)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusNotFound, apiErr.Status)
+
+	_, _, err = c.Limiter("down").Allow(ctx, "k1", 1)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.Status)
+	_, _, err = c.Limiter("down").Peek(ctx, "k1", 1)
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusNotImplemented, apiErr.Status)
+	assert.ErrorContains(t, c.Limiter("down").Reset(ctx, "k1", 0), "failed to reset key")
+}
+
+func TestClient_Batch(t *testing.T) {
+	c, clock := newTestServer(t)
+	ctx := context.Background()
+	clock.Advance(20 * time.Second)
+
+	weight := int64(2)
+	results, err := c.Allow(ctx,
+		Request{Policy: "fixed", Key: "k1", Weight: &weight},
+		Request{Policy: "fixed", Key: "k1", Weight: &weight},
+		Request{Policy: "leaky", Key: "k1"},
+		Request{Policy: "fixed"})
+	require.Nil(t, err)
+	require.Len(t, results, 4)
+
+	assert.True(t, results[0].Allowed)
+	assert.Equal(t, int64(1), results[0].Remaining)
+	assert.False(t, results[1].Allowed)
+	assert.Equal(t, int64(0), results[1].Remaining)
+	assert.Equal(t, int64(40000), results[1].RetryAfterMs)
+	assert.Equal(t, int64(3), results[1].Limit)
+	assert.True(t, results[2].Allowed)
+	assert.Equal(t, http.StatusBadRequest, results[3].Status)
+	assert.NotNil(t, results[3].Err())
+	assert.Nil(t, results[0].Err())
+
+	results, err = c.Peek(ctx, Request{Policy: "fixed", Key: "k1"}, Request{Policy: "fixed", Key: "k2"})
+	require.Nil(t, err)
+	assert.False(t, results[0].Allowed)
+	assert.True(t, results[1].Allowed)
+	assert.Equal(t, int64(3), results[1].Remaining)
+
+	reqs := make([]Request, maxBatchSize+1)
+	_, err = c.Allow(ctx, reqs...)
+	var apiErr *Error
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusBadRequest, apiErr.Status)
+}
+
+func TestHandler_Peek(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	store := leakybucket.NewMemStore(time.Minute, leakybucket.MemWithClock(clock))
+	defer store.Close()
+	l := leakybucket.New(1, 10*time.Second, 2, leakybucket.WithStore(store), leakybucket.WithClock(clock))
+	defer l.Close()
+	srv := httptest.NewServer(New(map[string]ratelimit.Limiter{"leaky": l}, WithClock(clock)))
+	defer srv.Close()
+	c := NewClient(srv.URL)
+
+	// peek of unknown key does not write it
+	results, err := c.Peek(ctx, Request{Policy: "leaky", Key: "k1"})
+	require.Nil(t, err)
+	assert.True(t, results[0].Allowed)
+	assert.Equal(t, int64(2), results[0].Remaining)
+	_, ok, err := store.State(ctx, "k1")
+	require.Nil(t, err)
+	assert.False(t, ok)
+
+	// peek tells when an event of weight fits
+	_, _, _ = l.Allow(ctx, "k1", 2)
+	clock.Advance(5 * time.Second)
+	weight := int64(2)
+	results, err = c.Peek(ctx, Request{Policy: "leaky", Key: "k1", Weight: &weight})
+	require.Nil(t, err)
+	assert.False(t, results[0].Allowed)
+	assert.Equal(t, int64(0), results[0].Remaining)
+	assert.Equal(t, int64(15000), results[0].RetryAfterMs)
+	state, _, _ := store.State(ctx, "k1")
+	assert.Equal(t, float64(2), state.Value)
+	assert.Equal(t, clock.Now().Add(-5*time.Second), *state.Last)
+}
+
+func TestHandler(t *testing.T) {
+	c, _ := newTestServer(t, WithAuthorizer(func(r *http.Request, a ratelimitadmin.Action, policy string) error {
+		if a == ratelimitadmin.ActionWrite && policy == "leaky" {
+			return ratelimitadmin.ErrForbidden
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{name: "single", path: "/v1/allow", body: `{"policy": "fixed", "key": "k1"}`, wantCode: http.StatusOK,
+			wantBody: `"allowed":true,"limit":3,"remaining":2`},
+		{name: "forbidden", path: "/v1/reset", body: `{"policy": "leaky", "key": "k1"}`,
+			wantCode: http.StatusForbidden, wantBody: `"error":"forbidden"`},
+		{name: "read is authorized", path: "/v1/peek", body: `{"policy": "leaky", "key": "k1"}`,
+			wantCode: http.StatusOK, wantBody: `"allowed":true`},
+		{name: "unknown field", path: "/v1/allow", body: `{"policy": "fixed", "key": "k1", "wieght": 2}`,
+			wantCode: http.StatusBadRequest, wantBody: `unknown field`},
+		{name: "invalid json", path: "/v1/allow", body: `[`, wantCode: http.StatusBadRequest},
+		{name: "negative weight", path: "/v1/allow", body: `{"policy": "fixed", "key": "k1", "weight": -1}`,
+			wantCode: http.StatusBadRequest},
+		{name: "batch", path: "/v1/reset", body: `{"requests": [{"policy": "leaky", "key": "k1"}]}`,
+			wantCode: http.StatusOK, wantBody: `"results":[{"policy":"leaky","key":"k1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(c.baseURL+tt.path, "application/json", strings.NewReader(tt.body))
+			require.Nil(t, err)
+			defer resp.Body.Close()
+			var b strings.Builder
+			_, _ = io.Copy(&b, resp.Body)
+			assert.Equal(t, tt.wantCode, resp.StatusCode)
+			assert.Contains(t, b.String(), tt.wantBody)
+		})
+	}
+
+	resp, err := http.Get(c.baseURL + "/v1/allow")
+	require.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
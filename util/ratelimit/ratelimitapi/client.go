@@ -0,0 +1,154 @@
+package ratelimitapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"ratelimit/util/ratelimit"
+	"strings"
+	"time"
+)
+
+var defaultClientTimeout = 2 * time.Second
+
+type ClientOption func(c *Client)
+
+// ClientWithHTTPClient set HTTP client used to call server, by default a client with 2s timeout is used
+func ClientWithHTTPClient(hc *http.Client) ClientOption {
+	return func(c *Client) {
+		c.http = hc
+	}
+}
+
+// ClientWithToken set bearer token sent in Authorization header
+func ClientWithToken(token string) ClientOption {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// Client calls decision API served by Handler
+type Client struct {
+	baseURL string
+	http    *http.Client
+	token   string
+}
+
+// NewClient creates client of server at baseURL, e.g. http://ratelimit:8080
+func NewClient(baseURL string, opts ...ClientOption) *Client {
+	c := &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		http:    &http.Client{Timeout: defaultClientTimeout},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Allow checks and consumes events of reqs in a single call, results are in order of reqs and failed requests
+// are reported by Result.Err
+func (c *Client) Allow(ctx context.Context, reqs ...Request) ([]Result, error) {
+	return c.batch(ctx, "/v1/allow", reqs)
+}
+
+// Peek checks events of reqs without consuming them
+func (c *Client) Peek(ctx context.Context, reqs ...Request) ([]Result, error) {
+	return c.batch(ctx, "/v1/peek", reqs)
+}
+
+// Reset set counter of keys of reqs to their value
+func (c *Client) Reset(ctx context.Context, reqs ...Request) ([]Result, error) {
+	return c.batch(ctx, "/v1/reset", reqs)
+}
+
+func (c *Client) batch(ctx context.Context, path string, reqs []Request) ([]Result, error) {
+	var resp batchResponse
+	if err := c.post(ctx, path, batchRequest{Requests: reqs}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Results) != len(reqs) {
+		return nil, fmt.Errorf("ratelimitapi: got %d results of %d requests", len(resp.Results), len(reqs))
+	}
+	return resp.Results, nil
+}
+
+func (c *Client) post(ctx context.Context, path string, body, v any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		if e.Error == "" {
+			e.Error = http.StatusText(resp.StatusCode)
+		}
+		return &Error{Status: resp.StatusCode, Message: e.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Limiter returns ratelimit.Limiter checking keys of policy on server, it's a drop-in replacement of a local
+// limiter of the same policy
+func (c *Client) Limiter(policy string) *Limiter {
+	return &Limiter{client: c, policy: policy}
+}
+
+// Limiter implements ratelimit.Limiter by calling server
+type Limiter struct {
+	client *Client
+	policy string
+}
+
+var _ ratelimit.Limiter = (*Limiter)(nil)
+
+func (l *Limiter) Allow(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	return l.check(ctx, "/v1/allow", k, v)
+}
+
+// Peek checks event k with weight of v without consuming it
+func (l *Limiter) Peek(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	return l.check(ctx, "/v1/peek", k, v)
+}
+
+func (l *Limiter) check(ctx context.Context, path, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	results, err := l.client.batch(ctx, path, []Request{{Policy: l.policy, Key: k, Weight: &v}})
+	if err != nil {
+		return nil, false, err
+	}
+	res := results[0]
+	if err := res.Err(); err != nil {
+		return nil, false, err
+	}
+	if res.Reservation == nil {
+		return nil, false, fmt.Errorf("ratelimitapi: result of %q has no reservation", k)
+	}
+	return res.Reservation.reservation(), res.Allowed, nil
+}
+
+func (l *Limiter) Reset(ctx context.Context, k string, v int64) error {
+	results, err := l.client.Reset(ctx, Request{Policy: l.policy, Key: k, Value: v})
+	if err != nil {
+		return err
+	}
+	return results[0].Err()
+}
@@ -0,0 +1,228 @@
+package ratelimitapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/ratelimitadmin"
+	"time"
+)
+
+var (
+	maxBatchSize       = 100
+	maxRequestBodySize = int64(1 << 20)
+)
+
+// operation is an endpoint of API
+type operation int
+
+const (
+	opAllow operation = iota
+	opPeek
+	opReset
+)
+
+type Option func(h *Handler)
+
+// WithAuthorizer set authorizer of requests, allow and reset are authorized as ratelimitadmin.ActionWrite and
+// peek as ratelimitadmin.ActionRead on policy of every request. By default, every request is authorized
+// since API is meant to be called by services of a private network
+func WithAuthorizer(a ratelimitadmin.Authorizer) Option {
+	return func(h *Handler) {
+		h.authorizer = a
+	}
+}
+
+// WithLogger set logger of handler, limiter errors are logged at error level. By default, slog.Default() is used
+func WithLogger(l *slog.Logger) Option {
+	return func(h *Handler) {
+		h.logger = l
+	}
+}
+
+// WithClock set clock used to compute retry after of results
+func WithClock(c ratelimit.Clock) Option {
+	return func(h *Handler) {
+		h.clock = c
+	}
+}
+
+// Handler serves decision API backed by limiters of policies
+type Handler struct {
+	limiters   map[string]ratelimit.Limiter
+	authorizer ratelimitadmin.Authorizer
+	logger     *slog.Logger
+	clock      ratelimit.Clock
+	mux        *http.ServeMux
+}
+
+// New creates handler of limiters by policy name
+func New(limiters map[string]ratelimit.Limiter, opts ...Option) *Handler {
+	h := &Handler{
+		limiters:   limiters,
+		authorizer: ratelimitadmin.AllowAll,
+		logger:     slog.Default(),
+		clock:      ratelimit.SystemClock,
+		mux:        http.NewServeMux(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	h.mux.HandleFunc("POST /v1/allow", h.serve(opAllow))
+	h.mux.HandleFunc("POST /v1/peek", h.serve(opPeek))
+	h.mux.HandleFunc("POST /v1/reset", h.serve(opReset))
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) serve(op operation) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+		if err != nil {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body is too large")
+			return
+		}
+
+		// batch is told apart from a single request by its requests field
+		var probe struct {
+			Requests json.RawMessage `json:"requests"`
+		}
+		if err := json.Unmarshal(body, &probe); err != nil {
+			writeError(w, http.StatusBadRequest, "body must be a request or {\"requests\": [...]}")
+			return
+		}
+
+		if probe.Requests == nil {
+			var req Request
+			if err := decodeStrict(body, &req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+				return
+			}
+			res := h.do(r, op, req)
+			code := http.StatusOK
+			if res.Status != 0 {
+				code = res.Status
+			}
+			writeJSON(w, code, res)
+			return
+		}
+
+		var batch batchRequest
+		if err := decodeStrict(body, &batch); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid batch: "+err.Error())
+			return
+		}
+		if len(batch.Requests) > maxBatchSize {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("batch is larger than %d requests", maxBatchSize))
+			return
+		}
+		resp := batchResponse{Results: make([]Result, 0, len(batch.Requests))}
+		for _, req := range batch.Requests {
+			resp.Results = append(resp.Results, h.do(r, op, req))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// do runs operation op of req, failure is reported by status and error of result
+func (h *Handler) do(r *http.Request, op operation, req Request) Result {
+	res := Result{Policy: req.Policy, Key: req.Key}
+	fail := func(status int, msg string) Result {
+		res.Status, res.Error = status, msg
+		return res
+	}
+
+	if req.Key == "" {
+		return fail(http.StatusBadRequest, "key is required")
+	}
+	if (req.Weight != nil && *req.Weight < 0) || req.Value < 0 {
+		return fail(http.StatusBadRequest, "weight and value must not be negative")
+	}
+	action := ratelimitadmin.ActionWrite
+	if op == opPeek {
+		action = ratelimitadmin.ActionRead
+	}
+	if err := h.authorizer(r, action, req.Policy); err != nil {
+		return fail(http.StatusForbidden, err.Error())
+	}
+	l, ok := h.limiters[req.Policy]
+	if !ok {
+		return fail(http.StatusNotFound, "policy not found")
+	}
+
+	ctx := r.Context()
+	if op == opReset {
+		if err := l.Reset(ctx, req.Key, req.Value); err != nil {
+			h.logger.ErrorContext(ctx, "failed to reset key", slog.String("policy", req.Policy),
+				ratelimit.LogKey(req.Key), slog.Any("error", err))
+			return fail(http.StatusServiceUnavailable, "failed to reset key")
+		}
+		return res
+	}
+
+	weight := int64(1)
+	if req.Weight != nil {
+		weight = *req.Weight
+	}
+	now := h.clock.Now()
+	var rsv *ratelimit.Reservation
+	var err error
+	if op == opPeek {
+		// peek reads usage of key, so limiters which can only count events are not peeked
+		p, ok := l.(ratelimit.Peeker)
+		if !ok {
+			return fail(http.StatusNotImplemented, "policy can not be peeked")
+		}
+		rsv, res.Allowed, err = p.Peek(ctx, req.Key, weight)
+		if errors.Is(err, ratelimit.ErrPeekNotSupported) {
+			return fail(http.StatusNotImplemented, "policy can not be peeked")
+		}
+	} else {
+		rsv, res.Allowed, err = l.Allow(ctx, req.Key, weight)
+	}
+	if err != nil {
+		h.logger.ErrorContext(ctx, "failed to check key", slog.String("policy", req.Policy),
+			ratelimit.LogKey(req.Key), slog.Any("error", err))
+		return fail(http.StatusServiceUnavailable, "failed to check key")
+	}
+
+	res.Limit = rsv.Bucket
+	res.Remaining = max(0, rsv.Bucket-int64(math.Ceil(rsv.Req)))
+	// retry after is rounded up so a client waiting for it is not denied again
+	res.RetryAfterMs = int64(math.Ceil(float64(rsv.DelayFrom(now)) / float64(time.Millisecond)))
+	res.Reservation = &Reservation{Req: rsv.Req, Bucket: rsv.Bucket, TimeToAct: rsv.TimeToAct, Last: rsv.Last}
+	return res
+}
+
+// decodeStrict decodes data into v rejecting unknown fields
+func decodeStrict(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after request")
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,548 @@
+package ratelimitconfig
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"ratelimit/driver/redis"
+	"ratelimit/middleware"
+	"ratelimit/util"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"ratelimit/util/ratelimit/leakybucket"
+	"ratelimit/util/ratelimit/penaltybox"
+	"ratelimit/util/ratelimit/ratelimitadmin"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Option func(b *builder)
+
+// WithRedisClient set client of redis store, store is connected to its address otherwise
+func WithRedisClient(store string, c *redis.McRedis) Option {
+	return func(b *builder) {
+		b.clients[store] = c
+	}
+}
+
+// WithLogger set logger passed to limiters, stores and middlewares
+func WithLogger(l *slog.Logger) Option {
+	return func(b *builder) {
+		b.logger = l
+	}
+}
+
+// WithClock set clock passed to limiters and stores
+func WithClock(c ratelimit.Clock) Option {
+	return func(b *builder) {
+		b.clock = c
+	}
+}
+
+// WithMiddlewareOptions set options applied to middleware of every policy, e.g. exceed handler or tracer
+func WithMiddlewareOptions(opts ...middleware.RateLimitOption) Option {
+	return func(b *builder) {
+		b.midOpts = append(b.midOpts, opts...)
+	}
+}
+
+// Policy is a policy built from PolicyConfig
+type Policy struct {
+	Config  PolicyConfig
+	Limiter ratelimit.Limiter
+	// Middleware checks requests by Limiter with key extracted as configured
+	Middleware *middleware.LimitMid
+	// Store lists keys of policy, it's nil if store of policy can not list keys
+	Store ratelimit.Inspector
+	// Box bans keys of policy, it wraps Limiter and it's nil if policy has no penalty box
+	Box    *penaltybox.Box
+	routes []route
+	// update applies limits of config to limiter and store of policy
+	update func(pc PolicyConfig) error
+}
+
+// Match reports if request r is checked by policy
+func (p *Policy) Match(r *http.Request) bool {
+	if len(p.routes) == 0 {
+		return true
+	}
+	for _, rt := range p.routes {
+		if (rt.method == "" || rt.method == r.Method) && strings.HasPrefix(r.URL.Path, rt.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Registry holds policies built from Config, limits and routes of policies are replaced by Apply
+type Registry struct {
+	// state is replaced as a whole by Apply so requests see either old or new policies
+	state   atomic.Pointer[registryState]
+	closers []io.Closer
+}
+
+type registryState struct {
+	cfg      *Config
+	policies []*Policy
+	byName   map[string]*Policy
+}
+
+type builder struct {
+	cfg     *Config
+	clients map[string]*redis.McRedis
+	logger  *slog.Logger
+	clock   ratelimit.Clock
+	midOpts []middleware.RateLimitOption
+	reg     *Registry
+}
+
+// Build validates cfg and builds its policies, stores and redis connections created by Build are released by
+// Registry.Close
+func Build(cfg *Config, opts ...Option) (*Registry, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	b := &builder{
+		cfg:     cfg,
+		clients: make(map[string]*redis.McRedis),
+		logger:  slog.Default(),
+		clock:   ratelimit.SystemClock,
+		reg:     &Registry{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	s := &registryState{cfg: cfg, byName: make(map[string]*Policy)}
+	for i, pc := range cfg.Policies {
+		p, err := b.policy(pc)
+		if err != nil {
+			_ = b.reg.Close()
+			return nil, fmt.Errorf("policies[%d]: %w", i, err)
+		}
+		s.policies = append(s.policies, p)
+		s.byName[pc.Name] = p
+	}
+	b.reg.state.Store(s)
+	return b.reg, nil
+}
+
+func (b *builder) policy(pc PolicyConfig) (*Policy, error) {
+	p := &Policy{Config: pc, routes: parseRoutes(pc.Routes)}
+
+	var errPolicy ratelimit.ErrorPolicy
+	if pc.ErrorPolicy != "" {
+		errPolicy, _ = ratelimit.ParseErrorPolicy(pc.ErrorPolicy)
+	}
+	scale := pc.FallbackScale
+	if scale == 0 {
+		scale = 1
+	}
+
+	switch pc.Algorithm {
+	case AlgorithmFixedWindow, AlgorithmRollingWindow:
+		store, err := b.fixedWindowStore(pc)
+		if err != nil {
+			return nil, err
+		}
+		l := fixedwindow.New(pc.Period, pc.Quota, fixedwindow.WithStore(store), fixedwindow.WithName(pc.Name),
+			fixedwindow.WithClock(b.clock), fixedwindow.WithLogger(b.logger), fixedwindow.WithErrorPolicy(errPolicy),
+			fixedwindow.WithFallbackScale(scale))
+		b.reg.closers = append(b.reg.closers, l)
+		p.Limiter = l
+		p.Store, _ = store.(ratelimit.Inspector)
+		p.update = func(pc PolicyConfig) error {
+			// store is set by WithStore so limiter leaves its window to us
+			if u, ok := store.(fixedwindow.WindowUpdater); ok && u.Window() != pc.Period {
+				u.UpdateWindow(pc.Period)
+			}
+			return l.Update(pc.Period, pc.Quota)
+		}
+	case AlgorithmLeakyBucket:
+		store, err := b.leakyBucketStore(pc)
+		if err != nil {
+			return nil, err
+		}
+		l := leakybucket.New(pc.Rate, pc.Period, pc.Burst, leakybucket.WithStore(store),
+			leakybucket.WithName(pc.Name), leakybucket.WithClock(b.clock), leakybucket.WithLogger(b.logger),
+			leakybucket.WithErrorPolicy(errPolicy), leakybucket.WithFallbackScale(scale))
+		b.reg.closers = append(b.reg.closers, l)
+		p.Limiter = l
+		p.Store, _ = store.(ratelimit.Inspector)
+		p.update = func(pc PolicyConfig) error {
+			if err := l.Update(pc.Rate, pc.Period, pc.Burst); err != nil {
+				return err
+			}
+			// store is set by WithStore so limiter leaves its ttl to us
+			if u, ok := store.(leakybucket.TTLUpdater); ok {
+				u.UpdateTTL(leakyBucketTTL(pc))
+			}
+			return nil
+		}
+	}
+
+	if pc.KeyPrefix != "" {
+		p.Limiter = &prefixLimiter{Limiter: p.Limiter, prefix: pc.KeyPrefix}
+		if p.Store != nil {
+			p.Store = &prefixInspector{Inspector: p.Store, prefix: pc.KeyPrefix}
+		}
+	}
+
+	midOpts := append(slices.Clip(b.midOpts), middleware.RateLimitWithLimiter(p.Limiter))
+	if pc.PenaltyBox != nil {
+		box, err := b.penaltyBox(pc, p.Limiter)
+		if err != nil {
+			return nil, err
+		}
+		p.Box = box
+		p.Limiter = box
+		midOpts = append(midOpts, middleware.RateLimitWithPenaltyBox(box))
+	}
+
+	extract, _ := keyExtractor(pc.Key)
+	p.Middleware = middleware.NewRateLimit(append(midOpts,
+		middleware.RateLimitWithPolicyName(pc.Name),
+		middleware.RateLimitWithRequestKeyExtractor(extract),
+		middleware.RateLimitWithLogger(b.logger))...)
+	b.reg.closers = append(b.reg.closers, p.Middleware)
+	return p, nil
+}
+
+// penaltyBox wraps limiter l of policy with penalty box, bans are shared on redis store of policy
+func (b *builder) penaltyBox(pc PolicyConfig, l ratelimit.Limiter) (*penaltybox.Box, error) {
+	bc := pc.PenaltyBox
+	opts := []penaltybox.Option{
+		penaltybox.WithThreshold(bc.Threshold, bc.Window),
+		penaltybox.WithBanDuration(bc.BanDuration, bc.MaxBan),
+		penaltybox.WithClock(b.clock),
+		penaltybox.WithLogger(b.logger),
+	}
+	if pc.Store != "" && b.cfg.Stores[pc.Store].Type == StoreRedis {
+		client, err := b.client(pc.Store)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, penaltybox.WithStore(penaltybox.NewRedisStore(client,
+			penaltybox.RedisWithPrefix("penalty:"+pc.Name+":"))))
+	}
+	box := penaltybox.New(l, opts...)
+	b.reg.closers = append(b.reg.closers, box)
+	return box, nil
+}
+
+func (b *builder) fixedWindowStore(pc PolicyConfig) (fixedwindow.Store, error) {
+	sc := b.cfg.Stores[pc.Store]
+	memOpts := []fixedwindow.MemStoreOption{fixedwindow.MemWithClock(b.clock), fixedwindow.MemWithLogger(b.logger)}
+	if sc.MaxKeys > 0 {
+		memOpts = append(memOpts, fixedwindow.MemWithMaxKeys(sc.MaxKeys, ratelimit.EvictionLRU))
+	}
+
+	if sc.Type != StoreRedis {
+		if pc.Algorithm == AlgorithmRollingWindow {
+			windows := pc.Windows
+			if windows == 0 {
+				windows = defaultRollingWindows
+			}
+			s := fixedwindow.NewMemRollingStore(pc.Period, windows, memOpts...)
+			b.reg.closers = append(b.reg.closers, s)
+			return s, nil
+		}
+		s := fixedwindow.NewMemStore(pc.Period, memOpts...)
+		b.reg.closers = append(b.reg.closers, s)
+		return s, nil
+	}
+
+	client, err := b.client(pc.Store)
+	if err != nil {
+		return nil, err
+	}
+	var fallback *fixedwindow.InMemStore
+	if sc.Fallback {
+		fallback = fixedwindow.NewMemStore(pc.Period, memOpts...)
+		b.reg.closers = append(b.reg.closers, fallback)
+	}
+	s := fixedwindow.NewRedisStore(client, pc.Period, fallback, fixedwindow.RedisWithClock(b.clock),
+		fixedwindow.RedisWithLogger(b.logger))
+	b.reg.closers = append(b.reg.closers, s)
+	return s, nil
+}
+
+func (b *builder) leakyBucketStore(pc PolicyConfig) (leakybucket.Store, error) {
+	sc := b.cfg.Stores[pc.Store]
+	ttl := leakyBucketTTL(pc)
+	memOpts := []leakybucket.MemStoreOption{leakybucket.MemWithClock(b.clock), leakybucket.MemWithLogger(b.logger)}
+	if sc.MaxKeys > 0 {
+		memOpts = append(memOpts, leakybucket.MemWithMaxKeys(sc.MaxKeys, ratelimit.EvictionLRU))
+	}
+
+	if sc.Type != StoreRedis {
+		s := leakybucket.NewMemStore(ttl, memOpts...)
+		b.reg.closers = append(b.reg.closers, s)
+		return s, nil
+	}
+
+	client, err := b.client(pc.Store)
+	if err != nil {
+		return nil, err
+	}
+	var fallback *leakybucket.InMemStore
+	if sc.Fallback {
+		fallback = leakybucket.NewMemStore(ttl, memOpts...)
+		b.reg.closers = append(b.reg.closers, fallback)
+	}
+	s := leakybucket.NewRedisStore(client, ttl, -1, fallback, leakybucket.RedisWithClock(b.clock),
+		leakybucket.RedisWithLogger(b.logger))
+	b.reg.closers = append(b.reg.closers, s)
+	return s, nil
+}
+
+// leakyBucketTTL returns ttl of keys of leaky bucket policy, keys live until a full bucket leaks like
+// the default store of leakybucket.New
+func leakyBucketTTL(pc PolicyConfig) time.Duration {
+	return pc.Period * time.Duration(int64(math.Ceil(float64(pc.Burst)/pc.Rate)))
+}
+
+// client returns redis client of store, it's connected once and shared by policies of store
+func (b *builder) client(store string) (*redis.McRedis, error) {
+	if c, ok := b.clients[store]; ok {
+		return c, nil
+	}
+	sc := b.cfg.Stores[store]
+	if sc.Address == "" {
+		return nil, &FieldError{Path: "stores." + store + ".address", Msg: "is required"}
+	}
+	c, err := redis.NewConnection(&redis.SingleConnection{Address: sc.Address})
+	if err != nil {
+		return nil, fmt.Errorf("connect to redis of store %q: %w", store, err)
+	}
+	b.clients[store] = c
+	b.reg.closers = append(b.reg.closers, c)
+	return c, nil
+}
+
+// Policy returns policy by name
+func (r *Registry) Policy(name string) (*Policy, bool) {
+	p, ok := r.state.Load().byName[name]
+	return p, ok
+}
+
+// Policies returns policies in order of config
+func (r *Registry) Policies() []*Policy {
+	return r.state.Load().policies
+}
+
+// Config returns config of registry, it's the last config applied by Apply
+func (r *Registry) Config() *Config {
+	return r.state.Load().cfg
+}
+
+// Apply updates limits and routes of running policies to cfg while counters of keys are kept.
+// Period, quota, rate, burst and routes of a policy can be changed, any other change, e.g. adding a policy
+// or moving it to another store, requires building a new Registry and is rejected without applying anything.
+// If a limiter fails to be updated, limiters already updated are rolled back to the old config.
+//
+// Counters are not rescaled to new limits: a window counter and a bucket level count events, which are
+// as valid under new limits as under old ones, so a key over lowered limits is denied until its window ends
+// or its bucket leaks at the new rate, and a key under raised limits gets the extra events right away
+func (r *Registry) Apply(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	old := r.state.Load()
+	if err := checkReloadable(old.cfg, cfg); err != nil {
+		return err
+	}
+
+	s := &registryState{cfg: cfg, byName: make(map[string]*Policy, len(cfg.Policies))}
+	for i, pc := range cfg.Policies {
+		p := old.policies[i]
+		if err := p.update(pc); err != nil {
+			err = fmt.Errorf("policies[%d]: %w", i, err)
+			return errors.Join(err, rollback(old, i))
+		}
+		updated := *p
+		updated.Config = pc
+		updated.routes = parseRoutes(pc.Routes)
+		s.policies = append(s.policies, &updated)
+		s.byName[pc.Name] = &updated
+	}
+	r.state.Store(s)
+	return nil
+}
+
+// rollback applies config of old to policies up to i, policy i is included since it may be updated partly
+func rollback(old *registryState, i int) error {
+	var errs []error
+	for j := 0; j <= i; j++ {
+		if err := old.policies[j].update(old.cfg.Policies[j]); err != nil {
+			errs = append(errs, fmt.Errorf("roll back policies[%d]: %w", j, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkReloadable returns FieldError if cfg differs from old in anything but limits and routes of policies
+func checkReloadable(old, cfg *Config) error {
+	if !reflect.DeepEqual(old.Stores, cfg.Stores) {
+		return &FieldError{Path: "stores", Msg: "can not be changed by reload"}
+	}
+	if len(old.Policies) != len(cfg.Policies) {
+		return &FieldError{Path: "policies", Msg: "can not be added or removed by reload"}
+	}
+	for i := range cfg.Policies {
+		if !reflect.DeepEqual(structure(old.Policies[i]), structure(cfg.Policies[i])) {
+			return &FieldError{
+				Path: fmt.Sprintf("policies[%d]", i),
+				Msg:  "only period, quota, rate, burst and routes can be changed by reload",
+			}
+		}
+	}
+	return nil
+}
+
+// structure returns pc without fields which can be changed by reload
+func structure(pc PolicyConfig) PolicyConfig {
+	pc.Period, pc.Quota, pc.Rate, pc.Burst, pc.Routes = 0, 0, 0, 0, nil
+	return pc
+}
+
+// ServeHTTP checks request by middleware of every policy matching it in order of config,
+// request is served by next once all of them allow it
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	servePolicies(r.state.Load().policies, w, req, next)
+}
+
+func servePolicies(policies []*Policy, w http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	for i, p := range policies {
+		if p.Match(req) {
+			p.Middleware.ServeHTTP(w, req, func(w http.ResponseWriter, req *http.Request) {
+				servePolicies(policies[i+1:], w, req, next)
+			})
+			return
+		}
+	}
+	next(w, req)
+}
+
+// AdminPolicies describes policies for ratelimitadmin.Handler as they are now, it's meant as source of
+// ratelimitadmin.NewWithSource so the handler follows limits changed by Apply
+func (r *Registry) AdminPolicies() []ratelimitadmin.Policy {
+	s := r.state.Load()
+	policies := make([]ratelimitadmin.Policy, 0, len(s.policies))
+	for _, p := range s.policies {
+		limit := p.Config.Quota
+		if p.Config.Algorithm == AlgorithmLeakyBucket {
+			limit = p.Config.Burst
+		}
+		ap := ratelimitadmin.Policy{
+			Name:      p.Config.Name,
+			Algorithm: p.Config.Algorithm,
+			Limit:     limit,
+			Period:    p.Config.Period,
+			Limiter:   p.Limiter,
+			Store:     p.Store,
+		}
+		if p.Box != nil {
+			ap.Bans = p.Box
+		}
+		policies = append(policies, ap)
+	}
+	return policies
+}
+
+// Close releases middlewares, limiters, stores and redis connections created by Build in reverse order
+func (r *Registry) Close() error {
+	var errs []error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		errs = append(errs, r.closers[i].Close())
+	}
+	r.closers = nil
+	return errors.Join(errs...)
+}
+
+// keyExtractor parses key of policy, it's ip, header:<name>, query:<name> or path
+func keyExtractor(key string) (middleware.RateRequestKeyExtractor, error) {
+	kind, name, _ := strings.Cut(key, ":")
+	switch kind {
+	case "", "ip":
+		if name == "" {
+			return util.GetClientIP, nil
+		}
+	case "path":
+		if name == "" {
+			return func(r *http.Request) string {
+				return r.URL.Path
+			}, nil
+		}
+	case "header":
+		if name != "" {
+			return func(r *http.Request) string {
+				return r.Header.Get(name)
+			}, nil
+		}
+	case "query":
+		if name != "" {
+			return func(r *http.Request) string {
+				return r.URL.Query().Get(name)
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("must be ip, path, header:<name> or query:<name>")
+}
+
+// prefixLimiter prepends prefix to keys of limiter
+type prefixLimiter struct {
+	ratelimit.Limiter
+	prefix string
+}
+
+func (l *prefixLimiter) Allow(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	return l.Limiter.Allow(ctx, l.prefix+k, v)
+}
+
+func (l *prefixLimiter) Reset(ctx context.Context, k string, v int64) error {
+	return l.Limiter.Reset(ctx, l.prefix+k, v)
+}
+
+func (l *prefixLimiter) Peek(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	p, ok := l.Limiter.(ratelimit.Peeker)
+	if !ok {
+		return nil, false, ratelimit.ErrPeekNotSupported
+	}
+	return p.Peek(ctx, l.prefix+k, v)
+}
+
+// prefixInspector lists keys having prefix with prefix removed
+type prefixInspector struct {
+	ratelimit.Inspector
+	prefix string
+}
+
+func (i *prefixInspector) Keys(ctx context.Context, cursor string, limit int) (ratelimit.KeyPage, error) {
+	page, err := i.Inspector.Keys(ctx, cursor, limit)
+	if err != nil {
+		return page, err
+	}
+	keys := page.Keys[:0]
+	for _, s := range page.Keys {
+		if k, ok := strings.CutPrefix(s.Key, i.prefix); ok {
+			s.Key = k
+			keys = append(keys, s)
+		}
+	}
+	page.Keys = keys
+	return page, nil
+}
+
+func (i *prefixInspector) State(ctx context.Context, key string) (ratelimit.KeyState, bool, error) {
+	s, ok, err := i.Inspector.State(ctx, i.prefix+key)
+	s.Key = key
+	return s, ok, err
+}
@@ -0,0 +1,295 @@
+// Package ratelimitconfig builds limiters and middlewares from declarative policy configuration
+package ratelimitconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"ratelimit/util/ratelimit"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Algorithms of policies
+const (
+	AlgorithmFixedWindow   = "fixed_window"
+	AlgorithmRollingWindow = "rolling_window"
+	AlgorithmLeakyBucket   = "leaky_bucket"
+)
+
+// Types of stores
+const (
+	StoreMemory = "memory"
+	StoreRedis  = "redis"
+)
+
+var defaultRollingWindows = int64(10)
+
+// Config describes named stores and policies, e.g.
+//
+//	stores:
+//	  shared:
+//	    type: redis
+//	    address: localhost:6379
+//	    fallback: true
+//	policies:
+//	  - name: api
+//	    algorithm: leaky_bucket
+//	    rate: 10
+//	    period: 1s
+//	    burst: 20
+//	    store: shared
+//	    key: header:X-User-Id
+//	    routes: ["/api/"]
+//	    error_policy: fallback
+//	    penalty_box:
+//	      threshold: 10
+//	      window: 1m
+//	      ban_duration: 5m
+type Config struct {
+	Stores   map[string]StoreConfig `yaml:"stores"`
+	Policies []PolicyConfig         `yaml:"policies"`
+}
+
+// StoreConfig describes a store shared by policies
+type StoreConfig struct {
+	// Type is memory or redis
+	Type string `yaml:"type"`
+	// Address of redis server, it's not required if client of store is given by WithRedisClient
+	Address string `yaml:"address"`
+	// Fallback counts events on in-memory store while redis is unavailable
+	Fallback bool `yaml:"fallback"`
+	// MaxKeys bounds number of keys of in-memory store, zero means unbounded
+	MaxKeys int `yaml:"max_keys"`
+}
+
+// PolicyConfig describes a rate limit policy
+type PolicyConfig struct {
+	Name string `yaml:"name"`
+	// Algorithm is fixed_window, rolling_window or leaky_bucket
+	Algorithm string `yaml:"algorithm"`
+	// Period is window of fixed and rolling window or leak period of leaky bucket
+	Period time.Duration `yaml:"period"`
+	// Quota is number of events allowed per window of fixed and rolling window
+	Quota int64 `yaml:"quota"`
+	// Windows is number of slices of rolling window, 10 by default
+	Windows int64 `yaml:"windows"`
+	// Rate is number of events leaked per period and Burst is bucket size of leaky bucket
+	Rate  float64 `yaml:"rate"`
+	Burst int64   `yaml:"burst"`
+	// Store is name of store in Config.Stores, events are counted on a private in-memory store if it's empty
+	Store string `yaml:"store"`
+	// KeyPrefix is prepended to keys so policies sharing a redis store don't collide
+	KeyPrefix string `yaml:"key_prefix"`
+	// Key extracts key of request, it's ip (default), header:<name>, query:<name> or path
+	Key string `yaml:"key"`
+	// Routes select requests checked by policy as "[METHOD ]/path/prefix", every request is checked if it's empty
+	Routes []string `yaml:"routes"`
+	// ErrorPolicy is propagate (default), fail_open, fail_closed or fallback
+	ErrorPolicy string `yaml:"error_policy"`
+	// FallbackScale is ratio of limit used by local limiter of fallback error policy, zero means 1
+	FallbackScale float64 `yaml:"fallback_scale"`
+	// PenaltyBox bans keys which keep exceeding limits of policy, keys are never banned if it's nil
+	PenaltyBox *PenaltyBoxConfig `yaml:"penalty_box"`
+}
+
+// PenaltyBoxConfig describes penalty box of a policy, zero fields keep defaults of penaltybox.New.
+// Bans are kept in redis with policy name in keys if policy uses a redis store, so they are shared between
+// instances, and in memory otherwise
+type PenaltyBoxConfig struct {
+	// Threshold is number of denied events within Window which bans key, 10 within 1m by default
+	Threshold int64         `yaml:"threshold"`
+	Window    time.Duration `yaml:"window"`
+	// BanDuration is duration of the first ban of key, 1m by default, every ban in a row lasts twice as long
+	// as the previous one up to MaxBan, 24h by default
+	BanDuration time.Duration `yaml:"ban_duration"`
+	MaxBan      time.Duration `yaml:"max_ban"`
+}
+
+// FieldError is validation error of a config field
+type FieldError struct {
+	// Path of field, e.g. policies[1].rate
+	Path string
+	Msg  string
+}
+
+func (e *FieldError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// Load reads config from YAML or JSON file
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse decodes config from YAML or JSON and validates it, unknown fields are rejected.
+// Validation errors are joined FieldError
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks config and returns joined FieldError of every invalid field
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(path, format string, args ...any) {
+		errs = append(errs, &FieldError{Path: path, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	storeNames := make([]string, 0, len(c.Stores))
+	for name := range c.Stores {
+		storeNames = append(storeNames, name)
+	}
+	sort.Strings(storeNames)
+	for _, name := range storeNames {
+		s := c.Stores[name]
+		path := "stores." + name
+		switch s.Type {
+		case StoreMemory:
+			if s.Fallback {
+				fail(path+".fallback", "is only supported by redis store")
+			}
+		case StoreRedis:
+		default:
+			fail(path+".type", "must be %s or %s", StoreMemory, StoreRedis)
+		}
+		if s.MaxKeys < 0 {
+			fail(path+".max_keys", "must not be negative")
+		}
+	}
+
+	names := make(map[string]bool)
+	prefixes := make(map[string]string)
+	for i, p := range c.Policies {
+		path := fmt.Sprintf("policies[%d]", i)
+		if p.Name == "" {
+			fail(path+".name", "is required")
+		} else if names[p.Name] {
+			fail(path+".name", "duplicates policy %q", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Period <= 0 {
+			fail(path+".period", "must be positive")
+		}
+		switch p.Algorithm {
+		case AlgorithmFixedWindow, AlgorithmRollingWindow:
+			if p.Quota <= 0 {
+				fail(path+".quota", "must be positive")
+			}
+			if p.Windows < 0 {
+				fail(path+".windows", "must not be negative")
+			}
+		case AlgorithmLeakyBucket:
+			if p.Rate <= 0 {
+				fail(path+".rate", "must be positive")
+			}
+			if p.Burst <= 0 {
+				fail(path+".burst", "must be positive")
+			}
+		default:
+			fail(path+".algorithm", "must be %s, %s or %s", AlgorithmFixedWindow, AlgorithmRollingWindow,
+				AlgorithmLeakyBucket)
+		}
+
+		if p.Store != "" {
+			s, ok := c.Stores[p.Store]
+			switch {
+			case !ok:
+				fail(path+".store", "unknown store %q", p.Store)
+			case s.Type == StoreRedis && p.Algorithm == AlgorithmRollingWindow:
+				fail(path+".store", "%s is only supported by memory store", AlgorithmRollingWindow)
+			case s.Type == StoreRedis:
+				if other, ok := prefixes[p.Store+"\x00"+p.KeyPrefix]; ok {
+					fail(path+".key_prefix", "must differ from policy %q sharing store %q", other, p.Store)
+				}
+				prefixes[p.Store+"\x00"+p.KeyPrefix] = p.Name
+			}
+		}
+
+		if _, err := keyExtractor(p.Key); err != nil {
+			fail(path+".key", "%v", err)
+		}
+		for j, r := range p.Routes {
+			if _, err := parseRoute(r); err != nil {
+				fail(fmt.Sprintf("%s.routes[%d]", path, j), "%v", err)
+			}
+		}
+		if p.ErrorPolicy != "" {
+			if _, err := ratelimit.ParseErrorPolicy(p.ErrorPolicy); err != nil {
+				fail(path+".error_policy", "%v", err)
+			}
+		}
+		if p.FallbackScale < 0 || p.FallbackScale > 1 {
+			fail(path+".fallback_scale", "must be in range (0, 1], or zero for 1")
+		}
+		if b := p.PenaltyBox; b != nil {
+			if b.Threshold < 0 {
+				fail(path+".penalty_box.threshold", "must not be negative")
+			}
+			if b.Window < 0 {
+				fail(path+".penalty_box.window", "must not be negative")
+			}
+			if b.BanDuration < 0 {
+				fail(path+".penalty_box.ban_duration", "must not be negative")
+			}
+			if b.MaxBan < 0 {
+				fail(path+".penalty_box.max_ban", "must not be negative")
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// route matches requests by method and path prefix
+type route struct {
+	method string
+	prefix string
+}
+
+// parseRoutes parses validated routes
+func parseRoutes(routes []string) []route {
+	var parsed []route
+	for _, r := range routes {
+		rt, _ := parseRoute(r)
+		parsed = append(parsed, rt)
+	}
+	return parsed
+}
+
+func parseRoute(s string) (route, error) {
+	var r route
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		r.prefix = fields[0]
+	case 2:
+		r.method, r.prefix = strings.ToUpper(fields[0]), fields[1]
+	default:
+		return r, fmt.Errorf("must be \"[METHOD ]/path\"")
+	}
+	if !strings.HasPrefix(r.prefix, "/") {
+		return r, fmt.Errorf("path must start with /")
+	}
+	return r, nil
+}
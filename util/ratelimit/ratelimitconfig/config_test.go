@@ -0,0 +1,395 @@
+package ratelimitconfig
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"ratelimit/driver/redis"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/ratelimitadmin"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+stores:
+  shared:
+    type: redis
+    fallback: true
+policies:
+  - name: api
+    algorithm: leaky_bucket
+    rate: 1
+    period: 1s
+    burst: 2
+    store: shared
+    key_prefix: "api:"
+    key: header:X-User-Id
+    routes: ["/api/"]
+    error_policy: fail_open
+  - name: login
+    algorithm: fixed_window
+    quota: 1
+    period: 1m
+    routes: ["POST /login"]
+  - name: search
+    algorithm: rolling_window
+    quota: 3
+    windows: 6
+    period: 1m
+    key: query:q
+`
+
+func newTestRegistry(t *testing.T, data string) (*Registry, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client, err := redis.NewConnection(&redis.SingleConnection{Address: mr.Addr()})
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	cfg, err := Parse([]byte(data))
+	require.Nil(t, err)
+	reg, err := Build(cfg, WithRedisClient("shared", client),
+		WithClock(clocktest.NewFakeClock(time.Unix(1700000000, 0))))
+	require.Nil(t, err)
+	t.Cleanup(func() { _ = reg.Close() })
+	return reg, mr
+}
+
+func serve(reg *Registry, method, target string, header http.Header) int {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res := httptest.NewRecorder()
+	reg.ServeHTTP(res, req, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return res.Code
+}
+
+func TestParse(t *testing.T) {
+	cfg, err := Parse([]byte(testConfig))
+	require.Nil(t, err)
+	require.Len(t, cfg.Policies, 3)
+	assert.Equal(t, time.Second, cfg.Policies[0].Period)
+	assert.Equal(t, []string{"POST /login"}, cfg.Policies[1].Routes)
+	assert.True(t, cfg.Stores["shared"].Fallback)
+
+	// JSON is accepted as well
+	path := filepath.Join(t.TempDir(), "ratelimit.json")
+	require.Nil(t, os.WriteFile(path, []byte(`{"policies": [
+		{"name": "api", "algorithm": "fixed_window", "quota": 10, "period": "1m"}
+	]}`), 0o600))
+	cfg, err = Load(path)
+	require.Nil(t, err)
+	assert.Equal(t, time.Minute, cfg.Policies[0].Period)
+
+	_, err = Parse([]byte("policies:\n  - name: api\n    burts: 2\n"))
+	assert.ErrorContains(t, err, "field burts not found")
+}
+
+func TestParse_Validation(t *testing.T) {
+	_, err := Parse([]byte(`
+stores:
+  local:
+    type: memory
+    fallback: true
+  shared:
+    type: redis
+policies:
+  - name: api
+    algorithm: leaky_bucket
+    period: 1s
+    burst: 2
+    store: shared
+  - name: api
+    algorithm: fixed_window
+    quota: 10
+    period: 1m
+    store: shared
+    key: cookie
+    routes: ["api"]
+    error_policy: retry
+  - name: search
+    algorithm: rolling_window
+    quota: 10
+    store: missing
+    fallback_scale: 1.5
+    penalty_box:
+      threshold: -1
+`))
+	require.NotNil(t, err)
+
+	var paths []string
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		var fe *FieldError
+		require.True(t, errors.As(e, &fe))
+		paths = append(paths, fe.Path)
+	}
+	assert.Equal(t, []string{
+		"stores.local.fallback",
+		"policies[0].rate",
+		"policies[1].name",
+		"policies[1].key_prefix",
+		"policies[1].key",
+		"policies[1].routes[0]",
+		"policies[1].error_policy",
+		"policies[2].period",
+		"policies[2].store",
+		"policies[2].fallback_scale",
+		"policies[2].penalty_box.threshold",
+	}, paths)
+	assert.ErrorContains(t, err, `policies[2].store: unknown store "missing"`)
+}
+
+func TestBuild(t *testing.T) {
+	reg, mr := newTestRegistry(t, testConfig)
+	user := http.Header{"X-User-Id": []string{"u1"}}
+
+	// api allows a burst of 2
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/api/items", user))
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/api/items", user))
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodGet, "/api/items", user))
+	assert.True(t, mr.Exists("api:u1"))
+
+	// login only limits POST
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodPost, "/login", nil))
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodPost, "/login", nil))
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/login", nil))
+
+	// search applies to every request carrying q
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/login?q=x", nil))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodGet, "/login?q=x", nil))
+
+	// events of api are counted on fallback store while redis is down
+	mr.SetError("down")
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/api/items", http.Header{"X-User-Id": {"u2"}}))
+	mr.SetError("")
+
+	p, ok := reg.Policy("api")
+	require.True(t, ok)
+	require.Nil(t, p.Middleware.Reset("u1"))
+	assert.False(t, mr.Exists("api:u1"))
+
+	admin := reg.AdminPolicies()
+	require.Len(t, admin, 3)
+	assert.Equal(t, int64(2), admin[0].Limit)
+	require.Nil(t, admin[0].Limiter.Reset(context.Background(), "u3", 1))
+	page, err := admin[0].Store.Keys(context.Background(), "", 10)
+	require.Nil(t, err)
+	require.Len(t, page.Keys, 1)
+	assert.Equal(t, "u3", page.Keys[0].Key)
+}
+
+func TestBuild_PenaltyBox(t *testing.T) {
+	reg, mr := newTestRegistry(t, `
+stores:
+  shared:
+    type: redis
+policies:
+  - name: api
+    algorithm: fixed_window
+    quota: 1
+    period: 1m
+    store: shared
+    key: header:X-User-Id
+    penalty_box:
+      threshold: 2
+      window: 1m
+      ban_duration: 10m
+`)
+	// window of redis keys expires at time of fake clock
+	mr.SetTime(time.Unix(1700000000, 0))
+	user := http.Header{"X-User-Id": []string{"u1"}}
+	admin := ratelimitadmin.NewWithSource(reg.AdminPolicies, ratelimitadmin.WithAuthorizer(ratelimitadmin.AllowAll))
+
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/", user))
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodGet, "/", user))
+	assert.Equal(t, http.StatusForbidden, serve(reg, http.MethodGet, "/", user))
+	assert.True(t, mr.Exists("penalty:api:u1:ban"))
+
+	res := httptest.NewRecorder()
+	admin.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/policies/api/bans/u1", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+
+	// unbanned key is limited by window again
+	res = httptest.NewRecorder()
+	admin.ServeHTTP(res, httptest.NewRequest(http.MethodDelete, "/policies/api/bans/u1", nil))
+	assert.Equal(t, http.StatusNoContent, res.Code)
+	assert.False(t, mr.Exists("penalty:api:u1:ban"))
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodGet, "/", user))
+}
+
+func TestBuild_Missing_Address(t *testing.T) {
+	cfg, err := Parse([]byte(`
+stores:
+  shared:
+    type: redis
+policies:
+  - name: api
+    algorithm: fixed_window
+    quota: 1
+    period: 1m
+    store: shared
+`))
+	require.Nil(t, err)
+	_, err = Build(cfg)
+	var fe *FieldError
+	require.True(t, errors.As(err, &fe))
+	assert.Equal(t, "stores.shared.address", fe.Path)
+}
+
+func TestRegistry_Apply(t *testing.T) {
+	reg, _ := newTestRegistry(t, testConfig)
+	user := http.Header{"X-User-Id": []string{"u1"}}
+	admin := ratelimitadmin.NewWithSource(reg.AdminPolicies, ratelimitadmin.WithAuthorizer(ratelimitadmin.AllowAll))
+
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/api/items", user))
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodPost, "/login", nil))
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodPost, "/login", nil))
+
+	// burst of api is raised and login moves to another route, counters are kept
+	cfg, err := Parse([]byte(strings.NewReplacer("burst: 2", "burst: 3",
+		`["POST /login"]`, `["POST /signin"]`).Replace(testConfig)))
+	require.Nil(t, err)
+	require.Nil(t, reg.Apply(cfg))
+	assert.Same(t, cfg, reg.Config())
+
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/api/items", user))
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/api/items", user))
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodGet, "/api/items", user))
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodPost, "/login", nil))
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodPost, "/signin", nil))
+	p, ok := reg.Policy("api")
+	require.True(t, ok)
+	assert.Equal(t, int64(3), p.Config.Burst)
+	assert.Equal(t, int64(3), reg.AdminPolicies()[0].Limit)
+	res := httptest.NewRecorder()
+	admin.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/policies/api", nil))
+	assert.Contains(t, res.Body.String(), `"limit":3`)
+
+	// structural changes are rejected and nothing is applied
+	cfg, err = Parse([]byte(strings.NewReplacer("burst: 3", "burst: 4",
+		"key: query:q", "key: path").Replace(testConfig)))
+	require.Nil(t, err)
+	err = reg.Apply(cfg)
+	var fe *FieldError
+	require.True(t, errors.As(err, &fe))
+	assert.Equal(t, "policies[2]", fe.Path)
+	p, _ = reg.Policy("api")
+	assert.Equal(t, int64(3), p.Config.Burst)
+
+	cfg, err = Parse([]byte(testConfig + "  - name: extra\n    algorithm: fixed_window\n    quota: 1\n    period: 1m\n"))
+	require.Nil(t, err)
+	assert.ErrorContains(t, reg.Apply(cfg), "can not be added or removed")
+}
+
+func TestWatch(t *testing.T) {
+	reg, _ := newTestRegistry(t, testConfig)
+	path := filepath.Join(t.TempDir(), "ratelimit.yaml")
+	require.Nil(t, os.WriteFile(path, []byte(testConfig), 0o600))
+
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	applied := make(chan *Config, 1)
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Watch(ctx, path, reg, WatchWithInterval(time.Second), WatchWithClock(clock),
+			WatchWithApplyHandler(func(cfg *Config) { applied <- cfg }),
+			WatchWithErrorHandler(func(err error) { errs <- err }))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	require.Eventually(t, func() bool { return clock.Waiters() > 0 }, time.Second, time.Millisecond)
+
+	require.Nil(t, os.WriteFile(path, []byte(strings.Replace(testConfig, "quota: 1\n", "quota: 5\n", 1)), 0o600))
+	clock.Advance(time.Second)
+	select {
+	case cfg := <-applied:
+		assert.Equal(t, int64(5), cfg.Policies[1].Quota)
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("config is not applied")
+	}
+	p, _ := reg.Policy("login")
+	assert.Equal(t, int64(5), p.Config.Quota)
+
+	// broken config is reported and limits are kept
+	require.Nil(t, os.WriteFile(path, []byte("policies: [\n"), 0o600))
+	clock.Advance(time.Second)
+	select {
+	case err := <-errs:
+		assert.ErrorContains(t, err, path)
+	case <-time.After(time.Second):
+		t.Fatal("error is not reported")
+	}
+	p, _ = reg.Policy("login")
+	assert.Equal(t, int64(5), p.Config.Quota)
+
+	// missing file is reported once until it's back
+	require.Nil(t, os.Remove(path))
+	clock.Advance(time.Second)
+	select {
+	case err := <-errs:
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	case <-time.After(time.Second):
+		t.Fatal("missing file is not reported")
+	}
+	clock.Advance(time.Second)
+	select {
+	case err := <-errs:
+		t.Fatalf("missing file is reported again: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.Nil(t, os.WriteFile(path, []byte(strings.Replace(testConfig, "quota: 1\n", "quota: 6\n", 1)), 0o600))
+	clock.Advance(time.Second)
+	select {
+	case cfg := <-applied:
+		assert.Equal(t, int64(6), cfg.Policies[1].Quota)
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(time.Second):
+		t.Fatal("config is not applied")
+	}
+}
+
+func TestRegistry_Apply_Rollback(t *testing.T) {
+	reg, _ := newTestRegistry(t, testConfig)
+	user := http.Header{"X-User-Id": []string{"u1"}}
+	old := reg.Config()
+
+	// search fails to be updated after api is raised
+	search, _ := reg.Policy("search")
+	update := search.update
+	search.update = func(pc PolicyConfig) error {
+		if pc.Quota != 3 {
+			return errors.New("store is down")
+		}
+		return update(pc)
+	}
+	cfg, err := Parse([]byte(strings.NewReplacer("burst: 2", "burst: 3", "quota: 3", "quota: 4").Replace(testConfig)))
+	require.Nil(t, err)
+	err = reg.Apply(cfg)
+	assert.ErrorContains(t, err, "policies[2]: store is down")
+	assert.Same(t, old, reg.Config())
+
+	// limiter of api is rolled back to burst of 2
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/api/items", user))
+	assert.Equal(t, http.StatusOK, serve(reg, http.MethodGet, "/api/items", user))
+	assert.Equal(t, http.StatusTooManyRequests, serve(reg, http.MethodGet, "/api/items", user))
+}
@@ -0,0 +1,125 @@
+package ratelimitconfig
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"os"
+	"ratelimit/util/ratelimit"
+	"time"
+)
+
+var defaultWatchInterval = 5 * time.Second
+
+type WatchOption func(w *watcher)
+
+// WatchWithInterval set how often config file is checked for changes, 5s by default
+func WatchWithInterval(d time.Duration) WatchOption {
+	return func(w *watcher) {
+		w.interval = d
+	}
+}
+
+// WatchWithErrorHandler set callback notified when changed config file can not be loaded or applied,
+// by default errors are logged by slog.Default()
+func WatchWithErrorHandler(h func(err error)) WatchOption {
+	return func(w *watcher) {
+		w.errHandler = h
+	}
+}
+
+// WatchWithApplyHandler set callback notified after config of changed file is applied
+func WatchWithApplyHandler(h func(cfg *Config)) WatchOption {
+	return func(w *watcher) {
+		w.applyHandler = h
+	}
+}
+
+// WatchWithClock set clock ticking checks of config file
+func WatchWithClock(c ratelimit.Clock) WatchOption {
+	return func(w *watcher) {
+		w.clock = c
+	}
+}
+
+type watcher struct {
+	path         string
+	reg          *Registry
+	interval     time.Duration
+	errHandler   func(err error)
+	applyHandler func(cfg *Config)
+	clock        ratelimit.Clock
+	// sum is checksum of the last content of file which was loaded, it's checked even if loading failed
+	// so a broken file is reported once
+	sum []byte
+	// readErr is error of the last read of file, e.g. a missing file, so it's reported once until it changes
+	readErr string
+}
+
+// Watch polls config file at path and applies it to reg by Registry.Apply whenever its content changes,
+// until ctx is done. Content of file at the time Watch is called is taken as already applied.
+// A file which can not be loaded or applied is reported to error handler and reg keeps its limits
+func Watch(ctx context.Context, path string, reg *Registry, opts ...WatchOption) {
+	w := &watcher{
+		path:     path,
+		reg:      reg,
+		interval: defaultWatchInterval,
+		clock:    ratelimit.SystemClock,
+		errHandler: func(err error) {
+			slog.Default().ErrorContext(ctx, "reload rate limit config", slog.Any("error", err))
+		},
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		w.sum = checksum(data)
+	}
+
+	ticker := w.clock.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+			w.check()
+		}
+	}
+}
+
+func (w *watcher) check() {
+	data, err := os.ReadFile(w.path)
+	if err != nil {
+		if err.Error() != w.readErr {
+			w.readErr = err.Error()
+			w.errHandler(err)
+		}
+		return
+	}
+	w.readErr = ""
+	sum := checksum(data)
+	if bytes.Equal(sum, w.sum) {
+		return
+	}
+	w.sum = sum
+
+	cfg, err := Parse(data)
+	if err == nil {
+		err = w.reg.Apply(cfg)
+	}
+	if err != nil {
+		w.errHandler(fmt.Errorf("%s: %w", w.path, err))
+		return
+	}
+	if w.applyHandler != nil {
+		w.applyHandler(cfg)
+	}
+}
+
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
@@ -0,0 +1,277 @@
+package ratelimitconn
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"ratelimit/util/ratelimit"
+	"sync"
+	"time"
+)
+
+var defaultMaxAcceptDelay = time.Second
+
+type ListenerOption func(l *Listener)
+
+// ListenerWithRateLimiter set limiter of new connections, keyed by source IP
+func ListenerWithRateLimiter(rl ratelimit.Limiter) ListenerOption {
+	return func(l *Listener) {
+		l.limiter = rl
+	}
+}
+
+// ListenerWithMaxConnsPerIP caps number of open connections of a source IP, connections over the cap are
+// rejected whatever the action is. Zero means unbounded
+func ListenerWithMaxConnsPerIP(n int) ListenerOption {
+	return func(l *Listener) {
+		l.maxConns = n
+	}
+}
+
+// ListenerWithAction set action taken on connections exceeding rate of their IP. ActionDelay hands connection
+// out of Accept once it's allowed, while ActionDrop and ActionClose close it at once, ActionDrop by default
+func ListenerWithAction(a Action) ListenerOption {
+	return func(l *Listener) {
+		l.action = a
+	}
+}
+
+// ListenerWithMaxDelay bounds how long ActionDelay holds a connection, connections which would wait longer are
+// rejected. It's 1s by default
+func ListenerWithMaxDelay(d time.Duration) ListenerOption {
+	return func(l *Listener) {
+		l.maxDelay = d
+	}
+}
+
+// ListenerWithClock set clock used to delay connections
+func ListenerWithClock(c ratelimit.Clock) ListenerOption {
+	return func(l *Listener) {
+		l.clock = c
+	}
+}
+
+// ListenerWithLogger set logger of listener, rejected connections are logged at debug level and limiter
+// errors at error level. By default, slog.Default() is used
+func ListenerWithLogger(logger *slog.Logger) ListenerOption {
+	return func(l *Listener) {
+		l.logger = logger
+	}
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// Listener limits rate and number of open connections per source IP of a net.Listener, rejected connections
+// are closed without being returned by Accept so servers keep serving other IPs
+type Listener struct {
+	net.Listener
+	limiter  ratelimit.Limiter
+	maxConns int
+	action   Action
+	maxDelay time.Duration
+	clock    ratelimit.Clock
+	logger   *slog.Logger
+
+	mu    sync.Mutex
+	conns map[string]int
+
+	start    sync.Once
+	accepted chan accepted
+	ctx      context.Context
+	cancel   context.CancelFunc
+	// err is terminal error of underlying listener, it's set before ctx is cancelled
+	err error
+}
+
+// NewListener limits connections accepted by ln, Close of Listener closes ln
+func NewListener(ln net.Listener, opts ...ListenerOption) *Listener {
+	l := &Listener{
+		Listener: ln,
+		maxDelay: defaultMaxAcceptDelay,
+		clock:    ratelimit.SystemClock,
+		conns:    make(map[string]int),
+		accepted: make(chan accepted),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.logger == nil {
+		l.logger = slog.Default()
+	}
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	return l
+}
+
+// Accept waits for next connection allowed for its source IP
+func (l *Listener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		go l.acceptLoop()
+	})
+
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes listener, connections being delayed are closed as well
+func (l *Listener) Close() error {
+	l.cancel()
+	return l.Listener.Close()
+}
+
+// acceptLoop accepts connections of underlying listener until it's closed, delayed connections are handed
+// out from their own goroutines so a limited IP doesn't hold up others. Listener is closed as well once
+// underlying listener is closed directly, so Accept doesn't wait for connections which never come
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.mu.Lock()
+				l.err = err
+				l.mu.Unlock()
+				l.cancel()
+				return
+			}
+			if !l.send(accepted{err: err}) {
+				return
+			}
+			continue
+		}
+
+		ip := sourceIP(c)
+		if !l.acquire(ip) {
+			l.reject(c, ip, "too many connections")
+			continue
+		}
+		conn := &limitedConn{Conn: c, release: func() { l.release(ip) }}
+
+		delay, ok := l.allow(ip)
+		switch {
+		case !ok:
+			_ = conn.Close()
+		case delay > 0:
+			go l.sendAfter(conn, delay)
+		default:
+			if !l.send(accepted{conn: conn}) {
+				_ = conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// allow checks rate of ip and returns how long connection is delayed, connection is rejected when ok is false
+func (l *Listener) allow(ip string) (delay time.Duration, ok bool) {
+	if l.limiter == nil {
+		return 0, true
+	}
+	r, allowed, err := l.limiter.Allow(l.ctx, ip, 1)
+	if err != nil {
+		l.logger.Error("failed to check connection rate", ratelimit.LogKey(ip), slog.Any("error", err))
+		return 0, false
+	}
+	if allowed {
+		return 0, true
+	}
+
+	if l.action == ActionDelay && r != nil {
+		delay = r.DelayFrom(l.clock.Now())
+		if delay <= l.maxDelay {
+			return delay, true
+		}
+	}
+	l.logger.Debug("connection rejected", ratelimit.LogKey(ip), slog.String("reason", "rate limit exceeded"))
+	return 0, false
+}
+
+// sendAfter hands conn out of Accept after delay, its rate is checked again since other connections of its IP
+// may have been allowed meanwhile
+func (l *Listener) sendAfter(conn *limitedConn, delay time.Duration) {
+	select {
+	case <-l.clock.After(delay):
+	case <-l.ctx.Done():
+		_ = conn.Close()
+		return
+	}
+
+	ip := sourceIP(conn)
+	delay, ok := l.allow(ip)
+	switch {
+	case !ok:
+		_ = conn.Close()
+	case delay > 0:
+		l.sendAfter(conn, delay)
+	default:
+		if !l.send(accepted{conn: conn}) {
+			_ = conn.Close()
+		}
+	}
+}
+
+// send passes a to Accept, it returns false if listener is closed
+func (l *Listener) send(a accepted) bool {
+	select {
+	case l.accepted <- a:
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+func (l *Listener) reject(c net.Conn, ip, reason string) {
+	l.logger.Debug("connection rejected", ratelimit.LogKey(ip), slog.String("reason", reason))
+	_ = c.Close()
+}
+
+// acquire counts a new connection of ip, it returns false if ip already has max connections
+func (l *Listener) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxConns > 0 && l.conns[ip] >= l.maxConns {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *Listener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// sourceIP returns IP of remote address of c, or the whole address if it has no port
+func sourceIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// limitedConn releases its slot of source IP once it's closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,139 @@
+package ratelimitconn
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestListener(t *testing.T, opts ...ListenerOption) (*Listener, <-chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	l := NewListener(ln, opts...)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+	return l, conns
+}
+
+func dial(t *testing.T, l net.Listener) net.Conn {
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+func accept(t *testing.T, conns <-chan net.Conn) net.Conn {
+	select {
+	case c := <-conns:
+		return c
+	case <-time.After(time.Second):
+		require.FailNow(t, "connection is not accepted")
+		return nil
+	}
+}
+
+// assertRejected checks that c is closed by listener
+func assertRejected(t *testing.T, c net.Conn) {
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := c.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestListener_Rate(t *testing.T) {
+	clock := newTestClock()
+	l, conns := newTestListener(t, ListenerWithRateLimiter(newTestLimiter(t, clock, 2)))
+
+	for i := 0; i < 2; i++ {
+		_ = dial(t, l)
+		accept(t, conns)
+	}
+	assertRejected(t, dial(t, l))
+	assert.Len(t, conns, 0)
+}
+
+func TestListener_MaxConns(t *testing.T) {
+	l, conns := newTestListener(t, ListenerWithMaxConnsPerIP(1))
+
+	_ = dial(t, l)
+	c := accept(t, conns)
+	assertRejected(t, dial(t, l))
+
+	// closed connection frees its slot
+	require.Nil(t, c.Close())
+	_ = dial(t, l)
+	accept(t, conns)
+}
+
+func TestListener_Delay(t *testing.T) {
+	clock := newTestClock()
+	l, conns := newTestListener(t, ListenerWithRateLimiter(newTestLimiter(t, clock, 1)),
+		ListenerWithAction(ActionDelay), ListenerWithMaxDelay(time.Second), ListenerWithClock(clock))
+
+	_ = dial(t, l)
+	accept(t, conns)
+	_ = dial(t, l)
+	clock.BlockUntilTimers(1)
+	assert.Len(t, conns, 0)
+
+	clock.Advance(time.Second)
+	accept(t, conns)
+
+	// connection which would wait longer than max delay is rejected
+	l, conns = newTestListener(t, ListenerWithRateLimiter(newTestLimiter(t, clock, 1)),
+		ListenerWithAction(ActionDelay), ListenerWithMaxDelay(500*time.Millisecond), ListenerWithClock(clock))
+	_ = dial(t, l)
+	accept(t, conns)
+	assertRejected(t, dial(t, l))
+}
+
+func TestListener_Close(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	l := NewListener(ln)
+	require.Nil(t, l.Close())
+	_, err = l.Accept()
+	assert.True(t, errors.Is(err, net.ErrClosed))
+}
+
+func TestListener_Close_Underlying(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	l := NewListener(ln)
+	defer l.Close()
+
+	accepted := make(chan error)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	// listener wrapped by Listener is closed directly, e.g. by server shutdown
+	require.Nil(t, ln.Close())
+	select {
+	case err = <-accepted:
+		assert.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(time.Second):
+		require.FailNow(t, "accept is not unblocked")
+	}
+
+	// later calls fail at once rather than waiting forever
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
@@ -0,0 +1,40 @@
+package ratelimitconn
+
+import (
+	"context"
+	"errors"
+)
+
+// MessageConn is a message oriented connection, e.g. a websocket adapted from a websocket library
+type MessageConn interface {
+	// ReadMessage blocks until next message is received
+	ReadMessage(ctx context.Context) ([]byte, error)
+	// Close closes connection with websocket close code and reason
+	Close(code int, reason string) error
+}
+
+// Serve reads messages of mc and passes those allowed by limits to handle until reading or handle fails. When
+// connection exceeds its limits and action is ActionClose, mc is closed with ClosePolicyViolation and
+// ErrPolicyViolation is returned
+func (c *Conn) Serve(ctx context.Context, mc MessageConn, handle func(ctx context.Context, msg []byte) error) error {
+	for {
+		msg, err := mc.ReadMessage(ctx)
+		if err != nil {
+			return err
+		}
+		allowed, err := c.Allow(ctx, len(msg))
+		if errors.Is(err, ErrPolicyViolation) {
+			_ = mc.Close(ClosePolicyViolation, "rate limit exceeded")
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			continue
+		}
+		if err := handle(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package ratelimitconn
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// minRetryDelay bounds how often denied bytes are checked again if limiter returns no delay
+var minRetryDelay = 10 * time.Millisecond
+
+// netConn limits bytes read from a stream connection
+type netConn struct {
+	net.Conn
+	c      *Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	// chunk is the smallest bucket of byte limiters seen so far, zero until a read doesn't fit into a bucket.
+	// Reads are capped to it and bytes are consumed from limiters in chunks of it
+	chunk atomic.Int64
+}
+
+// NetConn limits bytes read from nc by byte limiters of c, message limiters are skipped since a stream has no
+// messages. Bytes of a stream can't be dropped, so ActionDrop delays reading as ActionDelay does, a read larger
+// than bucket of a limiter is consumed in chunks of the bucket. On ActionClose nc is closed and Read returns
+// ErrPolicyViolation along with bytes already read
+func (c *Conn) NetConn(nc net.Conn) net.Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &netConn{Conn: nc, c: c, ctx: ctx, cancel: cancel}
+}
+
+// Read reads from connection and waits for byte limiters, bytes already read are returned even if waiting fails
+func (n *netConn) Read(p []byte) (int, error) {
+	if chunk := n.chunk.Load(); chunk > 0 && int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	read, err := n.Conn.Read(p)
+	if read == 0 {
+		return read, err
+	}
+
+	action := n.c.guard.action
+	if action == ActionDrop {
+		action = ActionDelay
+	}
+	if aerr := n.take(int64(read), action); aerr != nil {
+		// connection is closed while waiting for limiter
+		if n.ctx.Err() != nil {
+			return read, net.ErrClosed
+		}
+		_ = n.Close()
+		return read, aerr
+	}
+	return read, err
+}
+
+// take consumes size bytes from every byte limiter of connection, a chunk which can never fit into bucket of
+// a limiter is split to size of the bucket instead of being a violation
+func (n *netConn) take(size int64, action Action) error {
+	clock := n.c.guard.clock
+	for _, ch := range n.c.checks {
+		if !ch.bytes {
+			continue
+		}
+		for left := size; left > 0; {
+			weight := left
+			if chunk := n.chunk.Load(); chunk > 0 {
+				weight = min(weight, chunk)
+			}
+			r, allowed, err := ch.limiter.Allow(n.ctx, ch.key, weight)
+			if err != nil {
+				return err
+			}
+			if allowed {
+				left -= weight
+				continue
+			}
+
+			if action == ActionClose || r == nil {
+				return ErrPolicyViolation
+			}
+			if r.Bucket > 0 && weight > r.Bucket {
+				n.chunk.Store(r.Bucket)
+				continue
+			}
+			select {
+			case <-clock.After(max(r.DelayFrom(clock.Now()), minRetryDelay)):
+			case <-n.ctx.Done():
+				return n.ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes connection and stops waiting for limiters
+func (n *netConn) Close() error {
+	n.cancel()
+	return n.Conn.Close()
+}
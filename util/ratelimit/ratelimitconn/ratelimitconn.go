@@ -0,0 +1,224 @@
+// Package ratelimitconn limits messages and bytes received on long-lived connections such as websockets, which
+// are checked by http middleware only once on upgrade. Limits are applied per connection and per user, so a
+// user can't get around them by opening more connections. Listener limits connections themselves per source IP
+// for services below HTTP.
+//
+// The package doesn't depend on a websocket library, a connection is adapted to MessageConn, e.g. for gorilla:
+//
+//	type wsConn struct{ *websocket.Conn }
+//
+//	func (c wsConn) ReadMessage(ctx context.Context) ([]byte, error) {
+//		_, p, err := c.Conn.ReadMessage()
+//		return p, err
+//	}
+//
+//	func (c wsConn) Close(code int, reason string) error {
+//		_ = c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason),
+//			time.Now().Add(time.Second))
+//		return c.Conn.Close()
+//	}
+package ratelimitconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"ratelimit/util/ratelimit"
+	"strings"
+)
+
+// ClosePolicyViolation is websocket close code sent when a connection exceeds its limits
+const ClosePolicyViolation = 1008
+
+var (
+	// ErrPolicyViolation is returned when a connection exceeds its limits and Action is ActionClose
+	ErrPolicyViolation = errors.New("connection exceeds rate limit")
+)
+
+// Action decides what happens to a message which exceeds limits
+type Action int
+
+const (
+	// ActionDrop discards message and keeps connection open, it's the default behaviour
+	ActionDrop Action = iota
+	// ActionDelay waits until message is allowed, so reading slows down to the allowed rate
+	ActionDelay
+	// ActionClose closes connection with ClosePolicyViolation
+	ActionClose
+)
+
+var actionNames = map[Action]string{
+	ActionDrop:  "drop",
+	ActionDelay: "delay",
+	ActionClose: "close",
+}
+
+func (a Action) String() string {
+	if name, ok := actionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// ParseAction parses action from its name, e.g. "delay"
+func ParseAction(s string) (Action, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for a, name := range actionNames {
+		if name == s {
+			return a, nil
+		}
+	}
+	return ActionDrop, fmt.Errorf("unknown action %q", s)
+}
+
+type Option func(g *Guard)
+
+// WithConnMessageLimiter set limiter of messages of a connection, keyed by connection id
+func WithConnMessageLimiter(l ratelimit.Limiter) Option {
+	return func(g *Guard) {
+		g.connMessages = l
+	}
+}
+
+// WithConnByteLimiter set limiter of bytes of a connection, keyed by connection id
+func WithConnByteLimiter(l ratelimit.Limiter) Option {
+	return func(g *Guard) {
+		g.connBytes = l
+	}
+}
+
+// WithUserMessageLimiter set limiter of messages of all connections of a user, keyed by user
+func WithUserMessageLimiter(l ratelimit.Limiter) Option {
+	return func(g *Guard) {
+		g.userMessages = l
+	}
+}
+
+// WithUserByteLimiter set limiter of bytes of all connections of a user, keyed by user
+func WithUserByteLimiter(l ratelimit.Limiter) Option {
+	return func(g *Guard) {
+		g.userBytes = l
+	}
+}
+
+// WithAction set action taken on messages exceeding limits, ActionDrop by default
+func WithAction(a Action) Option {
+	return func(g *Guard) {
+		g.action = a
+	}
+}
+
+// WithClock set clock used to wait for reservations of delayed messages
+func WithClock(c ratelimit.Clock) Option {
+	return func(g *Guard) {
+		g.clock = c
+	}
+}
+
+// Guard holds limits shared by connections, it's created once and every accepted connection is checked by its
+// own Conn
+type Guard struct {
+	connMessages ratelimit.Limiter
+	connBytes    ratelimit.Limiter
+	userMessages ratelimit.Limiter
+	userBytes    ratelimit.Limiter
+	action       Action
+	clock        ratelimit.Clock
+}
+
+func New(opts ...Option) *Guard {
+	g := &Guard{
+		clock: ratelimit.SystemClock,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Conn returns limits of connection id of user, id must be unique among connections sharing connection limiters.
+// Limits of user are skipped if user is empty, e.g. for anonymous connections
+func (g *Guard) Conn(id, user string) *Conn {
+	c := &Conn{guard: g}
+	c.add(g.connMessages, id, false)
+	c.add(g.connBytes, id, true)
+	if user != "" {
+		c.add(g.userMessages, user, false)
+		c.add(g.userBytes, user, true)
+	}
+	return c
+}
+
+// check is a limiter with key of connection, bytes limiters are weighted by size of message
+type check struct {
+	limiter ratelimit.Limiter
+	key     string
+	bytes   bool
+}
+
+// Conn checks messages of a connection
+type Conn struct {
+	guard  *Guard
+	checks []check
+}
+
+func (c *Conn) add(l ratelimit.Limiter, key string, bytes bool) {
+	if l != nil {
+		c.checks = append(c.checks, check{limiter: l, key: key, bytes: bytes})
+	}
+}
+
+// Allow checks message of size bytes against limits of connection by action of guard. It returns false if
+// message is dropped, ErrPolicyViolation if connection should be closed or error of limiter or of ctx
+func (c *Conn) Allow(ctx context.Context, size int) (bool, error) {
+	return c.allow(ctx, size, c.guard.action, false)
+}
+
+// allow checks limiters in turn, limiters checked before a denied one have already consumed the message
+func (c *Conn) allow(ctx context.Context, size int, action Action, bytesOnly bool) (bool, error) {
+	for _, ch := range c.checks {
+		if bytesOnly && !ch.bytes {
+			continue
+		}
+		weight := int64(1)
+		if ch.bytes {
+			weight = int64(size)
+			if weight == 0 {
+				continue
+			}
+		}
+		allowed, err := c.check(ctx, ch, weight, action)
+		if err != nil || !allowed {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (c *Conn) check(ctx context.Context, ch check, weight int64, action Action) (bool, error) {
+	for {
+		r, allowed, err := ch.limiter.Allow(ctx, ch.key, weight)
+		if err != nil {
+			return false, err
+		}
+		if allowed {
+			return true, nil
+		}
+
+		switch action {
+		case ActionDrop:
+			return false, nil
+		case ActionClose:
+			return false, ErrPolicyViolation
+		}
+		// message larger than bucket would be delayed forever
+		if r == nil || (r.Bucket > 0 && weight > r.Bucket) {
+			return false, ErrPolicyViolation
+		}
+		select {
+		case <-c.guard.clock.After(r.DelayFrom(c.guard.clock.Now())):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package ratelimitconn
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/leakybucket"
+	"testing"
+	"time"
+)
+
+func newTestClock() *clocktest.FakeClock {
+	return clocktest.NewFakeClock(time.Unix(1700000000, 0))
+}
+
+// newTestLimiter allows n events per second with burst of n
+func newTestLimiter(t *testing.T, clock *clocktest.FakeClock, n int64) *leakybucket.Limiter {
+	l := leakybucket.New(float64(n), time.Second, n, leakybucket.WithClock(clock))
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return l
+}
+
+func TestConn_Allow(t *testing.T) {
+	clock := newTestClock()
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		action  Action
+		wantErr error
+	}{
+		{name: "drop", action: ActionDrop},
+		{name: "close", action: ActionClose, wantErr: ErrPolicyViolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := New(WithConnMessageLimiter(newTestLimiter(t, clock, 2)), WithAction(tt.action), WithClock(clock))
+			c := g.Conn("c1", "u1")
+			for i := 0; i < 2; i++ {
+				allowed, err := c.Allow(ctx, 10)
+				require.Nil(t, err)
+				assert.True(t, allowed)
+			}
+			allowed, err := c.Allow(ctx, 10)
+			assert.False(t, allowed)
+			assert.ErrorIs(t, err, tt.wantErr)
+
+			// other connections have their own limits
+			allowed, err = g.Conn("c2", "u1").Allow(ctx, 10)
+			require.Nil(t, err)
+			assert.True(t, allowed)
+		})
+	}
+}
+
+func TestConn_Allow_User(t *testing.T) {
+	clock := newTestClock()
+	ctx := context.Background()
+	g := New(WithUserByteLimiter(newTestLimiter(t, clock, 100)), WithClock(clock))
+
+	c1, c2 := g.Conn("c1", "u1"), g.Conn("c2", "u1")
+	allowed, _ := c1.Allow(ctx, 60)
+	assert.True(t, allowed)
+	// bytes of user are shared by its connections
+	allowed, _ = c2.Allow(ctx, 60)
+	assert.False(t, allowed)
+	allowed, _ = c2.Allow(ctx, 40)
+	assert.True(t, allowed)
+
+	// anonymous connections are not limited by user
+	allowed, _ = g.Conn("c3", "").Allow(ctx, 60)
+	assert.True(t, allowed)
+}
+
+func TestConn_Allow_Delay(t *testing.T) {
+	clock := newTestClock()
+	g := New(WithConnMessageLimiter(newTestLimiter(t, clock, 1)), WithConnByteLimiter(newTestLimiter(t, clock, 10)),
+		WithAction(ActionDelay), WithClock(clock))
+	c := g.Conn("c1", "")
+
+	allowed, err := c.Allow(context.Background(), 5)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		allowed, err = c.Allow(context.Background(), 5)
+	}()
+	clock.BlockUntilTimers(1)
+	clock.Advance(time.Second)
+	<-done
+	require.Nil(t, err)
+	assert.True(t, allowed)
+
+	// message larger than bucket is never allowed
+	_, err = New(WithConnByteLimiter(newTestLimiter(t, clock, 10)), WithAction(ActionDelay),
+		WithClock(clock)).Conn("c1", "").Allow(context.Background(), 11)
+	assert.ErrorIs(t, err, ErrPolicyViolation)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.Allow(ctx, 1)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+type testMessageConn struct {
+	msgs   [][]byte
+	code   int
+	reason string
+}
+
+func (c *testMessageConn) ReadMessage(ctx context.Context) ([]byte, error) {
+	if len(c.msgs) == 0 {
+		return nil, io.EOF
+	}
+	msg := c.msgs[0]
+	c.msgs = c.msgs[1:]
+	return msg, nil
+}
+
+func (c *testMessageConn) Close(code int, reason string) error {
+	c.code, c.reason = code, reason
+	return nil
+}
+
+func TestConn_Serve(t *testing.T) {
+	clock := newTestClock()
+	msgs := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	var handled []string
+	handle := func(ctx context.Context, msg []byte) error {
+		handled = append(handled, string(msg))
+		return nil
+	}
+	g := New(WithConnMessageLimiter(newTestLimiter(t, clock, 2)), WithClock(clock))
+	err := g.Conn("c1", "").Serve(context.Background(), &testMessageConn{msgs: msgs}, handle)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, []string{"a", "b"}, handled)
+
+	handled = nil
+	mc := &testMessageConn{msgs: msgs}
+	g = New(WithConnMessageLimiter(newTestLimiter(t, clock, 1)), WithAction(ActionClose), WithClock(clock))
+	err = g.Conn("c1", "").Serve(context.Background(), mc, handle)
+	assert.ErrorIs(t, err, ErrPolicyViolation)
+	assert.Equal(t, []string{"a"}, handled)
+	assert.Equal(t, ClosePolicyViolation, mc.code)
+
+	errHandle := errors.New("handle failed")
+	err = New().Conn("c1", "").Serve(context.Background(), &testMessageConn{msgs: msgs},
+		func(ctx context.Context, msg []byte) error {
+			return errHandle
+		})
+	assert.ErrorIs(t, err, errHandle)
+}
+
+func TestConn_NetConn(t *testing.T) {
+	clock := newTestClock()
+	g := New(WithConnByteLimiter(newTestLimiter(t, clock, 4)), WithAction(ActionClose), WithClock(clock))
+	server, client := net.Pipe()
+	defer client.Close()
+	nc := g.Conn("c1", "").NetConn(server)
+
+	go func() {
+		_, _ = client.Write([]byte("abcd"))
+		_, _ = client.Write([]byte("e"))
+	}()
+	buf := make([]byte, 8)
+	n, err := nc.Read(buf)
+	require.Nil(t, err)
+	assert.Equal(t, "abcd", string(buf[:n]))
+	// bytes already read are returned with the violation
+	n, err = nc.Read(buf)
+	assert.ErrorIs(t, err, ErrPolicyViolation)
+	assert.Equal(t, "e", string(buf[:n]))
+	_, err = client.Write([]byte("f"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// stream is delayed instead of dropped
+	g = New(WithConnByteLimiter(newTestLimiter(t, clock, 4)), WithClock(clock))
+	server, client = net.Pipe()
+	defer client.Close()
+	nc = g.Conn("c1", "").NetConn(server)
+	go func() {
+		_, _ = client.Write([]byte("abcd"))
+		_, _ = client.Write([]byte("e"))
+	}()
+	_, err = nc.Read(buf)
+	require.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err = nc.Read(buf)
+	}()
+	clock.BlockUntilTimers(1)
+	require.Nil(t, nc.Close())
+	<-done
+	assert.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestConn_NetConn_LargeRead(t *testing.T) {
+	clock := newTestClock()
+	g := New(WithConnByteLimiter(newTestLimiter(t, clock, 4)), WithClock(clock))
+	server, client := net.Pipe()
+	defer client.Close()
+	nc := g.Conn("c1", "").NetConn(server)
+	defer nc.Close()
+
+	go func() {
+		_, _ = client.Write([]byte("abcdefghij"))
+		_, _ = client.Write([]byte("klmnopqrst"))
+	}()
+
+	// read larger than bucket is delayed in chunks of bucket instead of closing connection
+	buf := make([]byte, 16)
+	var (
+		n   int
+		err error
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err = nc.Read(buf)
+	}()
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			waiting = false
+		case <-time.After(time.Millisecond):
+			clock.Advance(time.Second)
+		}
+	}
+	require.Nil(t, err)
+	assert.Equal(t, "abcdefghij", string(buf[:n]))
+
+	// next reads are capped to bucket
+	clock.Advance(time.Minute)
+	n, err = nc.Read(buf)
+	require.Nil(t, err)
+	assert.Equal(t, "klmn", string(buf[:n]))
+}
+
+func TestParseAction(t *testing.T) {
+	for a, name := range actionNames {
+		parsed, err := ParseAction(name)
+		require.Nil(t, err)
+		assert.Equal(t, a, parsed)
+		assert.Equal(t, name, a.String())
+	}
+	_, err := ParseAction("ignore")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,407 @@
+// Package ratelimitexec runs tasks tagged with a key, e.g. emails, webhooks or SMS of a tenant, at the rate allowed
+// by a limiter for their key
+package ratelimitexec
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"ratelimit/util/ratelimit"
+	"sync"
+	"time"
+)
+
+var (
+	defaultConcurrency = 10
+	// minRetryDelay bounds how often a denied key is checked again if limiter returns no delay
+	minRetryDelay = 10 * time.Millisecond
+)
+
+var (
+	// ErrClosed is returned by Submit after Shutdown and by jobs dropped by shutdown
+	ErrClosed = errors.New("executor is closed")
+	// ErrQueueFull is returned by Submit when queue of key is full
+	ErrQueueFull = errors.New("queue of key is full")
+)
+
+// Task is work limited by key, it consumes Weight events of key, 1 if it's zero
+type Task struct {
+	Key    string
+	Weight int64
+	Run    func(ctx context.Context) error
+}
+
+// Job is a submitted task
+type Job struct {
+	task Task
+	ctx  context.Context
+	stop func() bool
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once task has run, failed to be scheduled or is cancelled
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Err returns error of Run, error of limiter, ErrClosed or error of context of task once job is done
+func (j *Job) Err() error {
+	select {
+	case <-j.done:
+		return j.err
+	default:
+		return nil
+	}
+}
+
+// Wait blocks until job is done or ctx is done
+func (j *Job) Wait(ctx context.Context) error {
+	select {
+	case <-j.done:
+		return j.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (j *Job) finish(err error) {
+	j.once.Do(func() {
+		j.err = err
+		close(j.done)
+	})
+}
+
+// complete finishes job which is no longer watching its context
+func (j *Job) complete(err error) {
+	j.stop()
+	j.finish(err)
+}
+
+func (j *Job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+type Option func(e *Executor)
+
+// WithConcurrency set maximum number of tasks running at once, 10 by default
+func WithConcurrency(n int) Option {
+	return func(e *Executor) {
+		e.concurrency = n
+	}
+}
+
+// WithMaxQueue bounds number of queued tasks of a key, zero means unbounded
+func WithMaxQueue(n int) Option {
+	return func(e *Executor) {
+		e.maxQueue = n
+	}
+}
+
+// WithClock set clock used to wait for reservations of denied keys
+func WithClock(c ratelimit.Clock) Option {
+	return func(e *Executor) {
+		e.clock = c
+	}
+}
+
+// keyQueue is queue of tasks of a key
+type keyQueue struct {
+	key  string
+	jobs []*Job
+	// wake is time to check key again after it's denied
+	wake time.Time
+}
+
+// Executor runs tasks with bounded concurrency once limiter allows their key.
+// Keys take turns so a key with a long queue doesn't delay others, a denied key sleeps until TimeToAct of its
+// reservation while others keep running
+type Executor struct {
+	limiter     ratelimit.Limiter
+	concurrency int
+	maxQueue    int
+	clock       ratelimit.Clock
+
+	mu     sync.Mutex
+	queues map[string]*keyQueue
+	// ready keys are checked in turn, sleeping keys are ordered by wake time
+	ready    []*keyQueue
+	sleeping sleepHeap
+	closed   bool
+
+	notify  chan struct{}
+	slots   chan struct{}
+	running sync.WaitGroup
+	// base is context of running tasks, it's cancelled when shutdown times out
+	base     context.Context
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func New(l ratelimit.Limiter, opts ...Option) *Executor {
+	e := &Executor{
+		limiter:     l,
+		concurrency: defaultConcurrency,
+		clock:       ratelimit.SystemClock,
+		queues:      make(map[string]*keyQueue),
+		notify:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.concurrency <= 0 {
+		e.concurrency = defaultConcurrency
+	}
+	e.slots = make(chan struct{}, e.concurrency)
+	e.base, e.cancel = context.WithCancel(context.Background())
+
+	go e.schedule()
+	return e
+}
+
+// Submit queues task t, ctx cancels it while it's queued and is passed to Run
+func (e *Executor) Submit(ctx context.Context, t Task) (*Job, error) {
+	if t.Run == nil {
+		return nil, errors.New("task has no Run")
+	}
+	if t.Weight <= 0 {
+		t.Weight = 1
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	j := &Job{task: t, ctx: ctx, done: make(chan struct{})}
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil, ErrClosed
+	}
+	q, ok := e.queues[t.Key]
+	if !ok {
+		q = &keyQueue{key: t.Key}
+		e.queues[t.Key] = q
+		e.ready = append(e.ready, q)
+	}
+	if e.maxQueue > 0 && len(q.jobs) >= e.maxQueue {
+		e.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	// cancelled job is done at once, scheduler drops it when it reaches it
+	j.stop = context.AfterFunc(ctx, func() {
+		j.finish(ctx.Err())
+	})
+	q.jobs = append(q.jobs, j)
+	e.mu.Unlock()
+
+	e.wakeUp()
+	return j, nil
+}
+
+func (e *Executor) wakeUp() {
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// schedule dispatches tasks of ready keys in turn until executor is closed and queues are drained
+func (e *Executor) schedule() {
+	defer func() {
+		e.running.Wait()
+		close(e.done)
+	}()
+
+	for {
+		if e.base.Err() != nil {
+			e.dropAll()
+			return
+		}
+
+		e.mu.Lock()
+		now := e.clock.Now()
+		for len(e.sleeping) > 0 && !e.sleeping[0].wake.After(now) {
+			e.ready = append(e.ready, heap.Pop(&e.sleeping).(*keyQueue))
+		}
+
+		if len(e.ready) == 0 {
+			if e.closed && len(e.queues) == 0 {
+				e.mu.Unlock()
+				return
+			}
+			var wait <-chan time.Time
+			if len(e.sleeping) > 0 {
+				wait = e.clock.After(e.sleeping[0].wake.Sub(now))
+			}
+			e.mu.Unlock()
+
+			select {
+			case <-e.notify:
+			case <-wait:
+			case <-e.base.Done():
+				e.dropAll()
+				return
+			}
+			continue
+		}
+
+		q := e.ready[0]
+		e.ready = e.ready[1:]
+		j := e.head(q)
+		e.mu.Unlock()
+		if j == nil {
+			continue
+		}
+
+		select {
+		case e.slots <- struct{}{}:
+		case <-e.base.Done():
+			e.dropAll()
+			return
+		}
+		e.dispatch(q, j)
+	}
+}
+
+// head returns first job of q which is not cancelled, q is removed if it has none. It's called with mu held
+func (e *Executor) head(q *keyQueue) *Job {
+	for len(q.jobs) > 0 && q.jobs[0].finished() {
+		q.jobs = q.jobs[1:]
+	}
+	if len(q.jobs) == 0 {
+		delete(e.queues, q.key)
+		return nil
+	}
+	return q.jobs[0]
+}
+
+// dispatch checks job j at head of q by limiter and runs it if it's allowed, a slot is held by caller
+func (e *Executor) dispatch(q *keyQueue, j *Job) {
+	r, allowed, err := e.limiter.Allow(j.ctx, q.key, j.task.Weight)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err != nil || allowed {
+		q.jobs = q.jobs[1:]
+	}
+	switch {
+	case err != nil:
+		<-e.slots
+		j.complete(fmt.Errorf("check limit of key: %w", err))
+	case !allowed:
+		<-e.slots
+		now := e.clock.Now()
+		q.wake = r.TimeToAct
+		if q.wake.Before(now.Add(minRetryDelay)) {
+			q.wake = now.Add(minRetryDelay)
+		}
+		heap.Push(&e.sleeping, q)
+		return
+	case j.finished():
+		// job is cancelled while it's checked
+		<-e.slots
+	default:
+		e.running.Add(1)
+		go e.run(j)
+	}
+
+	if len(q.jobs) > 0 {
+		e.ready = append(e.ready, q)
+	} else {
+		delete(e.queues, q.key)
+	}
+}
+
+func (e *Executor) run(j *Job) {
+	defer func() {
+		<-e.slots
+		e.running.Done()
+	}()
+
+	ctx, cancel := context.WithCancel(j.ctx)
+	defer cancel()
+	stop := context.AfterFunc(e.base, cancel)
+	defer stop()
+
+	var err error
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("task panicked: %v", p)
+			}
+		}()
+		err = j.task.Run(ctx)
+	}()
+	j.complete(err)
+}
+
+// dropAll fails every queued job with ErrClosed
+func (e *Executor) dropAll() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, q := range e.queues {
+		for _, j := range q.jobs {
+			j.complete(ErrClosed)
+		}
+	}
+	e.queues = make(map[string]*keyQueue)
+	e.ready = nil
+	e.sleeping = nil
+}
+
+// Shutdown stops accepting tasks and waits until queued and running tasks are done. If ctx is done first,
+// queued tasks are dropped with ErrClosed, context of running tasks is cancelled and ctx.Err() is returned
+// once they return
+func (e *Executor) Shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	e.closed = true
+	e.mu.Unlock()
+	e.wakeUp()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		e.stopOnce.Do(e.cancel)
+		<-e.done
+		return ctx.Err()
+	}
+}
+
+// Close drops queued tasks, cancels running ones and waits until they return
+func (e *Executor) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := e.Shutdown(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// sleepHeap orders denied keys by wake time
+type sleepHeap []*keyQueue
+
+func (h sleepHeap) Len() int           { return len(h) }
+func (h sleepHeap) Less(i, j int) bool { return h[i].wake.Before(h[j].wake) }
+func (h sleepHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *sleepHeap) Push(x any) {
+	*h = append(*h, x.(*keyQueue))
+}
+
+func (h *sleepHeap) Pop() any {
+	old := *h
+	q := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return q
+}
@@ -0,0 +1,215 @@
+package ratelimitexec
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/leakybucket"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errStoreDown = errors.New("store is down")
+
+type failedLimiter struct{}
+
+func (failedLimiter) Allow(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, errStoreDown
+}
+
+func (failedLimiter) Reset(context.Context, string, int64) error {
+	return errStoreDown
+}
+
+// recorder records keys of tasks in order they run
+type recorder struct {
+	mu   sync.Mutex
+	keys []string
+}
+
+func (r *recorder) task(key string) Task {
+	return Task{Key: key, Run: func(ctx context.Context) error {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.keys = append(r.keys, key)
+		return nil
+	}}
+}
+
+func (r *recorder) ran() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.keys...)
+}
+
+func newTestLimiter(t *testing.T, clock *clocktest.FakeClock, rate float64, period time.Duration,
+	bucket int64) *leakybucket.Limiter {
+	l := leakybucket.New(rate, period, bucket, leakybucket.WithClock(clock))
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return l
+}
+
+func TestExecutor_Fairness(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	// every key has a burst of 2 and leaks 1 event every 10 seconds
+	l := newTestLimiter(t, clock, 1, 10*time.Second, 2)
+	e := New(l, WithConcurrency(1), WithClock(clock))
+	defer e.Close()
+
+	var rec recorder
+	var jobs []*Job
+	for _, key := range []string{"a", "a", "a", "a", "b"} {
+		j, err := e.Submit(context.Background(), rec.task(key))
+		require.Nil(t, err)
+		jobs = append(jobs, j)
+	}
+
+	// keys take turns until a is denied
+	require.Eventually(t, func() bool { return len(rec.ran()) == 3 }, time.Second, time.Millisecond)
+	assert.ElementsMatch(t, []string{"a", "a", "b"}, rec.ran())
+	clock.BlockUntilTimers(1)
+
+	clock.Advance(10 * time.Second)
+	require.Nil(t, jobs[2].Wait(context.Background()))
+	clock.BlockUntilTimers(1)
+	assert.False(t, jobs[3].finished())
+
+	clock.Advance(10 * time.Second)
+	require.Nil(t, jobs[3].Wait(context.Background()))
+	assert.Equal(t, 5, len(rec.ran()))
+}
+
+func TestExecutor_Concurrency(t *testing.T) {
+	e := New(leakybucket.New(1000, time.Second, 1000), WithConcurrency(2))
+	defer e.Close()
+
+	var running, peak atomic.Int32
+	release := make(chan struct{})
+	var jobs []*Job
+	for i := 0; i < 6; i++ {
+		j, err := e.Submit(context.Background(), Task{Key: "k", Run: func(ctx context.Context) error {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			<-release
+			running.Add(-1)
+			return nil
+		}})
+		require.Nil(t, err)
+		jobs = append(jobs, j)
+	}
+
+	require.Eventually(t, func() bool { return running.Load() == 2 }, time.Second, time.Millisecond)
+	close(release)
+	for _, j := range jobs {
+		require.Nil(t, j.Wait(context.Background()))
+	}
+	assert.Equal(t, int32(2), peak.Load())
+}
+
+func TestExecutor_Errors(t *testing.T) {
+	e := New(leakybucket.New(1000, time.Second, 1000), WithMaxQueue(1), WithConcurrency(1))
+	defer e.Close()
+
+	block := make(chan struct{})
+	j, err := e.Submit(context.Background(), Task{Key: "k", Run: func(ctx context.Context) error {
+		<-block
+		panic("boom")
+	}})
+	require.Nil(t, err)
+	// first task is running so queue of k is free
+	require.Eventually(t, func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return len(e.queues) == 0
+	}, time.Second, time.Millisecond)
+
+	_, err = e.Submit(context.Background(), Task{Key: "k", Run: func(ctx context.Context) error { return nil }})
+	require.Nil(t, err)
+	_, err = e.Submit(context.Background(), Task{Key: "k", Run: func(ctx context.Context) error { return nil }})
+	assert.ErrorIs(t, err, ErrQueueFull)
+
+	close(block)
+	assert.ErrorContains(t, j.Wait(context.Background()), "task panicked: boom")
+
+	failed := New(failedLimiter{})
+	defer failed.Close()
+	j, err = failed.Submit(context.Background(), Task{Key: "k", Run: func(ctx context.Context) error { return nil }})
+	require.Nil(t, err)
+	assert.ErrorIs(t, j.Wait(context.Background()), errStoreDown)
+}
+
+func TestExecutor_Cancel(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	e := New(newTestLimiter(t, clock, 1, time.Minute, 1), WithClock(clock))
+	defer e.Close()
+
+	var rec recorder
+	first, err := e.Submit(context.Background(), rec.task("k"))
+	require.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	j, err := e.Submit(ctx, rec.task("k"))
+	require.Nil(t, err)
+	clock.BlockUntilTimers(1)
+
+	// job waiting for its key is done as soon as it's cancelled
+	cancel()
+	assert.ErrorIs(t, j.Wait(context.Background()), context.Canceled)
+	clock.Advance(time.Minute)
+	require.Nil(t, first.Wait(context.Background()))
+	assert.Equal(t, []string{"k"}, rec.ran())
+
+	_, err = e.Submit(ctx, rec.task("k"))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestExecutor_Shutdown(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	l := leakybucket.New(1, time.Minute, 1, leakybucket.WithClock(clock))
+	defer l.Close()
+	e := New(l, WithClock(clock))
+
+	running := make(chan struct{})
+	j1, err := e.Submit(context.Background(), Task{Key: "a", Run: func(ctx context.Context) error {
+		close(running)
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+	require.Nil(t, err)
+	j2, err := e.Submit(context.Background(), Task{Key: "a", Run: func(ctx context.Context) error { return nil }})
+	require.Nil(t, err)
+	<-running
+
+	// queued task of a denied key is dropped and running task is cancelled once shutdown times out
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, e.Shutdown(ctx), context.DeadlineExceeded)
+	assert.ErrorIs(t, j1.Err(), context.Canceled)
+	assert.ErrorIs(t, j2.Err(), ErrClosed)
+
+	_, err = e.Submit(context.Background(), Task{Key: "a", Run: func(ctx context.Context) error { return nil }})
+	assert.ErrorIs(t, err, ErrClosed)
+	assert.Nil(t, e.Close())
+}
+
+func TestExecutor_Shutdown_Drain(t *testing.T) {
+	e := New(leakybucket.New(1000, time.Second, 1000))
+	var rec recorder
+	for i := 0; i < 10; i++ {
+		_, err := e.Submit(context.Background(), rec.task("k"))
+		require.Nil(t, err)
+	}
+	require.Nil(t, e.Shutdown(context.Background()))
+	assert.Len(t, rec.ran(), 10)
+}
@@ -0,0 +1,189 @@
+// Package ratelimitio limits bandwidth of readers and writers, every byte is an event of key checked by a
+// limiter, so a limiter of 1MB per second per customer caps throughput of all streams of the customer
+package ratelimitio
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"ratelimit/util/ratelimit"
+	"time"
+)
+
+var (
+	defaultChunkSize = 32 * 1024
+	// minRetryDelay bounds how often a denied chunk is checked again if limiter returns no delay
+	minRetryDelay = 10 * time.Millisecond
+)
+
+type Option func(t *throttle)
+
+// WithClock set clock used to wait for reservations of denied chunks
+func WithClock(c ratelimit.Clock) Option {
+	return func(t *throttle) {
+		t.clock = c
+	}
+}
+
+// WithChunkSize set maximum number of bytes consumed from limiter at once, 32KB by default.
+// It's lowered to bucket size of limiter when a chunk can never fit into the bucket
+func WithChunkSize(n int) Option {
+	return func(t *throttle) {
+		t.chunk = int64(n)
+	}
+}
+
+// throttle consumes bytes of key from limiter, waiting until they are allowed
+type throttle struct {
+	ctx     context.Context
+	limiter ratelimit.Limiter
+	key     string
+	clock   ratelimit.Clock
+	chunk   int64
+}
+
+func newThrottle(ctx context.Context, l ratelimit.Limiter, key string, opts []Option) *throttle {
+	t := &throttle{
+		ctx:     ctx,
+		limiter: l,
+		key:     key,
+		clock:   ratelimit.SystemClock,
+		chunk:   int64(defaultChunkSize),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.chunk <= 0 {
+		t.chunk = int64(defaultChunkSize)
+	}
+	return t
+}
+
+// take blocks until a chunk of at most n bytes is allowed by limiter and returns its size, it returns error of
+// limiter or of context
+func (t *throttle) take(n int64) (int64, error) {
+	for {
+		v := min(n, t.chunk)
+		r, allowed, err := t.limiter.Allow(t.ctx, t.key, v)
+		if err != nil {
+			return 0, err
+		}
+		if allowed {
+			return v, nil
+		}
+		// denied without reservation, e.g. by fail closed error policy, so there is nothing to wait for
+		if r == nil {
+			return 0, ratelimit.ErrLimitReached
+		}
+		// chunk larger than bucket would be denied forever
+		if r.Bucket > 0 && v > r.Bucket {
+			t.chunk = r.Bucket
+			continue
+		}
+
+		select {
+		case <-t.clock.After(max(r.DelayFrom(t.clock.Now()), minRetryDelay)):
+		case <-t.ctx.Done():
+			return 0, t.ctx.Err()
+		}
+	}
+}
+
+// wait blocks until all n bytes are allowed
+func (t *throttle) wait(n int64) error {
+	for n > 0 {
+		v, err := t.take(n)
+		if err != nil {
+			return err
+		}
+		n -= v
+	}
+	return nil
+}
+
+// Reader limits bytes read from underlying reader
+type Reader struct {
+	r io.Reader
+	t *throttle
+}
+
+// NewReader limits bytes read from r by limiter l with key, ctx cancels waiting for limiter
+func NewReader(ctx context.Context, r io.Reader, l ratelimit.Limiter, key string, opts ...Option) *Reader {
+	return &Reader{r: r, t: newThrottle(ctx, l, key, opts)}
+}
+
+// Read reads at most a chunk and waits until bytes read are allowed before returning them. Bytes which are
+// already read are returned with error of limiter, e.g. when ctx is done while waiting
+func (r *Reader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.t.chunk {
+		p = p[:r.t.chunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.t.wait(int64(n)); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Writer limits bytes written to underlying writer
+type Writer struct {
+	w io.Writer
+	t *throttle
+}
+
+// NewWriter limits bytes written to w by limiter l with key, ctx cancels waiting for limiter
+func NewWriter(ctx context.Context, w io.Writer, l ratelimit.Limiter, key string, opts ...Option) *Writer {
+	return &Writer{w: w, t: newThrottle(ctx, l, key, opts)}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	return write(w.w, w.t, p)
+}
+
+// write writes p chunk by chunk, every chunk is written once it's allowed
+func write(w io.Writer, t *throttle, p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		v, err := t.take(int64(len(p)))
+		if err != nil {
+			return written, err
+		}
+		n, err := w.Write(p[:v])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ResponseWriter limits bytes of response body written to underlying http.ResponseWriter
+type ResponseWriter struct {
+	http.ResponseWriter
+	t *throttle
+}
+
+// NewResponseWriter limits response body written to w by limiter l with key, ctx is usually context of request
+func NewResponseWriter(ctx context.Context, w http.ResponseWriter, l ratelimit.Limiter, key string,
+	opts ...Option) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w, t: newThrottle(ctx, l, key, opts)}
+}
+
+func (w *ResponseWriter) Write(p []byte) (int, error) {
+	return write(w.ResponseWriter, w.t, p)
+}
+
+// Flush flushes underlying writer if it supports http.Flusher
+func (w *ResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns underlying writer for http.ResponseController
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
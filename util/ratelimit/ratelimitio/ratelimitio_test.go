@@ -0,0 +1,194 @@
+package ratelimitio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/leakybucket"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errStoreDown = errors.New("store is down")
+
+type failedLimiter struct {
+	err error
+}
+
+func (l failedLimiter) Allow(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, l.err
+}
+
+func (l failedLimiter) Reset(context.Context, string, int64) error {
+	return l.err
+}
+
+// newTestLimiter allows 10 bytes per second with burst of 10 bytes
+func newTestLimiter(t *testing.T) (*leakybucket.Limiter, *clocktest.FakeClock) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	l := leakybucket.New(10, time.Second, 10, leakybucket.WithClock(clock))
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	return l, clock
+}
+
+// advanceUntil advances clock by a second whenever limiter is waited until done is closed
+func advanceUntil(t *testing.T, clock *clocktest.FakeClock, done <-chan struct{}) int {
+	var seconds int
+	for {
+		select {
+		case <-done:
+			return seconds
+		case <-time.After(time.Millisecond):
+		}
+		if clock.Timers() > 0 {
+			clock.Advance(time.Second)
+			seconds++
+		}
+		require.Less(t, seconds, 100)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	l, clock := newTestLimiter(t)
+	var buf bytes.Buffer
+	// chunk is lowered to bucket size of limiter
+	w := NewWriter(context.Background(), &buf, l, "k1", WithClock(clock))
+
+	done := make(chan struct{})
+	var n int
+	var err error
+	go func() {
+		defer close(done)
+		n, err = w.Write([]byte(strings.Repeat("a", 35)))
+	}()
+	assert.Equal(t, 3, advanceUntil(t, clock, done))
+	require.Nil(t, err)
+	assert.Equal(t, 35, n)
+	assert.Equal(t, 35, buf.Len())
+
+	// other keys are not limited
+	w = NewWriter(context.Background(), &buf, l, "k2", WithClock(clock))
+	n, err = w.Write([]byte("abc"))
+	require.Nil(t, err)
+	assert.Equal(t, 3, n)
+}
+
+func TestReader(t *testing.T) {
+	l, clock := newTestLimiter(t)
+	r := NewReader(context.Background(), strings.NewReader(strings.Repeat("a", 25)), l, "k1",
+		WithClock(clock), WithChunkSize(5))
+
+	done := make(chan struct{})
+	var data []byte
+	var err error
+	go func() {
+		defer close(done)
+		data, err = io.ReadAll(r)
+	}()
+	assert.Equal(t, 2, advanceUntil(t, clock, done))
+	require.Nil(t, err)
+	assert.Len(t, data, 25)
+}
+
+func TestErrors(t *testing.T) {
+	l, clock := newTestLimiter(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var buf bytes.Buffer
+	w := NewWriter(ctx, &buf, l, "k1", WithClock(clock))
+	done := make(chan struct{})
+	var n int
+	var err error
+	go func() {
+		defer close(done)
+		n, err = w.Write([]byte(strings.Repeat("a", 15)))
+	}()
+	clock.BlockUntilTimers(1)
+	cancel()
+	<-done
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 10, n)
+
+	// bytes read before limiter fails are not lost
+	r := NewReader(context.Background(), strings.NewReader("abc"), failedLimiter{err: errStoreDown}, "k1")
+	data, err := io.ReadAll(r)
+	assert.ErrorIs(t, err, errStoreDown)
+	assert.Equal(t, "abc", string(data))
+
+	// fail closed limiter has no reservation to wait for
+	w = NewWriter(context.Background(), &buf, failedLimiter{}, "k1")
+	_, err = w.Write([]byte("abc"))
+	assert.ErrorIs(t, err, ratelimit.ErrLimitReached)
+}
+
+// boundaryLimiter denies first event without delay, like a fixed window checked right at end of window
+type boundaryLimiter struct {
+	clock *clocktest.FakeClock
+	calls atomic.Int64
+}
+
+func (l *boundaryLimiter) Allow(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	now := l.clock.Now()
+	return &ratelimit.Reservation{TimeToAct: now, Last: now}, l.calls.Add(1) > 1, nil
+}
+
+func (l *boundaryLimiter) Reset(context.Context, string, int64) error {
+	return nil
+}
+
+func TestWriter_ZeroDelay(t *testing.T) {
+	clock := clocktest.NewFakeClock(time.Unix(1700000000, 0))
+	l := &boundaryLimiter{clock: clock}
+	var buf bytes.Buffer
+	w := NewWriter(context.Background(), &buf, l, "k1", WithClock(clock))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = w.Write([]byte("abc"))
+	}()
+	// denied chunk is retried after minimum delay rather than right away
+	clock.BlockUntilTimers(1)
+	assert.Equal(t, int64(1), l.calls.Load())
+	clock.Advance(minRetryDelay)
+	<-done
+	assert.Equal(t, int64(2), l.calls.Load())
+	assert.Equal(t, "abc", buf.String())
+}
+
+func TestResponseWriter(t *testing.T) {
+	l, clock := newTestLimiter(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w = NewResponseWriter(r.Context(), w, l, "k1", WithClock(clock))
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(strings.Repeat("a", 8)))
+		require.Nil(t, http.NewResponseController(w).Flush())
+		_, _ = w.Write([]byte(strings.Repeat("b", 8)))
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+
+	done := make(chan struct{})
+	var body []byte
+	go func() {
+		defer close(done)
+		body, _ = io.ReadAll(resp.Body)
+	}()
+	assert.Equal(t, 1, advanceUntil(t, clock, done))
+	assert.Equal(t, strings.Repeat("a", 8)+strings.Repeat("b", 8), string(body))
+}
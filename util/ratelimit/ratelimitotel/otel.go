@@ -0,0 +1,213 @@
+// Package ratelimitotel instruments limiters and stores with OpenTelemetry spans and metrics
+package ratelimitotel
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"math"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/internal/wrap"
+	"time"
+)
+
+// ScopeName is instrumentation scope of tracers and meters created by this package
+const ScopeName = "ratelimit/util/ratelimit/ratelimitotel"
+
+// Attribute keys of rate limit spans
+const (
+	AttrPolicy     = attribute.Key("ratelimit.policy")
+	AttrKeyHash    = attribute.Key("ratelimit.key_hash")
+	AttrWeight     = attribute.Key("ratelimit.weight")
+	AttrDecision   = attribute.Key("ratelimit.decision")
+	AttrRemaining  = attribute.Key("ratelimit.remaining")
+	AttrRetryAfter = attribute.Key("ratelimit.retry_after")
+	AttrStore      = attribute.Key("ratelimit.store")
+)
+
+// Decision values of AttrDecision
+const (
+	DecisionAllowed = "allowed"
+	DecisionDenied  = "denied"
+	DecisionError   = "error"
+)
+
+type Option func(c *config)
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+	clock          ratelimit.Clock
+}
+
+// WithTracerProvider set provider of tracer, global provider is used by default
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+// WithMeterProvider set provider of meter, global provider is used by default
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(c *config) {
+		c.meterProvider = mp
+	}
+}
+
+// WithClock set clock used to compute retry delay, it must be the clock of instrumented limiter
+func WithClock(c ratelimit.Clock) Option {
+	return func(cfg *config) {
+		cfg.clock = c
+	}
+}
+
+func newConfig(opts []Option) config {
+	c := config{
+		tracerProvider: otel.GetTracerProvider(),
+		meterProvider:  otel.GetMeterProvider(),
+		clock:          ratelimit.SystemClock,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// DecisionAttributes returns span attributes describing result of Allow
+func DecisionAttributes(r *ratelimit.Reservation, allowed bool, err error, now time.Time) []attribute.KeyValue {
+	if err != nil {
+		return []attribute.KeyValue{AttrDecision.String(DecisionError)}
+	}
+
+	decision := DecisionDenied
+	if allowed {
+		decision = DecisionAllowed
+	}
+	attrs := []attribute.KeyValue{AttrDecision.String(decision)}
+	if r != nil {
+		attrs = append(attrs,
+			AttrRemaining.Int64(Remaining(r)),
+			AttrRetryAfter.Float64(r.DelayFrom(now).Seconds()),
+		)
+	}
+	return attrs
+}
+
+// Remaining returns number of events still allowed by reservation r
+func Remaining(r *ratelimit.Reservation) int64 {
+	remaining := r.Bucket - int64(math.Ceil(r.Req))
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Limiter wraps l to trace its calls, decisions are also counted on meter labelled by policy. Update of fixedwindow
+// and leakybucket limiters, Peek and bans of penaltybox.Box are forwarded to l
+func Limiter(policy string, l ratelimit.Limiter, opts ...Option) ratelimit.Limiter {
+	c := newConfig(opts)
+	meter := c.meterProvider.Meter(ScopeName)
+	decisions, err := meter.Int64Counter("ratelimit.decisions",
+		metric.WithDescription("Number of events checked by limiter by decision."))
+	if err != nil {
+		otel.Handle(err)
+	}
+	delay, err := meter.Float64Histogram("ratelimit.delay",
+		metric.WithDescription("Delay until a denied event may be retried."), metric.WithUnit("s"))
+	if err != nil {
+		otel.Handle(err)
+	}
+
+	return wrap.Limiter(&limiter{
+		Limiter:   l,
+		policy:    AttrPolicy.String(policy),
+		tracer:    c.tracerProvider.Tracer(ScopeName),
+		clock:     c.clock,
+		decisions: decisions,
+		delay:     delay,
+	}, l)
+}
+
+type limiter struct {
+	ratelimit.Limiter
+	policy    attribute.KeyValue
+	tracer    trace.Tracer
+	clock     ratelimit.Clock
+	decisions metric.Int64Counter
+	delay     metric.Float64Histogram
+}
+
+func (l *limiter) Allow(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	ctx, span := l.tracer.Start(ctx, "ratelimit.Allow", trace.WithAttributes(
+		l.policy, AttrKeyHash.String(ratelimit.HashKey(k)), AttrWeight.Int64(v)))
+	defer span.End()
+
+	start := l.clock.Now()
+	r, ok, err := l.Limiter.Allow(ctx, k, v)
+	attrs := DecisionAttributes(r, ok, err, start)
+	span.SetAttributes(attrs...)
+	recordError(span, err)
+
+	// only policy and decision are used as metric labels to bound cardinality
+	labels := metric.WithAttributes(l.policy, attrs[0])
+	l.decisions.Add(ctx, 1, labels)
+	if err == nil && !ok && r != nil {
+		l.delay.Record(ctx, r.DelayFrom(start).Seconds(), metric.WithAttributes(l.policy))
+	}
+	return r, ok, err
+}
+
+func (l *limiter) Reset(ctx context.Context, k string, v int64) error {
+	ctx, span := l.tracer.Start(ctx, "ratelimit.Reset", trace.WithAttributes(
+		l.policy, AttrKeyHash.String(ratelimit.HashKey(k))))
+	defer span.End()
+
+	err := l.Limiter.Reset(ctx, k, v)
+	recordError(span, err)
+	return err
+}
+
+// Close closes wrapped limiter if it's closable
+func (l *limiter) Close() error {
+	if c, ok := l.Limiter.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// CheckTracer returns tracer of checks of middleware.LimitMid, set by middleware.RateLimitWithTracer. A span is
+// created for every checked request and it ends before request is served
+func CheckTracer(opts ...Option) ratelimit.CheckTracer {
+	c := newConfig(opts)
+	return &checkTracer{tracer: c.tracerProvider.Tracer(ScopeName), clock: c.clock}
+}
+
+type checkTracer struct {
+	tracer trace.Tracer
+	clock  ratelimit.Clock
+}
+
+func (t *checkTracer) StartCheck(ctx context.Context, policy, key string) (context.Context,
+	func(r *ratelimit.Reservation, allowed bool, err error)) {
+	ctx, span := t.tracer.Start(ctx, "ratelimit.LimitMid", trace.WithAttributes(
+		AttrPolicy.String(policy), AttrKeyHash.String(ratelimit.HashKey(key))))
+	return ctx, func(r *ratelimit.Reservation, allowed bool, err error) {
+		span.SetAttributes(DecisionAttributes(r, allowed, err, t.clock.Now())...)
+		recordError(span, err)
+		span.End()
+	}
+}
+
+// recordError records err on span, ErrLimitReached is a decision rather than failure so it's not recorded
+func recordError(span trace.Span, err error) {
+	if err == nil || errors.Is(err, ratelimit.ErrLimitReached) {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,209 @@
+package ratelimitotel
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"ratelimit/util/ratelimit/internal/wrap"
+	"ratelimit/util/ratelimit/leakybucket"
+	"ratelimit/util/ratelimit/penaltybox"
+	"testing"
+	"time"
+)
+
+type failedLimiter struct{}
+
+func (failedLimiter) Reset(context.Context, string, int64) error {
+	return errors.New("down")
+}
+
+func (failedLimiter) Allow(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, errors.New("down")
+}
+
+func spanAttrs(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+// decisionCounts returns value of decisions counter by decision
+func decisionCounts(t *testing.T, reader sdkmetric.Reader) map[string]int64 {
+	var rm metricdata.ResourceMetrics
+	require.Nil(t, reader.Collect(context.Background(), &rm))
+	counts := make(map[string]int64)
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "ratelimit.decisions" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				decision, _ := dp.Attributes.Value(AttrDecision)
+				counts[decision.AsString()] = dp.Value
+			}
+		}
+	}
+	return counts
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	opts := []Option{WithTracerProvider(tp), WithMeterProvider(mp)}
+
+	clock := clocktest.NewFakeClock(time.Unix(1699999995, 0))
+	store := fixedwindow.NewMemStore(time.Minute, fixedwindow.MemWithClock(clock))
+	defer store.Close()
+	l := Limiter("api", fixedwindow.New(time.Minute, 1,
+		fixedwindow.WithStore(FixedWindowStore("memory", store, opts...)), fixedwindow.WithClock(clock)),
+		append(opts, WithClock(clock))...)
+
+	_, allowed, err := l.Allow(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	_, allowed, err = l.Allow(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	_, _, err = Limiter("login", failedLimiter{}, opts...).Allow(ctx, "k1", 1)
+	assert.NotNil(t, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 5)
+	// store spans are children of limiter span
+	for i := 0; i < 2; i++ {
+		storeSpan, limiterSpan := spans[2*i], spans[2*i+1]
+		assert.Equal(t, "ratelimit.store.Incr", storeSpan.Name())
+		assert.Equal(t, "ratelimit.Allow", limiterSpan.Name())
+		assert.Equal(t, limiterSpan.SpanContext().SpanID(), storeSpan.Parent().SpanID())
+		assert.Equal(t, "memory", spanAttrs(storeSpan)[AttrStore].AsString())
+	}
+
+	attrs := spanAttrs(spans[1])
+	assert.Equal(t, "api", attrs[AttrPolicy].AsString())
+	assert.Equal(t, ratelimit.HashKey("k1"), attrs[AttrKeyHash].AsString())
+	assert.Equal(t, DecisionAllowed, attrs[AttrDecision].AsString())
+	assert.Equal(t, int64(0), attrs[AttrRemaining].AsInt64())
+
+	attrs = spanAttrs(spans[3])
+	assert.Equal(t, DecisionDenied, attrs[AttrDecision].AsString())
+	assert.Equal(t, float64(45), attrs[AttrRetryAfter].AsFloat64())
+
+	attrs = spanAttrs(spans[4])
+	assert.Equal(t, DecisionError, attrs[AttrDecision].AsString())
+	assert.Equal(t, codes.Error, spans[4].Status().Code)
+
+	assert.Equal(t, map[string]int64{DecisionAllowed: 1, DecisionDenied: 1, DecisionError: 1},
+		decisionCounts(t, reader))
+}
+
+func TestLimiter_OptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+
+	fw := fixedwindow.New(time.Minute, 1)
+	defer fw.Close()
+	l := Limiter("fixed", fw)
+	require.Implements(t, (*wrap.WindowUpdater)(nil), l)
+	require.Nil(t, l.(wrap.WindowUpdater).Update(time.Minute, 2))
+	for i := 0; i < 2; i++ {
+		_, allowed, err := l.Allow(ctx, "k1", 1)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	require.Implements(t, (*ratelimit.Peeker)(nil), l)
+	r, allowed, err := l.(ratelimit.Peeker).Peek(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, float64(2), r.Req)
+	_, ok := l.(wrap.Bans)
+	assert.False(t, ok)
+
+	lb := leakybucket.New(1, time.Second, 1)
+	defer lb.Close()
+	l = Limiter("leaky", lb)
+	require.Implements(t, (*wrap.BucketUpdater)(nil), l)
+	assert.NotNil(t, l.(wrap.BucketUpdater).Update(0, time.Second, 1))
+	require.Implements(t, (*ratelimit.Peeker)(nil), l)
+	_, allowed, err = l.(ratelimit.Peeker).Peek(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	_, ok = l.(wrap.Bans)
+	assert.False(t, ok)
+
+	box := penaltybox.New(lb)
+	defer box.Close()
+	l = Limiter("box", box)
+	require.Implements(t, (*wrap.Bans)(nil), l)
+	_, banned, err := l.(wrap.Bans).BannedUntil(ctx, "k1")
+	require.Nil(t, err)
+	assert.False(t, banned)
+	require.Nil(t, l.(wrap.Bans).Unban(ctx, "k1"))
+	require.Implements(t, (*ratelimit.Peeker)(nil), l)
+	_, allowed, err = l.(ratelimit.Peeker).Peek(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	_, ok = l.(wrap.BucketUpdater)
+	assert.False(t, ok)
+
+	l = Limiter("failed", failedLimiter{})
+	_, ok = l.(wrap.WindowUpdater)
+	assert.False(t, ok)
+	_, ok = l.(ratelimit.Peeker)
+	assert.False(t, ok)
+}
+
+func TestCheckTracer(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	clock := clocktest.NewFakeClock(time.Unix(1699999995, 0))
+	l := Limiter("api", fixedwindow.New(time.Minute, 1, fixedwindow.WithClock(clock)),
+		WithTracerProvider(tp), WithClock(clock))
+	tracer := CheckTracer(WithTracerProvider(tp), WithClock(clock))
+
+	for i := 0; i < 2; i++ {
+		ctx, end := tracer.StartCheck(context.Background(), "api", "k1")
+		r, allowed, err := l.Allow(ctx, "k1", 1)
+		end(r, allowed, err)
+	}
+	ctx, end := tracer.StartCheck(context.Background(), "login", "k1")
+	_, _, err := failedLimiter{}.Allow(ctx, "k1", 1)
+	end(nil, false, err)
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 5)
+	// limiter spans are children of check span
+	for i := 0; i < 2; i++ {
+		limiterSpan, checkSpan := spans[2*i], spans[2*i+1]
+		assert.Equal(t, "ratelimit.LimitMid", checkSpan.Name())
+		assert.Equal(t, checkSpan.SpanContext().SpanID(), limiterSpan.Parent().SpanID())
+	}
+
+	attrs := spanAttrs(spans[1])
+	assert.Equal(t, "api", attrs[AttrPolicy].AsString())
+	assert.Equal(t, ratelimit.HashKey("k1"), attrs[AttrKeyHash].AsString())
+	assert.Equal(t, DecisionAllowed, attrs[AttrDecision].AsString())
+	assert.Equal(t, int64(0), attrs[AttrRemaining].AsInt64())
+
+	attrs = spanAttrs(spans[3])
+	assert.Equal(t, DecisionDenied, attrs[AttrDecision].AsString())
+	assert.Equal(t, float64(45), attrs[AttrRetryAfter].AsFloat64())
+
+	attrs = spanAttrs(spans[4])
+	assert.Equal(t, "login", attrs[AttrPolicy].AsString())
+	assert.Equal(t, DecisionError, attrs[AttrDecision].AsString())
+	assert.Equal(t, codes.Error, spans[4].Status().Code)
+}
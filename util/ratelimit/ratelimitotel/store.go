@@ -0,0 +1,192 @@
+package ratelimitotel
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"ratelimit/util/ratelimit/leakybucket"
+	"time"
+)
+
+// storeTracer starts spans of store operations, they are children of limiter span since limiters pass
+// their context to store
+type storeTracer struct {
+	tracer trace.Tracer
+	name   attribute.KeyValue
+}
+
+func newStoreTracer(name string, opts []Option) storeTracer {
+	c := newConfig(opts)
+	return storeTracer{
+		tracer: c.tracerProvider.Tracer(ScopeName),
+		name:   AttrStore.String(name),
+	}
+}
+
+func (t storeTracer) start(ctx context.Context, op string, k string,
+	attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, t.name, AttrKeyHash.String(ratelimit.HashKey(k)))
+	return t.tracer.Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+// memStats is implemented by in-memory stores exposing their statistic
+type memStats interface {
+	Stats() ratelimit.StoreStats
+}
+
+// redisStats is implemented by redis stores exposing their statistic
+type redisStats interface {
+	Stats() ratelimit.RedisStoreStats
+}
+
+// FixedWindowStore wraps s to trace its operations, name identifies store in spans, e.g. "redis".
+// If s implements fixedwindow.WindowUpdater and ratelimit.Inspector like stores of fixedwindow package, wrapped
+// store implements them and Stats of s as well
+func FixedWindowStore(name string, s fixedwindow.Store, opts ...Option) fixedwindow.Store {
+	w := &fixedWindowStore{
+		Store:  s,
+		tracer: newStoreTracer(name, opts),
+	}
+	u, ok := s.(fixedwindow.WindowUpdater)
+	if !ok {
+		return w
+	}
+	i, ok := s.(ratelimit.Inspector)
+	if !ok {
+		return w
+	}
+	full := fixedWindowFullStore{fixedWindowStore: w, WindowUpdater: u, Inspector: i}
+	switch st := s.(type) {
+	case memStats:
+		return &fixedWindowMemStore{fixedWindowFullStore: full, memStats: st}
+	case redisStats:
+		return &fixedWindowRedisStore{fixedWindowFullStore: full, redisStats: st}
+	}
+	return &full
+}
+
+type fixedWindowStore struct {
+	fixedwindow.Store
+	tracer storeTracer
+}
+
+// fixedWindowFullStore forwards optional interfaces of wrapped store
+type fixedWindowFullStore struct {
+	*fixedWindowStore
+	fixedwindow.WindowUpdater
+	ratelimit.Inspector
+}
+
+type fixedWindowMemStore struct {
+	fixedWindowFullStore
+	memStats
+}
+
+type fixedWindowRedisStore struct {
+	fixedWindowFullStore
+	redisStats
+}
+
+func (s *fixedWindowStore) Incr(ctx context.Context, key string, value int64, now time.Time) (int64, error) {
+	ctx, span := s.tracer.start(ctx, "ratelimit.store.Incr", key, AttrWeight.Int64(value))
+	defer span.End()
+
+	newVal, err := s.Store.Incr(ctx, key, value, now)
+	recordError(span, err)
+	return newVal, err
+}
+
+func (s *fixedWindowStore) Reset(ctx context.Context, key string, value int64) error {
+	ctx, span := s.tracer.start(ctx, "ratelimit.store.Reset", key)
+	defer span.End()
+
+	err := s.Store.Reset(ctx, key, value)
+	recordError(span, err)
+	return err
+}
+
+// Close closes wrapped store if it's closable
+func (s *fixedWindowStore) Close() error {
+	if c, ok := s.Store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// LeakyBucketStore wraps s to trace its operations, name identifies store in spans, e.g. "redis".
+// If s implements leakybucket.TTLUpdater and ratelimit.Inspector like stores of leakybucket package, wrapped
+// store implements them and Stats of s as well
+func LeakyBucketStore(name string, s leakybucket.Store, opts ...Option) leakybucket.Store {
+	w := &leakyBucketStore{
+		Store:  s,
+		tracer: newStoreTracer(name, opts),
+	}
+	u, ok := s.(leakybucket.TTLUpdater)
+	if !ok {
+		return w
+	}
+	i, ok := s.(ratelimit.Inspector)
+	if !ok {
+		return w
+	}
+	full := leakyBucketFullStore{leakyBucketStore: w, TTLUpdater: u, Inspector: i}
+	switch st := s.(type) {
+	case memStats:
+		return &leakyBucketMemStore{leakyBucketFullStore: full, memStats: st}
+	case redisStats:
+		return &leakyBucketRedisStore{leakyBucketFullStore: full, redisStats: st}
+	}
+	return &full
+}
+
+type leakyBucketStore struct {
+	leakybucket.Store
+	tracer storeTracer
+}
+
+// leakyBucketFullStore forwards optional interfaces of wrapped store
+type leakyBucketFullStore struct {
+	*leakyBucketStore
+	leakybucket.TTLUpdater
+	ratelimit.Inspector
+}
+
+type leakyBucketMemStore struct {
+	leakyBucketFullStore
+	memStats
+}
+
+type leakyBucketRedisStore struct {
+	leakyBucketFullStore
+	redisStats
+}
+
+func (s *leakyBucketStore) Incr(ctx context.Context, key string, value int64, now time.Time,
+	handler leakybucket.RateFunc) (ratelimit.Reservation, error) {
+	ctx, span := s.tracer.start(ctx, "ratelimit.store.Incr", key, AttrWeight.Int64(value))
+	defer span.End()
+
+	r, err := s.Store.Incr(ctx, key, value, now, handler)
+	recordError(span, err)
+	return r, err
+}
+
+func (s *leakyBucketStore) Reset(ctx context.Context, key string, value int64) error {
+	ctx, span := s.tracer.start(ctx, "ratelimit.store.Reset", key)
+	defer span.End()
+
+	err := s.Store.Reset(ctx, key, value)
+	recordError(span, err)
+	return err
+}
+
+// Close closes wrapped store if it's closable
+func (s *leakyBucketStore) Close() error {
+	if c, ok := s.Store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package ratelimitotel
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"ratelimit/util/ratelimit/leakybucket"
+	"testing"
+	"time"
+)
+
+// countStore counts events without optional interfaces
+type countStore struct{}
+
+func (countStore) Incr(context.Context, string, int64, time.Time) (int64, error) {
+	return 1, nil
+}
+
+func (countStore) Reset(context.Context, string, int64) error {
+	return nil
+}
+
+// redisLikeStore implements optional interfaces of a redis store
+type redisLikeStore struct {
+	countStore
+	window time.Duration
+}
+
+func (s *redisLikeStore) UpdateWindow(d time.Duration) {
+	s.window = d
+}
+
+func (s *redisLikeStore) Window() time.Duration {
+	return s.window
+}
+
+func (s *redisLikeStore) Keys(context.Context, string, int) (ratelimit.KeyPage, error) {
+	return ratelimit.KeyPage{Keys: []ratelimit.KeyState{{Key: "k1", Value: 1}}}, nil
+}
+
+func (s *redisLikeStore) State(context.Context, string) (ratelimit.KeyState, bool, error) {
+	return ratelimit.KeyState{Key: "k1", Value: 1}, true, nil
+}
+
+func (s *redisLikeStore) Stats() ratelimit.RedisStoreStats {
+	return ratelimit.RedisStoreStats{Fallbacks: 2}
+}
+
+func TestFixedWindowStore_OptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+	mem := fixedwindow.NewMemStore(time.Minute)
+	defer mem.Close()
+
+	s := FixedWindowStore("memory", mem)
+	_, err := s.Incr(ctx, "k1", 1, time.Now())
+	require.Nil(t, err)
+	require.Implements(t, (*fixedwindow.WindowUpdater)(nil), s)
+	require.Implements(t, (*ratelimit.Inspector)(nil), s)
+	state, ok, err := s.(ratelimit.Inspector).State(ctx, "k1")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float64(1), state.Value)
+	require.Implements(t, (*memStats)(nil), s)
+	assert.Equal(t, int64(1), s.(memStats).Stats().Keys)
+
+	redisLike := &redisLikeStore{}
+	s = FixedWindowStore("redis", redisLike)
+	s.(fixedwindow.WindowUpdater).UpdateWindow(time.Hour)
+	assert.Equal(t, time.Hour, redisLike.window)
+	require.Implements(t, (*redisStats)(nil), s)
+	assert.Equal(t, uint64(2), s.(redisStats).Stats().Fallbacks)
+
+	s = FixedWindowStore("custom", countStore{})
+	_, ok = s.(ratelimit.Inspector)
+	assert.False(t, ok)
+	_, ok = s.(fixedwindow.WindowUpdater)
+	assert.False(t, ok)
+}
+
+func TestLeakyBucketStore_OptionalInterfaces(t *testing.T) {
+	mem := leakybucket.NewMemStore(time.Minute)
+	defer mem.Close()
+
+	s := LeakyBucketStore("memory", mem)
+	require.Implements(t, (*leakybucket.TTLUpdater)(nil), s)
+	require.Implements(t, (*ratelimit.Inspector)(nil), s)
+	require.Implements(t, (*memStats)(nil), s)
+	require.Nil(t, s.Reset(context.Background(), "k1", 3))
+	state, ok, err := s.(ratelimit.Inspector).State(context.Background(), "k1")
+	require.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, float64(3), state.Value)
+	assert.Equal(t, int64(1), s.(memStats).Stats().Keys)
+}
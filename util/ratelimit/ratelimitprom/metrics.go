@@ -0,0 +1,241 @@
+// Package ratelimitprom exports Prometheus metrics of limiter decisions and store health
+package ratelimitprom
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/internal/wrap"
+	"sync"
+)
+
+const (
+	decisionAllowed = "allowed"
+	decisionDenied  = "denied"
+	decisionError   = "error"
+)
+
+var (
+	defaultLatencyBuckets = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25}
+	defaultDelayBuckets   = []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300}
+)
+
+// MemStore is in-memory store exposing its statistic, e.g. fixedwindow.InMemStore or leakybucket.InMemStore
+type MemStore interface {
+	Stats() ratelimit.StoreStats
+}
+
+// RedisStore is redis store exposing its statistic, e.g. fixedwindow.RedisStore or leakybucket.RedisStore
+type RedisStore interface {
+	Stats() ratelimit.RedisStoreStats
+}
+
+type Option func(m *Metrics)
+
+// WithNamespace set namespace prefixed to all metric names, default is "ratelimit"
+func WithNamespace(ns string) Option {
+	return func(m *Metrics) {
+		m.namespace = ns
+	}
+}
+
+// WithLatencyBuckets set buckets in seconds of Allow latency histogram
+func WithLatencyBuckets(buckets []float64) Option {
+	return func(m *Metrics) {
+		m.latencyBuckets = buckets
+	}
+}
+
+// WithDelayBuckets set buckets in seconds of histogram of delay returned to denied events
+func WithDelayBuckets(buckets []float64) Option {
+	return func(m *Metrics) {
+		m.delayBuckets = buckets
+	}
+}
+
+// WithClock set clock used to time Allow calls, it must be the clock of instrumented limiters
+// for delay to be measured correctly
+func WithClock(c ratelimit.Clock) Option {
+	return func(m *Metrics) {
+		m.clock = c
+	}
+}
+
+// Metrics is prometheus.Collector of instrumented limiters and stores, it must be registered to be exported
+type Metrics struct {
+	namespace      string
+	latencyBuckets []float64
+	delayBuckets   []float64
+	clock          ratelimit.Clock
+
+	decisions *prometheus.CounterVec
+	latency   *prometheus.HistogramVec
+	delay     *prometheus.HistogramVec
+
+	storeKeys      *prometheus.Desc
+	storeEvictions *prometheus.Desc
+	storeRestores  *prometheus.Desc
+	redisRetries   *prometheus.Desc
+	redisFallbacks *prometheus.Desc
+	redisPending   *prometheus.Desc
+
+	lock        sync.RWMutex
+	memStores   map[string]MemStore
+	redisStores map[string]RedisStore
+}
+
+func New(opts ...Option) *Metrics {
+	m := &Metrics{
+		namespace:      "ratelimit",
+		latencyBuckets: defaultLatencyBuckets,
+		delayBuckets:   defaultDelayBuckets,
+		clock:          ratelimit.SystemClock,
+		memStores:      make(map[string]MemStore),
+		redisStores:    make(map[string]RedisStore),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	m.decisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: m.namespace,
+		Name:      "decisions_total",
+		Help:      "Number of events checked by limiter by decision.",
+	}, []string{"policy", "decision"})
+	m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: m.namespace,
+		Name:      "allow_duration_seconds",
+		Help:      "Latency of checking an event.",
+		Buckets:   m.latencyBuckets,
+	}, []string{"policy"})
+	m.delay = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: m.namespace,
+		Name:      "delay_seconds",
+		Help:      "Delay until a denied event may be retried.",
+		Buckets:   m.delayBuckets,
+	}, []string{"policy"})
+
+	storeLabels := []string{"store"}
+	m.storeKeys = prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "store", "keys"),
+		"Number of keys kept by in-memory store.", storeLabels, nil)
+	m.storeEvictions = prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "store", "evictions_total"),
+		"Number of keys evicted because in-memory store is full.", storeLabels, nil)
+	m.storeRestores = prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "store", "restores_total"),
+		"Number of evicted keys whose usage is restored.", storeLabels, nil)
+	m.redisRetries = prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "redis", "retries_total"),
+		"Number of redis transactions retried on concurrent update.", storeLabels, nil)
+	m.redisFallbacks = prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "redis", "fallbacks_total"),
+		"Number of events which could not be counted on redis.", storeLabels, nil)
+	m.redisPending = prometheus.NewDesc(prometheus.BuildFQName(m.namespace, "redis", "pending_keys"),
+		"Number of keys whose fallback usage is not merged back to redis yet.", storeLabels, nil)
+
+	return m
+}
+
+// Limiter wraps l to record its decisions labelled by policy, Update of fixedwindow and leakybucket limiters,
+// Peek and bans of penaltybox.Box are forwarded to l
+func (m *Metrics) Limiter(policy string, l ratelimit.Limiter) ratelimit.Limiter {
+	w := &limiter{
+		Limiter: l,
+		allowed: m.decisions.WithLabelValues(policy, decisionAllowed),
+		denied:  m.decisions.WithLabelValues(policy, decisionDenied),
+		errored: m.decisions.WithLabelValues(policy, decisionError),
+		latency: m.latency.WithLabelValues(policy),
+		delay:   m.delay.WithLabelValues(policy),
+		clock:   m.clock,
+	}
+	return wrap.Limiter(w, l)
+}
+
+// MemStore exports statistic of in-memory store s labelled by name, it's read on every scrape
+func (m *Metrics) MemStore(name string, s MemStore) {
+	m.lock.Lock()
+	m.memStores[name] = s
+	m.lock.Unlock()
+}
+
+// RedisStore exports statistic of redis store s labelled by name, it's read on every scrape
+func (m *Metrics) RedisStore(name string, s RedisStore) {
+	m.lock.Lock()
+	m.redisStores[name] = s
+	m.lock.Unlock()
+}
+
+// Unregister stops exporting statistic of store name
+func (m *Metrics) Unregister(name string) {
+	m.lock.Lock()
+	delete(m.memStores, name)
+	delete(m.redisStores, name)
+	m.lock.Unlock()
+}
+
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.decisions.Describe(ch)
+	m.latency.Describe(ch)
+	m.delay.Describe(ch)
+	ch <- m.storeKeys
+	ch <- m.storeEvictions
+	ch <- m.storeRestores
+	ch <- m.redisRetries
+	ch <- m.redisFallbacks
+	ch <- m.redisPending
+}
+
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.decisions.Collect(ch)
+	m.latency.Collect(ch)
+	m.delay.Collect(ch)
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for name, s := range m.memStores {
+		stats := s.Stats()
+		ch <- prometheus.MustNewConstMetric(m.storeKeys, prometheus.GaugeValue, float64(stats.Keys), name)
+		ch <- prometheus.MustNewConstMetric(m.storeEvictions, prometheus.CounterValue, float64(stats.Evictions), name)
+		ch <- prometheus.MustNewConstMetric(m.storeRestores, prometheus.CounterValue, float64(stats.Restores), name)
+	}
+	for name, s := range m.redisStores {
+		stats := s.Stats()
+		ch <- prometheus.MustNewConstMetric(m.redisRetries, prometheus.CounterValue, float64(stats.Retries), name)
+		ch <- prometheus.MustNewConstMetric(m.redisFallbacks, prometheus.CounterValue, float64(stats.Fallbacks), name)
+		ch <- prometheus.MustNewConstMetric(m.redisPending, prometheus.GaugeValue, float64(stats.PendingKeys), name)
+	}
+}
+
+type limiter struct {
+	ratelimit.Limiter
+	allowed prometheus.Counter
+	denied  prometheus.Counter
+	errored prometheus.Counter
+	latency prometheus.Observer
+	delay   prometheus.Observer
+	clock   ratelimit.Clock
+}
+
+func (l *limiter) Allow(ctx context.Context, k string, v int64) (*ratelimit.Reservation, bool, error) {
+	start := l.clock.Now()
+	r, ok, err := l.Limiter.Allow(ctx, k, v)
+	l.latency.Observe(l.clock.Now().Sub(start).Seconds())
+
+	switch {
+	case err != nil:
+		l.errored.Inc()
+	case ok:
+		l.allowed.Inc()
+	default:
+		l.denied.Inc()
+		if r != nil {
+			l.delay.Observe(r.DelayFrom(start).Seconds())
+		}
+	}
+	return r, ok, err
+}
+
+// Close closes wrapped limiter if it's closable
+func (l *limiter) Close() error {
+	if c, ok := l.Limiter.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package ratelimitprom
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"ratelimit/util/ratelimit/internal/wrap"
+	"ratelimit/util/ratelimit/leakybucket"
+	"ratelimit/util/ratelimit/penaltybox"
+	"strings"
+	"testing"
+	"time"
+)
+
+type failedLimiter struct{}
+
+func (failedLimiter) Reset(context.Context, string, int64) error {
+	return errors.New("down")
+}
+
+func (failedLimiter) Allow(context.Context, string, int64) (*ratelimit.Reservation, bool, error) {
+	return nil, false, errors.New("down")
+}
+
+type redisStats ratelimit.RedisStoreStats
+
+func (s redisStats) Stats() ratelimit.RedisStoreStats {
+	return ratelimit.RedisStoreStats(s)
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	clock := clocktest.NewFakeClock(time.Unix(1699999980, 0))
+	store := fixedwindow.NewMemStore(time.Minute, fixedwindow.MemWithClock(clock))
+	defer store.Close()
+
+	m := New(WithClock(clock), WithDelayBuckets([]float64{30, 90}))
+	reg := prometheus.NewPedanticRegistry()
+	require.Nil(t, reg.Register(m))
+
+	l := m.Limiter("api", fixedwindow.New(time.Minute, 2, fixedwindow.WithStore(store),
+		fixedwindow.WithClock(clock)))
+	m.MemStore("api", store)
+	m.RedisStore("shared", redisStats{Retries: 3, Fallbacks: 2, PendingKeys: 1})
+
+	clock.Advance(15 * time.Second)
+	for i := 0; i < 3; i++ {
+		_, _, err := l.Allow(ctx, "k1", 1)
+		require.Nil(t, err)
+	}
+	_, _, err := m.Limiter("login", failedLimiter{}).Allow(ctx, "k1", 1)
+	assert.NotNil(t, err)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.decisions.WithLabelValues("api", decisionAllowed)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.decisions.WithLabelValues("api", decisionDenied)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.decisions.WithLabelValues("login", decisionError)))
+	assert.Equal(t, 2, testutil.CollectAndCount(m, "ratelimit_allow_duration_seconds"))
+
+	expected := `
+# HELP ratelimit_delay_seconds Delay until a denied event may be retried.
+# TYPE ratelimit_delay_seconds histogram
+ratelimit_delay_seconds_bucket{policy="api",le="30"} 0
+ratelimit_delay_seconds_bucket{policy="api",le="90"} 1
+ratelimit_delay_seconds_bucket{policy="api",le="+Inf"} 1
+ratelimit_delay_seconds_sum{policy="api"} 45
+ratelimit_delay_seconds_count{policy="api"} 1
+ratelimit_delay_seconds_bucket{policy="login",le="30"} 0
+ratelimit_delay_seconds_bucket{policy="login",le="90"} 0
+ratelimit_delay_seconds_bucket{policy="login",le="+Inf"} 0
+ratelimit_delay_seconds_sum{policy="login"} 0
+ratelimit_delay_seconds_count{policy="login"} 0
+# HELP ratelimit_redis_fallbacks_total Number of events which could not be counted on redis.
+# TYPE ratelimit_redis_fallbacks_total counter
+ratelimit_redis_fallbacks_total{store="shared"} 2
+# HELP ratelimit_redis_pending_keys Number of keys whose fallback usage is not merged back to redis yet.
+# TYPE ratelimit_redis_pending_keys gauge
+ratelimit_redis_pending_keys{store="shared"} 1
+# HELP ratelimit_redis_retries_total Number of redis transactions retried on concurrent update.
+# TYPE ratelimit_redis_retries_total counter
+ratelimit_redis_retries_total{store="shared"} 3
+# HELP ratelimit_store_evictions_total Number of keys evicted because in-memory store is full.
+# TYPE ratelimit_store_evictions_total counter
+ratelimit_store_evictions_total{store="api"} 0
+# HELP ratelimit_store_keys Number of keys kept by in-memory store.
+# TYPE ratelimit_store_keys gauge
+ratelimit_store_keys{store="api"} 1
+`
+	assert.Nil(t, testutil.GatherAndCompare(reg, strings.NewReader(expected),
+		"ratelimit_delay_seconds", "ratelimit_redis_fallbacks_total", "ratelimit_redis_pending_keys",
+		"ratelimit_redis_retries_total", "ratelimit_store_evictions_total", "ratelimit_store_keys"))
+
+	m.Unregister("shared")
+	assert.Equal(t, 0, testutil.CollectAndCount(m, "ratelimit_redis_retries_total"))
+}
+
+func TestLimiter_OptionalInterfaces(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+
+	fw := fixedwindow.New(time.Minute, 1)
+	defer fw.Close()
+	l := m.Limiter("fixed", fw)
+	require.Implements(t, (*wrap.WindowUpdater)(nil), l)
+	require.Nil(t, l.(wrap.WindowUpdater).Update(time.Minute, 2))
+	for i := 0; i < 2; i++ {
+		_, allowed, err := l.Allow(ctx, "k1", 1)
+		require.Nil(t, err)
+		assert.True(t, allowed)
+	}
+	require.Implements(t, (*ratelimit.Peeker)(nil), l)
+	r, allowed, err := l.(ratelimit.Peeker).Peek(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, float64(2), r.Req)
+	assert.False(t, implementsBans(l))
+
+	lb := leakybucket.New(1, time.Second, 1)
+	defer lb.Close()
+	l = m.Limiter("leaky", lb)
+	require.Implements(t, (*wrap.BucketUpdater)(nil), l)
+	assert.NotNil(t, l.(wrap.BucketUpdater).Update(0, time.Second, 1))
+	require.Implements(t, (*ratelimit.Peeker)(nil), l)
+	_, allowed, err = l.(ratelimit.Peeker).Peek(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	assert.False(t, implementsBans(l))
+
+	box := penaltybox.New(lb)
+	defer box.Close()
+	l = m.Limiter("box", box)
+	require.Implements(t, (*wrap.Bans)(nil), l)
+	_, banned, err := l.(wrap.Bans).BannedUntil(ctx, "k1")
+	require.Nil(t, err)
+	assert.False(t, banned)
+	require.Nil(t, l.(wrap.Bans).Unban(ctx, "k1"))
+	require.Implements(t, (*ratelimit.Peeker)(nil), l)
+	_, allowed, err = l.(ratelimit.Peeker).Peek(ctx, "k1", 1)
+	require.Nil(t, err)
+	assert.True(t, allowed)
+	_, ok := l.(wrap.BucketUpdater)
+	assert.False(t, ok)
+
+	l = m.Limiter("failed", failedLimiter{})
+	_, ok = l.(wrap.WindowUpdater)
+	assert.False(t, ok)
+	_, ok = l.(ratelimit.Peeker)
+	assert.False(t, ok)
+	assert.False(t, implementsBans(l))
+}
+
+func implementsBans(l ratelimit.Limiter) bool {
+	_, ok := l.(wrap.Bans)
+	return ok
+}
@@ -0,0 +1,142 @@
+// Package ratelimittest provides conformance suites verifying that a store behaves like built-in ones
+package ratelimittest
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/fixedwindow"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	// suiteStart is start of a window of every duration used by suites
+	suiteStart = time.Unix(1699999200, 0)
+	suiteTTL   = time.Minute
+)
+
+// Harness is store under test
+type Harness[S any] struct {
+	Store S
+	// Advance is called after suite moves clock forward by d, it's optional and needed by stores
+	// expiring keys on their own time, e.g. fast-forwarding a redis server
+	Advance func(d time.Duration)
+	// Fail is called to make store unable to reach its backend, e.g. stopping a redis server, it's optional and
+	// suites checking error propagation are skipped without it
+	Fail func()
+}
+
+func (h Harness[S]) advance(clock *clocktest.FakeClock, d time.Duration) {
+	clock.Advance(d)
+	if h.Advance != nil {
+		h.Advance(d)
+	}
+}
+
+// FixedWindowStoreFactory builds an empty store counting events in windows of ttl,
+// store must take current time from clock
+type FixedWindowStoreFactory func(t *testing.T, ttl time.Duration,
+	clock *clocktest.FakeClock) Harness[fixedwindow.Store]
+
+// TestFixedWindowStore runs conformance suite of fixedwindow.Store
+func TestFixedWindowStore(t *testing.T, newStore FixedWindowStoreFactory) {
+	ctx := context.Background()
+	setup := func(t *testing.T) (Harness[fixedwindow.Store], *clocktest.FakeClock) {
+		clock := clocktest.NewFakeClock(suiteStart)
+		return newStore(t, suiteTTL, clock), clock
+	}
+
+	t.Run("weights", func(t *testing.T) {
+		h, clock := setup(t)
+		newVal, err := h.Store.Incr(ctx, "k1", 1, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, int64(1), newVal)
+
+		newVal, err = h.Store.Incr(ctx, "k1", 3, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, int64(4), newVal)
+
+		newVal, err = h.Store.Incr(ctx, "k2", 2, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, int64(2), newVal, "keys must be counted separately")
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		h, clock := setup(t)
+		now := clock.Now()
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					_, err := h.Store.Incr(ctx, "k1", 1, now)
+					assert.Nil(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		newVal, err := h.Store.Incr(ctx, "k1", 1, now)
+		require.Nil(t, err)
+		assert.Equal(t, int64(101), newVal)
+	})
+
+	t.Run("error propagation", func(t *testing.T) {
+		h, clock := setup(t)
+		if h.Fail == nil {
+			t.Skip("store can not be made to fail")
+		}
+		_, err := h.Store.Incr(ctx, "k1", 2, clock.Now())
+		require.Nil(t, err)
+
+		h.Fail()
+		_, err = h.Store.Incr(ctx, "k1", 1, clock.Now())
+		assert.True(t, errors.Is(err, ratelimit.ErrStoreUnavailable),
+			"failure of store must wrap ratelimit.ErrStoreUnavailable, got %v", err)
+		assert.NotNil(t, h.Store.Reset(ctx, "k1", 0), "failure of store must be returned by Reset")
+	})
+
+	t.Run("ttl expiry", func(t *testing.T) {
+		h, clock := setup(t)
+		_, err := h.Store.Incr(ctx, "k1", 5, clock.Now())
+		require.Nil(t, err)
+
+		h.advance(clock, suiteTTL/2)
+		newVal, err := h.Store.Incr(ctx, "k1", 1, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, int64(6), newVal, "count must be kept within window")
+
+		h.advance(clock, 2*suiteTTL)
+		newVal, err = h.Store.Incr(ctx, "k1", 1, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, int64(1), newVal, "count must start over once window is over")
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		h, clock := setup(t)
+		_, err := h.Store.Incr(ctx, "k1", 3, clock.Now())
+		require.Nil(t, err)
+
+		require.Nil(t, h.Store.Reset(ctx, "k1", 10))
+		newVal, err := h.Store.Incr(ctx, "k1", 1, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, int64(11), newVal)
+
+		require.Nil(t, h.Store.Reset(ctx, "k1", 0))
+		newVal, err = h.Store.Incr(ctx, "k1", 1, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, int64(1), newVal)
+
+		// reset of unknown key creates it
+		require.Nil(t, h.Store.Reset(ctx, "k2", 4))
+		newVal, err = h.Store.Incr(ctx, "k2", 1, clock.Now())
+		require.Nil(t, err)
+		assert.Equal(t, int64(5), newVal)
+	})
+}
@@ -0,0 +1,169 @@
+package ratelimittest
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"ratelimit/util/ratelimit"
+	"ratelimit/util/ratelimit/clocktest"
+	"ratelimit/util/ratelimit/leakybucket"
+	"sync"
+	"testing"
+	"time"
+)
+
+// LeakyBucketStoreFactory builds an empty store keeping rate data of a key for ttl after its last update,
+// store must take current time from clock
+type LeakyBucketStoreFactory func(t *testing.T, ttl time.Duration,
+	clock *clocktest.FakeClock) Harness[leakybucket.Store]
+
+// rateState is what a RateFunc observed from store
+type rateState struct {
+	remain float64
+	last   time.Time
+}
+
+// accumulate returns RateFunc adding incr to remain, observed state is sent to seen if it's not nil
+func accumulate(seen *rateState) leakybucket.RateFunc {
+	return func(remain float64, last time.Time, now time.Time, incr int64) (ratelimit.Reservation, error) {
+		if seen != nil {
+			*seen = rateState{remain: remain, last: last}
+		}
+		return ratelimit.Reservation{
+			Req:       remain + float64(incr),
+			Bucket:    100,
+			TimeToAct: now,
+			Last:      now,
+		}, nil
+	}
+}
+
+// failWith returns RateFunc rejecting every event with err
+func failWith(err error, seen *rateState) leakybucket.RateFunc {
+	return func(remain float64, last time.Time, now time.Time, incr int64) (ratelimit.Reservation, error) {
+		if seen != nil {
+			*seen = rateState{remain: remain, last: last}
+		}
+		return ratelimit.Reservation{
+			Req:       remain + float64(incr),
+			Bucket:    1,
+			TimeToAct: now.Add(time.Second),
+			Last:      now,
+		}, err
+	}
+}
+
+// TestLeakyBucketStore runs conformance suite of leakybucket.Store
+func TestLeakyBucketStore(t *testing.T, newStore LeakyBucketStoreFactory) {
+	ctx := context.Background()
+	setup := func(t *testing.T) (Harness[leakybucket.Store], *clocktest.FakeClock) {
+		clock := clocktest.NewFakeClock(suiteStart)
+		return newStore(t, suiteTTL, clock), clock
+	}
+
+	t.Run("weights", func(t *testing.T) {
+		h, clock := setup(t)
+		var seen rateState
+		r, err := h.Store.Incr(ctx, "k1", 1, clock.Now(), accumulate(&seen))
+		require.Nil(t, err)
+		assert.Equal(t, float64(0), seen.remain, "new key must start with empty bucket")
+		assert.Equal(t, float64(1), r.Req)
+
+		clock.Advance(time.Second)
+		r, err = h.Store.Incr(ctx, "k1", 3, clock.Now(), accumulate(&seen))
+		require.Nil(t, err)
+		assert.Equal(t, float64(1), seen.remain)
+		assert.True(t, seen.last.Equal(suiteStart), "last must be kept, got %v", seen.last)
+		assert.Equal(t, float64(4), r.Req)
+
+		_, err = h.Store.Incr(ctx, "k2", 2, clock.Now(), accumulate(&seen))
+		require.Nil(t, err)
+		assert.Equal(t, float64(0), seen.remain, "keys must be counted separately")
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		h, clock := setup(t)
+		now := clock.Now()
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					_, err := h.Store.Incr(ctx, "k1", 1, now, accumulate(nil))
+					assert.Nil(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		r, err := h.Store.Incr(ctx, "k1", 1, now, accumulate(nil))
+		require.Nil(t, err)
+		assert.Equal(t, float64(101), r.Req)
+	})
+
+	t.Run("error propagation", func(t *testing.T) {
+		h, clock := setup(t)
+		_, err := h.Store.Incr(ctx, "k1", 2, clock.Now(), accumulate(nil))
+		require.Nil(t, err)
+
+		errCustom := errors.New("custom")
+		for _, wantErr := range []error{ratelimit.ErrLimitReached, errCustom} {
+			r, err := h.Store.Incr(ctx, "k1", 1, clock.Now(), failWith(wantErr, nil))
+			assert.True(t, errors.Is(err, wantErr), "want %v, got %v", wantErr, err)
+			if wantErr == ratelimit.ErrLimitReached {
+				assert.Equal(t, time.Second, r.DelayFrom(clock.Now()), "reservation must be returned with error")
+			}
+		}
+
+		var seen rateState
+		_, err = h.Store.Incr(ctx, "k1", 1, clock.Now(), accumulate(&seen))
+		require.Nil(t, err)
+		assert.Equal(t, float64(2), seen.remain, "rejected events must not change rate data")
+	})
+
+	t.Run("ttl expiry", func(t *testing.T) {
+		h, clock := setup(t)
+		_, err := h.Store.Incr(ctx, "k1", 5, clock.Now(), accumulate(nil))
+		require.Nil(t, err)
+
+		h.advance(clock, suiteTTL/2)
+		var seen rateState
+		_, err = h.Store.Incr(ctx, "k1", 1, clock.Now(), failWith(ratelimit.ErrLimitReached, &seen))
+		assert.ErrorIs(t, err, ratelimit.ErrLimitReached)
+		assert.Equal(t, float64(5), seen.remain, "rate data must be kept within ttl")
+
+		// stores may expire keys in background, keep clock moving until they do
+		assert.Eventually(t, func() bool {
+			h.advance(clock, suiteTTL)
+			_, _ = h.Store.Incr(ctx, "k1", 1, clock.Now(), failWith(ratelimit.ErrLimitReached, &seen))
+			return seen.remain == 0
+		}, time.Second, 10*time.Millisecond, "rate data must be forgotten after ttl")
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		h, clock := setup(t)
+		_, err := h.Store.Incr(ctx, "k1", 3, clock.Now(), accumulate(nil))
+		require.Nil(t, err)
+
+		var seen rateState
+		clock.Advance(time.Second)
+		require.Nil(t, h.Store.Reset(ctx, "k1", 10))
+		_, err = h.Store.Incr(ctx, "k1", 1, clock.Now(), accumulate(&seen))
+		require.Nil(t, err)
+		assert.Equal(t, float64(10), seen.remain)
+		assert.True(t, seen.last.Equal(clock.Now()), "reset must set last to current time, got %v", seen.last)
+
+		require.Nil(t, h.Store.Reset(ctx, "k1", 0))
+		_, err = h.Store.Incr(ctx, "k1", 1, clock.Now(), accumulate(&seen))
+		require.Nil(t, err)
+		assert.Equal(t, float64(0), seen.remain)
+
+		// reset of unknown key creates it
+		require.Nil(t, h.Store.Reset(ctx, "k2", 4))
+		_, err = h.Store.Incr(ctx, "k2", 1, clock.Now(), accumulate(&seen))
+		require.Nil(t, err)
+		assert.Equal(t, float64(4), seen.remain)
+	})
+}
@@ -0,0 +1,42 @@
+package ratelimit
+
+// EvictionPolicy selects key evicted from a full in-memory store
+type EvictionPolicy int
+
+const (
+	// EvictionLRU evicts least recently used key
+	EvictionLRU EvictionPolicy = iota
+	// EvictionCLOCK evicts key not used since last pass of clock hand, it approximates LRU with less locking
+	EvictionCLOCK
+)
+
+// EvictedKeyPolicy decides how a key coming back after being evicted from a full in-memory store is treated
+type EvictedKeyPolicy int
+
+const (
+	// EvictedKeyFresh starts evicted key over with empty usage
+	EvictedKeyFresh EvictedKeyPolicy = iota
+	// EvictedKeyRestore remembers compact usage of evicted keys, up to max keys of store,
+	// and restores it when key comes back, so flooding store with new keys does not reset existing ones
+	EvictedKeyRestore
+)
+
+// StoreStats is statistic of in-memory store
+type StoreStats struct {
+	// Keys is number of keys currently kept in store
+	Keys int64
+	// Evictions is number of keys evicted because store is full
+	Evictions uint64
+	// Restores is number of evicted keys whose usage is restored when they come back
+	Restores uint64
+}
+
+// RedisStoreStats is statistic of redis store
+type RedisStoreStats struct {
+	// Retries is number of redis transactions retried because watched key was updated concurrently
+	Retries uint64
+	// Fallbacks is number of events which could not be counted on redis
+	Fallbacks uint64
+	// PendingKeys is number of keys whose usage counted on fallback store is not merged back to redis yet
+	PendingKeys int64
+}
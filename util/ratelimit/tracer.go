@@ -0,0 +1,12 @@
+package ratelimit
+
+import "context"
+
+// CheckTracer traces checks of middleware, e.g. ratelimitotel.CheckTracer creating OpenTelemetry spans. It keeps
+// tracing libraries out of packages enforcing limits
+type CheckTracer interface {
+	// StartCheck is called before key of policy is checked, returned context is passed to limiter and returned
+	// func is called with result of the check once it's done
+	StartCheck(ctx context.Context, policy, key string) (context.Context,
+		func(r *Reservation, allowed bool, err error))
+}